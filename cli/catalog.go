@@ -0,0 +1,23 @@
+package cli
+
+import (
+	"github.com/opengovern/og-task-container-vulnerability/task"
+	"github.com/spf13/cobra"
+)
+
+// CatalogCommand is the hidden command the scans run as a child process to catalog the packages of their target,
+// see task.RunCatalog.
+func CatalogCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:    task.CatalogCommand + " <target> <output>",
+		Short:  "Catalog the packages of a scan target into a syft JSON SBOM",
+		Hidden: true,
+		Args:   cobra.ExactArgs(2),
+		// Errors are reported by main, to the stderr the scan quotes
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return task.RunCatalog(cmd.Context(), args[0], args[1])
+		},
+	}
+}
@@ -0,0 +1,293 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/opengovern/og-task-container-vulnerability/task"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Exit codes of the one-shot scan command. Any other error, including those of the worker command, exits with
+// ExitCodeError.
+const (
+	// ExitCodeOK means all images were scanned and the severity gate, if any, passed.
+	ExitCodeOK = 0
+	// ExitCodeError is an unexpected error.
+	ExitCodeError = 1
+	// ExitCodeConfigError means invalid flags or params.
+	ExitCodeConfigError = 2
+	// ExitCodeAuthError means the registry credentials were missing, invalid or lacked access to an image.
+	ExitCodeAuthError = 3
+	// ExitCodePullError means an image couldn't be pulled.
+	ExitCodePullError = 4
+	// ExitCodeScanError means grype failed to scan an image.
+	ExitCodeScanError = 5
+	// ExitCodeImageNotFound means an image doesn't exist in the registry.
+	ExitCodeImageNotFound = 6
+	// ExitCodeTimeout means the run didn't complete within run_timeout.
+	ExitCodeTimeout = 7
+	// ExitCodeSeverityGate means the scan succeeded but an image has matches at or above --exit-on-severity.
+	ExitCodeSeverityGate = 10
+)
+
+// exitError is an error carrying the exit code it should end the process with.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// ExitCode maps an error returned by a command to the process exit code.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitCodeOK
+	}
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+	switch task.ErrorKindOf(err) {
+	case task.ErrorKindConfig:
+		return ExitCodeConfigError
+	case task.ErrorKindAuth:
+		return ExitCodeAuthError
+	case task.ErrorKindPull:
+		return ExitCodePullError
+	case task.ErrorKindScan:
+		return ExitCodeScanError
+	case task.ErrorKindNotFound:
+		return ExitCodeImageNotFound
+	case task.ErrorKindTimeout:
+		return ExitCodeTimeout
+	case task.ErrorKindSeverityGate:
+		return ExitCodeSeverityGate
+	default:
+		return ExitCodeError
+	}
+}
+
+// ScanCommand scans images once and writes the results as JSON instead of running as a worker.
+func ScanCommand() *cobra.Command {
+	var (
+		images         []string
+		sboms          []string
+		dirs           []string
+		archives       []string
+		digests        []string
+		registryType   string
+		params         []string
+		exitOnSeverity string
+		workDir        string
+		outputPath     string
+		parallelism    int
+	)
+
+	cmd := &cobra.Command{
+		Use:   "scan",
+		Short: "Scan images once and write the results as JSON",
+		Long: `Scan images once and write the results as JSON.
+
+Exit codes:
+  0   all images scanned, severity gate passed
+  1   unexpected error
+  2   invalid flags or params
+  3   registry authentication or access error
+  4   image pull error
+  5   scanner error
+  6   image not found in the registry
+  7   run timed out (run_timeout)
+  10  severity gate breached (--exit-on-severity)`,
+		// Errors are reported by main, along with the exit code
+		SilenceErrors: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+
+			targets := 0
+			for _, t := range [][]string{images, sboms, dirs, archives} {
+				if len(t) > 0 {
+					targets++
+				}
+			}
+			if targets == 0 {
+				return &exitError{code: ExitCodeConfigError, err: fmt.Errorf("at least one --image, --sbom, --dir or --archive is required")}
+			}
+			if targets > 1 {
+				return &exitError{code: ExitCodeConfigError, err: fmt.Errorf("--image, --sbom, --dir and --archive can't be combined")}
+			}
+			taskParams, err := parseParams(params)
+			if err != nil {
+				return &exitError{code: ExitCodeConfigError, err: err}
+			}
+			if len(sboms) > 0 {
+				if err := addSBOMParams(taskParams, sboms); err != nil {
+					return &exitError{code: ExitCodeConfigError, err: err}
+				}
+				if len(digests) > 0 {
+					taskParams["artifact_digest"] = digests
+				}
+			} else if len(dirs) > 0 {
+				if err := addDirParams(taskParams, dirs); err != nil {
+					return &exitError{code: ExitCodeConfigError, err: err}
+				}
+				if len(digests) > 0 {
+					taskParams["artifact_digest"] = digests
+				}
+			} else if len(archives) > 0 {
+				taskParams["archive_url"] = archives
+				if len(digests) > 0 {
+					taskParams["artifact_digest"] = digests
+				}
+			} else {
+				taskParams["oci_artifact_url"] = images
+				if len(digests) == 0 {
+					// Digests are optional for the CLI, the resolved manifest digest is recorded instead
+					digests = make([]string, len(images))
+				}
+				taskParams["artifact_digest"] = digests
+			}
+			if registryType != "" {
+				taskParams["registry_type"] = []string{registryType}
+			}
+			if exitOnSeverity != "" {
+				taskParams["fail_on_severity"] = []string{exitOnSeverity}
+			}
+			if parallelism > 0 {
+				taskParams["scan_parallelism"] = []string{strconv.Itoa(parallelism)}
+			}
+
+			logger, err := zap.NewProduction()
+			if err != nil {
+				return err
+			}
+			task.SetGrypeBaseLogger(logger)
+
+			if workDir == "" {
+				workDir, err = os.MkdirTemp("", "og-task-grype-")
+				if err != nil {
+					return err
+				}
+				defer os.RemoveAll(workDir)
+			}
+
+			out := os.Stdout
+			if outputPath != "" {
+				out, err = os.Create(outputPath)
+				if err != nil {
+					return err
+				}
+				defer out.Close()
+			}
+
+			dbSource := task.GrypeDBSource
+			if v := taskParams["grype_db_source"]; len(v) > 0 {
+				dbSource = v[0]
+			}
+			if err := task.LoadGrypeDBSource(cmd.Context(), logger, dbSource); err != nil {
+				return err
+			}
+
+			results, scanErr := task.ScanArtifacts(cmd.Context(), logger, taskParams, workDir)
+
+			if len(results) > 0 {
+				enc := json.NewEncoder(out)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(results); err != nil {
+					return err
+				}
+			}
+			if scanErr != nil {
+				return scanErr
+			}
+
+			for _, r := range results {
+				if gate := r.Summary.SeverityGate; gate != nil && gate.Breached {
+					err := fmt.Errorf("%s has %d vulnerabilities at or above %s severity", r.ImageURL, gate.BreachingMatches, gate.Threshold)
+					return &exitError{code: ExitCodeSeverityGate, err: err}
+				}
+				if gate := r.Summary.NewSeverityGate; gate != nil && gate.Breached {
+					err := fmt.Errorf("%s has %d new vulnerabilities at or above %s severity", r.ImageURL, gate.BreachingMatches, gate.Threshold)
+					return &exitError{code: ExitCodeSeverityGate, err: err}
+				}
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringSliceVar(&images, "image", nil, "image reference to scan, repeatable")
+	cmd.Flags().StringSliceVar(&sboms, "sbom", nil, "path or http(s) URL of an SBOM (CycloneDX, SPDX or Syft JSON) to scan instead of an image, repeatable")
+	cmd.Flags().StringSliceVar(&dirs, "dir", nil, "directory, tarball or http(s) tarball URL of a filesystem to scan instead of an image, repeatable")
+	cmd.Flags().StringSliceVar(&archives, "archive", nil, "s3:// or http(s) URL of a docker-archive or oci-archive tarball to scan instead of an image, repeatable")
+	cmd.Flags().StringSliceVar(&digests, "digest", nil, "expected digest of each --image, --sbom, --dir or --archive, in the same order")
+	cmd.Flags().StringVar(&registryType, "registry-type", "", "registry type (ghcr, ecr, acr, public), defaults to ghcr")
+	cmd.Flags().StringArrayVar(&params, "param", nil, "task param as key=value, repeatable, e.g. --param max_matches=100")
+	cmd.Flags().StringVar(&exitOnSeverity, "exit-on-severity", "", "exit with code 10 when a vulnerability at or above this severity is found, same as the fail_on_severity param")
+	cmd.Flags().IntVar(&parallelism, "parallelism", 0, "number of images scanned at once, same as the scan_parallelism param, 1 by default")
+	cmd.Flags().StringVar(&workDir, "work-dir", "", "directory images are fetched to, a temporary directory by default")
+	cmd.Flags().StringVarP(&outputPath, "output", "o", "", "file to write the results to, stdout by default")
+	cmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return &exitError{code: ExitCodeConfigError, err: err}
+	})
+
+	return cmd
+}
+
+// parseParams parses key=value flags into task params, repeated keys adding values.
+func parseParams(values []string) (map[string][]string, error) {
+	params := make(map[string][]string)
+	for _, v := range values {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid param %q: expected key=value", v)
+		}
+		params[key] = append(params[key], value)
+	}
+	return params, nil
+}
+
+// addSBOMParams adds the SBOMs of the --sbom flags to params, reading files into sbom params and passing URLs as
+// sbom_url params.
+func addSBOMParams(params map[string][]string, sboms []string) error {
+	for _, s := range sboms {
+		if strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") {
+			params["sbom_url"] = append(params["sbom_url"], s)
+			continue
+		}
+		content, err := os.ReadFile(s)
+		if err != nil {
+			return fmt.Errorf("failed to read SBOM: %w", err)
+		}
+		params["sbom"] = append(params["sbom"], string(content))
+	}
+	return nil
+}
+
+// addDirParams adds the filesystem bundles of the --dir flags to params, passing paths, made absolute, as dir_path
+// params and URLs as dir_url params.
+func addDirParams(params map[string][]string, dirs []string) error {
+	for _, d := range dirs {
+		if strings.HasPrefix(d, "http://") || strings.HasPrefix(d, "https://") {
+			params["dir_url"] = append(params["dir_url"], d)
+			continue
+		}
+		abs, err := filepath.Abs(d)
+		if err != nil {
+			return fmt.Errorf("invalid --dir %s: %w", d, err)
+		}
+		params["dir_path"] = append(params["dir_path"], abs)
+	}
+	params["scan_target_type"] = []string{task.ScanTargetDir}
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"github.com/opengovern/og-task-container-vulnerability/cli"
 	"github.com/opengovern/og-task-container-vulnerability/worker"
 	"golang.org/x/net/context"
 	"os"
@@ -28,8 +29,12 @@ func main() {
 		}
 	}()
 
-	if err := worker.WorkerCommand().ExecuteContext(ctx); err != nil {
-		fmt.Printf("Error: %v\n", err)
-		os.Exit(1)
+	cmd := worker.WorkerCommand()
+	cmd.AddCommand(cli.ScanCommand(), cli.CatalogCommand())
+
+	if err := cmd.ExecuteContext(ctx); err != nil {
+		// Stderr keeps stdout clean for the results of the scan command
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(cli.ExitCode(err))
 	}
 }
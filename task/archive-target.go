@@ -0,0 +1,308 @@
+package task
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opengovern/og-util/pkg/opengovernance-es-sdk"
+	"github.com/opengovern/og-util/pkg/tasks"
+	"github.com/opengovern/opencomply/services/tasks/scheduler"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ImageSourceArchive is the source of images scanned from the docker-archive or oci-archive tarballs of archive_url,
+// e.g. exported by CI systems instead of pushed to a registry.
+const ImageSourceArchive = "archive"
+
+const (
+	// azureStorageScope is the scope of the AAD tokens reading Azure Blob Storage.
+	azureStorageScope = "https://storage.azure.com/.default"
+	// azureStorageAPIVersion is the Blob service version requested, AAD tokens needing 2017-11-09 or later.
+	azureStorageAPIVersion = "2020-10-02"
+)
+
+// archiveScanParams checks the image tarballs of archive_url, returning the params scanning them as artifacts. Each is
+// stored as the result of archive_image (by position), by default its URL without the query, which may carry a SAS
+// token or a signature, and archive_sha256 is the checksum its download is verified against. Tarballs are downloaded
+// when scanned, each into the directory of its artifact.
+func archiveScanParams(params map[string][]string) (map[string][]string, error) {
+	locations := params["archive_url"]
+	if len(locations) == 0 {
+		return nil, fmt.Errorf("archive_url parameter is not provided")
+	}
+	if getParamValue(params, "scan_scope", ScanScopeImage) != ScanScopeImage {
+		return nil, fmt.Errorf("scan_scope is not supported when scanning archives")
+	}
+	if getBoolParam(params, "delete_after_scan") {
+		return nil, fmt.Errorf("delete_after_scan is not supported when scanning archives")
+	}
+
+	var names, digests, checksums []string
+	for i, location := range locations {
+		if !strings.HasPrefix(location, "s3://") && !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+			return nil, fmt.Errorf("archive_url %s: expected an s3:// or http(s) URL", location)
+		}
+		checksum, err := parseArchiveChecksum(paramAt(params, "archive_sha256", i, ""))
+		if err != nil {
+			return nil, fmt.Errorf("archive_url %s: %w", location, err)
+		}
+		names = append(names, paramAt(params, "archive_image", i, archiveName(location)))
+		digests = append(digests, paramAt(params, "artifact_digest", i, ""))
+		checksums = append(checksums, checksum)
+	}
+
+	scanParams := copyParams(params)
+	delete(scanParams, "scan_target_type")
+	delete(scanParams, "archive_url")
+	delete(scanParams, "archive_sha256")
+	scanParams["oci_artifact_url"] = names
+	scanParams["artifact_digest"] = digests
+	scanParams["artifact_archive"] = locations
+	scanParams["artifact_archive_sha256"] = checksums
+	return scanParams, nil
+}
+
+// runScanArchiveTask scans the docker-archive or oci-archive tarballs downloaded from archive_url as images: s3://
+// URLs, read with the AWS credentials of the environment, or http(s) URLs, those of Azure Blob Storage without a SAS
+// token being read with the Azure credential of the params. Registry credentials aren't needed.
+func runScanArchiveTask(ctx context.Context, esClient opengovernance.Client, logger *zap.Logger, request tasks.TaskRequest, response *scheduler.TaskResponse, publish ProgressPublisher, publishFindings FindingsPublisher) error {
+	params, err := archiveScanParams(request.TaskDefinition.Params)
+	if err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+	scanRequest := request
+	scanRequest.TaskDefinition.Params = params
+	return runScanTask(ctx, esClient, logger, scanRequest, response, publish, publishFindings)
+}
+
+// parseArchiveChecksum parses an archive_sha256, a sha256 digest with or without its algorithm as sha256sum prints
+// it, empty when none was given.
+func parseArchiveChecksum(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	if !strings.Contains(value, ":") {
+		value = "sha256:" + value
+	}
+	checksum, err := normalizeDigest(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid archive_sha256: %w", err)
+	}
+	if !strings.HasPrefix(checksum, "sha256:") {
+		return "", fmt.Errorf("invalid archive_sha256 %q: expected a sha256 digest", value)
+	}
+	return checksum, nil
+}
+
+// fetchArchiveTarget downloads the docker-archive or oci-archive tarball at location to outputDir, verified against
+// checksum when given. Docker archives are handed to the scanner as a plain tar, OCI archives are extracted into an
+// OCI layout, whose manifest is the one scanned.
+func fetchArchiveTarget(ctx context.Context, outputDir, location, checksum string, creds Credentials, opts pullOptions) (*FetchedImage, error) {
+	if err := os.MkdirAll(outputDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	name := archiveName(location)
+	downloadPath := filepath.Join(outputDir, "archive.download")
+	digest, err := downloadTarball(ctx, location, downloadPath, creds, opts.maxSize())
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	defer os.Remove(downloadPath)
+	if checksum != "" && digest != checksum {
+		return nil, fmt.Errorf("%w: archive %s has checksum %s, expected %s", ErrDigestMismatch, name, digest, checksum)
+	}
+
+	format, err := detectArchiveFormat(downloadPath)
+	if err != nil {
+		return nil, err
+	}
+	fetched := &FetchedImage{Source: ImageSourceArchive, ArchiveDigest: digest}
+	kind := "docker-archive"
+	switch format {
+	case ImageLayoutDockerArchive:
+		archivePath := filepath.Join(outputDir, imageTarName)
+		if err := decompressFile(downloadPath, archivePath); err != nil {
+			return nil, fmt.Errorf("failed to decompress %s: %w", name, err)
+		}
+		if fetched.TarDigest, err = fileDigest(archivePath); err != nil {
+			return nil, err
+		}
+		fetched.ArchivePath = archivePath
+	case ImageLayoutOCIDir:
+		layoutDir := filepath.Join(outputDir, ociLayoutDirName)
+		if err := applyLayersSubtree([]string{downloadPath}, []string{path.Base(name)}, "", layoutDir); err != nil {
+			return nil, fmt.Errorf("failed to extract %s: %w", name, err)
+		}
+		if fetched.ManifestDigest, err = layoutManifestDigest(layoutDir); err != nil {
+			return nil, err
+		}
+		fetched.LayoutPath = layoutDir
+		if fetched.LayoutDigest, err = treeDigest(layoutDir); err != nil {
+			return nil, err
+		}
+		kind = "oci-archive"
+	}
+	opts.logger().Info("downloaded archive", zap.String("kind", kind), zap.String("name", name), zap.String("digest", digest))
+	return fetched, nil
+}
+
+// detectArchiveFormat tells a docker archive, listing its images in manifest.json, from an OCI archive, holding an
+// OCI layout.
+func detectArchiveFormat(tarPath string) (string, error) {
+	var format string
+	err := walkArchive(tarPath, func(hdr *tar.Header, r io.Reader) (bool, error) {
+		switch path.Clean(strings.TrimPrefix(hdr.Name, "/")) {
+		case ocispec.ImageLayoutFile:
+			format = ImageLayoutOCIDir
+			return true, nil
+		case "manifest.json":
+			format = ImageLayoutDockerArchive
+		}
+		// OCI archives written by docker save have a manifest.json too, the oci-layout file is looked for to the end
+		return false, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read archive: %w", err)
+	}
+	if format == "" {
+		return "", fmt.Errorf("not a docker-archive or oci-archive: neither manifest.json nor %s found", ocispec.ImageLayoutFile)
+	}
+	return format, nil
+}
+
+// layoutManifestDigest returns the digest of the only manifest of the OCI layout at layoutDir.
+func layoutManifestDigest(layoutDir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(layoutDir, ocispec.ImageIndexFile))
+	if err != nil {
+		return "", err
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return "", fmt.Errorf("failed to parse %s: %w", ocispec.ImageIndexFile, err)
+	}
+	if len(index.Manifests) != 1 {
+		return "", fmt.Errorf("expected one image in %s, found %d", ocispec.ImageIndexFile, len(index.Manifests))
+	}
+	return index.Manifests[0].Digest.String(), nil
+}
+
+// decompressFile writes the (optionally gzip or zstd compressed) file at src to dst uncompressed.
+func decompressFile(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := maybeDecompress(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, r); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// downloadTarball downloads the tarball at location, an s3://bucket/key or http(s) URL, to tarPath, up to maxSize
+// bytes, returning its sha256 digest. Azure Blob Storage URLs without a SAS token are read with the Azure credential
+// of creds.
+func downloadTarball(ctx context.Context, location, tarPath string, creds Credentials, maxSize int64) (string, error) {
+	var body io.ReadCloser
+	var size int64
+	var err error
+	if strings.HasPrefix(location, "s3://") {
+		body, size, err = getS3Object(ctx, location)
+	} else {
+		body, size, err = getHTTPObject(ctx, location, creds)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	if size > maxSize {
+		return "", fmt.Errorf("%w: tarball size %d bytes exceeds maximum allowed size of %d bytes", ErrImageTooLarge, size, maxSize)
+	}
+
+	f, err := os.Create(tarPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(body, maxSize+1))
+	if err != nil {
+		return "", err
+	}
+	if n > maxSize {
+		return "", fmt.Errorf("%w: tarball exceeds maximum allowed size of %d bytes", ErrImageTooLarge, maxSize)
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// getHTTPObject returns the content at the http(s) URL location and its size, -1 when unknown.
+func getHTTPObject(ctx context.Context, location string, creds Credentials) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if isAzureBlobURL(req.URL) && req.URL.Query().Get("sig") == "" {
+		cred, err := newAzureCredential(creds)
+		if err != nil {
+			return nil, 0, err
+		}
+		token, err := cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{azureStorageScope}})
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to acquire AAD token for Azure Blob Storage: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token.Token)
+		req.Header.Set("x-ms-version", azureStorageAPIVersion)
+	}
+
+	httpClient, err := retryingHTTPClient()
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, &statusError{StatusCode: resp.StatusCode, Err: fmt.Errorf("unexpected status %d downloading %s", resp.StatusCode, archiveName(location))}
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+func isAzureBlobURL(u *url.URL) bool {
+	return u.Scheme == "https" && strings.HasSuffix(u.Hostname(), ".blob.core.windows.net")
+}
+
+// archiveName is location without its query, which may carry credentials such as a SAS token.
+func archiveName(location string) string {
+	name, _, _ := strings.Cut(location, "?")
+	return name
+}
@@ -0,0 +1,356 @@
+package task
+
+import (
+	"fmt"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+	"io"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/errdef"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Content-addressed cache of the blobs pulled, keyed by digest, so scans of images sharing base layers don't download
+// them again. BLOB_CACHE_DIR enables it, e.g. on a volume kept across jobs. The cache is bounded to
+// BLOB_CACHE_MAX_SIZE_MIB (10240 by default), evicting the least recently used blobs not used by a pull in progress.
+var (
+	BlobCacheDir        = os.Getenv("BLOB_CACHE_DIR")
+	BlobCacheMaxSizeMiB = os.Getenv("BLOB_CACHE_MAX_SIZE_MIB")
+)
+
+const defaultBlobCacheMaxSizeMiB = 10240
+
+// BlobCacheStats are the metrics of the blob cache since the worker started.
+type BlobCacheStats struct {
+	Enabled bool `json:"enabled"`
+	// Hits and Misses count the blobs served from the cache and downloaded, HitBytes the bytes not downloaded.
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	HitBytes  int64 `json:"hitBytes"`
+	Evictions int64 `json:"evictions"`
+	Blobs     int   `json:"blobs"`
+	Size      int64 `json:"size"`
+	MaxSize   int64 `json:"maxSize"`
+}
+
+// blobCache stores the blobs under <dir>/blobs/<algorithm>/<encoded>, their last use being the file modification
+// time so the eviction order survives restarts.
+type blobCache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	entries map[digest.Digest]*blobEntry
+	size    int64
+	stats   BlobCacheStats
+}
+
+type blobEntry struct {
+	size     int64
+	lastUsed time.Time
+	// leases is the number of pulls in progress using the blob, which is never evicted meanwhile
+	leases int
+}
+
+var (
+	blobCacheOnce   sync.Once
+	sharedBlobCache *blobCache
+)
+
+// getBlobCache returns the blob cache, nil when BLOB_CACHE_DIR isn't set or the cache couldn't be opened.
+func getBlobCache() *blobCache {
+	blobCacheOnce.Do(func() {
+		if BlobCacheDir == "" {
+			return
+		}
+		maxSizeMiB := defaultBlobCacheMaxSizeMiB
+		if BlobCacheMaxSizeMiB != "" {
+			v, err := strconv.Atoi(BlobCacheMaxSizeMiB)
+			if err != nil || v <= 0 {
+				fmt.Fprintf(os.Stderr, "Invalid BLOB_CACHE_MAX_SIZE_MIB %q, using %d\n", BlobCacheMaxSizeMiB, defaultBlobCacheMaxSizeMiB)
+			} else {
+				maxSizeMiB = v
+			}
+		}
+		cache, err := openBlobCache(BlobCacheDir, int64(maxSizeMiB)*1024*1024)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Blob cache disabled: %v\n", err)
+			return
+		}
+		sharedBlobCache = cache
+	})
+	return sharedBlobCache
+}
+
+// GetBlobCacheStats returns the metrics of the blob cache, Enabled being false when it's disabled.
+func GetBlobCacheStats() BlobCacheStats {
+	cache := getBlobCache()
+	if cache == nil {
+		return BlobCacheStats{}
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	stats := cache.stats
+	stats.Enabled = true
+	stats.Blobs = len(cache.entries)
+	stats.Size = cache.size
+	stats.MaxSize = cache.maxSize
+	return stats
+}
+
+// openBlobCache indexes the blobs already in dir, removing the partial writes left by a crash.
+func openBlobCache(dir string, maxSize int64) (*blobCache, error) {
+	cache := &blobCache{dir: dir, maxSize: maxSize, entries: make(map[digest.Digest]*blobEntry)}
+	blobsDir := filepath.Join(dir, "blobs")
+	if err := os.MkdirAll(blobsDir, 0o700); err != nil {
+		return nil, err
+	}
+	err := filepath.WalkDir(blobsDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.Contains(d.Name(), ".tmp") {
+			return os.Remove(path)
+		}
+		rel, err := filepath.Rel(blobsDir, path)
+		if err != nil {
+			return err
+		}
+		algorithm, encoded, ok := strings.Cut(filepath.ToSlash(rel), "/")
+		dgst := digest.NewDigestFromEncoded(digest.Algorithm(algorithm), encoded)
+		if !ok || dgst.Validate() != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		cache.entries[dgst] = &blobEntry{size: info.Size(), lastUsed: info.ModTime()}
+		cache.size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	cache.evict()
+	return cache, nil
+}
+
+func (c *blobCache) path(dgst digest.Digest) string {
+	return filepath.Join(c.dir, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// lease marks the blob as used by a pull, returning false when it isn't cached.
+func (c *blobCache) lease(dgst digest.Digest) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[dgst]
+	if !ok {
+		return false
+	}
+	entry.leases++
+	entry.lastUsed = time.Now()
+	// Best effort, only the eviction order after a restart depends on it
+	_ = os.Chtimes(c.path(dgst), entry.lastUsed, entry.lastUsed)
+	return true
+}
+
+func (c *blobCache) release(dgst digest.Digest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[dgst]; ok && entry.leases > 0 {
+		entry.leases--
+	}
+}
+
+// put writes the blob of desc read from r to the cache, leased, verifying its size and digest.
+func (c *blobCache) put(desc ocispec.Descriptor, r io.Reader) error {
+	path := c.path(desc.Digest)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to write blob to the cache: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), desc.Digest.Encoded()+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to write blob to the cache: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	verifier := content.NewVerifyReader(r, desc)
+	if _, err := io.Copy(tmp, verifier); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := verifier.Verify(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write blob to the cache: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write blob to the cache: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Misses++
+	if entry, ok := c.entries[desc.Digest]; ok {
+		// Pushed by a concurrent pull meanwhile
+		entry.leases++
+		entry.lastUsed = time.Now()
+		return nil
+	}
+	c.entries[desc.Digest] = &blobEntry{size: desc.Size, lastUsed: time.Now(), leases: 1}
+	c.size += desc.Size
+	return nil
+}
+
+// evict removes the least recently used blobs without leases until the cache fits its size.
+func (c *blobCache) evict() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= c.maxSize {
+		return
+	}
+	var candidates []digest.Digest
+	for dgst, entry := range c.entries {
+		if entry.leases == 0 {
+			candidates = append(candidates, dgst)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return c.entries[candidates[i]].lastUsed.Before(c.entries[candidates[j]].lastUsed)
+	})
+	for _, dgst := range candidates {
+		if c.size <= c.maxSize {
+			break
+		}
+		if err := os.Remove(c.path(dgst)); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Failed to evict blob %s from the cache: %v\n", dgst, err)
+			continue
+		}
+		c.size -= c.entries[dgst].size
+		delete(c.entries, dgst)
+		c.stats.Evictions++
+	}
+}
+
+// blobCacheSession is the store of a single pull backed by the blob cache. Manifests are kept in memory, so a cached
+// manifest never makes oras skip copying layers that were evicted since.
+type blobCacheSession struct {
+	cache     *blobCache
+	manifests *memory.Store
+
+	mu       sync.Mutex
+	leased   map[digest.Digest]bool
+	hits     int
+	misses   int
+	hitBytes int64
+}
+
+// pullStore returns the store a pull copies the image to, and the func to call once the pull is done with it, which
+// returns how much of the pull the cache served. Without the blob cache, that's the shared in-memory store.
+func pullStore() (oras.Target, func() blobCacheUsage) {
+	cache := getBlobCache()
+	if cache == nil {
+		return memoryStore, func() blobCacheUsage { return blobCacheUsage{} }
+	}
+	s := &blobCacheSession{cache: cache, manifests: memory.New(), leased: make(map[digest.Digest]bool)}
+	return s, s.close
+}
+
+// blobCacheUsage is how much of a pull the blob cache served.
+type blobCacheUsage struct {
+	Enabled  bool
+	Hits     int
+	Misses   int
+	HitBytes int64
+}
+
+func isManifestMediaType(mediaType string) bool {
+	return isImageIndex(mediaType) || mediaType == ocispec.MediaTypeImageManifest ||
+		mediaType == "application/vnd.docker.distribution.manifest.v2+json"
+}
+
+func (s *blobCacheSession) Exists(ctx context.Context, desc ocispec.Descriptor) (bool, error) {
+	if isManifestMediaType(desc.MediaType) {
+		return s.manifests.Exists(ctx, desc)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leased[desc.Digest] {
+		return true, nil
+	}
+	if !s.cache.lease(desc.Digest) {
+		return false, nil
+	}
+	s.leased[desc.Digest] = true
+	s.hits++
+	s.hitBytes += desc.Size
+	s.cache.mu.Lock()
+	s.cache.stats.Hits++
+	s.cache.stats.HitBytes += desc.Size
+	s.cache.mu.Unlock()
+	return true, nil
+}
+
+func (s *blobCacheSession) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	if isManifestMediaType(desc.MediaType) {
+		return s.manifests.Fetch(ctx, desc)
+	}
+	if exists, _ := s.Exists(ctx, desc); !exists {
+		return nil, fmt.Errorf("%s: %w", desc.Digest, errdef.ErrNotFound)
+	}
+	return os.Open(s.cache.path(desc.Digest))
+}
+
+func (s *blobCacheSession) Push(ctx context.Context, desc ocispec.Descriptor, r io.Reader) error {
+	if isManifestMediaType(desc.MediaType) {
+		return s.manifests.Push(ctx, desc, r)
+	}
+	s.mu.Lock()
+	leased := s.leased[desc.Digest]
+	s.mu.Unlock()
+	if leased {
+		return fmt.Errorf("%s: %w", desc.Digest, errdef.ErrAlreadyExists)
+	}
+	if err := s.cache.put(desc, r); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.leased[desc.Digest] = true
+	s.misses++
+	s.mu.Unlock()
+	s.cache.evict()
+	return nil
+}
+
+func (s *blobCacheSession) Tag(ctx context.Context, desc ocispec.Descriptor, reference string) error {
+	return s.manifests.Tag(ctx, desc, reference)
+}
+
+func (s *blobCacheSession) Resolve(ctx context.Context, reference string) (ocispec.Descriptor, error) {
+	return s.manifests.Resolve(ctx, reference)
+}
+
+// close releases the blobs of the pull, evicting those the cache no longer fits, and returns its usage. Closing again
+// returns the same usage.
+func (s *blobCacheSession) close() blobCacheUsage {
+	s.mu.Lock()
+	for dgst := range s.leased {
+		s.cache.release(dgst)
+	}
+	s.leased = make(map[digest.Digest]bool)
+	usage := blobCacheUsage{Enabled: true, Hits: s.hits, Misses: s.misses, HitBytes: s.hitBytes}
+	s.mu.Unlock()
+	s.cache.evict()
+	return usage
+}
@@ -0,0 +1,52 @@
+package task
+
+import (
+	"go.uber.org/zap"
+	"os"
+)
+
+// artifactCleanup is when the files written for the scans (image archives, intermediate files, grype reports) are
+// removed. By default they're removed as soon as each image is scanned, so a run's disk usage doesn't grow with its
+// number of images.
+type artifactCleanup struct {
+	// Keep never removes them (keep_artifacts).
+	Keep bool
+	// KeepOnFailure keeps those of the images whose scan failed, and the work directory of failed runs, for
+	// debugging (keep_on_failure).
+	KeepOnFailure bool
+}
+
+func getArtifactCleanupFromParams(params map[string][]string) artifactCleanup {
+	return artifactCleanup{
+		Keep:          getBoolParam(params, "keep_artifacts"),
+		KeepOnFailure: getBoolParam(params, "keep_on_failure"),
+	}
+}
+
+func (c artifactCleanup) keep(failed bool) bool {
+	return c.Keep || (failed && c.KeepOnFailure)
+}
+
+// imageDone removes the directory of the scanned image, scanErr being the outcome of its scan.
+func (c artifactCleanup) imageDone(logger *zap.Logger, dir string, scanErr error) {
+	if c.keep(scanErr != nil) {
+		if scanErr != nil {
+			logger.Info("keeping the files of the failed scan", zap.String("dir", dir))
+		}
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		logger.Warn("failed to remove scanned image files", zap.String("dir", dir), zap.Error(err))
+	}
+}
+
+// runDone removes the work directory of the run, runErr being the outcome of the run.
+func (c artifactCleanup) runDone(logger *zap.Logger, workDir *WorkDir, runErr error) {
+	if c.keep(runErr != nil) {
+		logger.Info("keeping the work directory of the run", zap.String("dir", workDir.Path), zap.Bool("failed", runErr != nil))
+		return
+	}
+	if err := workDir.Close(); err != nil {
+		logger.Warn("failed to remove work directory", zap.String("dir", workDir.Path), zap.Error(err))
+	}
+}
@@ -0,0 +1,128 @@
+package task
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// maxConfigRefBytes bounds the size of a config_ref file.
+const maxConfigRefBytes = 4 * 1024 * 1024 // 4 MiB
+
+// mergeConfigRef returns the params with the defaults from the file at config_ref merged in, the params of the
+// message winning over those of the file. config_ref is a path (e.g. on a mounted volume) or an http(s) URL (e.g. a
+// presigned object store URL) of a YAML or JSON map of param names to a value or a list of values.
+func mergeConfigRef(ctx context.Context, params map[string][]string) (map[string][]string, error) {
+	ref := getParamValue(params, "config_ref", "")
+	if ref == "" {
+		return params, nil
+	}
+
+	data, err := readConfigRef(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config_ref %s: %w", ref, err)
+	}
+	defaults, err := parseConfigRef(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config_ref %s: %w", ref, err)
+	}
+
+	merged := make(map[string][]string, len(params)+len(defaults))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range params {
+		merged[k] = v
+	}
+	return merged, nil
+}
+
+func readConfigRef(ctx context.Context, ref string) ([]byte, error) {
+	var r io.Reader
+	if strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, ref, nil)
+		if err != nil {
+			return nil, err
+		}
+		httpClient, err := outboundHTTPClient()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(ref)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, maxConfigRefBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxConfigRefBytes {
+		return nil, fmt.Errorf("file exceeds %d bytes", maxConfigRefBytes)
+	}
+	return data, nil
+}
+
+// parseConfigRef parses a config_ref file (YAML, which includes JSON) into params.
+func parseConfigRef(data []byte) (map[string][]string, error) {
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	params := make(map[string][]string, len(raw))
+	for k, v := range raw {
+		if k == "config_ref" {
+			return nil, fmt.Errorf("config_ref can't be set in a config_ref file")
+		}
+		switch t := v.(type) {
+		case nil:
+			continue
+		case []interface{}:
+			values := make([]string, 0, len(t))
+			for _, item := range t {
+				s, ok := configRefScalar(item)
+				if !ok {
+					return nil, fmt.Errorf("param %q: expected a value or a list of values", k)
+				}
+				values = append(values, s)
+			}
+			params[k] = values
+		default:
+			s, ok := configRefScalar(t)
+			if !ok {
+				return nil, fmt.Errorf("param %q: expected a value or a list of values", k)
+			}
+			params[k] = []string{s}
+		}
+	}
+	return params, nil
+}
+
+func configRefScalar(v interface{}) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(t), true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,113 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/archive"
+	"github.com/containerd/errdefs"
+	"github.com/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+	"io"
+	"oras.land/oras-go/v2/registry"
+	"os"
+)
+
+const (
+	// DefaultContainerdSocket is the containerd socket used when containerd_socket is not provided.
+	DefaultContainerdSocket = "/run/containerd/containerd.sock"
+	// DefaultContainerdNamespace is the namespace kubelet pulls images into.
+	DefaultContainerdNamespace = "k8s.io"
+)
+
+// errNotInContainerd is returned when the image can't be served from the local containerd content store.
+var errNotInContainerd = errors.New("image not available in containerd content store")
+
+// exportFromContainerd builds imageTarPath from the local containerd content store, avoiding a registry pull for
+// images already present on the node. It returns errNotInContainerd when the socket isn't available or the image
+// (or its content for the platform) isn't present, in which case callers fall back to pulling.
+func exportFromContainerd(ctx context.Context, socket, namespace, ociArtifactURI, imageTarPath string, platform ocispec.Platform) (*FetchedImage, error) {
+	if _, err := os.Stat(socket); err != nil {
+		return nil, errNotInContainerd
+	}
+
+	ref, err := registry.ParseReference(ociArtifactURI)
+	if err != nil {
+		return nil, fmt.Errorf("invalid oci-artifact-uri: %w", err)
+	}
+	name := ref.String()
+
+	client, err := containerd.New(socket, containerd.WithDefaultNamespace(namespace))
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to connect to containerd: %v", errNotInContainerd, err)
+	}
+	defer client.Close()
+
+	img, err := client.GetImage(ctx, name)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil, errNotInContainerd
+		}
+		return nil, fmt.Errorf("%w: %v", errNotInContainerd, err)
+	}
+
+	// Multi-arch images are exported for the manifest a registry pull selects, so both record the same digests
+	selection := &platformSelection{Platform: platform}
+	manifest, err := selection.mapRoot(ctx, containerdStorage{img.ContentStore()}, img.Target())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNotInContainerd, err)
+	}
+
+	// kubelet only pulls the content for the node's platform, make sure all of it is present for the one scanned
+	available, _, _, missing, err := images.Check(ctx, img.ContentStore(), manifest, platforms.All)
+	if err != nil || !available || len(missing) > 0 {
+		return nil, errNotInContainerd
+	}
+
+	f, err := os.Create(imageTarPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create image.tar: %w", err)
+	}
+	defer f.Close()
+
+	err = client.Export(ctx, f, archive.WithManifest(manifest, name))
+	if err != nil {
+		f.Close()
+		os.Remove(imageTarPath)
+		return nil, fmt.Errorf("%w: export failed: %v", errNotInContainerd, err)
+	}
+
+	return &FetchedImage{
+		ManifestDigest: manifest.Digest.String(),
+		Source:         ImageSourceContainerd,
+		Platform:       platforms.Format(selection.Platform),
+		IndexDigest:    selection.IndexDigest,
+	}, nil
+}
+
+// containerdStorage reads the blobs of a containerd content store as the oras storage platformSelection reads.
+type containerdStorage struct {
+	store content.Store
+}
+
+func (s containerdStorage) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	ra, err := s.store.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{content.NewReader(ra), ra}, nil
+}
+
+func (s containerdStorage) Exists(ctx context.Context, desc ocispec.Descriptor) (bool, error) {
+	_, err := s.store.Info(ctx, desc.Digest)
+	if errdefs.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
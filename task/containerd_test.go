@@ -0,0 +1,93 @@
+package task
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+func TestContainerdStoragePlatformSelection(t *testing.T) {
+	ctx := context.Background()
+	store, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(mediaType string, v interface{}) ocispec.Descriptor {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+		if err := content.WriteBlob(ctx, store, desc.Digest.String(), bytes.NewReader(data), desc); err != nil {
+			t.Fatal(err)
+		}
+		return desc
+	}
+	manifests := map[string]ocispec.Descriptor{}
+	var index ocispec.Index
+	index.SchemaVersion = 2
+	for _, p := range []ocispec.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64", Variant: "v8"}} {
+		manifest := write(ocispec.MediaTypeImageManifest, ocispec.Manifest{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromString(p.Architecture)},
+		})
+		platform := p
+		manifest.Platform = &platform
+		manifests[p.Architecture] = manifest
+		index.Manifests = append(index.Manifests, manifest)
+	}
+	// An attestation manifest, without platform
+	index.Manifests = append(index.Manifests, ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest,
+		Digest: digest.FromString("attestation"), Size: 1})
+	target := write(ocispec.MediaTypeImageIndex, index)
+	single := manifests["amd64"]
+	single.Platform = nil
+
+	for _, tc := range []struct {
+		name          string
+		target        ocispec.Descriptor
+		platform      string
+		expected      digest.Digest
+		expectedIndex string
+		notFound      bool
+	}{
+		{name: "amd64 of an index", target: target, platform: "linux/amd64", expected: manifests["amd64"].Digest, expectedIndex: target.Digest.String()},
+		{name: "arm64 of an index", target: target, platform: "linux/arm64", expected: manifests["arm64"].Digest, expectedIndex: target.Digest.String()},
+		{name: "platform missing from the index", target: target, platform: "linux/s390x", notFound: true},
+		{name: "single-platform image", target: single, platform: "linux/arm64", expected: single.Digest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			platform, err := parseImagePlatform(tc.platform)
+			if err != nil {
+				t.Fatal(err)
+			}
+			selection := &platformSelection{Platform: platform}
+			manifest, err := selection.mapRoot(ctx, containerdStorage{store}, tc.target)
+			if tc.notFound {
+				if err == nil {
+					t.Fatalf("expected no manifest for %s, got %s", tc.platform, manifest.Digest)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if manifest.Digest != tc.expected {
+				t.Errorf("expected manifest %s, got %s", tc.expected, manifest.Digest)
+			}
+			if selection.IndexDigest != tc.expectedIndex {
+				t.Errorf("expected index digest %q, got %q", tc.expectedIndex, selection.IndexDigest)
+			}
+		})
+	}
+
+	exists, err := containerdStorage{store}.Exists(ctx, ocispec.Descriptor{Digest: digest.FromString("missing")})
+	if err != nil || exists {
+		t.Errorf("expected a missing blob not to exist, got %t, %v", exists, err)
+	}
+}
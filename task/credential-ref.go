@@ -0,0 +1,252 @@
+package task
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Schemes of the param values resolved by the worker instead of carried in the task message: vault://path#key, a
+// key of a Vault secret, and k8s-secret://namespace/name/key, a key of a secret of the cluster the worker runs in.
+const (
+	credentialRefVault     = "vault://"
+	credentialRefK8sSecret = "k8s-secret://"
+)
+
+// VaultAddr is the address of the Vault server vault:// references are read from, e.g. https://vault:8200.
+var VaultAddr = os.Getenv("VAULT_ADDR")
+
+// VaultToken is the token reading vault:// references. Without it, the worker logs in with the token of its service
+// account at the Kubernetes auth method as VaultKubernetesRole.
+var VaultToken = os.Getenv("VAULT_TOKEN")
+
+// VaultKubernetesRole is the Vault role the worker logs in as with the token of its service account.
+var VaultKubernetesRole = os.Getenv("VAULT_K8S_ROLE")
+
+// VaultKubernetesAuthPath is the mount of the Kubernetes auth method the worker logs in at, kubernetes by default.
+var VaultKubernetesAuthPath = os.Getenv("VAULT_K8S_AUTH_PATH")
+
+// VaultNamespace is the Vault Enterprise namespace of the references, the root namespace when empty.
+var VaultNamespace = os.Getenv("VAULT_NAMESPACE")
+
+// resolveCredentialRefs returns the params with their vault:// and k8s-secret:// values replaced by the secrets they
+// reference, so that credentials don't travel in the task message. Secrets are read once per run, and the error of a
+// reference that can't be resolved names the reference only.
+func resolveCredentialRefs(ctx context.Context, params map[string][]string) (map[string][]string, error) {
+	r := &credentialResolver{secrets: map[string]map[string]string{}}
+	var resolved map[string][]string
+	for key, values := range params {
+		var out []string
+		for i, value := range values {
+			if !isCredentialRef(value) {
+				continue
+			}
+			secret, err := r.resolve(ctx, value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve %s of %s: %w", value, key, err)
+			}
+			if out == nil {
+				out = append([]string(nil), values...)
+			}
+			out[i] = secret
+		}
+		if out != nil {
+			if resolved == nil {
+				resolved = copyParams(params)
+			}
+			resolved[key] = out
+		}
+	}
+	if resolved == nil {
+		return params, nil
+	}
+	return resolved, nil
+}
+
+func isCredentialRef(value string) bool {
+	return strings.HasPrefix(value, credentialRefVault) || strings.HasPrefix(value, credentialRefK8sSecret)
+}
+
+// credentialResolver reads the secrets of the references of a run, keeping them by secret.
+type credentialResolver struct {
+	vaultToken string
+	kube       *kubeClient
+	secrets    map[string]map[string]string
+}
+
+func (r *credentialResolver) resolve(ctx context.Context, ref string) (string, error) {
+	var secretRef, key string
+	var read func(context.Context, string) (map[string]string, error)
+	switch {
+	case strings.HasPrefix(ref, credentialRefVault):
+		var ok bool
+		secretRef, key, ok = strings.Cut(strings.TrimPrefix(ref, credentialRefVault), "#")
+		if !ok || secretRef == "" || key == "" {
+			return "", fmt.Errorf("expected vault://path#key")
+		}
+		read = r.readVaultSecret
+	default:
+		parts := strings.Split(strings.TrimPrefix(ref, credentialRefK8sSecret), "/")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return "", fmt.Errorf("expected k8s-secret://namespace/name/key")
+		}
+		secretRef, key = parts[0]+"/"+parts[1], parts[2]
+		read = r.readK8sSecret
+	}
+
+	cacheKey := ref[:strings.Index(ref, "://")+3] + secretRef
+	secret, ok := r.secrets[cacheKey]
+	if !ok {
+		var err error
+		if secret, err = read(ctx, secretRef); err != nil {
+			return "", err
+		}
+		r.secrets[cacheKey] = secret
+	}
+	value, ok := secret[key]
+	if !ok {
+		return "", fmt.Errorf("secret has no key %s", key)
+	}
+	return value, nil
+}
+
+// readK8sSecret reads the secret namespace/name of the cluster the worker runs in, with its service account.
+func (r *credentialResolver) readK8sSecret(ctx context.Context, secretRef string) (map[string]string, error) {
+	if r.kube == nil {
+		client, err := newInClusterKubeClient()
+		if err != nil {
+			return nil, err
+		}
+		r.kube = client
+	}
+	namespace, name, _ := strings.Cut(secretRef, "/")
+	var secret kubeSecret
+	if err := r.kube.get(ctx, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/secrets/"+url.PathEscape(name), nil, &secret); err != nil {
+		return nil, clusterError(err)
+	}
+	values := make(map[string]string, len(secret.Data))
+	for k, v := range secret.Data {
+		values[k] = string(v)
+	}
+	return values, nil
+}
+
+// readVaultSecret reads the Vault secret at path, of a KV version 1 or 2 engine (secret/data/... for the latter) or
+// any engine returning its keys as data.
+func (r *credentialResolver) readVaultSecret(ctx context.Context, path string) (map[string]string, error) {
+	if VaultAddr == "" {
+		return nil, newTaskError(ErrorKindConfig, fmt.Errorf("VAULT_ADDR is not set"))
+	}
+	if r.vaultToken == "" {
+		token, err := vaultLogin(ctx)
+		if err != nil {
+			return nil, err
+		}
+		r.vaultToken = token
+	}
+
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := vaultRequest(ctx, http.MethodGet, strings.TrimPrefix(path, "/"), r.vaultToken, nil, &resp); err != nil {
+		return nil, err
+	}
+	data := resp.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		// KV version 2 nests the keys along with the metadata of the version
+		if _, hasMetadata := data["metadata"]; hasMetadata {
+			data = nested
+		}
+	}
+	values := make(map[string]string, len(data))
+	for k, v := range data {
+		if s, ok := v.(string); ok {
+			values[k] = s
+			continue
+		}
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		values[k] = string(encoded)
+	}
+	return values, nil
+}
+
+// vaultLogin returns VaultToken, or the token of the login of the worker with its service account token at the
+// Kubernetes auth method.
+func vaultLogin(ctx context.Context) (string, error) {
+	if VaultToken != "" {
+		return VaultToken, nil
+	}
+	if VaultKubernetesRole == "" {
+		return "", newTaskError(ErrorKindConfig, fmt.Errorf("VAULT_TOKEN or VAULT_K8S_ROLE is required to read vault:// references"))
+	}
+	jwt, err := os.ReadFile(serviceAccountTokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the service account token: %w", err)
+	}
+	mount := VaultKubernetesAuthPath
+	if mount == "" {
+		mount = "kubernetes"
+	}
+	body, err := json.Marshal(map[string]string{"role": VaultKubernetesRole, "jwt": strings.TrimSpace(string(jwt))})
+	if err != nil {
+		return "", err
+	}
+
+	var resp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := vaultRequest(ctx, http.MethodPost, "auth/"+strings.Trim(mount, "/")+"/login", "", body, &resp); err != nil {
+		return "", fmt.Errorf("Vault login failed: %w", err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return "", fmt.Errorf("Vault login returned no token")
+	}
+	return resp.Auth.ClientToken, nil
+}
+
+// vaultRequest sends a request to the Vault API at path, decoding its response into out.
+func vaultRequest(ctx context.Context, method, path, token string, body []byte, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(VaultAddr, "/")+"/v1/"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if VaultNamespace != "" {
+		req.Header.Set("X-Vault-Namespace", VaultNamespace)
+	}
+
+	httpClient, err := retryingHTTPClient()
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Vault request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := &statusError{StatusCode: resp.StatusCode, Err: fmt.Errorf("Vault request %s: unexpected status %d", path, resp.StatusCode)}
+		if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized {
+			return newTaskError(ErrorKindAuth, err)
+		}
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
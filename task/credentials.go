@@ -0,0 +1,158 @@
+package task
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ValidateFor checks that the credential params required by the registry type are set.
+func (c Credentials) ValidateFor(registryType string) error {
+	var missing []string
+	require := func(value, key string) {
+		if value == "" {
+			missing = append(missing, key)
+		}
+	}
+
+	switch RegistryType(registryType) {
+	case RegistryGHCR:
+		if c.hasGitHubApp() {
+			require(c.GithubAppID, "github_app_id")
+			require(c.GithubAppInstallationID, "github_app_installation_id")
+			require(c.GithubAppPrivateKey, "github_app_private_key")
+		} else {
+			require(c.GithubUsername, "github_username")
+			require(c.GithubToken, "github_token")
+		}
+	case RegistryECR:
+		require(c.ECRAccountID, "ecr_account_id")
+		require(c.ECRRegion, "ecr_region")
+		if c.hasOIDCToken() {
+			require(c.OIDCRoleARN, "oidc_role_arn")
+		}
+		if c.ECRExternalID != "" {
+			require(c.ECRRoleARN, "ecr_role_arn")
+		}
+	case RegistryECRPublic:
+		if c.hasOIDCToken() {
+			require(c.OIDCRoleARN, "oidc_role_arn")
+		}
+		if c.ECRExternalID != "" {
+			require(c.ECRRoleARN, "ecr_role_arn")
+		}
+	case RegistryACR:
+		require(c.ACRLoginServer, "acr_login_server")
+		switch c.azureAuthMethod() {
+		case AzureAuthServicePrincipal:
+			require(c.ACRTenantID, "acr_tenant_id")
+			require(c.ACRClientID, "acr_client_id")
+			require(c.ACRClientSecret, "acr_client_secret")
+		case AzureAuthWorkloadIdentity:
+			// Without an OIDC token, the AKS workload identity environment gives them
+			if c.hasOIDCToken() {
+				require(c.ACRTenantID, "acr_tenant_id")
+				require(c.ACRClientID, "acr_client_id")
+			}
+		case AzureAuthManagedIdentity, AzureAuthDefault:
+		default:
+			return fmt.Errorf("invalid acr_auth_method %q: expected %s, %s, %s or %s", c.ACRAuthMethod,
+				AzureAuthDefault, AzureAuthServicePrincipal, AzureAuthManagedIdentity, AzureAuthWorkloadIdentity)
+		}
+	case RegistryDockerHub:
+		// Anonymous without credentials, both are needed otherwise
+		if c.DockerHubUsername != "" || c.DockerHubToken != "" {
+			require(c.DockerHubUsername, "dockerhub_username")
+			require(c.DockerHubToken, "dockerhub_token")
+		}
+	case RegistryGCR:
+	case RegistryGAR:
+		require(c.GCPRegistryHost, "gcp_registry_host")
+	case RegistryGeneric:
+		require(c.RegistryHost, "registry_host")
+		require(c.RegistryUsername, "registry_username")
+		require(c.RegistryPassword, "registry_password")
+	case RegistryPublic:
+	default:
+		return fmt.Errorf("Unsupported registry type: %s", registryType)
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required credential parameters for registry type %s: %s", registryType, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// credentialParamKeys returns the param keys read into Credentials, derived from its json tags.
+func credentialParamKeys() []string {
+	var keys []string
+	t := reflect.TypeOf(Credentials{})
+	for i := 0; i < t.NumField(); i++ {
+		if tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; tag != "" && tag != "-" {
+			keys = append(keys, tag)
+		}
+	}
+	return keys
+}
+
+// suggestCredentialParams returns the params that look like typos of a credential param, mapped to the
+// credential param they most likely meant (e.g. gh_token -> github_token).
+func suggestCredentialParams(params map[string][]string) map[string]string {
+	known := credentialParamKeys()
+	suggestions := make(map[string]string)
+	for key := range params {
+		if containsString(known, key) {
+			continue
+		}
+		for _, k := range known {
+			if looksLikeTypo(key, k) {
+				suggestions[key] = k
+				break
+			}
+		}
+	}
+	return suggestions
+}
+
+// formatSuggestions renders suggestions as "a -> b, c -> d" in a stable order.
+func formatSuggestions(suggestions map[string]string) string {
+	var parts []string
+	for typo, key := range suggestions {
+		parts = append(parts, typo+" -> "+key)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
+
+// looksLikeTypo reports whether key is within a small edit distance of known, or is an abbreviation of it
+// (same first letter and same last "_" segment, e.g. gh_token for github_token).
+func looksLikeTypo(key, known string) bool {
+	key = strings.ToLower(key)
+	if levenshtein(key, known) <= 2 {
+		return true
+	}
+	keyParts, knownParts := strings.Split(key, "_"), strings.Split(known, "_")
+	return len(keyParts) > 1 && len(keyParts) == len(knownParts) &&
+		keyParts[0][0] == knownParts[0][0] && keyParts[len(keyParts)-1] == knownParts[len(knownParts)-1]
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,67 @@
+package task
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"oras.land/oras-go/v2/registry"
+)
+
+// deleteScannedImages deletes the scanned manifests of the items from their registry, for delete_after_scan. Only the
+// exact manifest digest that was scanned is deleted, so an image pushed under the same tag since is left alone.
+// Failures, e.g. a registry denying or not supporting deletes, are logged and don't fail the run.
+func deleteScannedImages(ctx context.Context, logger *zap.Logger, opts scanOptions, items []indexItem) {
+	if RegistryType(opts.registryType) == RegistryPublic {
+		logger.Warn("delete_after_scan is ignored for public registries")
+		return
+	}
+
+	auths, err := getRegistryAuths(ctx, opts.registryType, opts.creds)
+	if err != nil {
+		logger.Error("failed to get registry credentials to delete scanned images", zap.Error(err))
+		return
+	}
+	cfg := DockerConfig{Auths: auths}
+
+	for _, item := range items {
+		imageURL := item.scan.ImageURL
+		if item.manifestDigest == "" {
+			logger.Warn("not deleting image without a known manifest digest", zap.String("image", imageURL))
+			continue
+		}
+		// A digest given in the params that doesn't match what was scanned means the reference is ambiguous
+		if item.scan.ArtifactDigest != item.manifestDigest {
+			logger.Warn("not deleting image, scanned manifest digest differs from the artifact digest",
+				zap.String("image", imageURL), zap.String("manifestDigest", item.manifestDigest), zap.String("artifactDigest", item.scan.ArtifactDigest))
+			continue
+		}
+
+		if err := deleteManifest(ctx, cfg, imageURL, item.manifestDigest); err != nil {
+			logger.Error("failed to delete scanned image", zap.String("image", imageURL), zap.String("digest", item.manifestDigest), zap.Error(err))
+			continue
+		}
+		logger.Info("deleted scanned image from registry", zap.String("image", imageURL), zap.String("digest", item.manifestDigest))
+	}
+}
+
+// deleteManifest deletes the manifest with the given digest from the repository of imageURL.
+func deleteManifest(ctx context.Context, cfg DockerConfig, imageURL, manifestDigest string) error {
+	ref, err := registry.ParseReference(imageURL)
+	if err != nil {
+		return fmt.Errorf("invalid image reference: %w", err)
+	}
+	ref.Reference = manifestDigest
+
+	repo, err := newRemoteRepository(ref, cfg, pullOptions{})
+	if err != nil {
+		return err
+	}
+	desc, err := repo.Resolve(ctx, manifestDigest)
+	if err != nil {
+		return fmt.Errorf("failed to resolve manifest: %w", err)
+	}
+	if err := repo.Delete(ctx, desc); err != nil {
+		return fmt.Errorf("failed to delete manifest: %w", err)
+	}
+	return nil
+}
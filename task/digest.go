@@ -0,0 +1,93 @@
+package task
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// digestAlgorithmPattern matches the algorithm component of an OCI digest (e.g. sha256, sha512, multihash+base58).
+var digestAlgorithmPattern = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*$`)
+
+// digestEncodedPattern matches the encoded component of an OCI digest.
+var digestEncodedPattern = regexp.MustCompile(`^[a-zA-Z0-9=_-]+$`)
+
+// digestHexLengths defines the expected hex-encoded length for the registered digest algorithms.
+var digestHexLengths = map[string]int{
+	"sha256": 64,
+	"sha384": 96,
+	"sha512": 128,
+}
+
+// normalizeDigest validates that digest is in the <algorithm>:<encoded> form and returns it in canonical
+// (lowercase) form. Registered algorithms (sha256, sha384, sha512) must carry a hex value of the right length.
+func normalizeDigest(digest string) (string, error) {
+	digest = strings.TrimSpace(digest)
+
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("invalid artifact digest %q: expected <algorithm>:<hex>, e.g. sha256:<64 hex characters>", digest)
+	}
+
+	algorithm := strings.ToLower(parts[0])
+	encoded := parts[1]
+	if !digestAlgorithmPattern.MatchString(algorithm) {
+		return "", fmt.Errorf("invalid artifact digest %q: malformed algorithm %q", digest, parts[0])
+	}
+	if !digestEncodedPattern.MatchString(encoded) {
+		return "", fmt.Errorf("invalid artifact digest %q: malformed encoded value", digest)
+	}
+
+	if expectedLen, ok := digestHexLengths[algorithm]; ok {
+		encoded = strings.ToLower(encoded)
+		if len(encoded) != expectedLen {
+			return "", fmt.Errorf("invalid artifact digest %q: %s digest must be %d hex characters, got %d", digest, algorithm, expectedLen, len(encoded))
+		}
+		for _, c := range encoded {
+			if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+				return "", fmt.Errorf("invalid artifact digest %q: %s digest must be hex encoded", digest, algorithm)
+			}
+		}
+	}
+
+	return algorithm + ":" + encoded, nil
+}
+
+// verifyArtifactDigest checks that the pulled image has the expected digest, that of its manifest or, for multi-arch
+// images, of the index the manifest was selected from, or that of the content of a filesystem bundle.
+func verifyArtifactDigest(expected string, fetched *FetchedImage) error {
+	if fetched.DirPath != "" {
+		// Filesystem bundles have the digest of their content
+		if expected == fetched.DirDigest {
+			return nil
+		}
+		return fmt.Errorf("%w: expected %s, scanned %s", ErrDigestMismatch, expected, fetched.DirDigest)
+	}
+	if expected == fetched.ManifestDigest || (fetched.IndexDigest != "" && expected == fetched.IndexDigest) {
+		return nil
+	}
+	pulled := fetched.ManifestDigest
+	if fetched.IndexDigest != "" {
+		pulled += " (index " + fetched.IndexDigest + ")"
+	}
+	return fmt.Errorf("%w: expected %s, pulled %s", ErrDigestMismatch, expected, pulled)
+}
+
+// fileDigest returns the sha256 digest of the file at path in <algorithm>:<hex> form.
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,72 @@
+package task
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeDigest(t *testing.T) {
+	hex64 := strings.Repeat("ab", 32)
+	for _, tc := range []struct {
+		digest   string
+		expected string
+		invalid  bool
+	}{
+		{digest: "sha256:" + hex64, expected: "sha256:" + hex64},
+		{digest: " SHA256:" + strings.ToUpper(hex64) + "\n", expected: "sha256:" + hex64},
+		{digest: "sha384:" + strings.Repeat("0", 96), expected: "sha384:" + strings.Repeat("0", 96)},
+		{digest: "sha512:" + strings.Repeat("f", 128), expected: "sha512:" + strings.Repeat("f", 128)},
+		// Unregistered algorithms keep their encoding, only validated by the OCI grammar
+		{digest: "multihash+base58:QmRZxt2b1FVZPNqd8hsiykDL3TdBDeTSPX9Kv46HmX4Gx8", expected: "multihash+base58:QmRZxt2b1FVZPNqd8hsiykDL3TdBDeTSPX9Kv46HmX4Gx8"},
+		{digest: "", invalid: true},
+		{digest: hex64, invalid: true},
+		{digest: "sha256:", invalid: true},
+		{digest: ":" + hex64, invalid: true},
+		{digest: "sha256:" + hex64[:63], invalid: true},
+		{digest: "sha256:" + hex64 + "0", invalid: true},
+		{digest: "sha256:" + hex64[:62] + "zz", invalid: true},
+		{digest: "sha512:" + hex64, invalid: true},
+		{digest: "sha_:" + hex64, invalid: true},
+		{digest: "sha256:" + hex64[:32] + "/" + hex64[33:], invalid: true},
+	} {
+		t.Run(tc.digest, func(t *testing.T) {
+			normalized, err := normalizeDigest(tc.digest)
+			if tc.invalid {
+				if err == nil {
+					t.Errorf("expected an error, got %s", normalized)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if normalized != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, normalized)
+			}
+		})
+	}
+}
+
+func TestVerifyArtifactDigest(t *testing.T) {
+	const manifest, index, other = "sha256:" + "11", "sha256:" + "22", "sha256:" + "33"
+	for _, tc := range []struct {
+		name     string
+		expected string
+		fetched  FetchedImage
+		mismatch bool
+	}{
+		{name: "manifest digest", expected: manifest, fetched: FetchedImage{ManifestDigest: manifest}},
+		{name: "index digest", expected: index, fetched: FetchedImage{ManifestDigest: manifest, IndexDigest: index}},
+		{name: "other digest", expected: other, fetched: FetchedImage{ManifestDigest: manifest, IndexDigest: index}, mismatch: true},
+		{name: "no index", expected: "", fetched: FetchedImage{ManifestDigest: manifest}, mismatch: true},
+		{name: "directory digest", expected: other, fetched: FetchedImage{DirPath: "/bundle", DirDigest: other}},
+		{name: "directory manifest digest", expected: manifest, fetched: FetchedImage{DirPath: "/bundle", DirDigest: other, ManifestDigest: manifest}, mismatch: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := verifyArtifactDigest(tc.expected, &tc.fetched)
+			if tc.mismatch != (err != nil) {
+				t.Errorf("expected mismatch %t, got %v", tc.mismatch, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package task
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/opengovern/og-util/pkg/opengovernance-es-sdk"
+	"github.com/opengovern/og-util/pkg/tasks"
+	"github.com/opengovern/opencomply/services/tasks/scheduler"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Types of the targets of a scan (scan_target_type): registry images, filesystem bundles scanned with the dir:
+// scheme, or the image tarballs of archive_url, the default when it's given.
+const (
+	ScanTargetImage   = "image"
+	ScanTargetDir     = "dir"
+	ScanTargetArchive = "archive"
+)
+
+// ImageSourceDirTarget is the source of the results of filesystem bundles scanned with scan_target_type=dir.
+const ImageSourceDirTarget = "dir"
+
+func parseScanTargetType(params map[string][]string) (string, error) {
+	defaultType := ScanTargetImage
+	if len(params["archive_url"]) > 0 {
+		defaultType = ScanTargetArchive
+	}
+	targetType := getParamValue(params, "scan_target_type", defaultType)
+	if targetType != ScanTargetImage && targetType != ScanTargetDir && targetType != ScanTargetArchive {
+		return "", fmt.Errorf("invalid scan_target_type %q: expected %s, %s or %s", targetType, ScanTargetImage, ScanTargetDir, ScanTargetArchive)
+	}
+	return targetType, nil
+}
+
+// runScanDirTask scans the filesystem bundles of dir_path, directories or tarballs on a mounted volume such as a PVC,
+// and of dir_url, tarballs downloaded over http(s), with the dir: scheme, e.g. unpacked applications and build
+// outputs. Each is stored as the result of dir_name (by position, paths first), by default its path or URL, and the
+// digest of its tarball or directory tree. Registry credentials aren't needed, no image is pulled.
+func runScanDirTask(ctx context.Context, esClient opengovernance.Client, logger *zap.Logger, request tasks.TaskRequest, response *scheduler.TaskResponse, publish ProgressPublisher, publishFindings FindingsPublisher) error {
+	params, err := dirScanParams(request.TaskDefinition.Params)
+	if err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+	scanRequest := request
+	scanRequest.TaskDefinition.Params = params
+	return runScanTask(ctx, esClient, logger, scanRequest, response, publish, publishFindings)
+}
+
+// dirScanParams checks the filesystem bundles of params, returning the params scanning them as artifacts. Bundles
+// are fetched when scanned, each into the directory of its artifact.
+func dirScanParams(params map[string][]string) (map[string][]string, error) {
+	var locations []string
+	for _, p := range params["dir_path"] {
+		if !filepath.IsAbs(p) {
+			return nil, fmt.Errorf("dir_path %s: expected an absolute path", p)
+		}
+		if _, err := os.Stat(p); err != nil {
+			return nil, fmt.Errorf("dir_path %s: %w", p, err)
+		}
+		locations = append(locations, filepath.Clean(p))
+	}
+	for _, u := range params["dir_url"] {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return nil, fmt.Errorf("dir_url %s: expected an http(s) URL", u)
+		}
+		locations = append(locations, u)
+	}
+	if len(locations) == 0 {
+		return nil, fmt.Errorf("dir_path or dir_url parameter is not provided")
+	}
+	if getParamValue(params, "scan_scope", ScanScopeImage) != ScanScopeImage {
+		return nil, fmt.Errorf("scan_scope is not supported when scanning directories")
+	}
+	if getBoolParam(params, "delete_after_scan") {
+		return nil, fmt.Errorf("delete_after_scan is not supported when scanning directories")
+	}
+
+	scanParams := copyParams(params)
+	delete(scanParams, "scan_target_type")
+	delete(scanParams, "dir_path")
+	delete(scanParams, "dir_url")
+	var names, digests []string
+	for i, location := range locations {
+		names = append(names, paramAt(params, "dir_name", i, location))
+		digests = append(digests, paramAt(params, "artifact_digest", i, ""))
+	}
+	scanParams["oci_artifact_url"] = names
+	scanParams["artifact_digest"] = digests
+	scanParams["artifact_dir"] = locations
+	return scanParams, nil
+}
+
+// fetchDirTarget makes the filesystem bundle at location the target of the scan: directories are scanned in place,
+// tarballs, downloaded to outputDir for URLs, are extracted to outputDir/rootfs first.
+func fetchDirTarget(ctx context.Context, outputDir, location string, opts pullOptions) (*FetchedImage, error) {
+	if err := os.MkdirAll(outputDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	tarPath := location
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		tarPath = filepath.Join(outputDir, "dir.tar")
+		if _, err := downloadTarball(ctx, location, tarPath, Credentials{}, opts.maxSize()); err != nil {
+			return nil, fmt.Errorf("failed to download %s: %w", location, err)
+		}
+		defer os.Remove(tarPath)
+	} else {
+		info, err := os.Stat(location)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			digest, err := treeDigest(location)
+			if err != nil {
+				return nil, fmt.Errorf("failed to digest %s: %w", location, err)
+			}
+			return &FetchedImage{Source: ImageSourceDirTarget, DirPath: location, DirDigest: digest}, nil
+		}
+		if info.Size() > opts.maxSize() {
+			return nil, fmt.Errorf("%w: tarball size %d bytes exceeds maximum allowed size of %d bytes", ErrImageTooLarge, info.Size(), opts.maxSize())
+		}
+	}
+
+	digest, err := fileDigest(tarPath)
+	if err != nil {
+		return nil, err
+	}
+	rootfsDir := filepath.Join(outputDir, "rootfs")
+	opts.logger().Info("extracting filesystem bundle", zap.String("location", location), zap.String("dir", rootfsDir))
+	if err := applyLayersSubtree([]string{tarPath}, []string{filepath.Base(tarPath)}, "", rootfsDir); err != nil {
+		return nil, fmt.Errorf("failed to extract %s: %w", location, err)
+	}
+	return &FetchedImage{Source: ImageSourceDirTarget, DirPath: rootfsDir, DirDigest: digest}, nil
+}
+
+// treeDigest returns the sha256 digest of the directory tree at root, over the paths, types and contents of its
+// entries in lexical order. Symlinks are digested by their target, not followed.
+func treeDigest(root string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		switch {
+		case d.IsDir():
+			fmt.Fprintf(h, "dir %s\n", rel)
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "symlink %s %s\n", rel, target)
+		case d.Type().IsRegular():
+			digest, err := fileDigest(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "file %s %s\n", rel, digest)
+		}
+		// Devices, fifos etc. carry no package metadata
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,287 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/opengovern/og-util/pkg/opengovernance-es-sdk"
+	"github.com/opengovern/og-util/pkg/tasks"
+	"github.com/opengovern/opencomply/services/tasks/scheduler"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"net/http"
+	"net/url"
+	"oras.land/oras-go/v2/registry/remote"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DefaultMaxRepositories is the cap on the repositories of a registry selected by the discovery (max_repositories).
+	DefaultMaxRepositories = 1000
+	// githubPackagesPageSize is the number of packages requested per page of the GitHub packages API.
+	githubPackagesPageSize = 100
+	// catalogPageSize is the number of repositories requested per page of the registry catalog.
+	catalogPageSize = 1000
+)
+
+// githubAPIURL is the GitHub API the GHCR packages are listed from.
+const githubAPIURL = "https://api.github.com"
+
+// errMaxRepositoriesReached stops the discovery once max_repositories repositories were selected.
+var errMaxRepositoriesReached = errors.New("max repositories reached")
+
+// repositoryQuery selects the repositories of a registry discovered.
+type repositoryQuery struct {
+	// Regex keeps the repositories it matches, registry host included (repository_regex).
+	Regex *regexp.Regexp
+	// MaxRepositories is the maximum number of repositories selected, the discovery stops at that point
+	// (max_repositories).
+	MaxRepositories int
+	// GitHubOwner is the organization or user whose GHCR packages are listed, those of the owner of github_token when
+	// empty (github_owner).
+	GitHubOwner string
+}
+
+// getRepositoryQueryFromParams builds the repository query from the task params.
+func getRepositoryQueryFromParams(params map[string][]string) (repositoryQuery, error) {
+	q := repositoryQuery{GitHubOwner: getParamValue(params, "github_owner", "")}
+	if v := getParamValue(params, "repository_regex", ""); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid repository_regex: %w", err)
+		}
+		q.Regex = re
+	}
+	var err error
+	if q.MaxRepositories, err = getIntParam(params, "max_repositories", DefaultMaxRepositories); err != nil {
+		return q, err
+	}
+	if q.MaxRepositories < 1 {
+		return q, fmt.Errorf("max_repositories must be positive")
+	}
+	return q, nil
+}
+
+// RepositoryDiscoveryResult is the result of discover-repositories, the repositories of the registry selected,
+// Truncated being set when the discovery stopped at max_repositories.
+type RepositoryDiscoveryResult struct {
+	RegistryType string   `json:"registryType"`
+	Repositories []string `json:"repositories"`
+	Truncated    bool     `json:"truncated,omitempty"`
+}
+
+// runDiscoverRepositoriesTask lists the repositories of the registry of the credentials, for the scheduler to enqueue
+// their scans.
+func runDiscoverRepositoriesTask(ctx context.Context, logger *zap.Logger, request tasks.TaskRequest, response *scheduler.TaskResponse) error {
+	discovered, err := discoverRepositoriesFromParams(ctx, logger, request.TaskDefinition.Params)
+	if err != nil {
+		return err
+	}
+	resultJson, err := json.Marshal(discovered)
+	if err != nil {
+		return err
+	}
+	response.Result = resultJson
+	return nil
+}
+
+// runScanRegistryTask scans the tags of every repository of the registry of the credentials (scan_scope=registry),
+// as scan_scope=repository does for the repositories given.
+func runScanRegistryTask(ctx context.Context, esClient opengovernance.Client, logger *zap.Logger, request tasks.TaskRequest, response *scheduler.TaskResponse, publish ProgressPublisher, publishFindings FindingsPublisher) error {
+	discovered, err := discoverRepositoriesFromParams(ctx, logger, request.TaskDefinition.Params)
+	if err != nil {
+		return err
+	}
+	if len(discovered.Repositories) == 0 {
+		response.Result = []byte("No repositories found in the registry")
+		return nil
+	}
+
+	scanRequest := request
+	scanRequest.TaskDefinition.Params = copyParams(request.TaskDefinition.Params)
+	scanRequest.TaskDefinition.Params["oci_artifact_url"] = discovered.Repositories
+	return runScanRepositoryTask(ctx, esClient, logger, scanRequest, response, publish, publishFindings)
+}
+
+func discoverRepositoriesFromParams(ctx context.Context, logger *zap.Logger, params map[string][]string) (RepositoryDiscoveryResult, error) {
+	query, err := getRepositoryQueryFromParams(params)
+	if err != nil {
+		return RepositoryDiscoveryResult{}, newTaskError(ErrorKindConfig, err)
+	}
+	registryType := getParamValue(params, "registry_type", string(RegistryGHCR))
+	creds := getCredsFromParams(params)
+	if err := creds.ValidateFor(registryType); err != nil {
+		return RepositoryDiscoveryResult{}, newTaskError(ErrorKindConfig, err)
+	}
+
+	discovered, err := discoverRepositories(ctx, registryType, creds, query)
+	if err != nil {
+		if isAccessError(err) {
+			return RepositoryDiscoveryResult{}, newTaskError(ErrorKindAuth, err)
+		}
+		return RepositoryDiscoveryResult{}, newTaskError(ErrorKindPull, err)
+	}
+	logger.Info("Discovered registry repositories", zap.String("registryType", registryType),
+		zap.Int("count", len(discovered.Repositories)), zap.Bool("truncated", discovered.Truncated))
+	return discovered, nil
+}
+
+// discoverRepositories lists the repositories of the registry of the credentials selected by the query, through the
+// ECR API, the GitHub packages API for GHCR, and the registry catalog for ACR and generic registries.
+func discoverRepositories(ctx context.Context, registryType string, creds Credentials, q repositoryQuery) (RepositoryDiscoveryResult, error) {
+	result := RepositoryDiscoveryResult{RegistryType: registryType, Repositories: []string{}}
+	add := func(repository string) error {
+		if q.Regex != nil && !q.Regex.MatchString(repository) {
+			return nil
+		}
+		if len(result.Repositories) >= q.MaxRepositories {
+			result.Truncated = true
+			return errMaxRepositoriesReached
+		}
+		result.Repositories = append(result.Repositories, repository)
+		return nil
+	}
+
+	var err error
+	switch RegistryType(registryType) {
+	case RegistryECR:
+		err = discoverECRRepositories(ctx, creds, add)
+	case RegistryGHCR:
+		err = discoverGHCRRepositories(ctx, creds, q.GitHubOwner, add)
+	case RegistryACR:
+		err = discoverCatalogRepositories(ctx, registryType, creds, creds.ACRLoginServer, add)
+	case RegistryGeneric:
+		host := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(creds.RegistryHost, "https://"), "http://"), "/")
+		err = discoverCatalogRepositories(ctx, registryType, creds, host, add)
+	default:
+		return RepositoryDiscoveryResult{}, newTaskError(ErrorKindConfig, fmt.Errorf("repository discovery is not supported for registry type %s", registryType))
+	}
+	if err != nil && !errors.Is(err, errMaxRepositoriesReached) {
+		return RepositoryDiscoveryResult{}, err
+	}
+	return result, nil
+}
+
+// discoverECRRepositories lists the repositories of the ECR registry of ecr_account_id in ecr_region.
+func discoverECRRepositories(ctx context.Context, creds Credentials, add func(repository string) error) error {
+	cfg, retries, err := loadECRConfig(ctx, creds)
+	if err != nil {
+		return err
+	}
+	paginator := ecr.NewDescribeRepositoriesPaginator(ecr.NewFromConfig(cfg), &ecr.DescribeRepositoriesInput{
+		RegistryId: aws.String(creds.ECRAccountID),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("ECR error: failed to describe repositories: %w", retryFailure(err, retries.MaxAttempts))
+		}
+		for _, repository := range page.Repositories {
+			if err := add(ecrHost(creds) + "/" + aws.ToString(repository.RepositoryName)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// discoverGHCRRepositories lists the container packages of owner, an organization or a user, or of the owner of
+// github_token when empty, GHCR not serving the registry catalog.
+func discoverGHCRRepositories(ctx context.Context, creds Credentials, owner string, add func(repository string) error) error {
+	path := "/user/packages"
+	if owner != "" {
+		path = "/orgs/" + url.PathEscape(owner) + "/packages"
+	}
+	if creds.hasGitHubApp() && owner == "" {
+		return newTaskError(ErrorKindConfig, fmt.Errorf("github_owner is required with a GitHub App, installations have no packages of their own"))
+	}
+	token, err := githubToken(ctx, creds)
+	if err != nil {
+		return newTaskError(ErrorKindAuth, fmt.Errorf("GHCR error: %w", err))
+	}
+	httpClient, err := retryingHTTPClient()
+	if err != nil {
+		return err
+	}
+
+	for page := 1; ; page++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+			fmt.Sprintf("%s%s?package_type=container&per_page=%d&page=%d", githubAPIURL, path, githubPackagesPageSize, page), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", "application/vnd.github+json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to list GHCR packages: %w", err)
+		}
+		if resp.StatusCode == http.StatusNotFound && page == 1 && strings.HasPrefix(path, "/orgs/") {
+			// Not an organization, the packages of a user
+			resp.Body.Close()
+			path = "/users/" + url.PathEscape(owner) + "/packages"
+			page--
+			continue
+		}
+
+		var packages []struct {
+			Name  string `json:"name"`
+			Owner struct {
+				Login string `json:"login"`
+			} `json:"owner"`
+		}
+		err = func() error {
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return &statusError{StatusCode: resp.StatusCode, Err: fmt.Errorf("failed to list GHCR packages: unexpected status %d", resp.StatusCode)}
+			}
+			return json.NewDecoder(resp.Body).Decode(&packages)
+		}()
+		if err != nil {
+			return err
+		}
+		for _, p := range packages {
+			if err := add("ghcr.io/" + strings.ToLower(p.Owner.Login) + "/" + p.Name); err != nil {
+				return err
+			}
+		}
+		if len(packages) < githubPackagesPageSize {
+			return nil
+		}
+	}
+}
+
+// discoverCatalogRepositories lists the repositories of the registry at host through its catalog
+// (/v2/_catalog), which needs credentials allowed to read it.
+func discoverCatalogRepositories(ctx context.Context, registryType string, creds Credentials, host string, add func(repository string) error) error {
+	auths, err := getRegistryAuths(ctx, registryType, creds)
+	if err != nil {
+		return newTaskError(ErrorKindAuth, err)
+	}
+	client, err := newAuthClient(DockerConfig{Auths: auths}, pullOptions{})
+	if err != nil {
+		return err
+	}
+	reg, err := remote.NewRegistry(host)
+	if err != nil {
+		return fmt.Errorf("invalid registry host %q: %w", host, err)
+	}
+	reg.Client = client
+	reg.RepositoryListPageSize = catalogPageSize
+
+	err = reg.Repositories(ctx, "", func(repositories []string) error {
+		for _, repository := range repositories {
+			if err := add(host + "/" + repository); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errMaxRepositoriesReached) {
+		return fmt.Errorf("failed to list the catalog of %s: %w", host, err)
+	}
+	return err
+}
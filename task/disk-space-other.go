@@ -0,0 +1,11 @@
+//go:build !unix
+
+package task
+
+import (
+	"errors"
+)
+
+func freeDiskBytes(path string) (int64, error) {
+	return 0, errors.New("not supported on this platform")
+}
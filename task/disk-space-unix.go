@@ -0,0 +1,25 @@
+//go:build unix
+
+package task
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// freeDiskBytes returns the space available to unprivileged users on the volume of path, or of its closest existing
+// parent when it isn't created yet.
+func freeDiskBytes(path string) (int64, error) {
+	for {
+		if _, err := os.Stat(path); err == nil || filepath.Dir(path) == path {
+			break
+		}
+		path = filepath.Dir(path)
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,343 @@
+package task
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EPSS (Exploit Prediction Scoring System) scores annotated on the matches of CVEs. EPSS_DATASET is either "api", to
+// query the FIRST API (EPSS_API_URL, https://api.first.org/data/v1/epss by default) for the CVEs of each scan, or the
+// path or http(s) URL of a FIRST CSV snapshot (epss_scores-current.csv, optionally gzipped), e.g. one bundled in the
+// image for air-gapped clusters. Scores are reloaded once older than EPSS_DATASET_REFRESH (a duration, 24h by
+// default).
+var (
+	EPSSDataset        = os.Getenv("EPSS_DATASET")
+	EPSSAPIURL         = os.Getenv("EPSS_API_URL")
+	EPSSDatasetRefresh = os.Getenv("EPSS_DATASET_REFRESH")
+)
+
+const (
+	epssDatasetAPI            = "api"
+	defaultEPSSAPIURL         = "https://api.first.org/data/v1/epss"
+	defaultEPSSDatasetRefresh = 24 * time.Hour
+	// epssAPIBatchSize is the number of CVEs queried per API request, keeping the URL short
+	epssAPIBatchSize = 100
+)
+
+// epssScore is the EPSS score of a CVE, the probability of exploitation in the next 30 days, and its percentile.
+type epssScore struct {
+	Score      float64
+	Percentile float64
+}
+
+// epssIndex maps upper-cased CVE IDs to their score.
+type epssIndex map[string]epssScore
+
+// epssCache holds the loaded snapshot, or the scores queried from the API so far with when they were. A failed
+// reload keeps serving the previous scores.
+var epssCache struct {
+	mu       sync.Mutex
+	index    epssIndex
+	loadedAt time.Time
+	// queriedAt is when the API was queried for each CVE, including those it has no score for
+	queriedAt map[string]time.Time
+}
+
+func getEPSSRefresh() time.Duration {
+	refresh, err := time.ParseDuration(EPSSDatasetRefresh)
+	if err != nil || refresh <= 0 {
+		return defaultEPSSDatasetRefresh
+	}
+	return refresh
+}
+
+// getEPSSScores returns the EPSS scores of the CVEs of matches, nil when EPSS_DATASET isn't set or the scores never
+// loaded.
+func getEPSSScores(ctx context.Context, logger *zap.Logger, matches []VulnerabilityMatch) epssIndex {
+	switch EPSSDataset {
+	case "":
+		return nil
+	case epssDatasetAPI:
+		return queryEPSSScores(ctx, logger, matchCVEs(matches))
+	}
+
+	refresh := getEPSSRefresh()
+	epssCache.mu.Lock()
+	defer epssCache.mu.Unlock()
+	if epssCache.index != nil && time.Since(epssCache.loadedAt) < refresh {
+		return epssCache.index
+	}
+
+	index, err := loadEPSSDataset(ctx, EPSSDataset)
+	if err != nil {
+		logger.Warn("failed to load EPSS dataset, EPSS scores may be stale or missing", zap.String("dataset", EPSSDataset), zap.Error(err))
+		if epssCache.index != nil {
+			// Retry the stale dataset no sooner than a tenth of the refresh interval
+			epssCache.loadedAt = time.Now().Add(-refresh + refresh/10)
+		}
+		return epssCache.index
+	}
+	logger.Info("loaded EPSS dataset", zap.String("dataset", EPSSDataset), zap.Int("cves", len(index)))
+	epssCache.index = index
+	epssCache.loadedAt = time.Now()
+	return index
+}
+
+// matchCVEs returns the upper-cased CVE IDs of the matches and their related vulnerabilities.
+func matchCVEs(matches []VulnerabilityMatch) []string {
+	seen := make(map[string]bool)
+	var cves []string
+	for _, m := range matches {
+		for _, id := range matchVulnerabilityIDs(m) {
+			if id = strings.ToUpper(id); strings.HasPrefix(id, "CVE-") && !seen[id] {
+				seen[id] = true
+				cves = append(cves, id)
+			}
+		}
+	}
+	return cves
+}
+
+func matchVulnerabilityIDs(m VulnerabilityMatch) []string {
+	ids := []string{m.Vulnerability.ID}
+	for _, related := range m.RelatedVulnerabilities {
+		ids = append(ids, related.ID)
+	}
+	return ids
+}
+
+// queryEPSSScores returns the scores of cves, querying the API for those not queried within the refresh interval.
+func queryEPSSScores(ctx context.Context, logger *zap.Logger, cves []string) epssIndex {
+	refresh := getEPSSRefresh()
+	epssCache.mu.Lock()
+	defer epssCache.mu.Unlock()
+	if epssCache.index == nil {
+		epssCache.index = make(epssIndex)
+		epssCache.queriedAt = make(map[string]time.Time)
+	}
+
+	var stale []string
+	for _, cve := range cves {
+		if at, ok := epssCache.queriedAt[cve]; !ok || time.Since(at) >= refresh {
+			stale = append(stale, cve)
+		}
+	}
+	for start := 0; start < len(stale); start += epssAPIBatchSize {
+		batch := stale[start:min(start+epssAPIBatchSize, len(stale))]
+		scores, err := fetchEPSSScores(ctx, logger, batch)
+		if err != nil {
+			logger.Warn("failed to query EPSS scores, EPSS scores may be stale or missing", zap.Int("cves", len(batch)), zap.Error(err))
+			break
+		}
+		now := time.Now()
+		for _, cve := range batch {
+			epssCache.queriedAt[cve] = now
+			delete(epssCache.index, cve)
+		}
+		for cve, score := range scores {
+			epssCache.index[cve] = score
+		}
+	}
+
+	index := make(epssIndex, len(cves))
+	for _, cve := range cves {
+		if score, ok := epssCache.index[cve]; ok {
+			index[cve] = score
+		}
+	}
+	return index
+}
+
+// fetchEPSSScores queries the API for the scores of cves.
+func fetchEPSSScores(ctx context.Context, logger *zap.Logger, cves []string) (epssIndex, error) {
+	apiURL := EPSSAPIURL
+	if apiURL == "" {
+		apiURL = defaultEPSSAPIURL
+	}
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EPSS_API_URL: %w", err)
+	}
+	query := u.Query()
+	query.Set("cve", strings.Join(cves, ","))
+	query.Set("limit", strconv.Itoa(len(cves)))
+	u.RawQuery = query.Encode()
+
+	httpClient, err := retryingHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{StatusCode: resp.StatusCode, Err: fmt.Errorf("unexpected status %d querying EPSS scores", resp.StatusCode)}
+	}
+
+	// The API serves the scores as strings
+	var page struct {
+		Data []struct {
+			CVE        string `json:"cve"`
+			EPSS       string `json:"epss"`
+			Percentile string `json:"percentile"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("failed to parse EPSS scores: %w", err)
+	}
+	index := make(epssIndex, len(page.Data))
+	for _, d := range page.Data {
+		score, err := parseEPSSScore(d.EPSS, d.Percentile)
+		if err != nil {
+			logger.Debug("skipping invalid EPSS score", zap.String("cve", d.CVE), zap.Error(err))
+			continue
+		}
+		index[strings.ToUpper(d.CVE)] = score
+	}
+	return index, nil
+}
+
+func loadEPSSDataset(ctx context.Context, location string) (epssIndex, error) {
+	var data []byte
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+		if err != nil {
+			return nil, err
+		}
+		httpClient, err := retryingHTTPClient()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %d downloading %s", resp.StatusCode, location)
+		}
+		if data, err = io.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if data, err = os.ReadFile(location); err != nil {
+			return nil, err
+		}
+	}
+	return parseEPSSCSV(data)
+}
+
+// parseEPSSCSV parses a FIRST EPSS snapshot: a #model_version comment line, then the cve, epss and percentile
+// columns. Gzipped snapshots are decompressed.
+func parseEPSSCSV(data []byte) (epssIndex, error) {
+	var reader io.Reader = bytes.NewReader(data)
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse EPSS dataset: %w", err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	buffered := bufio.NewReader(reader)
+	if first, err := buffered.Peek(1); err == nil && first[0] == '#' {
+		if _, err := buffered.ReadString('\n'); err != nil {
+			return nil, fmt.Errorf("failed to parse EPSS dataset: %w", err)
+		}
+	}
+
+	r := csv.NewReader(buffered)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse EPSS dataset: %w", err)
+	}
+	cveCol, epssCol, percentileCol := -1, -1, -1
+	for i, name := range header {
+		switch strings.TrimSpace(name) {
+		case "cve":
+			cveCol = i
+		case "epss":
+			epssCol = i
+		case "percentile":
+			percentileCol = i
+		}
+	}
+	if cveCol < 0 || epssCol < 0 || percentileCol < 0 {
+		return nil, fmt.Errorf("failed to parse EPSS dataset: expected cve, epss and percentile columns")
+	}
+
+	index := make(epssIndex)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse EPSS dataset: %w", err)
+		}
+		if len(record) <= cveCol || len(record) <= epssCol || len(record) <= percentileCol {
+			continue
+		}
+		score, err := parseEPSSScore(record[epssCol], record[percentileCol])
+		if err != nil {
+			continue
+		}
+		index[strings.ToUpper(strings.TrimSpace(record[cveCol]))] = score
+	}
+	return index, nil
+}
+
+func parseEPSSScore(epss, percentile string) (epssScore, error) {
+	score, err := strconv.ParseFloat(strings.TrimSpace(epss), 64)
+	if err != nil {
+		return epssScore{}, err
+	}
+	pct, err := strconv.ParseFloat(strings.TrimSpace(percentile), 64)
+	if err != nil {
+		return epssScore{}, err
+	}
+	return epssScore{Score: score, Percentile: pct}, nil
+}
+
+// annotateEPSS sets EPSSScore and EPSSPercentile on the matches whose vulnerability, or one of its related
+// vulnerabilities (e.g. the CVE of a GHSA), has an EPSS score, the highest one when several have.
+func annotateEPSS(matches []VulnerabilityMatch, index epssIndex) {
+	if index == nil {
+		return
+	}
+	for i := range matches {
+		m := &matches[i]
+		var best *epssScore
+		for _, id := range matchVulnerabilityIDs(*m) {
+			if score, ok := index[strings.ToUpper(id)]; ok && (best == nil || score.Score > best.Score) {
+				best = &score
+			}
+		}
+		if best != nil {
+			m.EPSSScore = &best.Score
+			m.EPSSPercentile = &best.Percentile
+		}
+	}
+}
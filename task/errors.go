@@ -0,0 +1,76 @@
+package task
+
+import (
+	"errors"
+)
+
+// ErrorKind classifies why a task failed, so callers can tell bad input apart from registry and scanner failures.
+type ErrorKind string
+
+const (
+	ErrorKindConfig ErrorKind = "config"
+	ErrorKindAuth   ErrorKind = "auth"
+	ErrorKindPull   ErrorKind = "pull"
+	ErrorKindScan   ErrorKind = "scan"
+	// ErrorKindNotFound means the image doesn't exist (anymore) in the registry, as opposed to ErrorKindPull
+	// failures which may succeed later.
+	ErrorKindNotFound ErrorKind = "not_found"
+	// ErrorKindSeverityGate means every image was scanned and stored but the matches of some breached the
+	// fail_on_severity or fail_on_new_severity threshold.
+	ErrorKindSeverityGate ErrorKind = "severity_gate"
+	// ErrorKindTooLarge means the image is larger than the maximum size (MAX_IMAGE_SIZE_MIB, max_image_size_mib),
+	// it wasn't downloaded.
+	ErrorKindTooLarge ErrorKind = "too_large"
+	// ErrorKindTimeout means the run was cancelled by its timeout (run_timeout), whatever it was doing then.
+	ErrorKindTimeout ErrorKind = "timeout"
+)
+
+// ErrImageNotFound is returned when the registry reports that the manifest (deleted tag, wrong digest) or the
+// repository of an image doesn't exist. It's permanent, the pull isn't retried.
+var ErrImageNotFound = errors.New("image not found")
+
+// ErrDigestMismatch is returned when the manifest pulled for an image doesn't have the artifact_digest given for it,
+// e.g. because its tag was moved. Nothing is scanned or stored for the image then.
+var ErrDigestMismatch = errors.New("artifact digest mismatch")
+
+// ErrImageTooLarge is returned when the layers the manifest of an image lists exceed the maximum size. It's checked
+// before they're downloaded, the pull isn't retried.
+var ErrImageTooLarge = errors.New("image exceeds limit")
+
+// ErrInsufficientDiskSpace is returned when the volume of the work directory hasn't the space to write out an image,
+// checked before its layers are downloaded.
+var ErrInsufficientDiskSpace = errors.New("not enough free disk space")
+
+// ErrSeverityGateBreached fails a run, once its results are stored, when an image breached a severity gate.
+var ErrSeverityGateBreached = errors.New("severity gate breached")
+
+// TaskError is an error of a known kind. It reads as the wrapped error.
+type TaskError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *TaskError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TaskError) Unwrap() error {
+	return e.Err
+}
+
+// newTaskError wraps err with kind, keeping the kind of an already classified error.
+func newTaskError(kind ErrorKind, err error) error {
+	if err == nil || ErrorKindOf(err) != "" {
+		return err
+	}
+	return &TaskError{Kind: kind, Err: err}
+}
+
+// ErrorKindOf returns the kind of err, or an empty kind when it isn't classified.
+func ErrorKindOf(err error) ErrorKind {
+	var taskErr *TaskError
+	if errors.As(err, &taskErr) {
+		return taskErr.Kind
+	}
+	return ""
+}
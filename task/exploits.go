@@ -0,0 +1,188 @@
+package task
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Public exploit dataset used to flag matches with public exploit code. EXPLOIT_DATASET is a path or http(s) URL of
+// either the ExploitDB files_exploits.csv or a JSON object mapping vulnerability IDs to exploit references, e.g.
+// {"CVE-2021-44228": ["https://github.com/rapid7/metasploit-framework/..."]}. The dataset is reloaded once older than
+// EXPLOIT_DATASET_REFRESH (a duration, 24h by default).
+var (
+	ExploitDataset        = os.Getenv("EXPLOIT_DATASET")
+	ExploitDatasetRefresh = os.Getenv("EXPLOIT_DATASET_REFRESH")
+)
+
+const defaultExploitDatasetRefresh = 24 * time.Hour
+
+// exploitDBURL is the reference recorded for exploits found in the ExploitDB dataset.
+const exploitDBURL = "https://www.exploit-db.com/exploits/"
+
+// exploitIndex maps upper-cased vulnerability IDs to exploit references.
+type exploitIndex map[string][]string
+
+// exploitCache holds the loaded dataset. A failed reload keeps serving the previous dataset.
+var exploitCache struct {
+	mu       sync.Mutex
+	index    exploitIndex
+	loadedAt time.Time
+}
+
+// getExploitIndex returns the exploit dataset, (re)loading it when it's stale. It returns nil when no dataset is
+// configured or it never loaded.
+func getExploitIndex(ctx context.Context, logger *zap.Logger) exploitIndex {
+	if ExploitDataset == "" {
+		return nil
+	}
+	refresh, err := time.ParseDuration(ExploitDatasetRefresh)
+	if err != nil || refresh <= 0 {
+		refresh = defaultExploitDatasetRefresh
+	}
+
+	exploitCache.mu.Lock()
+	defer exploitCache.mu.Unlock()
+	if exploitCache.index != nil && time.Since(exploitCache.loadedAt) < refresh {
+		return exploitCache.index
+	}
+
+	index, err := loadExploitDataset(ctx, ExploitDataset)
+	if err != nil {
+		logger.Warn("failed to load exploit dataset, exploit availability may be stale or missing", zap.String("dataset", ExploitDataset), zap.Error(err))
+		if exploitCache.index != nil {
+			// Retry the stale dataset no sooner than a tenth of the refresh interval
+			exploitCache.loadedAt = time.Now().Add(-refresh + refresh/10)
+		}
+		return exploitCache.index
+	}
+	logger.Info("loaded exploit dataset", zap.String("dataset", ExploitDataset), zap.Int("vulnerabilities", len(index)))
+	exploitCache.index = index
+	exploitCache.loadedAt = time.Now()
+	return index
+}
+
+func loadExploitDataset(ctx context.Context, location string) (exploitIndex, error) {
+	var data []byte
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+		if err != nil {
+			return nil, err
+		}
+		httpClient, err := outboundHTTPClient()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %d downloading %s", resp.StatusCode, location)
+		}
+		if data, err = io.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		if data, err = os.ReadFile(location); err != nil {
+			return nil, err
+		}
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		return parseExploitJSON(trimmed)
+	}
+	return parseExploitDBCSV(data)
+}
+
+func parseExploitJSON(data []byte) (exploitIndex, error) {
+	var raw map[string][]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse exploit dataset: %w", err)
+	}
+	index := make(exploitIndex, len(raw))
+	for id, refs := range raw {
+		index[strings.ToUpper(id)] = append(index[strings.ToUpper(id)], refs...)
+	}
+	return index, nil
+}
+
+// parseExploitDBCSV parses the ExploitDB files_exploits.csv, whose codes column lists the CVE (and other) IDs of each
+// exploit separated by semicolons.
+func parseExploitDBCSV(data []byte) (exploitIndex, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse exploit dataset: %w", err)
+	}
+	idCol, codesCol := -1, -1
+	for i, name := range header {
+		switch strings.TrimSpace(name) {
+		case "id":
+			idCol = i
+		case "codes":
+			codesCol = i
+		}
+	}
+	if idCol < 0 || codesCol < 0 {
+		return nil, fmt.Errorf("failed to parse exploit dataset: expected id and codes columns")
+	}
+
+	index := make(exploitIndex)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse exploit dataset: %w", err)
+		}
+		if len(record) <= idCol || len(record) <= codesCol {
+			continue
+		}
+		for _, code := range strings.Split(record[codesCol], ";") {
+			code = strings.ToUpper(strings.TrimSpace(code))
+			if strings.HasPrefix(code, "CVE-") {
+				index[code] = append(index[code], exploitDBURL+record[idCol])
+			}
+		}
+	}
+	return index, nil
+}
+
+// flagExploitAvailable sets ExploitAvailable and ExploitReferences on the matches whose vulnerability, or one of its
+// related vulnerabilities (e.g. the CVE of a GHSA), has public exploit code in the index.
+func flagExploitAvailable(matches []VulnerabilityMatch, index exploitIndex) {
+	if index == nil {
+		return
+	}
+	for i := range matches {
+		m := &matches[i]
+		ids := []string{m.Vulnerability.ID}
+		for _, related := range m.RelatedVulnerabilities {
+			ids = append(ids, related.ID)
+		}
+		seen := make(map[string]bool)
+		for _, id := range ids {
+			for _, ref := range index[strings.ToUpper(id)] {
+				if !seen[ref] {
+					seen[ref] = true
+					m.ExploitReferences = append(m.ExploitReferences, ref)
+				}
+			}
+		}
+		m.ExploitAvailable = len(m.ExploitReferences) > 0
+	}
+}
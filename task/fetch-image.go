@@ -2,37 +2,45 @@ package task
 
 import (
 	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
-	"github.com/opengovern/resilient-bridge/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
 	"golang.org/x/net/context"
 	"io"
+	"net/http"
 	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
 	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/errdef"
 	"oras.land/oras-go/v2/registry"
 	"oras.land/oras-go/v2/registry/remote"
 	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/errcode"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-// MaxSizeMiB is the maximum allowed size of the image in MiB, defaulting to 2 GiB.
+// MaxSizeMiB is the default maximum size of images in MiB (MAX_IMAGE_SIZE_MIB).
 const MaxSizeMiB = 2048 // 2 GiB
-var maxSizeBytes = int64(MaxSizeMiB) * 1024 * 1024
-
-// MaxRetries for pulling and processing the artifact
-const MaxRetries = 3
-
-// BackoffBaseDelay is the base delay for exponential backoff between retries.
-const BackoffBaseDelay = 2 * time.Second
 
 type AuthConfig struct {
 	Auth string `json:"auth,omitempty"`
+	// RegistryToken is a bearer token of the registry used instead of Auth, e.g. a scoped ACR access token.
+	RegistryToken string `json:"registrytoken,omitempty"`
 }
 
 type DockerConfig struct {
@@ -44,18 +52,65 @@ type RegistryType string
 const (
 	RegistryGHCR RegistryType = "ghcr"
 	RegistryECR  RegistryType = "ecr"
-	RegistryACR  RegistryType = "acr"
+	// RegistryECRPublic authenticates to the Amazon ECR Public Gallery (public.ecr.aws) with the AWS credentials of
+	// the environment, for the rate limits of authenticated pulls.
+	RegistryECRPublic RegistryType = "ecr-public"
+	RegistryACR       RegistryType = "acr"
+	// RegistryDockerHub authenticates to docker.io with a username and access token, or pulls anonymously without.
+	RegistryDockerHub RegistryType = "dockerhub"
+	// RegistryGCR and RegistryGAR authenticate to Google Container Registry (gcr.io) and Artifact Registry
+	// (*-docker.pkg.dev, set in gcp_registry_host) with a GCP access token.
+	RegistryGCR RegistryType = "gcr"
+	RegistryGAR RegistryType = "gar"
+	// RegistryGeneric authenticates to a self-hosted registry at registry_host with basic auth.
+	RegistryGeneric RegistryType = "generic"
+	// RegistryPublic skips all authentication and pulls anonymously.
+	RegistryPublic RegistryType = "public"
 )
 
 type Credentials struct {
 	GithubUsername string `json:"github_username"`
 	GithubToken    string `json:"github_token"`
+	// GithubApp* are the credentials of a GitHub App, minting installation tokens instead of github_token.
+	GithubAppID             string `json:"github_app_id"`
+	GithubAppInstallationID string `json:"github_app_installation_id"`
+	GithubAppPrivateKey     string `json:"github_app_private_key"`
 
 	ECRAccountID string `json:"ecr_account_id"`
 	ECRRegion    string `json:"ecr_region"`
+	// ECRRoleARN is the role assumed, with ECRExternalID when required by its trust policy, before calling ECR, e.g.
+	// in the account of the registry.
+	ECRRoleARN    string `json:"ecr_role_arn"`
+	ECRExternalID string `json:"ecr_external_id"`
 
 	ACRLoginServer string `json:"acr_login_server"`
 	ACRTenantID    string `json:"acr_tenant_id"`
+	ACRClientID    string `json:"acr_client_id"`
+	// ACRAuthMethod is the Azure credential of ACR and Azure Blob Storage, one of the AzureAuth methods, inferred
+	// from the credential params when empty. ACRClientSecret is the secret of the service principal of ACRClientID,
+	// ACRManagedIdentityClientID the client ID of a user-assigned managed identity.
+	ACRAuthMethod              string `json:"acr_auth_method"`
+	ACRClientSecret            string `json:"acr_client_secret"`
+	ACRManagedIdentityClientID string `json:"acr_managed_identity_client_id"`
+	// ACRTokenScope is the space separated scopes of the ACR access token pulling images, pull on the repository of
+	// the image by default. acrRepository is that repository, set when pulling, without it the refresh token is used.
+	ACRTokenScope string `json:"acr_token_scope"`
+	acrRepository string
+
+	DockerHubUsername string `json:"dockerhub_username"`
+	DockerHubToken    string `json:"dockerhub_token"`
+
+	GCPCredentialsJSON string `json:"gcp_credentials_json"`
+	GCPRegistryHost    string `json:"gcp_registry_host"`
+
+	RegistryHost     string `json:"registry_host"`
+	RegistryUsername string `json:"registry_username"`
+	RegistryPassword string `json:"registry_password"`
+
+	// OIDC federated credentials, exchanged for short-lived cloud credentials (ECR/ACR)
+	OIDCToken     string `json:"oidc_token"`
+	OIDCTokenFile string `json:"oidc_token_file"`
+	OIDCRoleARN   string `json:"oidc_role_arn"`
 }
 
 // AllowedMediaTypes defines the permitted OCI and Docker-compatible media types that are acceptable.
@@ -78,23 +133,124 @@ var AllowedMediaTypes = []string{
 	// Docker compatible types if needed:
 	"application/vnd.docker.distribution.manifest.v2+json",
 	"application/vnd.docker.image.rootfs.diff.tar.gzip",
+	"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip",
 	"application/vnd.docker.container.image.v1+json",
 }
 
-func fetchImage(registryType, outputDir, ociArtifactURI string, creds Credentials) error {
+// FetchedImage describes an image archive or OCI layout produced by fetchImage.
+type FetchedImage struct {
+	// ManifestDigest is the digest of the image manifest as resolved from the registry.
+	ManifestDigest string
+	// ArchivePath is the path of the docker archive handed to the scanner.
+	ArchivePath string
+	// TarDigest is the sha256 digest of the archive handed to the scanner.
+	TarDigest string
+	// LayoutPath is set instead of ArchivePath when the image is pulled into an OCI layout (image_layout=oci-dir),
+	// LayoutDigest being the digest of its directory tree as handed to the scanner.
+	LayoutPath   string
+	LayoutDigest string
+	// Source is where the image content was read from (registry, containerd or an attached SBOM or attestation).
+	Source string
+
+	// SBOMPath is set instead of ArchivePath when an attached SBOM is scanned rather than the image filesystem.
+	// SBOMVerified is set when its attestation was signed by the sbom_attestation_key.
+	SBOMPath     string
+	SBOMFormat   string
+	SBOMDigest   string
+	SBOMVerified bool
+
+	// DirPath is set instead of ArchivePath for filesystem bundles scanned with scan_target_type=dir, DirDigest being
+	// the digest of their tarball or directory tree.
+	DirPath   string
+	DirDigest string
+
+	// ArchiveDigest is the sha256 digest of the image tarball downloaded from archive_url, as stored.
+	ArchiveDigest string
+
+	// ForeignLayers are the digests of the foreign layers fetched from the URLs in the manifest.
+	ForeignLayers []string
+
+	// ResolvedReference is the reference pulled, DefaultTagApplied being set when the requested reference had no
+	// tag or digest and DefaultTag was pulled.
+	ResolvedReference string
+	DefaultTagApplied bool
+
+	// Platform is the platform scanned, IndexDigest being the digest of the multi-arch image index the platform
+	// manifest (ManifestDigest) was selected from.
+	Platform    string
+	IndexDigest string
+
+	// BlobCache is how much of the pull the blob cache served, when enabled.
+	BlobCache blobCacheUsage
+}
+
+const (
+	ImageSourceRegistry   = "registry"
+	ImageSourceContainerd = "containerd"
+	ImageSourceSBOM       = "sbom-referrer"
+	// ImageSourceSBOMAttestation is an SBOM attestation attached to the image (cosign attest or in-toto referrer).
+	ImageSourceSBOMAttestation = "sbom-attestation"
+)
+
+// scanTarget returns the grype source for the fetched image.
+func (f *FetchedImage) scanTarget() string {
+	if f.SBOMPath != "" {
+		return "sbom:" + f.SBOMPath
+	}
+	if f.LayoutPath != "" {
+		return "oci-dir:" + f.LayoutPath
+	}
+	if f.DirPath != "" {
+		return "dir:" + f.DirPath
+	}
+	return f.ArchivePath
+}
+
+func fetchImage(ctx context.Context, registryType, outputDir, ociArtifactURI string, creds Credentials, opts pullOptions) (*FetchedImage, error) {
 	flag.Parse()
 
+	imageRef, err := parseImageReference(ociArtifactURI)
+	if err != nil {
+		return nil, newTaskError(ErrorKindConfig, err)
+	}
+	fetched, err := fetchResolvedImage(ctx, registryType, outputDir, imageRef, creds, opts)
+	if err != nil {
+		return nil, err
+	}
+	fetched.ResolvedReference = imageRef.String()
+	fetched.DefaultTagApplied = imageRef.DefaultTagApplied
+	return fetched, nil
+}
+
+// fetchResolvedImage fetches the image at imageRef, which has a tag or digest.
+func fetchResolvedImage(ctx context.Context, registryType, outputDir string, imageRef imageReference, creds Credentials, opts pullOptions) (*FetchedImage, error) {
+	ociArtifactURI := imageRef.String()
+
 	// Ensure output directory exists
 	if err := os.MkdirAll(outputDir, 0700); err != nil {
-		return fmt.Errorf("Error creating output directory: %v\n", err)
+		return nil, fmt.Errorf("Error creating output directory: %v\n", err)
+	}
+
+	// Remove existing image.tar (or image.tar.gz, or OCI layout) if exists
+	for _, name := range []string{imageTarName, imageTarGzName, ociLayoutDirName} {
+		existingPath := filepath.Join(outputDir, name)
+		if _, err := os.Stat(existingPath); err == nil {
+			if err := os.RemoveAll(existingPath); err != nil {
+				return nil, fmt.Errorf("Error removing existing %s: %v\n", name, err)
+			}
+		}
 	}
+	imageTarPath := filepath.Join(outputDir, imageTarName)
 
-	// Remove existing image.tar if exists
-	imageTarPath := filepath.Join(outputDir, "image.tar")
-	if _, err := os.Stat(imageTarPath); err == nil {
-		if err := os.Remove(imageTarPath); err != nil {
-			return fmt.Errorf("Error removing existing image.tar: %v\n", err)
+	// Serve the image from the local containerd content store when it's already on the node
+	if opts.ContainerdSocket != "" {
+		fetched, err := exportFromContainerd(ctx, opts.ContainerdSocket, opts.ContainerdNamespace, ociArtifactURI, imageTarPath, opts.platform())
+		if err == nil {
+			opts.logger().Info("exported image from containerd", zap.String("image", ociArtifactURI))
+			fetched.ArchivePath = imageTarPath
+			return withTarDigest(fetched)
 		}
+		opts.logger().Warn("falling back to registry pull", zap.String("image", ociArtifactURI), zap.Error(err))
 	}
 
 	// Initialize a DockerConfig structure
@@ -102,65 +258,102 @@ func fetchImage(registryType, outputDir, ociArtifactURI string, creds Credential
 		Auths: make(map[string]AuthConfig),
 	}
 
-	ghInputJSON := fmt.Sprintf(`{
-			"github": {
-				"username": %q,
-				"token": %q
-			}
-		}`, creds.GithubUsername, creds.GithubToken)
-
-	ghcrCreds, err := utils.GetAllCredentials([]byte(ghInputJSON), "")
+	authCtx, span := startSpan(ctx, "registry.auth", attribute.String("registry_type", registryType))
+	if imageRef.Registry == creds.ACRLoginServer {
+		creds.acrRepository = imageRef.Repository
+	}
+	registryAuths, err := getRegistryAuths(authCtx, registryType, creds)
+	endSpan(span, err)
 	if err != nil {
-		return fmt.Errorf("GHCR error: %v\n", err)
+		return nil, newTaskError(ErrorKindAuth, fmt.Errorf("%v\n", err))
 	}
+	mergeAuths(cfg.Auths, registryAuths)
+	mergeAuths(cfg.Auths, opts.ExtraAuths)
+
+	opts.Anonymous = RegistryType(registryType) == RegistryPublic
 
-	ghcrAuth := map[string]AuthConfig{}
-	for host, val := range ghcrCreds {
-		ghcrAuth[host] = AuthConfig{Auth: val}
+	// Scan an attached SBOM instead of the image filesystem when one is available
+	if opts.PreferSBOM {
+		fetched, err := fetchAttachedSBOM(ctx, ociArtifactURI, cfg, outputDir, opts)
+		if err == nil {
+			opts.logger().Info("found attached SBOM", zap.String("image", ociArtifactURI), zap.String("format", fetched.SBOMFormat),
+				zap.String("source", fetched.Source))
+			return fetched, nil
+		}
+		opts.logger().Info("falling back to image scan", zap.String("image", ociArtifactURI), zap.Error(err))
 	}
-	mergeAuths(cfg.Auths, ghcrAuth)
 
-	// If user requested, write out the credentials to a file or print them
-	configBytes, err := json.MarshalIndent(cfg, "", "  ")
+	// Attempt pulling and creating Docker archive with retries. Single registry requests are retried by the
+	// transport already, this only retries the pulls failing midway (e.g. a dropped blob download).
+	retries, err := getRetryPolicy()
 	if err != nil {
-		return fmt.Errorf("Error marshaling config to JSON: %v\n", err)
+		return nil, newTaskError(ErrorKindConfig, err)
 	}
-
-	fmt.Println(string(configBytes))
-
-	// Attempt pulling and creating Docker archive with retries
-	for i := 1; i <= MaxRetries; i++ {
-		err = pullAndCreateDockerArchive(ociArtifactURI, cfg, outputDir)
+	var fetched *FetchedImage
+	for i := 1; i <= retries.MaxAttempts; i++ {
+		fetched, err = pullImage(ctx, ociArtifactURI, imageRef.repoTags(), cfg, outputDir, opts)
 		if err == nil {
-			fmt.Printf("Successfully created image.tar for %s.\n", ociArtifactURI)
+			if fetched.LayoutPath != "" {
+				opts.logger().Info("created OCI layout", zap.String("image", ociArtifactURI))
+				return withLayoutDigest(fetched)
+			}
+			opts.logger().Info("created image archive", zap.String("image", ociArtifactURI), zap.String("file", filepath.Base(fetched.ArchivePath)))
 			break
 		}
 
 		if isNoSpaceError(err) {
 			// Attempt cleanup before retry
 			cleanupIntermediateFiles(outputDir)
-			if i == MaxRetries {
+			if i == retries.MaxAttempts {
 				// Out of retries
-				return fmt.Errorf("Failed due to no space left on device even after cleanup: %v\n", err)
+				return nil, fmt.Errorf("Failed due to no space left on device even after cleanup: %v\n", err)
 			}
-		} else if isAccessError(err) || isNotFoundError(err) {
-			// Don't retry on access or not found errors
-			return fmt.Errorf("%v\n", err)
+		} else if isAccessError(err) || errors.Is(err, ErrImageNotFound) || errors.Is(err, errForeignLayersRejected) ||
+			errors.Is(err, errPlatformNotFound) || errors.Is(err, ErrImageTooLarge) || errors.Is(err, ErrInsufficientDiskSpace) {
+			// Don't retry on access or not found errors, or images that can't be pulled
+			return nil, fmt.Errorf("%w\n", err)
 		} else {
-			// Other errors
 			cleanupIntermediateFiles(outputDir)
-			if i == MaxRetries {
-				return fmt.Errorf("Failed after %d attempts: %v\n", MaxRetries, err)
+			if retriedByTransport(err) {
+				return nil, fmt.Errorf("%w\n", retryFailure(err, retries.MaxAttempts))
+			}
+			if !isRetryable(err) || i == retries.MaxAttempts {
+				return nil, fmt.Errorf("%w\n", retryFailure(err, i))
 			}
 		}
 
 		// Exponential backoff before next retry
-		backoffDelay := BackoffBaseDelay * time.Duration(i)
-		fmt.Fprintf(os.Stderr, "Retrying in %s...\n", backoffDelay)
-		time.Sleep(backoffDelay)
+		backoffDelay := retries.delay(i)
+		opts.logger().Warn("retrying image pull", zap.String("image", ociArtifactURI), zap.Int("attempt", i),
+			zap.Duration("backoff", backoffDelay), zap.Error(err))
+		select {
+		case <-time.After(backoffDelay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 
-	return nil
+	return withTarDigest(fetched)
+}
+
+// withTarDigest records the digest of the produced archive on fetched.
+func withTarDigest(fetched *FetchedImage) (*FetchedImage, error) {
+	tarDigest, err := fileDigest(fetched.ArchivePath)
+	if err != nil {
+		return nil, fmt.Errorf("Error computing %s digest: %v\n", filepath.Base(fetched.ArchivePath), err)
+	}
+	fetched.TarDigest = tarDigest
+	return fetched, nil
+}
+
+// withLayoutDigest records the digest of the produced OCI layout on fetched.
+func withLayoutDigest(fetched *FetchedImage) (*FetchedImage, error) {
+	layoutDigest, err := treeDigest(fetched.LayoutPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error computing OCI layout digest: %v\n", err)
+	}
+	fetched.LayoutDigest = layoutDigest
+	return fetched, nil
 }
 
 func loadDockerConfigFile(path string) (DockerConfig, error) {
@@ -178,16 +371,188 @@ func loadDockerConfigFile(path string) (DockerConfig, error) {
 	return dc, nil
 }
 
-func pullAndCreateDockerArchive(ociArtifactURI string, cfg DockerConfig, outputDir string) error {
-	ctx := context.Background()
+// pullOptions configures how fetchImage and pullAndCreateDockerArchive obtain and assemble an image.
+type pullOptions struct {
+	// Anonymous skips authentication for the hosts without credentials, for images known to be public.
+	Anonymous bool
+	// ExtraAuths are credentials of the image besides those of the registry type, e.g. the image pull secrets of the
+	// pods running it in a cluster scan.
+	ExtraAuths map[string]AuthConfig
 
-	ref, err := registry.ParseReference(ociArtifactURI)
+	// ContainerdSocket, when set, makes fetchImage try the local containerd content store before pulling.
+	ContainerdSocket    string
+	ContainerdNamespace string
+
+	// Layout is what the image is pulled into for the scanner, ImageLayoutOCIDir or ImageLayoutDockerArchive
+	// (image_layout). Tar configures the docker archive.
+	Layout string
+	Tar    tarOptions
+
+	// PreferSBOM scans an SBOM attached to the image as an OCI referrer or attestation, when one is found, in
+	// SBOMFormats (any supported format when empty). SBOMAttestationKey, when set, restricts the SBOMs scanned to
+	// the attestations signed with it (sbom_attestation_key).
+	PreferSBOM         bool
+	SBOMFormats        []string
+	SBOMAttestationKey crypto.PublicKey
+
+	// MaxSizeBytes is the maximum size of the image, the MAX_IMAGE_SIZE_MIB limit when zero (max_image_size_mib).
+	MaxSizeBytes int64
+
+	// Concurrency is the number of blobs downloaded, and layers written out, at once (pull_concurrency).
+	Concurrency int
+
+	// ForeignLayers is how layers hosted outside the registry are handled, ForeignLayersDownload or
+	// ForeignLayersReject (foreign_layers).
+	ForeignLayers string
+
+	// Platform is the platform whose manifest is pulled when the reference is a multi-arch image (image_platform).
+	Platform ocispec.Platform
+
+	// OnStage, when set, is told when the pull reaches a stage of the progress of the run.
+	OnStage func(stage ProgressStage)
+
+	// Logger, when set, is the logger of the run the pull logs to, which keeps credentials out of what's logged.
+	Logger *zap.Logger
+}
+
+// logger returns Logger, discarding logs when it's not set.
+func (o pullOptions) logger() *zap.Logger {
+	if o.Logger == nil {
+		return zap.NewNop()
+	}
+	return o.Logger
+}
+
+func (o pullOptions) stage(stage ProgressStage) {
+	if o.OnStage != nil {
+		o.OnStage(stage)
+	}
+}
+
+// acceptsSBOMFormat tells whether an attached SBOM of the format is scanned.
+func (o pullOptions) acceptsSBOMFormat(format string) bool {
+	return format != "" && (len(o.SBOMFormats) == 0 || containsString(o.SBOMFormats, format))
+}
+
+func (o pullOptions) maxSize() int64 {
+	if o.MaxSizeBytes == 0 {
+		return maxSizeBytes
+	}
+	return o.MaxSizeBytes
+}
+
+func (o pullOptions) concurrency() int {
+	if o.Concurrency < 1 {
+		return 1
+	}
+	return o.Concurrency
+}
+
+func (o pullOptions) platform() ocispec.Platform {
+	if o.Platform.OS == "" {
+		p, _ := parseImagePlatform(DefaultImagePlatform)
+		return p
+	}
+	return o.Platform
+}
+
+// getPullOptionsFromParams builds the pull options from the task params.
+func getPullOptionsFromParams(params map[string][]string) (pullOptions, error) {
+	opts := pullOptions{}
+	if getBoolParam(params, "use_containerd") {
+		opts.ContainerdSocket = getParamValue(params, "containerd_socket", DefaultContainerdSocket)
+		opts.ContainerdNamespace = getParamValue(params, "containerd_namespace", DefaultContainerdNamespace)
+	}
+
+	opts.PreferSBOM = getBoolParam(params, "prefer_sbom")
+	opts.SBOMFormats = splitParamValues(params["sbom_formats"])
+	if v := getParamValue(params, "sbom_attestation_key", ""); v != "" {
+		key, err := parseAttestationKey(v)
+		if err != nil {
+			return opts, err
+		}
+		opts.SBOMAttestationKey = key
+	}
+
+	maxSize, err := parseMaxImageSize(params)
+	if err != nil {
+		return opts, err
+	}
+	opts.MaxSizeBytes = maxSize
+
+	concurrency, err := getIntParam(params, "pull_concurrency", 1)
+	if err != nil {
+		return opts, err
+	}
+	if concurrency < 1 {
+		return opts, fmt.Errorf("pull_concurrency must be positive")
+	}
+	opts.Concurrency = concurrency
+
+	opts.Platform, err = parseImagePlatform(getParamValue(params, "image_platform", DefaultImagePlatform))
+	if err != nil {
+		return opts, err
+	}
+
+	opts.ForeignLayers = getParamValue(params, "foreign_layers", ForeignLayersDownload)
+	if opts.ForeignLayers != ForeignLayersDownload && opts.ForeignLayers != ForeignLayersReject {
+		return opts, fmt.Errorf("invalid foreign_layers %q: expected %s or %s", opts.ForeignLayers, ForeignLayersDownload, ForeignLayersReject)
+	}
+
+	opts.Layout, err = parseImageLayout(params)
 	if err != nil {
-		return fmt.Errorf("invalid oci-artifact-uri: %w", err)
+		return opts, err
 	}
+	reproducible, err := strconv.ParseBool(getParamValue(params, "reproducible_tar", "true"))
+	if err != nil {
+		return opts, fmt.Errorf("invalid reproducible_tar: %w", err)
+	}
+	opts.Tar.Raw = !reproducible
+
+	if level := getParamValue(params, "tar_compression_level", ""); level != "" {
+		l, err := strconv.Atoi(level)
+		if err != nil || l < gzip.HuffmanOnly || l > gzip.BestCompression {
+			return opts, fmt.Errorf("invalid tar_compression_level %q: expected %d to %d", level, gzip.HuffmanOnly, gzip.BestCompression)
+		}
+		opts.Tar.Compress = true
+		opts.Tar.CompressionLevel = l
+	}
+	return opts, nil
+}
+
+// newRemoteRepository creates an ORAS repository for ref authenticating with the auths in cfg.
+func newRemoteRepository(ref registry.Reference, cfg DockerConfig, opts pullOptions) (*remote.Repository, error) {
+	authClient, err := newAuthClient(cfg, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, err := remote.NewRepository(ref.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create repository object: %w", err)
+	}
+	repo.Client = authClient
 
+	return repo, nil
+}
+
+// newAuthClient returns the client of registry requests authenticating with the auths in cfg.
+func newAuthClient(cfg DockerConfig, opts pullOptions) (*auth.Client, error) {
 	credentialsFunc := auth.CredentialFunc(func(ctx context.Context, host string) (auth.Credential, error) {
-		if a, ok := cfg.Auths[host]; ok {
+		a, ok := cfg.Auths[host]
+		if !ok && isDockerHubHost(host) {
+			// Docker configs key Docker Hub credentials by its legacy index URL, public images pull without
+			if a, ok = cfg.Auths[dockerHubAuthKey]; !ok {
+				return auth.EmptyCredential, nil
+			}
+		}
+		if !ok && opts.Anonymous {
+			return auth.EmptyCredential, nil
+		}
+		if ok && a.RegistryToken != "" {
+			return auth.Credential{AccessToken: a.RegistryToken}, nil
+		}
+		if ok {
 			decoded, err := base64.StdEncoding.DecodeString(a.Auth)
 			if err != nil {
 				return auth.Credential{}, err
@@ -204,142 +569,256 @@ func pullAndCreateDockerArchive(ociArtifactURI string, cfg DockerConfig, outputD
 		return auth.Credential{}, fmt.Errorf("no credentials for host %s", host)
 	})
 
-	authClient := &auth.Client{
+	httpClient, err := retryingHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return &auth.Client{
+		Client:     httpClient,
 		Credential: credentialsFunc,
+	}, nil
+}
+
+// pullImage pulls the image at ociArtifactURI into an OCI layout, or a docker archive with
+// image_layout=docker-archive, naming it repoTags.
+func pullImage(ctx context.Context, ociArtifactURI string, repoTags []string, cfg DockerConfig, outputDir string, opts pullOptions) (*FetchedImage, error) {
+	ref, err := registry.ParseReference(ociArtifactURI)
+	if err != nil {
+		return nil, fmt.Errorf("invalid oci-artifact-uri: %w", err)
 	}
 
-	repo, err := remote.NewRepository(ref.String())
+	repo, err := newRemoteRepository(ref, cfg, opts)
 	if err != nil {
-		return fmt.Errorf("failed to create repository object: %w", err)
+		return nil, err
 	}
-	repo.Client = authClient
 
-	// Create custom copy options with concurrency = 1 for low bandwidth resilience
-	opts := oras.DefaultCopyOptions
-	opts.Concurrency = 1 // single-threaded fetch
+	// Single-threaded fetch by default for low bandwidth resilience
+	copyOpts := oras.DefaultCopyOptions
+	copyOpts.Concurrency = opts.concurrency()
+	// Foreign layers are fetched from their own URLs once the manifest is known, and images too large for the limit
+	// or the disk fail before their layers are downloaded
+	copyOpts.FindSuccessors = sizeCheckingSuccessors(successorsSkippingForeignLayers, outputDir, opts)
+	// Multi-arch images are pulled for a single platform
+	selection := &platformSelection{Platform: opts.platform()}
+	copyOpts.MapRoot = selection.mapRoot
 
-	desc, err := oras.Copy(ctx, repo, ref.Reference, memoryStore, "", opts)
+	store, releaseStore := pullStore()
+	defer releaseStore()
+
+	copyCtx, span := startSpan(ctx, "oras.copy", attribute.String("image", ociArtifactURI))
+	desc, err := oras.Copy(copyCtx, repo, ref.Reference, store, "", copyOpts)
+	endSpan(span, err)
 	if err != nil {
-		// Check if unauthorized or not found by message
-		errMsg := err.Error()
-		if strings.Contains(strings.ToLower(errMsg), "unauthorized") || strings.Contains(strings.ToLower(errMsg), "forbidden") {
-			return fmt.Errorf("access denied: the credentials provided do not have permission to access %s", ociArtifactURI)
+		if isAccessError(err) {
+			return nil, fmt.Errorf("access denied: the credentials provided do not have permission to access %s: %w", ociArtifactURI, err)
 		}
-		if strings.Contains(strings.ToLower(errMsg), "not found") {
-			return fmt.Errorf("the artifact %s was not found in the registry", ociArtifactURI)
+		if isImageNotFound(err) {
+			return nil, fmt.Errorf("%w: the artifact %s was not found in the registry: %v", ErrImageNotFound, ociArtifactURI, err)
 		}
-		return fmt.Errorf("oras pull failed: %w", err)
+		return nil, fmt.Errorf("oras pull failed: %w", err)
 	}
+	opts.stage(StageBuildingArchive)
 
-	rc, err := memoryStore.Fetch(ctx, desc)
+	rc, err := store.Fetch(ctx, desc)
 	if err != nil {
-		return fmt.Errorf("failed to fetch manifest: %w", err)
+		return nil, fmt.Errorf("failed to fetch manifest: %w", err)
 	}
 	defer rc.Close()
 
 	manifestContent, err := io.ReadAll(rc)
 	if err != nil {
-		return fmt.Errorf("failed to read manifest: %w", err)
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
 	}
 
 	var manifest ocispec.Manifest
 	if err := json.Unmarshal(manifestContent, &manifest); err != nil {
-		return fmt.Errorf("failed to unmarshal manifest: %w", err)
+		return nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
 	}
 
 	// Validate that all media types in manifest are allowed
 	if err := validateOCIMediaTypes(manifest); err != nil {
-		return fmt.Errorf("media type validation failed: %w", err)
+		return nil, fmt.Errorf("media type validation failed: %w", err)
 	}
 
 	// Check for a valid artifact: must have config and at least one layer
 	if manifest.Config.Size == 0 || len(manifest.Layers) == 0 {
-		return fmt.Errorf("the artifact appears invalid: missing config or layers")
+		return nil, fmt.Errorf("the artifact appears invalid: missing config or layers")
 	}
 
-	// Check total size of image
-	var totalSize int64
-	totalSize += manifest.Config.Size
-	for _, layer := range manifest.Layers {
-		totalSize += layer.Size
+	foreign, err := fetchForeignLayers(ctx, repo, store, manifest, opts.ForeignLayers, opts.logger())
+	if err != nil {
+		return nil, err
 	}
-	if totalSize > maxSizeBytes {
-		return fmt.Errorf("image size %d bytes exceeds maximum allowed size of %d bytes", totalSize, maxSizeBytes)
+
+	// The scanner reads the layout as pulled, nothing to assemble
+	if opts.Layout == ImageLayoutOCIDir {
+		layoutPath := filepath.Join(outputDir, ociLayoutDirName)
+		_, span = startSpan(ctx, "layout.write", attribute.String("image", ociArtifactURI), attribute.Int("layers", len(manifest.Layers)))
+		err = writeOCILayout(ctx, store, desc, layoutPath, repoTags, opts.concurrency())
+		endSpan(span, err)
+		if err != nil {
+			return nil, err
+		}
+		return &FetchedImage{
+			ManifestDigest: desc.Digest.String(),
+			LayoutPath:     layoutPath,
+			Source:         ImageSourceRegistry,
+			ForeignLayers:  foreign,
+			Platform:       platforms.Format(selection.Platform),
+			IndexDigest:    selection.IndexDigest,
+			BlobCache:      releaseStore(),
+		}, nil
 	}
 
 	ociManifestPath := filepath.Join(outputDir, "oci-manifest.json")
 	if err := writeFile(ociManifestPath, manifestContent); err != nil {
-		return fmt.Errorf("failed to write oci-manifest.json: %w", err)
+		return nil, fmt.Errorf("failed to write oci-manifest.json: %w", err)
 	}
 
 	// Fetch config
 	configDesc := manifest.Config
-	configRC, err := memoryStore.Fetch(ctx, configDesc)
+	configRC, err := store.Fetch(ctx, configDesc)
 	if err != nil {
-		return fmt.Errorf("failed to fetch config: %w", err)
+		return nil, fmt.Errorf("failed to fetch config: %w", err)
 	}
 	defer configRC.Close()
 	configBytes, err := io.ReadAll(configRC)
 	if err != nil {
-		return fmt.Errorf("failed to read config: %w", err)
+		return nil, fmt.Errorf("failed to read config: %w", err)
 	}
 
 	configPath := filepath.Join(outputDir, "config.json")
 	if err := writeFile(configPath, configBytes); err != nil {
-		return fmt.Errorf("failed to write config.json: %w", err)
+		return nil, fmt.Errorf("failed to write config.json: %w", err)
 	}
 
 	// Fetch layers and write them out
-	var layerFiles []string
-	for i, layerDesc := range manifest.Layers {
-		layerRC, err := memoryStore.Fetch(ctx, layerDesc)
-		if err != nil {
-			return fmt.Errorf("failed to fetch layer: %w", err)
-		}
-		layerBytes, err := io.ReadAll(layerRC)
-		layerRC.Close()
-		if err != nil {
-			return fmt.Errorf("failed to read layer: %w", err)
-		}
-		layerFileName := fmt.Sprintf("layer%d.tar", i+1)
-		layerPath := filepath.Join(outputDir, layerFileName)
-		if err := writeFile(layerPath, layerBytes); err != nil {
-			return fmt.Errorf("failed to write layer to disk: %w", err)
-		}
-		layerFiles = append(layerFiles, layerFileName)
+	diffIDs := configDiffIDs(configBytes, manifest.Layers)
+	layerFiles, err := writeLayers(ctx, store, manifest.Layers, diffIDs, outputDir, opts.concurrency())
+	if err != nil {
+		return nil, err
 	}
 
-	repoTag := ref.String()
+	// Create image.tar
+	archivePath := filepath.Join(outputDir, opts.Tar.archiveName())
+	manifestPath := filepath.Join(outputDir, "manifest.json")
+	_, span = startSpan(ctx, "archive.build", attribute.String("image", ociArtifactURI), attribute.Int("layers", len(layerFiles)))
+	err = writeDockerArchive(archivePath, outputDir, repoTags, manifest.Layers, diffIDs, layerFiles, opts.Tar)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove manifest.json and oci-manifest.json after creating the tar
+	if err := os.Remove(manifestPath); err != nil {
+		return nil, fmt.Errorf("failed to remove manifest.json: %w", err)
+	}
+	if err := os.Remove(ociManifestPath); err != nil {
+		return nil, fmt.Errorf("failed to remove oci-manifest.json: %w", err)
+	}
+	// The layers and config are in the archive now
+	cleanupIntermediateFiles(outputDir)
+	cacheUsage := releaseStore()
+	if cacheUsage.Enabled {
+		opts.logger().Info("blob cache usage", zap.String("image", ociArtifactURI), zap.Int("hits", cacheUsage.Hits),
+			zap.Int("blobs", cacheUsage.Hits+cacheUsage.Misses), zap.Int64("hitBytes", cacheUsage.HitBytes))
+	}
+
+	return &FetchedImage{
+		ManifestDigest: desc.Digest.String(),
+		ArchivePath:    archivePath,
+		Source:         ImageSourceRegistry,
+		ForeignLayers:  foreign,
+		Platform:       platforms.Format(selection.Platform),
+		IndexDigest:    selection.IndexDigest,
+		BlobCache:      cacheUsage,
+	}, nil
+}
+
+// writeDockerArchive writes the manifest.json of the docker archive, listing layerFiles in the order of the layers of
+// the manifest, and archives it to archivePath along with config.json, oci-manifest.json and the layers of outputDir.
+func writeDockerArchive(archivePath, outputDir string, repoTags []string, layers []ocispec.Descriptor, diffIDs []digest.Digest, layerFiles []string, opts tarOptions) error {
 	dockerManifest := []map[string]interface{}{
 		{
 			"Config":   "config.json",
-			"RepoTags": []string{repoTag},
+			"RepoTags": repoTags,
 			"Layers":   layerFiles,
 		},
 	}
+	if sources := layerSources(layers, diffIDs); sources != nil {
+		dockerManifest[0]["LayerSources"] = sources
+	}
 	dockerManifestBytes, err := json.MarshalIndent(dockerManifest, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal docker manifest.json: %w", err)
 	}
-	manifestPath := filepath.Join(outputDir, "manifest.json")
-	if err := writeFile(manifestPath, dockerManifestBytes); err != nil {
+	if err := writeFile(filepath.Join(outputDir, "manifest.json"), dockerManifestBytes); err != nil {
 		return fmt.Errorf("failed to write manifest.json: %w", err)
 	}
 
-	// Create image.tar
 	filesToTar := append([]string{"manifest.json", "config.json", "oci-manifest.json"}, layerFiles...)
-	if err := createTar(filepath.Join(outputDir, "image.tar"), filesToTar, outputDir); err != nil {
+	if err := createTar(archivePath, filesToTar, outputDir, opts); err != nil {
 		return fmt.Errorf("failed to create tar: %w", err)
 	}
+	return nil
+}
 
-	// Remove manifest.json and oci-manifest.json after creating the tar
-	if err := os.Remove(manifestPath); err != nil {
-		return fmt.Errorf("failed to remove manifest.json: %w", err)
+// writeLayers writes the layers from the store of the pull to layer<n>.tar files in outputDir, up to concurrency at once,
+// and returns the file names in manifest order, whatever order the writes complete in, as the docker archive
+// requires. diffIDs are those of the config, nil when unknown.
+func writeLayers(ctx context.Context, store content.Fetcher, layers []ocispec.Descriptor, diffIDs []digest.Digest, outputDir string, concurrency int) ([]string, error) {
+	layerFiles := make([]string, len(layers))
+	errs := make([]error, len(layers))
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	for i, layerDesc := range layers {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, layerDesc ocispec.Descriptor) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			layerFileName := fmt.Sprintf("layer%d.tar", i+1)
+			var diffID digest.Digest
+			if diffIDs != nil {
+				diffID = diffIDs[i]
+			}
+			errs[i] = writeLayer(ctx, store, layerDesc, diffID, filepath.Join(outputDir, layerFileName))
+			layerFiles[i] = layerFileName
+		}(i, layerDesc)
 	}
-	if err := os.Remove(ociManifestPath); err != nil {
-		return fmt.Errorf("failed to remove oci-manifest.json: %w", err)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return layerFiles, nil
+}
+
+// writeLayer writes the layer to layerPath, gzip compressed and plain tars as pulled, zstd compressed ones
+// decompressed, docker archive readers not all reading them.
+func writeLayer(ctx context.Context, store content.Fetcher, layerDesc ocispec.Descriptor, diffID digest.Digest, layerPath string) error {
+	layerRC, err := store.Fetch(ctx, layerDesc)
+	if err != nil {
+		return fmt.Errorf("failed to fetch layer: %w", err)
 	}
+	defer layerRC.Close()
 
+	f, err := os.OpenFile(layerPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write layer to disk: %w", err)
+	}
+	defer f.Close()
+	if isZstdLayer(layerDesc) {
+		return writeDecompressedLayer(f, layerRC, layerDesc, diffID)
+	}
+	if _, err := io.Copy(f, layerRC); err != nil {
+		return fmt.Errorf("failed to write layer to disk: %w", err)
+	}
 	return nil
 }
 
@@ -364,15 +843,54 @@ func isAllowedMediaType(mt string) bool {
 	return false
 }
 
-func createTar(tarPath string, files []string, baseDir string) error {
+const (
+	imageTarName   = "image.tar"
+	imageTarGzName = "image.tar.gz"
+)
+
+// tarWriteBufferSize is the size of the buffers used to write the archive and copy each file into it.
+const tarWriteBufferSize = 1024 * 1024 // 1 MiB
+
+// tarOptions configures how createTar writes the archive.
+type tarOptions struct {
+	// Compress gzip-compresses the archive at CompressionLevel.
+	Compress         bool
+	CompressionLevel int
+
+	// Raw keeps the mode, mtime and ownership of the files in the archive headers, rather than normalizing them so
+	// the same image always produces a byte-identical archive (and tar digest). For debugging (reproducible_tar=false).
+	Raw bool
+}
+
+func (o tarOptions) archiveName() string {
+	if o.Compress {
+		return imageTarGzName
+	}
+	return imageTarName
+}
+
+func createTar(tarPath string, files []string, baseDir string, opts tarOptions) error {
 	tarFile, err := os.Create(tarPath)
 	if err != nil {
 		return err
 	}
 	defer tarFile.Close()
 
-	tw := tar.NewWriter(tarFile)
-	defer tw.Close()
+	// Buffer writes to the file, tar headers and small files otherwise result in many small writes
+	bw := bufio.NewWriterSize(tarFile, tarWriteBufferSize)
+
+	var out io.Writer = bw
+	var gw *gzip.Writer
+	if opts.Compress {
+		gw, err = gzip.NewWriterLevel(bw, opts.CompressionLevel)
+		if err != nil {
+			return fmt.Errorf("failed to create gzip writer: %w", err)
+		}
+		out = gw
+	}
+
+	tw := tar.NewWriter(out)
+	copyBuf := make([]byte, tarWriteBufferSize)
 
 	for _, file := range files {
 		fullPath := filepath.Join(baseDir, file)
@@ -380,11 +898,10 @@ func createTar(tarPath string, files []string, baseDir string) error {
 		if err != nil {
 			return fmt.Errorf("failed to stat file %s: %w", fullPath, err)
 		}
-		header, err := tar.FileInfoHeader(info, "")
+		header, err := tarHeader(file, info, opts)
 		if err != nil {
 			return fmt.Errorf("failed to create tar header for %s: %w", fullPath, err)
 		}
-		header.Name = file
 		if err := tw.WriteHeader(header); err != nil {
 			return fmt.Errorf("failed to write header for %s: %w", fullPath, err)
 		}
@@ -392,15 +909,50 @@ func createTar(tarPath string, files []string, baseDir string) error {
 		if err != nil {
 			return fmt.Errorf("failed to open file %s: %w", fullPath, err)
 		}
-		_, copyErr := io.Copy(tw, fh)
+		_, copyErr := io.CopyBuffer(tw, fh, copyBuf)
 		fh.Close()
 		if copyErr != nil {
 			return fmt.Errorf("failed to copy file data for %s: %w", fullPath, copyErr)
 		}
 	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to finalize tar: %w", err)
+	}
+	if gw != nil {
+		if err := gw.Close(); err != nil {
+			return fmt.Errorf("failed to finalize gzip stream: %w", err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to flush tar: %w", err)
+	}
 	return nil
 }
 
+// tarHeader returns the archive header of the file at name, normalized unless opts.Raw is set.
+func tarHeader(name string, info os.FileInfo, opts tarOptions) (*tar.Header, error) {
+	if opts.Raw {
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return nil, err
+		}
+		header.Name = name
+		return header, nil
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", name)
+	}
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     info.Size(),
+		Mode:     0644,
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatUSTAR,
+	}, nil
+}
+
 func mergeAuths(dst, src map[string]AuthConfig) {
 	for k, v := range src {
 		dst[k] = v
@@ -436,12 +988,78 @@ func isNoSpaceError(err error) bool {
 	return err != nil && strings.Contains(strings.ToLower(err.Error()), "no space left on device")
 }
 
+// classifyFetchError gives the failure to fetch an image its kind: auth, not found, too large or else pull.
+func classifyFetchError(err error) error {
+	switch {
+	case isAccessError(err):
+		return newTaskError(ErrorKindAuth, err)
+	case errors.Is(err, ErrImageNotFound):
+		return newTaskError(ErrorKindNotFound, err)
+	case errors.Is(err, ErrImageTooLarge):
+		return newTaskError(ErrorKindTooLarge, err)
+	}
+	return newTaskError(ErrorKindPull, err)
+}
+
+// isAccessError reports whether a registry or an API refused the credentials of a request: a 401 or 403 response, or
+// the UNAUTHORIZED and DENIED error codes of the distribution spec. Failures to read or write local files, whatever
+// their permissions, aren't.
 func isAccessError(err error) bool {
-	msg := strings.ToLower(err.Error())
-	return strings.Contains(msg, "access denied") || strings.Contains(msg, "unauthorized") || strings.Contains(msg, "forbidden") || strings.Contains(msg, "permission")
+	if err == nil {
+		return false
+	}
+	if ErrorKindOf(err) == ErrorKindAuth {
+		return true
+	}
+	var errResp *errcode.ErrorResponse
+	if errors.As(err, &errResp) {
+		if isAccessStatus(errResp.StatusCode) {
+			return true
+		}
+		for _, e := range errResp.Errors {
+			if e.Code == errcode.ErrorCodeUnauthorized || e.Code == errcode.ErrorCodeDenied {
+				return true
+			}
+		}
+		return false
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return isAccessStatus(statusErr.StatusCode)
+	}
+	// Responses of the AWS SDK (ECR)
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) {
+		return isAccessStatus(respErr.HTTPStatusCode())
+	}
+	return false
 }
 
-func isNotFoundError(err error) bool {
-	msg := strings.ToLower(err.Error())
-	return strings.Contains(msg, "not found")
+func isAccessStatus(code int) bool {
+	return code == http.StatusUnauthorized || code == http.StatusForbidden
+}
+
+// isImageNotFound reports whether the registry answered that the manifest or repository doesn't exist, rather than
+// failing in a way that may be transient (network errors, 5xx, throttling).
+func isImageNotFound(err error) bool {
+	if errors.Is(err, errdef.ErrNotFound) {
+		return true
+	}
+	var errResp *errcode.ErrorResponse
+	if !errors.As(err, &errResp) {
+		return false
+	}
+	if errResp.StatusCode == http.StatusNotFound {
+		return true
+	}
+	if errResp.StatusCode >= http.StatusInternalServerError {
+		return false
+	}
+	for _, e := range errResp.Errors {
+		switch e.Code {
+		case errcode.ErrorCodeManifestUnknown, errcode.ErrorCodeNameUnknown:
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,427 @@
+package task
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// syntheticImageLayout writes the files of a docker archive to a directory: its manifest and config, and layers from
+// a few KiB to a few MiB as images have.
+func syntheticImageLayout(tb testing.TB) (string, []string, int64) {
+	dir := tb.TempDir()
+	files := []string{"manifest.json", "config.json"}
+	var total int64
+	write := func(name string, data []byte) {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			tb.Fatal(err)
+		}
+		total += int64(len(data))
+	}
+	write("manifest.json", []byte(`[{"Config":"config.json","Layers":[]}]`))
+	write("config.json", bytes.Repeat([]byte(`{"k":"v"}`), 512))
+	for i, size := range []int{4 << 10, 16 << 10, 64 << 10, 512 << 10, 2 << 20, 8 << 20, 1 << 10, 32 << 20} {
+		name := fmt.Sprintf("layer-%d.tar", i)
+		write(name, bytes.Repeat([]byte{byte(i + 1)}, size))
+		files = append(files, name)
+	}
+	return dir, files, total
+}
+
+// createTarUnbuffered is createTar as it was before its writes were buffered, for comparison.
+func createTarUnbuffered(tarPath string, files []string, baseDir string, opts tarOptions) error {
+	tarFile, err := os.Create(tarPath)
+	if err != nil {
+		return err
+	}
+	defer tarFile.Close()
+
+	tw := tar.NewWriter(tarFile)
+	for _, file := range files {
+		fullPath := filepath.Join(baseDir, file)
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			return err
+		}
+		header, err := tarHeader(file, info, opts)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		fh, err := os.Open(fullPath)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, fh)
+		fh.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// writeSyscalls returns the number of write syscalls of the process so far, -1 where /proc/self/io isn't available.
+func writeSyscalls() int64 {
+	f, err := os.Open("/proc/self/io")
+	if err != nil {
+		return -1
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "syscw: "); ok {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return -1
+			}
+			return n
+		}
+	}
+	return -1
+}
+
+func BenchmarkCreateTar(b *testing.B) {
+	dir, files, total := syntheticImageLayout(b)
+	for _, bc := range []struct {
+		name   string
+		create func(tarPath string, files []string, baseDir string, opts tarOptions) error
+	}{
+		{name: "buffered", create: createTar},
+		{name: "unbuffered", create: createTarUnbuffered},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			tarPath := filepath.Join(b.TempDir(), imageTarName)
+			b.SetBytes(total)
+			writes := writeSyscalls()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := bc.create(tarPath, files, dir, tarOptions{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			if writes >= 0 {
+				b.ReportMetric(float64(writeSyscalls()-writes)/float64(b.N), "writes/op")
+			}
+		})
+	}
+}
+
+// reverseFetcher serves layers whose downloads complete in reverse order: a layer's content is only served once the
+// download of the next layer was closed.
+type reverseFetcher struct {
+	contents map[digest.Digest][]byte
+	index    map[digest.Digest]int
+	closed   []chan struct{}
+
+	mu        sync.Mutex
+	completed []int
+}
+
+func newReverseFetcher(contents [][]byte) (*reverseFetcher, []ocispec.Descriptor) {
+	f := &reverseFetcher{contents: map[digest.Digest][]byte{}, index: map[digest.Digest]int{}}
+	var layers []ocispec.Descriptor
+	for i, c := range contents {
+		d := digest.FromBytes(c)
+		f.contents[d], f.index[d] = c, i
+		f.closed = append(f.closed, make(chan struct{}))
+		layers = append(layers, ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: d, Size: int64(len(c))})
+	}
+	return f, layers
+}
+
+func (f *reverseFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	i := f.index[desc.Digest]
+	if i+1 < len(f.closed) {
+		select {
+		case <-f.closed[i+1]:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return &reverseFetcherReader{Reader: bytes.NewReader(f.contents[desc.Digest]), fetcher: f, i: i}, nil
+}
+
+type reverseFetcherReader struct {
+	*bytes.Reader
+	fetcher *reverseFetcher
+	i       int
+}
+
+func (r *reverseFetcherReader) Close() error {
+	r.fetcher.mu.Lock()
+	r.fetcher.completed = append(r.fetcher.completed, r.i)
+	r.fetcher.mu.Unlock()
+	close(r.fetcher.closed[r.i])
+	return nil
+}
+
+func TestWriteLayersKeepsManifestOrder(t *testing.T) {
+	var contents [][]byte
+	for i := 0; i < 6; i++ {
+		contents = append(contents, bytes.Repeat([]byte{byte('a' + i)}, 1024*(i+1)))
+	}
+	fetcher, layers := newReverseFetcher(contents)
+	dir := t.TempDir()
+	for _, name := range []string{"config.json", "oci-manifest.json"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(`{}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// Every layer is written at once, or the first ones would wait on the others for a slot
+	layerFiles, err := writeLayers(ctx, fetcher, layers, nil, dir, len(layers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int{5, 4, 3, 2, 1, 0}; !reflect.DeepEqual(fetcher.completed, expected) {
+		t.Fatalf("expected downloads to complete in order %v, got %v", expected, fetcher.completed)
+	}
+	archivePath := filepath.Join(dir, imageTarName)
+	if err := writeDockerArchive(archivePath, dir, []string{"repo:tag"}, layers, nil, layerFiles, tarOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedLayers := []string{"layer1.tar", "layer2.tar", "layer3.tar", "layer4.tar", "layer5.tar", "layer6.tar"}
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	tr := tar.NewReader(archive)
+	var entries []string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, header.Name)
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case header.Name == "manifest.json":
+			var manifest []struct {
+				Layers []string
+			}
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				t.Fatal(err)
+			}
+			if len(manifest) != 1 || !reflect.DeepEqual(manifest[0].Layers, expectedLayers) {
+				t.Errorf("expected manifest.json layers %v, got %+v", expectedLayers, manifest)
+			}
+		case strings.HasPrefix(header.Name, "layer"):
+			i, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(header.Name, "layer"), ".tar"))
+			if !bytes.Equal(data, contents[i-1]) {
+				t.Errorf("%s doesn't hold layer %d of the manifest", header.Name, i)
+			}
+		}
+	}
+	expectedEntries := append([]string{"manifest.json", "config.json", "oci-manifest.json"}, expectedLayers...)
+	if !reflect.DeepEqual(entries, expectedEntries) {
+		t.Errorf("expected tar entries %v, got %v", expectedEntries, entries)
+	}
+}
+
+// sdkResponseError has the status of a response as the errors of the AWS SDK do.
+type sdkResponseError struct {
+	status int
+}
+
+func (e *sdkResponseError) Error() string {
+	return fmt.Sprintf("operation error ECR: DescribeRepositories, https response error StatusCode: %d", e.status)
+}
+
+func (e *sdkResponseError) HTTPStatusCode() int {
+	return e.status
+}
+
+func TestIsAccessError(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{
+			name:     "registry 401",
+			err:      fmt.Errorf("pull: %w", &errcode.ErrorResponse{Method: http.MethodGet, StatusCode: http.StatusUnauthorized}),
+			expected: true,
+		},
+		{
+			name:     "registry 403",
+			err:      &errcode.ErrorResponse{Method: http.MethodGet, StatusCode: http.StatusForbidden},
+			expected: true,
+		},
+		{
+			name: "registry DENIED error code",
+			err: &errcode.ErrorResponse{Method: http.MethodGet, StatusCode: http.StatusBadRequest,
+				Errors: errcode.Errors{{Code: errcode.ErrorCodeDenied}}},
+			expected: true,
+		},
+		{
+			name: "registry 404",
+			err: &errcode.ErrorResponse{Method: http.MethodGet, StatusCode: http.StatusNotFound,
+				Errors: errcode.Errors{{Code: errcode.ErrorCodeManifestUnknown, Message: "permission to read it"}}},
+		},
+		{
+			name:     "token request 401",
+			err:      &statusError{StatusCode: http.StatusUnauthorized, Err: errors.New("token request failed with status 401")},
+			expected: true,
+		},
+		{
+			name: "api 500",
+			err:  &statusError{StatusCode: http.StatusInternalServerError, Err: errors.New("unauthorized upstream")},
+		},
+		{
+			name:     "aws sdk 403",
+			err:      fmt.Errorf("ECR error: %w", &sdkResponseError{status: http.StatusForbidden}),
+			expected: true,
+		},
+		{
+			name:     "classified auth error",
+			err:      newTaskError(ErrorKindAuth, errors.New("invalid GitHub App private key")),
+			expected: true,
+		},
+		{
+			name: "local permission denied",
+			err:  fmt.Errorf("failed to create layer file: %w", &fs.PathError{Op: "open", Path: "/work/layer1.tar", Err: syscall.EACCES}),
+		},
+		{
+			name: "permission in the message",
+			err:  errors.New("mkdir /work/run-1: permission denied"),
+		},
+		{
+			name: "nil",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isAccessError(tc.err); got != tc.expected {
+				t.Errorf("expected isAccessError %t for %v", tc.expected, tc.err)
+			}
+		})
+	}
+}
+
+// trustTestServer makes the outbound HTTP client trust the certificate of server for the test.
+func trustTestServer(t *testing.T, server *httptest.Server) {
+	client, err := outboundHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := client.Transport.(*http.Transport)
+	previous := transport.TLSClientConfig
+	t.Cleanup(func() { transport.TLSClientConfig = previous })
+	transport.TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+}
+
+func TestFetchImageRegistryAccessDenied(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		status    int
+		challenge string
+	}{
+		{name: "401 with a basic challenge", status: http.StatusUnauthorized, challenge: `Basic realm="registry"`},
+		{name: "401 without a challenge", status: http.StatusUnauthorized},
+		{name: "403", status: http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var requests int
+			registry := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				requests++
+				mu.Unlock()
+				if tc.challenge != "" {
+					w.Header().Set("WWW-Authenticate", tc.challenge)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tc.status)
+				io.WriteString(w, `{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`)
+			}))
+			defer registry.Close()
+			trustTestServer(t, registry)
+
+			host := strings.TrimPrefix(registry.URL, "https://")
+			creds := Credentials{RegistryHost: host, RegistryUsername: "user", RegistryPassword: "wrong"}
+			_, err := fetchImage(context.Background(), string(RegistryGeneric), t.TempDir(), host+"/org/repo:tag", creds, pullOptions{})
+			if err == nil {
+				t.Fatal("expected the pull to fail")
+			}
+			if kind := ErrorKindOf(classifyFetchError(err)); kind != ErrorKindAuth {
+				t.Errorf("expected error kind %s, got %q for %v", ErrorKindAuth, kind, err)
+			}
+			var errResp *errcode.ErrorResponse
+			if !errors.As(err, &errResp) || errResp.StatusCode != tc.status {
+				t.Errorf("expected the %d response of the registry to be wrapped, got %v", tc.status, err)
+			}
+			// Refused credentials aren't retried, neither by the transport nor by the pull
+			mu.Lock()
+			defer mu.Unlock()
+			if requests > 2 {
+				t.Errorf("expected the manifest to be requested at most twice, got %d requests", requests)
+			}
+		})
+	}
+}
+
+func TestFetchImageRetriesUnavailableRegistryOnce(t *testing.T) {
+	defer func(attempts, base, max string) {
+		RetryMaxAttempts, RetryBaseDelay, RetryMaxDelay = attempts, base, max
+	}(RetryMaxAttempts, RetryBaseDelay, RetryMaxDelay)
+	RetryMaxAttempts, RetryBaseDelay, RetryMaxDelay = "3", "1ms", "1ms"
+
+	var mu sync.Mutex
+	var requests int
+	registry := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer registry.Close()
+	trustTestServer(t, registry)
+
+	host := strings.TrimPrefix(registry.URL, "https://")
+	_, err := fetchImage(context.Background(), string(RegistryPublic), t.TempDir(), host+"/org/repo:tag", Credentials{}, pullOptions{})
+	if err == nil {
+		t.Fatal("expected the pull to fail")
+	}
+	if !strings.Contains(err.Error(), "giving up after 3 attempts") {
+		t.Errorf("expected the failure to report 3 attempts, got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// The transport retries the request, the pull doesn't retry it again
+	if requests != 3 {
+		t.Errorf("expected 3 requests for 3 attempts, got %d", requests)
+	}
+}
@@ -0,0 +1,100 @@
+package task
+
+import (
+	"strings"
+)
+
+// TargetedFilter records a post-scan filter narrowing the stored matches to specific CVEs or packages,
+// so a targeted result isn't mistaken for a full scan.
+type TargetedFilter struct {
+	CVEs              []string `json:"cves,omitempty"`
+	Packages          []string `json:"packages,omitempty"`
+	UnfilteredMatches int      `json:"unfilteredMatches"`
+}
+
+// getTargetedFilterFromParams builds the filter from the filter_cve and filter_package params, which accept
+// multiple values and comma separated lists. It returns nil when no filter is requested.
+func getTargetedFilterFromParams(params map[string][]string) *TargetedFilter {
+	filter := TargetedFilter{
+		CVEs:     splitParamValues(params["filter_cve"]),
+		Packages: splitParamValues(params["filter_package"]),
+	}
+	if len(filter.CVEs) == 0 && len(filter.Packages) == 0 {
+		return nil
+	}
+	return &filter
+}
+
+// Apply returns the matches whose vulnerability (or a related vulnerability) is one of the CVEs, or whose
+// package is one of the packages. Both comparisons are case-insensitive.
+func (f *TargetedFilter) Apply(matches []VulnerabilityMatch) []VulnerabilityMatch {
+	f.UnfilteredMatches = len(matches)
+
+	var filtered []VulnerabilityMatch
+	for _, m := range matches {
+		if f.matchesCVE(m) || f.matchesPackage(m) {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
+
+func (f *TargetedFilter) matchesCVE(m VulnerabilityMatch) bool {
+	for _, cve := range f.CVEs {
+		if strings.EqualFold(m.Vulnerability.ID, cve) {
+			return true
+		}
+		for _, related := range m.RelatedVulnerabilities {
+			if strings.EqualFold(related.ID, cve) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *TargetedFilter) matchesPackage(m VulnerabilityMatch) bool {
+	name := matchPackageName(m)
+	if name == "" {
+		return false
+	}
+	for _, pkg := range f.Packages {
+		if strings.EqualFold(name, pkg) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPackageName returns the name of the package the match was found in.
+func matchPackageName(m VulnerabilityMatch) string {
+	artifact, ok := m.Artifact.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	name, _ := artifact["name"].(string)
+	return name
+}
+
+// matchPackageVersion returns the version of the package the match was found in.
+func matchPackageVersion(m VulnerabilityMatch) string {
+	artifact, ok := m.Artifact.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	version, _ := artifact["version"].(string)
+	return version
+}
+
+// splitParamValues flattens multi-valued and comma separated param values, dropping empty entries.
+func splitParamValues(values []string) []string {
+	var result []string
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				result = append(result, part)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,153 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/context"
+	"sort"
+)
+
+// FindingsPublisher publishes a findings message to the findings topic, for UIs rendering findings as images are
+// scanned. It may be called concurrently by parallel scans.
+type FindingsPublisher func(ctx context.Context, payload []byte) error
+
+// DefaultFindingsBatchSize is the default number of findings per findings message.
+const DefaultFindingsBatchSize = 100
+
+// FindingsMessage carries findings of one image of the run. Chunk (from 1) out of Chunks tells a UI when it has all
+// the findings of the image, or of the severity when they're grouped by severity.
+type FindingsMessage struct {
+	RunID          uint                 `json:"runId"`
+	ImageURL       string               `json:"imageUrl"`
+	ArtifactDigest string               `json:"artifactDigest"`
+	Severity       string               `json:"severity,omitempty"`
+	Chunk          int                  `json:"chunk"`
+	Chunks         int                  `json:"chunks"`
+	Findings       []VulnerabilityMatch `json:"findings"`
+}
+
+// findingsStreamer splits the findings of scanned images into messages of up to batchSize findings (optionally
+// grouped by severity), splitting further when a message would exceed maxMessageBytes.
+type findingsStreamer struct {
+	publish         FindingsPublisher
+	runID           uint
+	batchSize       int
+	groupBySeverity bool
+	maxMessageBytes int
+}
+
+// newFindingsStreamer returns the streamer configured by the stream_findings, findings_batch_size,
+// findings_group_by_severity and result_max_message_bytes params, or nil when streaming isn't requested or there's
+// no findings topic.
+func newFindingsStreamer(publish FindingsPublisher, runID uint, params map[string][]string) (*findingsStreamer, error) {
+	if publish == nil || !getBoolParam(params, "stream_findings") {
+		return nil, nil
+	}
+	batchSize, err := getIntParam(params, "findings_batch_size", DefaultFindingsBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	maxMessageBytes, err := getIntParam(params, "result_max_message_bytes", DefaultResultMaxMessageBytes)
+	if err != nil {
+		return nil, err
+	}
+	if batchSize < 1 || maxMessageBytes < 1 {
+		return nil, fmt.Errorf("findings_batch_size and result_max_message_bytes must be positive")
+	}
+	return &findingsStreamer{
+		publish:         publish,
+		runID:           runID,
+		batchSize:       batchSize,
+		groupBySeverity: getBoolParam(params, "findings_group_by_severity"),
+		maxMessageBytes: maxMessageBytes,
+	}, nil
+}
+
+// Stream publishes the findings of an image.
+func (s *findingsStreamer) Stream(ctx context.Context, imageURL, artifactDigest string, matches []VulnerabilityMatch) error {
+	if s == nil || len(matches) == 0 {
+		return nil
+	}
+
+	if !s.groupBySeverity {
+		return s.streamGroup(ctx, FindingsMessage{ImageURL: imageURL, ArtifactDigest: artifactDigest}, matches)
+	}
+
+	bySeverity := make(map[string][]VulnerabilityMatch)
+	for _, m := range matches {
+		bySeverity[m.Vulnerability.Severity] = append(bySeverity[m.Vulnerability.Severity], m)
+	}
+	severities := make([]string, 0, len(bySeverity))
+	for severity := range bySeverity {
+		severities = append(severities, severity)
+	}
+	// Most severe first, so a UI renders what matters most earliest
+	sort.Slice(severities, func(i, j int) bool {
+		return severityRank(severities[i]) > severityRank(severities[j])
+	})
+	for _, severity := range severities {
+		msg := FindingsMessage{ImageURL: imageURL, ArtifactDigest: artifactDigest, Severity: severity}
+		if err := s.streamGroup(ctx, msg, bySeverity[severity]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *findingsStreamer) streamGroup(ctx context.Context, header FindingsMessage, matches []VulnerabilityMatch) error {
+	chunks, err := s.chunk(header, matches)
+	if err != nil {
+		return err
+	}
+	for i, chunk := range chunks {
+		msg := header
+		msg.RunID = s.runID
+		msg.Chunk = i + 1
+		msg.Chunks = len(chunks)
+		msg.Findings = chunk
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		if err := s.publish(ctx, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunk splits matches into batches of up to batchSize, halving batches whose message exceeds maxMessageBytes. A
+// single finding is always sent as is.
+func (s *findingsStreamer) chunk(header FindingsMessage, matches []VulnerabilityMatch) ([][]VulnerabilityMatch, error) {
+	var chunks [][]VulnerabilityMatch
+	var split func(batch []VulnerabilityMatch) error
+	split = func(batch []VulnerabilityMatch) error {
+		msg := header
+		msg.RunID = s.runID
+		msg.Findings = batch
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		if len(payload) > s.maxMessageBytes && len(batch) > 1 {
+			mid := len(batch) / 2
+			if err := split(batch[:mid]); err != nil {
+				return err
+			}
+			return split(batch[mid:])
+		}
+		chunks = append(chunks, batch)
+		return nil
+	}
+
+	for start := 0; start < len(matches); start += s.batchSize {
+		end := start + s.batchSize
+		if end > len(matches) {
+			end = len(matches)
+		}
+		if err := split(matches[start:end]); err != nil {
+			return nil, err
+		}
+	}
+	return chunks, nil
+}
@@ -0,0 +1,83 @@
+package task
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Fix states reported by grype in Vulnerability.Fix.State.
+const (
+	FixStateFixed    = "fixed"
+	FixStateNotFixed = "not-fixed"
+	FixStateWontFix  = "wont-fix"
+	FixStateUnknown  = "unknown"
+)
+
+var knownFixStates = []string{FixStateFixed, FixStateNotFixed, FixStateWontFix, FixStateUnknown}
+
+// FixStatePolicy selects which fix states count towards the severity gate and the fixable count.
+// When IncludedStates is set only those states count, ExcludedStates are removed afterwards.
+type FixStatePolicy struct {
+	IncludedStates []string `json:"includedStates,omitempty"`
+	ExcludedStates []string `json:"excludedStates,omitempty"`
+}
+
+// getFixStatePolicyFromParams builds the policy from the comma separated include_fix_states and exclude_fix_states params.
+func getFixStatePolicyFromParams(params map[string][]string) (FixStatePolicy, error) {
+	var policy FixStatePolicy
+	var err error
+	if policy.IncludedStates, err = parseFixStates(getParamValue(params, "include_fix_states", "")); err != nil {
+		return policy, err
+	}
+	if policy.ExcludedStates, err = parseFixStates(getParamValue(params, "exclude_fix_states", "")); err != nil {
+		return policy, err
+	}
+	return policy, nil
+}
+
+func parseFixStates(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var states []string
+	for _, state := range strings.Split(value, ",") {
+		state = strings.ToLower(strings.TrimSpace(state))
+		if !containsString(knownFixStates, state) {
+			return nil, fmt.Errorf("invalid fix state %q: expected one of %s", state, strings.Join(knownFixStates, ", "))
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// Includes reports whether a match with the given fix state counts under the policy.
+func (p FixStatePolicy) Includes(state string) bool {
+	state = strings.ToLower(state)
+	if state == "" {
+		state = FixStateUnknown
+	}
+	if len(p.IncludedStates) > 0 && !containsString(p.IncludedStates, state) {
+		return false
+	}
+	return !containsString(p.ExcludedStates, state)
+}
+
+// filterFixed keeps the matches with an available fix (only_fixed), returning how many unfixed ones were dropped.
+func filterFixed(matches []VulnerabilityMatch) ([]VulnerabilityMatch, int) {
+	var kept []VulnerabilityMatch
+	for _, m := range matches {
+		if strings.EqualFold(m.Vulnerability.Fix.State, FixStateFixed) {
+			kept = append(kept, m)
+		}
+	}
+	return kept, len(matches) - len(kept)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package task
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetFixStatePolicyFromParams(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		params   map[string][]string
+		expected FixStatePolicy
+		invalid  bool
+	}{
+		{name: "no params"},
+		{name: "included states", params: map[string][]string{"include_fix_states": {"fixed,wont-fix"}},
+			expected: FixStatePolicy{IncludedStates: []string{FixStateFixed, FixStateWontFix}}},
+		{name: "case and whitespace", params: map[string][]string{"exclude_fix_states": {" Not-Fixed , UNKNOWN"}},
+			expected: FixStatePolicy{ExcludedStates: []string{FixStateNotFixed, FixStateUnknown}}},
+		{name: "both", params: map[string][]string{"include_fix_states": {"fixed"}, "exclude_fix_states": {"unknown"}},
+			expected: FixStatePolicy{IncludedStates: []string{FixStateFixed}, ExcludedStates: []string{FixStateUnknown}}},
+		{name: "invalid included state", params: map[string][]string{"include_fix_states": {"fixed,patched"}}, invalid: true},
+		{name: "invalid excluded state", params: map[string][]string{"exclude_fix_states": {"wontfix"}}, invalid: true},
+		{name: "empty state in list", params: map[string][]string{"include_fix_states": {"fixed,"}}, invalid: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := getFixStatePolicyFromParams(tc.params)
+			if tc.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got policy %+v", policy)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(policy, tc.expected) {
+				t.Errorf("expected policy %+v, got %+v", tc.expected, policy)
+			}
+		})
+	}
+}
+
+func TestFixStatePolicyIncludes(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		policy   FixStatePolicy
+		state    string
+		expected bool
+	}{
+		{name: "empty policy", state: FixStateNotFixed, expected: true},
+		{name: "included", policy: FixStatePolicy{IncludedStates: []string{FixStateFixed}}, state: FixStateFixed, expected: true},
+		{name: "not included", policy: FixStatePolicy{IncludedStates: []string{FixStateFixed}}, state: FixStateWontFix},
+		{name: "excluded", policy: FixStatePolicy{ExcludedStates: []string{FixStateWontFix}}, state: FixStateWontFix},
+		{name: "state case", policy: FixStatePolicy{ExcludedStates: []string{FixStateWontFix}}, state: "Wont-Fix"},
+		{name: "empty state is unknown", policy: FixStatePolicy{ExcludedStates: []string{FixStateUnknown}}, state: ""},
+		{name: "empty state included as unknown", policy: FixStatePolicy{IncludedStates: []string{FixStateUnknown}},
+			state: "", expected: true},
+		{name: "exclusion wins over inclusion",
+			policy: FixStatePolicy{IncludedStates: []string{FixStateFixed}, ExcludedStates: []string{FixStateFixed}},
+			state:  FixStateFixed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if included := tc.policy.Includes(tc.state); included != tc.expected {
+				t.Errorf("expected %q included %t, got %t", tc.state, tc.expected, included)
+			}
+		})
+	}
+}
+
+func TestFilterFixed(t *testing.T) {
+	match := func(state string) VulnerabilityMatch {
+		return VulnerabilityMatch{Vulnerability: Vulnerability{Fix: VulnerabilityFix{State: state}}}
+	}
+	for _, tc := range []struct {
+		name    string
+		matches []VulnerabilityMatch
+		kept    int
+		dropped int
+	}{
+		{name: "no matches"},
+		{name: "all fixed", matches: []VulnerabilityMatch{match("fixed"), match("Fixed")}, kept: 2},
+		{name: "mixed", matches: []VulnerabilityMatch{match("fixed"), match("not-fixed"), match(""), match("wont-fix")},
+			kept: 1, dropped: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			kept, dropped := filterFixed(tc.matches)
+			if len(kept) != tc.kept || dropped != tc.dropped {
+				t.Errorf("expected %d kept and %d dropped, got %d and %d", tc.kept, tc.dropped, len(kept), dropped)
+			}
+		})
+	}
+}
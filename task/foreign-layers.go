@@ -0,0 +1,146 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"net/http"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote"
+	"strings"
+)
+
+// Handling of foreign (non-distributable) layers, e.g. those of Windows base images, whose manifest lists URLs to
+// download them from rather than a blob in the registry (foreign_layers param).
+const (
+	// ForeignLayersDownload downloads foreign layers from their URLs, falling back to the registry.
+	ForeignLayersDownload = "download"
+	// ForeignLayersReject fails the pull of images with foreign layers.
+	ForeignLayersReject = "reject"
+)
+
+// errForeignLayersRejected fails the pull of images with foreign layers under ForeignLayersReject, without retrying.
+var errForeignLayersRejected = errors.New("foreign layers are not supported")
+
+// foreignLayerMediaTypes are the layer media types whose content may live outside the registry.
+var foreignLayerMediaTypes = []string{
+	"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip",
+	"application/vnd.oci.image.layer.nondistributable.v1.tar",
+	"application/vnd.oci.image.layer.nondistributable.v1.tar+gzip",
+	"application/vnd.oci.image.layer.nondistributable.v1.tar+zstd",
+}
+
+// isForeignLayer reports whether the layer is to be downloaded from its URLs rather than the registry.
+func isForeignLayer(desc ocispec.Descriptor) bool {
+	if len(desc.URLs) == 0 {
+		return false
+	}
+	for _, mt := range foreignLayerMediaTypes {
+		if desc.MediaType == mt {
+			return true
+		}
+	}
+	return false
+}
+
+// foreignLayers returns the foreign layers of the manifest.
+func foreignLayers(manifest ocispec.Manifest) []ocispec.Descriptor {
+	var foreign []ocispec.Descriptor
+	for _, layer := range manifest.Layers {
+		if isForeignLayer(layer) {
+			foreign = append(foreign, layer)
+		}
+	}
+	return foreign
+}
+
+// successorsSkippingForeignLayers is an oras FindSuccessors func leaving foreign layers out of the copy, as their
+// blobs are usually not in the registry.
+func successorsSkippingForeignLayers(ctx context.Context, fetcher content.Fetcher, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	successors, err := content.Successors(ctx, fetcher, desc)
+	if err != nil {
+		return nil, err
+	}
+	var kept []ocispec.Descriptor
+	for _, s := range successors {
+		if !isForeignLayer(s) {
+			kept = append(kept, s)
+		}
+	}
+	return kept, nil
+}
+
+// fetchForeignLayers stores the foreign layers of the manifest in the memory store, trying their URLs in order (through
+// the outbound proxy) and then the registry. It returns the digests of the foreign layers.
+func fetchForeignLayers(ctx context.Context, repo *remote.Repository, store content.Storage, manifest ocispec.Manifest, mode string, logger *zap.Logger) ([]string, error) {
+	foreign := foreignLayers(manifest)
+	if len(foreign) == 0 {
+		return nil, nil
+	}
+
+	var digests []string
+	for _, layer := range foreign {
+		digests = append(digests, layer.Digest.String())
+	}
+	if mode == ForeignLayersReject {
+		return nil, fmt.Errorf("%w with foreign_layers=%s: the image has %d (%s)",
+			errForeignLayersRejected, ForeignLayersReject, len(foreign), strings.Join(digests, ", "))
+	}
+
+	for _, layer := range foreign {
+		if exists, _ := store.Exists(ctx, layer); exists {
+			continue
+		}
+		if err := fetchForeignLayer(ctx, repo, store, layer, logger); err != nil {
+			return nil, fmt.Errorf("failed to fetch foreign layer %s: %w", layer.Digest, err)
+		}
+	}
+	return digests, nil
+}
+
+func fetchForeignLayer(ctx context.Context, repo *remote.Repository, store content.Storage, layer ocispec.Descriptor, logger *zap.Logger) error {
+	httpClient, err := retryingHTTPClient()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, u := range layer.URLs {
+		err := func() error {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+			if err != nil {
+				return err
+			}
+			resp, err := httpClient.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return fmt.Errorf("unexpected status %d", resp.StatusCode)
+			}
+			// The store verifies the size and digest of what's read against the descriptor
+			return store.Push(ctx, layer, resp.Body)
+		}()
+		if err == nil || errors.Is(err, errdef.ErrAlreadyExists) {
+			return nil
+		}
+		logger.Warn("failed to download foreign layer", zap.String("digest", layer.Digest.String()), zap.String("url", u), zap.Error(err))
+		errs = append(errs, fmt.Errorf("%s: %w", u, err))
+	}
+
+	// Registries set up to mirror non-distributable artifacts serve them as regular blobs
+	rc, err := repo.Fetch(ctx, layer)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("registry: %w", err))
+		return errors.Join(errs...)
+	}
+	defer rc.Close()
+	if err := store.Push(ctx, layer, rc); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return err
+	}
+	return nil
+}
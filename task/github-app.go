@@ -0,0 +1,143 @@
+package task
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"golang.org/x/net/context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// githubAppTokenUsername is the username GHCR expects along with a GitHub App installation token.
+const githubAppTokenUsername = "x-access-token"
+
+// githubAppJWTLifetime is the lifetime of the JWTs authenticating as the app, GitHub accepting 10 minutes at most.
+const githubAppJWTLifetime = 9 * time.Minute
+
+// hasGitHubApp reports whether GitHub App credentials were provided instead of a username and token.
+func (c Credentials) hasGitHubApp() bool {
+	return c.GithubAppID != "" || c.GithubAppInstallationID != "" || c.GithubAppPrivateKey != ""
+}
+
+// githubToken returns the token of the GitHub API calls of creds: github_token, or an installation token of the
+// GitHub App.
+func githubToken(ctx context.Context, creds Credentials) (string, error) {
+	if !creds.hasGitHubApp() {
+		return creds.GithubToken, nil
+	}
+	return githubAppInstallationToken(ctx, creds)
+}
+
+// githubAppInstallationToken mints a short-lived installation token of the GitHub App of creds, restricted to
+// reading packages, authenticating as the app with a JWT signed with its private key.
+func githubAppInstallationToken(ctx context.Context, creds Credentials) (string, error) {
+	if creds.GithubAppID == "" || creds.GithubAppInstallationID == "" || creds.GithubAppPrivateKey == "" {
+		return "", fmt.Errorf("github_app_id, github_app_installation_id and github_app_private_key are required for a GitHub App")
+	}
+	if _, err := strconv.ParseInt(creds.GithubAppInstallationID, 10, 64); err != nil {
+		return "", fmt.Errorf("invalid github_app_installation_id %q", creds.GithubAppInstallationID)
+	}
+	key, err := parseGitHubAppPrivateKey(creds.GithubAppPrivateKey)
+	if err != nil {
+		return "", err
+	}
+	appJWT, err := githubAppJWT(creds.GithubAppID, key, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	body := []byte(`{"permissions":{"packages":"read"}}`)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		fmt.Sprintf("%s/app/installations/%s/access_tokens", githubAPIURL, creds.GithubAppInstallationID), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+appJWT)
+
+	httpClient, err := retryingHTTPClient()
+	if err != nil {
+		return "", err
+	}
+	// retryingHTTPClient already validated the policy
+	retries, _ := getRetryPolicy()
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to create installation token: %w", retryFailure(err, retries.MaxAttempts))
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read installation token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		err := &statusError{StatusCode: resp.StatusCode, Err: fmt.Errorf("failed to create installation token: status %d: %s", resp.StatusCode, truncateForLog(respBody))}
+		return "", retryFailure(err, retries.MaxAttempts)
+	}
+
+	var tokenResp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(respBody, &tokenResp); err != nil {
+		return "", fmt.Errorf("failed to parse installation token response: %w", err)
+	}
+	if tokenResp.Token == "" {
+		return "", fmt.Errorf("installation token response did not contain a token")
+	}
+	return tokenResp.Token, nil
+}
+
+// parseGitHubAppPrivateKey parses the PEM private key of a GitHub App, PKCS#1 as GitHub generates them or PKCS#8.
+func parseGitHubAppPrivateKey(keyPEM string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("invalid github_app_private_key: no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid github_app_private_key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("invalid github_app_private_key: expected an RSA key")
+	}
+	return key, nil
+}
+
+// githubAppJWT returns the RS256 JWT authenticating as the app, issued a minute in the past against clock drift.
+func githubAppJWT(appID string, key *rsa.PrivateKey, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(githubAppJWTLifetime).Unix(),
+		"iss": appID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign GitHub App JWT: %w", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,108 @@
+package task
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/anchore/grype/grype/pkg"
+	"github.com/anchore/syft/syft"
+	"github.com/anchore/syft/syft/format/syftjson"
+	"github.com/anchore/syft/syft/sbom"
+	"github.com/anchore/syft/syft/source/sourceproviders"
+	"golang.org/x/net/context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CatalogCommand is the hidden command of the worker binary cataloging the packages of a scan target into a syft
+// JSON SBOM, run as a child process of the scan so that it can be killed.
+const CatalogCommand = "catalog"
+
+// catalogFileName is the name of the SBOM cataloged into the run directory, catalogTmpDir the temp directory of the
+// child, where syft unpacks images, removed along with the run directory even when the child is killed.
+const (
+	catalogFileName = "catalog.syft.json"
+	catalogTmpDir   = "catalog-tmp"
+)
+
+// catalogKillDelay is how long a cancelled catalog process has to exit before its output pipes are closed.
+const catalogKillDelay = 5 * time.Second
+
+// catalogPackages catalogs the packages of target into runDir as grype's pkg.Provide does. Syft doesn't stop
+// indexing file trees when its context is cancelled, so the cataloging, by far the longest step of a scan, runs in a
+// child process killed once ctx is done (e.g. by the run timeout), and grype reads the SBOM it writes. SBOM targets,
+// which are only decoded, are handed to grype directly.
+func catalogPackages(ctx context.Context, target, runDir string, cfg pkg.ProviderConfig) ([]pkg.Package, pkg.Context, *sbom.SBOM, error) {
+	if strings.HasPrefix(target, "sbom:") {
+		return pkg.Provide(target, cfg)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, pkg.Context{}, nil, fmt.Errorf("failed to find the worker executable: %w", err)
+	}
+	tmpDir := filepath.Join(runDir, catalogTmpDir)
+	if err := os.MkdirAll(tmpDir, 0700); err != nil {
+		return nil, pkg.Context{}, nil, fmt.Errorf("failed to create catalog temp directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	outputPath := filepath.Join(runDir, catalogFileName)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, executable, CatalogCommand, target, outputPath)
+	cmd.Env = append(os.Environ(), "TMPDIR="+tmpDir)
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = catalogKillDelay
+	if err := cmd.Run(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, pkg.Context{}, nil, ctxErr
+		}
+		return nil, pkg.Context{}, nil, fmt.Errorf("%w: %s", err, truncateForLog(bytes.TrimSpace(stderr.Bytes())))
+	}
+	return pkg.Provide("sbom:"+outputPath, cfg)
+}
+
+// RunCatalog catalogs the packages of target, a grype style source such as oci-dir:<path> or an image archive, the
+// way grype does, writing them to outputPath as a syft JSON SBOM. It's the CatalogCommand of the worker binary.
+func RunCatalog(ctx context.Context, target, outputPath string) error {
+	getSourceCfg := syft.DefaultGetSourceConfig()
+	if scheme, input, ok := strings.Cut(target, ":"); ok && isSourceScheme(scheme) {
+		getSourceCfg, target = getSourceCfg.WithSources(strings.ToLower(scheme)), input
+	}
+	src, err := syft.GetSource(ctx, target, getSourceCfg)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	s, err := syft.CreateSBOM(ctx, src, grypeProviderConfig().SBOMOptions)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return fmt.Errorf("no SBOM created for %s", target)
+	}
+
+	f, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", outputPath, err)
+	}
+	if err := syftjson.NewFormatEncoder().Encode(f, *s); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to encode SBOM: %w", err)
+	}
+	return f.Close()
+}
+
+// isSourceScheme tells whether scheme is the tag of a syft source provider, e.g. oci-dir or dir.
+func isSourceScheme(scheme string) bool {
+	scheme = strings.ToLower(strings.TrimSpace(scheme))
+	for _, provider := range sourceproviders.All("", nil) {
+		if containsString(provider.Tags, scheme) {
+			return true
+		}
+	}
+	return false
+}
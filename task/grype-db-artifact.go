@@ -0,0 +1,81 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"io"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultGrypeDBArchiveName is the name the DB archive is written under when its layer has no title annotation.
+const defaultGrypeDBArchiveName = "grype-db.tar.gz"
+
+// pullGrypeDBArtifact pulls the grype DB archive packaged as the single layer of the OCI artifact at artifactRef
+// (e.g. pushed with `oras push registry/grype-db:v5 vulnerability-db.tar.gz`) into dir, authenticating with the task
+// registry credentials. It returns the path of the archive and the digest of the artifact manifest.
+func pullGrypeDBArtifact(ctx context.Context, logger *zap.Logger, params map[string][]string, artifactRef, dir string) (string, string, error) {
+	ref, err := registry.ParseReference(artifactRef)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid grype_db_artifact %q: %w", artifactRef, err)
+	}
+
+	registryType := getParamValue(params, "registry_type", string(RegistryGHCR))
+	auths, err := getRegistryAuths(ctx, registryType, getCredsFromParams(params))
+	if err != nil {
+		return "", "", newTaskError(ErrorKindAuth, err)
+	}
+	repo, err := newRemoteRepository(ref, DockerConfig{Auths: auths}, pullOptions{Anonymous: RegistryType(registryType) == RegistryPublic})
+	if err != nil {
+		return "", "", err
+	}
+
+	manifestDesc, manifestBytes, err := oras.FetchBytes(ctx, repo, ref.Reference, oras.DefaultFetchBytesOptions)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to fetch grype db artifact manifest: %w", err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return "", "", fmt.Errorf("failed to unmarshal grype db artifact manifest: %w", err)
+	}
+	if len(manifest.Layers) != 1 {
+		return "", "", fmt.Errorf("expected the grype db artifact to have a single layer, found %d", len(manifest.Layers))
+	}
+	layer := manifest.Layers[0]
+
+	// The title annotation carries the file name, which tells grype the archive's compression
+	name := filepath.Base(layer.Annotations[ocispec.AnnotationTitle])
+	if name == "." || name == "/" || name == "" || strings.HasPrefix(name, ".") {
+		name = defaultGrypeDBArchiveName
+	}
+	archivePath := filepath.Join(dir, name)
+
+	logger.Info("pulling grype db artifact", zap.String("artifact", artifactRef), zap.String("digest", manifestDesc.Digest.String()),
+		zap.Int64("size", layer.Size))
+	rc, err := repo.Fetch(ctx, layer)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to fetch grype db archive: %w", err)
+	}
+	defer rc.Close()
+
+	f, err := os.Create(archivePath)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	vr := content.NewVerifyReader(rc, layer)
+	if _, err := io.Copy(f, vr); err != nil {
+		return "", "", fmt.Errorf("failed to write grype db archive: %w", err)
+	}
+	if err := vr.Verify(); err != nil {
+		return "", "", fmt.Errorf("failed to verify grype db archive: %w", err)
+	}
+	return archivePath, manifestDesc.Digest.String(), nil
+}
@@ -0,0 +1,157 @@
+package task
+
+import (
+	"fmt"
+	v5 "github.com/anchore/grype/grype/db/v5"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// GrypeDBSource is where the vulnerability database is loaded from at startup, for clusters without access to the
+// grype listing (grype_db_source for the CLI). When set the database is never updated by the scans. It's one of:
+//   - a directory, e.g. a mounted PVC, holding a grype database cache (the GRYPE_DB_CACHE_DIR of the worker or
+//     refresh-db run that populated it), used in place
+//   - the path of a database archive, or an http(s) or s3://bucket/key URL to download it from, imported into
+//     GRYPE_DB_CACHE_DIR
+//   - oci://registry/repository:tag, the OCI artifact packaging the archive as for grype_db_artifact, pulled
+//     anonymously
+var GrypeDBSource = os.Getenv("GRYPE_DB_SOURCE")
+
+// LoadGrypeDBSource installs the vulnerability database from source (see GrypeDBSource) and disables its automatic
+// update. It's a no-op when source is empty.
+func LoadGrypeDBSource(ctx context.Context, logger *zap.Logger, source string) error {
+	if source == "" {
+		return nil
+	}
+	GrypeDBAutoUpdate = "false"
+
+	switch {
+	case strings.HasPrefix(source, "oci://"):
+		dir, err := os.MkdirTemp(WorkDirRoot, "grype-db-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		params := map[string][]string{"registry_type": {string(RegistryPublic)}}
+		archivePath, digest, err := pullGrypeDBArtifact(ctx, logger, params, strings.TrimPrefix(source, "oci://"), dir)
+		if err != nil {
+			return fmt.Errorf("failed to pull grype_db_source: %w", err)
+		}
+		logger.Info("Importing grype db", zap.String("artifact", source), zap.String("digest", digest))
+		if err := updateGrypeDB(logger, archivePath); err != nil {
+			return err
+		}
+	case strings.HasPrefix(source, "s3://"), strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"):
+		dir, err := os.MkdirTemp(WorkDirRoot, "grype-db-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		// The extension tells grype the compression of the archive
+		name := filepath.Base(strings.SplitN(source, "?", 2)[0])
+		if !strings.Contains(name, ".tar") {
+			name = defaultGrypeDBArchiveName
+		}
+		archivePath := filepath.Join(dir, name)
+		if strings.HasPrefix(source, "s3://") {
+			err = downloadS3Object(ctx, source, archivePath)
+		} else {
+			err = downloadFile(ctx, source, archivePath)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to download grype_db_source: %w", err)
+		}
+		logger.Info("Importing grype db", zap.String("archive", source))
+		if err := updateGrypeDB(logger, archivePath); err != nil {
+			return err
+		}
+	default:
+		info, err := os.Stat(source)
+		if err != nil {
+			return newTaskError(ErrorKindConfig, fmt.Errorf("invalid grype_db_source: %w", err))
+		}
+		if info.IsDir() {
+			dbPath := filepath.Join(source, strconv.Itoa(v5.SchemaVersion), "vulnerability.db")
+			if _, err := os.Stat(dbPath); err != nil {
+				return newTaskError(ErrorKindConfig, fmt.Errorf("invalid grype_db_source: %s has no schema v%d database: %w",
+					source, v5.SchemaVersion, err))
+			}
+			GrypeDBCacheDir = source
+			logger.Info("Using grype db directory", zap.String("dir", source))
+		} else {
+			logger.Info("Importing grype db", zap.String("archive", source))
+			if err := updateGrypeDB(logger, source); err != nil {
+				return err
+			}
+		}
+	}
+
+	status, err := getGrypeDBStatus()
+	if err != nil {
+		return err
+	}
+	if !status.Valid {
+		return fmt.Errorf("grype db from %s is not valid: %s", source, status.Error)
+	}
+	logger.Info("grype db loaded", zap.String("source", source), zap.Any("status", status))
+	return nil
+}
+
+// downloadS3Object downloads the object at the s3://bucket/key URL to path, with the AWS credentials and region of
+// the environment.
+func downloadS3Object(ctx context.Context, objectURL, path string) error {
+	body, _, err := getS3Object(ctx, objectURL)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, body); err != nil {
+		return err
+	}
+	return nil
+}
+
+// getS3Object returns the content of the object at the s3://bucket/key URL and its size, with the AWS credentials and
+// region of the environment.
+func getS3Object(ctx context.Context, objectURL string) (io.ReadCloser, int64, error) {
+	u, err := url.Parse(objectURL)
+	if err != nil {
+		return nil, 0, err
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, 0, fmt.Errorf("invalid s3 URL %q: expected s3://bucket/key", objectURL)
+	}
+
+	httpClient, err := outboundHTTPClient()
+	if err != nil {
+		return nil, 0, err
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithHTTPClient(httpClient))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to load AWS config: %w", err)
+	}
+	out, err := s3.NewFromConfig(cfg).GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(u.Host),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return out.Body, aws.ToInt64(out.ContentLength), nil
+}
@@ -0,0 +1,388 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/anchore/clio"
+	"github.com/anchore/grype/grype"
+	"github.com/anchore/grype/grype/db/legacy/distribution"
+	v5 "github.com/anchore/grype/grype/db/v5"
+	"github.com/opengovern/og-util/pkg/tasks"
+	"github.com/opengovern/opencomply/services/tasks/scheduler"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GrypeDBStatus is the vulnerability database metadata, as reported by `grype db status`.
+type GrypeDBStatus struct {
+	SchemaVersion string `json:"schemaVersion"`
+	Built         string `json:"built"`
+	Path          string `json:"path"`
+	Valid         bool   `json:"valid"`
+	Error         string `json:"error,omitempty"`
+}
+
+// RefreshDBResult is the task result of a refresh-db run.
+type RefreshDBResult struct {
+	Action   string        `json:"action"`
+	Source   string        `json:"source"`
+	DBStatus GrypeDBStatus `json:"dbStatus"`
+	// ArtifactDigest is the manifest digest of the imported grype_db_artifact.
+	ArtifactDigest string `json:"artifactDigest,omitempty"`
+}
+
+// runRefreshDBTask updates the grype vulnerability database, either from the upstream listing (as `grype db update`)
+// or by importing the archive provided in the grype_db_archive param (local path or http(s) URL) or packaged as the
+// OCI artifact in the grype_db_artifact param (pulled with the registry credentials of the task).
+func runRefreshDBTask(ctx context.Context, logger *zap.Logger, request tasks.TaskRequest, response *scheduler.TaskResponse) error {
+	archive := getParamValue(request.TaskDefinition.Params, "grype_db_archive", "")
+	artifact := getParamValue(request.TaskDefinition.Params, "grype_db_artifact", "")
+	if archive != "" && artifact != "" {
+		return newTaskError(ErrorKindConfig, fmt.Errorf("grype_db_archive and grype_db_artifact are mutually exclusive"))
+	}
+
+	result := RefreshDBResult{
+		Action: ActionRefreshDB,
+		Source: "update",
+	}
+
+	switch {
+	case artifact != "":
+		result.Source = artifact
+
+		workDir, err := NewWorkDir(request.TaskDefinition.RunID)
+		if err != nil {
+			return err
+		}
+		defer workDir.Close()
+		archivePath, digest, err := pullGrypeDBArtifact(ctx, logger, request.TaskDefinition.Params, artifact, workDir.Path)
+		if err != nil {
+			return err
+		}
+		result.ArtifactDigest = digest
+
+		logger.Info("Importing grype db", zap.String("artifact", artifact), zap.String("digest", digest))
+		if err := updateGrypeDB(logger, archivePath); err != nil {
+			return err
+		}
+	case archive == "":
+		logger.Info("Updating grype db")
+		if err := updateGrypeDB(logger, ""); err != nil {
+			return err
+		}
+	default:
+		result.Source = archive
+
+		archivePath := archive
+		if strings.HasPrefix(archive, "http://") || strings.HasPrefix(archive, "https://") {
+			workDir, err := NewWorkDir(request.TaskDefinition.RunID)
+			if err != nil {
+				return err
+			}
+			defer workDir.Close()
+			archivePath = filepath.Join(workDir.Path, "grype-db.tar.gz")
+			if err := downloadFile(ctx, archive, archivePath); err != nil {
+				return fmt.Errorf("failed to download grype db archive: %w", err)
+			}
+		}
+
+		logger.Info("Importing grype db", zap.String("archive", archive))
+		if err := updateGrypeDB(logger, archivePath); err != nil {
+			return err
+		}
+	}
+
+	status, err := getGrypeDBStatus()
+	if err != nil {
+		return err
+	}
+	if !status.Valid {
+		return fmt.Errorf("grype db is not valid after refresh: %s", status.Error)
+	}
+	result.DBStatus = status
+	logger.Info("grype db refreshed", zap.Any("status", status))
+
+	resultJson, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	response.Result = resultJson
+	return nil
+}
+
+// Vulnerability database settings, named and defaulting as for the grype CLI: GRYPE_DB_CACHE_DIR (grype/db in the
+// user cache directory), GRYPE_DB_UPDATE_URL (the anchore listing), GRYPE_DB_CA_CERT, GRYPE_DB_AUTO_UPDATE (whether
+// scans update the database first, true), GRYPE_DB_VALIDATE_AGE (true) and GRYPE_DB_MAX_ALLOWED_BUILT_AGE (120h).
+var (
+	GrypeDBCacheDir           = os.Getenv("GRYPE_DB_CACHE_DIR")
+	GrypeDBUpdateURL          = os.Getenv("GRYPE_DB_UPDATE_URL")
+	GrypeDBCACert             = os.Getenv("GRYPE_DB_CA_CERT")
+	GrypeDBAutoUpdate         = os.Getenv("GRYPE_DB_AUTO_UPDATE")
+	GrypeDBValidateAge        = os.Getenv("GRYPE_DB_VALIDATE_AGE")
+	GrypeDBMaxAllowedBuiltAge = os.Getenv("GRYPE_DB_MAX_ALLOWED_BUILT_AGE")
+)
+
+// GrypeDBUpdateInterval is how often the scans check for a vulnerability database update when GRYPE_DB_AUTO_UPDATE is
+// on (a duration, 6h by default) rather than querying the listing for every scan. A database that is missing or older
+// than GRYPE_DB_MAX_ALLOWED_BUILT_AGE is updated before the next scan whatever the interval.
+var GrypeDBUpdateInterval = os.Getenv("GRYPE_DB_UPDATE_INTERVAL")
+
+const (
+	defaultGrypeDBUpdateURL          = "https://toolbox-data.anchore.io/grype/databases/listing.json"
+	defaultGrypeDBMaxAllowedBuiltAge = 120 * time.Hour
+	grypeDBListingTimeout            = 30 * time.Second
+	grypeDBUpdateTimeout             = 300 * time.Second
+	defaultGrypeDBUpdateInterval     = 6 * time.Hour
+	// grypeDBStaleRetryInterval bounds how often the update of a stale database is retried when it fails.
+	grypeDBStaleRetryInterval = 5 * time.Minute
+)
+
+// grypeDBMu serializes the updates and imports of the database with the loads of the scans.
+var grypeDBMu sync.Mutex
+
+// grypeDBLastUpdateCheck is when the scans last checked for a database update, guarded by grypeDBMu.
+var grypeDBLastUpdateCheck time.Time
+
+// grypeID identifies the grype library, with its module version, in the reports and the database requests.
+func grypeID() clio.Identification {
+	id := clio.Identification{Name: "grype", Version: "[not provided]"}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/anchore/grype" {
+				id.Version = dep.Version
+			}
+		}
+	}
+	return id
+}
+
+// grypeDBConfig is the configuration of the database curator. It doesn't limit the frequency of the update checks,
+// scans checking on the schedule of GrypeDBUpdateInterval and refresh-db runs whenever they run.
+func grypeDBConfig() (distribution.Config, error) {
+	cfg := distribution.Config{
+		ID:                 grypeID(),
+		DBRootDir:          GrypeDBCacheDir,
+		ListingURL:         GrypeDBUpdateURL,
+		CACert:             GrypeDBCACert,
+		ValidateAge:        true,
+		MaxAllowedBuiltAge: defaultGrypeDBMaxAllowedBuiltAge,
+		ListingFileTimeout: grypeDBListingTimeout,
+		UpdateTimeout:      grypeDBUpdateTimeout,
+	}
+	if cfg.DBRootDir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			cacheDir = "/.cache"
+		}
+		cfg.DBRootDir = filepath.Join(cacheDir, "grype", "db")
+	}
+	if cfg.ListingURL == "" {
+		cfg.ListingURL = defaultGrypeDBUpdateURL
+	}
+	if GrypeDBValidateAge != "" {
+		validateAge, err := strconv.ParseBool(GrypeDBValidateAge)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid GRYPE_DB_VALIDATE_AGE: %w", err)
+		}
+		cfg.ValidateAge = validateAge
+	}
+	if GrypeDBMaxAllowedBuiltAge != "" {
+		maxAge, err := time.ParseDuration(GrypeDBMaxAllowedBuiltAge)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid GRYPE_DB_MAX_ALLOWED_BUILT_AGE: %w", err)
+		}
+		cfg.MaxAllowedBuiltAge = maxAge
+	}
+	return cfg, nil
+}
+
+func newGrypeDBCurator() (distribution.Curator, error) {
+	cfg, err := grypeDBConfig()
+	if err != nil {
+		return distribution.Curator{}, err
+	}
+	return distribution.NewCurator(cfg)
+}
+
+// loadGrypeDB opens the vulnerability database for a scan. When GRYPE_DB_AUTO_UPDATE is set the database is first
+// updated if the update interval elapsed, or if it's missing or stale.
+func loadGrypeDB(logger *zap.Logger) (*v5.ProviderStore, *distribution.Status, error) {
+	cfg, err := grypeDBConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	autoUpdate := true
+	if GrypeDBAutoUpdate != "" {
+		if autoUpdate, err = strconv.ParseBool(GrypeDBAutoUpdate); err != nil {
+			return nil, nil, fmt.Errorf("invalid GRYPE_DB_AUTO_UPDATE: %w", err)
+		}
+	}
+	interval := defaultGrypeDBUpdateInterval
+	if GrypeDBUpdateInterval != "" {
+		if interval, err = time.ParseDuration(GrypeDBUpdateInterval); err != nil {
+			return nil, nil, fmt.Errorf("invalid GRYPE_DB_UPDATE_INTERVAL: %w", err)
+		}
+	}
+
+	grypeDBMu.Lock()
+	defer grypeDBMu.Unlock()
+	if autoUpdate {
+		if err := updateGrypeDBIfDue(logger, cfg, interval); err != nil {
+			return nil, nil, err
+		}
+	}
+	store, status, err := grype.LoadVulnerabilityDB(cfg, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load vulnerability db: %w", err)
+	}
+	if status == nil {
+		store.Close()
+		return nil, nil, fmt.Errorf("unable to determine the status of the vulnerability db")
+	}
+	if status.Err != nil {
+		store.Close()
+		return nil, nil, fmt.Errorf("vulnerability db could not be loaded: %w", status.Err)
+	}
+	// Only reached with GRYPE_DB_VALIDATE_AGE off, loading a stale database fails otherwise
+	if age := time.Since(status.Built); age > cfg.MaxAllowedBuiltAge {
+		logger.Warn("vulnerability db is stale, results may miss recent vulnerabilities", zap.Time("built", status.Built),
+			zap.Duration("age", age), zap.Duration("maxAllowedBuiltAge", cfg.MaxAllowedBuiltAge))
+	}
+	return store, status, nil
+}
+
+// updateGrypeDBIfDue checks for a database update when the interval elapsed since the last check, or right away when
+// the installed database is missing or stale. grypeDBMu must be held.
+func updateGrypeDBIfDue(logger *zap.Logger, cfg distribution.Config, interval time.Duration) error {
+	curator, err := distribution.NewCurator(cfg)
+	if err != nil {
+		return err
+	}
+	installed := curator.Status()
+	stale := installed.Err != nil || time.Since(installed.Built) > cfg.MaxAllowedBuiltAge
+	sinceCheck := time.Since(grypeDBLastUpdateCheck)
+	if sinceCheck < interval && !(stale && sinceCheck >= grypeDBStaleRetryInterval) {
+		return nil
+	}
+
+	grypeDBLastUpdateCheck = time.Now()
+	updated, err := curator.Update()
+	if err != nil {
+		if installed.Err != nil {
+			return fmt.Errorf("grype db update failed: %w", err)
+		}
+		logger.Warn("grype db update failed, scanning with the installed db", zap.Time("built", installed.Built), zap.Error(err))
+		return nil
+	}
+	logger.Info("grype db update checked", zap.Bool("updated", updated), zap.Bool("stale", stale),
+		zap.Duration("interval", interval))
+	return nil
+}
+
+// updateGrypeDB updates the vulnerability database from the listing, or imports archivePath when set.
+func updateGrypeDB(logger *zap.Logger, archivePath string) error {
+	curator, err := newGrypeDBCurator()
+	if err != nil {
+		return err
+	}
+
+	grypeDBMu.Lock()
+	defer grypeDBMu.Unlock()
+	if archivePath != "" {
+		if err := curator.ImportFrom(archivePath); err != nil {
+			return fmt.Errorf("grype db import failed: %w", err)
+		}
+		return nil
+	}
+	updated, err := curator.Update()
+	if err != nil {
+		return fmt.Errorf("grype db update failed: %w", err)
+	}
+	grypeDBLastUpdateCheck = time.Now()
+	logger.Info("grype db update checked", zap.Bool("updated", updated))
+	return nil
+}
+
+// getGrypeDBStatus returns the metadata of the currently installed grype vulnerability database.
+func getGrypeDBStatus() (GrypeDBStatus, error) {
+	curator, err := newGrypeDBCurator()
+	if err != nil {
+		return GrypeDBStatus{}, err
+	}
+
+	grypeDBMu.Lock()
+	s := curator.Status()
+	grypeDBMu.Unlock()
+	return grypeDBStatus(s), nil
+}
+
+// CheckGrypeDB tells whether a valid grype vulnerability database is installed, for the readiness probe of the
+// worker. The database counts as available while it's being updated, the probe doesn't wait for the update.
+func CheckGrypeDB() error {
+	curator, err := newGrypeDBCurator()
+	if err != nil {
+		return err
+	}
+	if !grypeDBMu.TryLock() {
+		return nil
+	}
+	s := curator.Status()
+	grypeDBMu.Unlock()
+	if s.Err != nil {
+		return s.Err
+	}
+	return nil
+}
+
+func grypeDBStatus(s distribution.Status) GrypeDBStatus {
+	status := GrypeDBStatus{
+		SchemaVersion: strconv.Itoa(s.SchemaVersion),
+		Built:         s.Built.UTC().Format(time.RFC3339),
+		Path:          s.Location,
+		Valid:         s.Err == nil,
+	}
+	if s.Err != nil {
+		status.Error = s.Err.Error()
+	}
+	return status
+}
+
+// downloadFile downloads url to path.
+func downloadFile(ctx context.Context, url, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	httpClient, err := outboundHTTPClient()
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d downloading %s", resp.StatusCode, url)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package task
+
+import (
+	"fmt"
+	"github.com/anchore/go-logger"
+	"github.com/anchore/grype/grype"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"sync"
+)
+
+// grypeLogs is the core of the logger installed once as the process-global logger of the grype library. The library
+// doesn't tell which scan it logs for, so its logs go to the logger of the scan while a single one runs, and otherwise
+// to the base logger set with SetGrypeBaseLogger, with the secrets of every running scan scrubbed.
+var grypeLogs = &grypeLogCore{router: &grypeLogRouter{}}
+
+var grypeLoggerOnce sync.Once
+
+// SetGrypeBaseLogger sets the logger the logs of the grype library go to while several scans run at once, the logger
+// of the worker or CLI the loggers of the runs are derived from. Those logs are dropped until it's set.
+func SetGrypeBaseLogger(l *zap.Logger) {
+	grypeLogs.router.setBase(l.With(zap.String("component", "grype")).Core())
+}
+
+// attachGrypeLogger routes the logs of the grype library to the task logger l until the returned function is called,
+// once the scan is done.
+func attachGrypeLogger(l *zap.Logger) func() {
+	grypeLoggerOnce.Do(func() {
+		grype.SetLogger(grypeLogger{sugar: zap.New(grypeLogs).Sugar()})
+	})
+	return grypeLogs.router.attach(l.With(zap.String("component", "grype")).Core())
+}
+
+// unwrapRedaction returns the core under the redacting cores core is made of, and their redactors.
+func unwrapRedaction(core zapcore.Core) (zapcore.Core, []redactor) {
+	var redactors []redactor
+	for {
+		rc, ok := core.(*redactingCore)
+		if !ok {
+			return core, redactors
+		}
+		redactors = append(redactors, rc.redactor)
+		core = rc.Core
+	}
+}
+
+// grypeLogRouter keeps the loggers of the scans running.
+type grypeLogRouter struct {
+	mu    sync.Mutex
+	base  zapcore.Core
+	scans []*grypeLogScan
+}
+
+type grypeLogScan struct {
+	core      zapcore.Core
+	redactors []redactor
+}
+
+func (r *grypeLogRouter) setBase(core zapcore.Core) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.base = core
+}
+
+func (r *grypeLogRouter) attach(core zapcore.Core) func() {
+	_, redactors := unwrapRedaction(core)
+	scan := &grypeLogScan{core: core, redactors: redactors}
+	r.mu.Lock()
+	r.scans = append(r.scans, scan)
+	r.mu.Unlock()
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for i, s := range r.scans {
+			if s == scan {
+				r.scans = append(r.scans[:i], r.scans[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// route returns the core to write an entry to, and the redactors to apply first when it's the base core.
+func (r *grypeLogRouter) route() (zapcore.Core, []redactor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.scans) == 1 {
+		return r.scans[0].core, nil
+	}
+	redactors := []redactor{newRedactor(nil)}
+	for _, s := range r.scans {
+		redactors = append(redactors, s.redactors...)
+	}
+	return r.base, redactors
+}
+
+// grypeLogCore is a zapcore.Core writing to the core the router routes each entry to.
+type grypeLogCore struct {
+	router *grypeLogRouter
+	fields []zapcore.Field
+}
+
+func (c *grypeLogCore) Enabled(level zapcore.Level) bool {
+	core, _ := c.router.route()
+	return core != nil && core.Enabled(level)
+}
+
+func (c *grypeLogCore) With(fields []zapcore.Field) zapcore.Core {
+	return &grypeLogCore{router: c.router, fields: append(append([]zapcore.Field(nil), c.fields...), fields...)}
+}
+
+func (c *grypeLogCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *grypeLogCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	core, redactors := c.router.route()
+	if core == nil {
+		return nil
+	}
+	fields = append(append([]zapcore.Field(nil), c.fields...), fields...)
+	for _, r := range redactors {
+		entry.Message = r.String(entry.Message)
+		for i, f := range fields {
+			fields[i] = r.Field(f)
+		}
+	}
+	return core.Write(entry, fields)
+}
+
+func (c *grypeLogCore) Sync() error {
+	core, _ := c.router.route()
+	if core == nil {
+		return nil
+	}
+	return core.Sync()
+}
+
+// grypeLogger adapts zap to the grype logger interface, trace logs going to debug.
+type grypeLogger struct {
+	sugar *zap.SugaredLogger
+}
+
+func (l grypeLogger) Errorf(format string, args ...interface{}) { l.sugar.Errorf(format, args...) }
+func (l grypeLogger) Error(args ...interface{})                 { l.sugar.Error(args...) }
+func (l grypeLogger) Warnf(format string, args ...interface{})  { l.sugar.Warnf(format, args...) }
+func (l grypeLogger) Warn(args ...interface{})                  { l.sugar.Warn(args...) }
+func (l grypeLogger) Infof(format string, args ...interface{})  { l.sugar.Infof(format, args...) }
+func (l grypeLogger) Info(args ...interface{})                  { l.sugar.Info(args...) }
+func (l grypeLogger) Debugf(format string, args ...interface{}) { l.sugar.Debugf(format, args...) }
+func (l grypeLogger) Debug(args ...interface{})                 { l.sugar.Debug(args...) }
+func (l grypeLogger) Tracef(format string, args ...interface{}) { l.sugar.Debugf(format, args...) }
+func (l grypeLogger) Trace(args ...interface{})                 { l.sugar.Debug(args...) }
+
+func (l grypeLogger) WithFields(fields ...interface{}) logger.MessageLogger {
+	return l.Nested(fields...)
+}
+
+func (l grypeLogger) Nested(fields ...interface{}) logger.Logger {
+	var kv []interface{}
+	for i := 0; i < len(fields); i++ {
+		switch f := fields[i].(type) {
+		case logger.Fields:
+			for k, v := range f {
+				kv = append(kv, k, v)
+			}
+		case map[string]interface{}:
+			for k, v := range f {
+				kv = append(kv, k, v)
+			}
+		default:
+			if i+1 < len(fields) {
+				kv = append(kv, fmt.Sprint(f), fields[i+1])
+				i++
+			}
+		}
+	}
+	return grypeLogger{sugar: l.sugar.With(kv...)}
+}
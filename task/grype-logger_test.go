@@ -0,0 +1,44 @@
+package task
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"strings"
+	"testing"
+)
+
+func TestGrypeLoggerRouting(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	base := zap.New(core)
+	SetGrypeBaseLogger(base)
+	run1 := RedactingLogger(base.With(zap.Uint("run_id", 1)), map[string][]string{"registry_password": {"run-1-password"}})
+	run2 := RedactingLogger(base.With(zap.Uint("run_id", 2)), map[string][]string{"registry_password": {"run-2-password"}})
+	grypeLog := zap.New(grypeLogs)
+
+	detach1 := attachGrypeLogger(run1)
+	grypeLog.Info("only run 1 with run-1-password")
+	detach2 := attachGrypeLogger(run2)
+	grypeLog.Info("both runs with run-1-password and run-2-password")
+	detach1()
+	grypeLog.Info("only run 2 with run-2-password")
+	detach2()
+
+	entries := logs.All()
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for i, expectedRun := range []interface{}{uint64(1), nil, uint64(2)} {
+		fields := entries[i].ContextMap()
+		if fields["run_id"] != expectedRun {
+			t.Errorf("entry %d: expected run_id %v, got %v", i, expectedRun, fields["run_id"])
+		}
+		if fields["component"] != "grype" {
+			t.Errorf("entry %d: expected the grype component, got %v", i, fields["component"])
+		}
+		if strings.Contains(entries[i].Message, "password") && !strings.Contains(entries[i].Message, RedactedValue) ||
+			strings.Contains(entries[i].Message, "run-1-password") || strings.Contains(entries[i].Message, "run-2-password") {
+			t.Errorf("entry %d leaks a secret: %s", i, entries[i].Message)
+		}
+	}
+}
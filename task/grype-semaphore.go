@@ -0,0 +1,51 @@
+package task
+
+import (
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"os"
+	"runtime"
+	"strconv"
+)
+
+// MaxGrypeProcesses caps the number of scans (in-process grype scans or trivy processes) running at once across the
+// whole worker, regardless of how message and batch concurrency are tuned. Defaults to the number of CPUs.
+var MaxGrypeProcesses = os.Getenv("MAX_GRYPE_PROCESSES")
+
+var grypeSemaphore = newProcessSemaphore(MaxGrypeProcesses)
+
+// processSemaphore is a counting semaphore bounding concurrent processes.
+type processSemaphore struct {
+	slots chan struct{}
+}
+
+func newProcessSemaphore(size string) *processSemaphore {
+	n, err := strconv.Atoi(size)
+	if err != nil || n < 1 {
+		n = runtime.NumCPU()
+	}
+	return &processSemaphore{slots: make(chan struct{}, n)}
+}
+
+// Acquire blocks until a slot is available or ctx is done, logging when the caller has to wait.
+func (s *processSemaphore) Acquire(ctx context.Context, logger *zap.Logger) error {
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	logger.Info("waiting for a free grype process slot", zap.Int("max", cap(s.slots)))
+	select {
+	case s.slots <- struct{}{}:
+		logger.Info("acquired grype process slot")
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot acquired with Acquire.
+func (s *processSemaphore) Release() {
+	<-s.slots
+}
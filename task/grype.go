@@ -0,0 +1,358 @@
+package task
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/anchore/grype/grype"
+	"github.com/anchore/grype/grype/db/v5/matcher"
+	"github.com/anchore/grype/grype/db/v5/matcher/golang"
+	"github.com/anchore/grype/grype/db/v5/matcher/java"
+	"github.com/anchore/grype/grype/db/v5/matcher/stock"
+	"github.com/anchore/grype/grype/match"
+	"github.com/anchore/grype/grype/pkg"
+	"github.com/anchore/grype/grype/presenter/cyclonedx"
+	"github.com/anchore/grype/grype/presenter/models"
+	"github.com/anchore/grype/grype/presenter/sarif"
+	"github.com/anchore/grype/grype/presenter/table"
+	"github.com/anchore/grype/grype/vex"
+	"github.com/anchore/syft/syft"
+	"github.com/anchore/syft/syft/cataloging"
+	syftPkg "github.com/anchore/syft/syft/pkg"
+	"github.com/anchore/syft/syft/source"
+	openvex "github.com/openvex/go-vex/pkg/vex"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// GrypeOutputFileName is the name of the file the grype report is written to when file output is enabled.
+const GrypeOutputFileName = "grype-output.json"
+
+// ignoreLinuxKernelHeaders are the rules grype applies by default so kernel header packages aren't matched against
+// the vulnerabilities of the kernel they're built from.
+var ignoreLinuxKernelHeaders = []match.IgnoreRule{
+	{Package: match.IgnoreRulePackage{Name: "kernel-headers", UpstreamName: "kernel", Type: string(syftPkg.RpmPkg)}, MatchType: match.ExactIndirectMatch},
+	{Package: match.IgnoreRulePackage{Name: "linux-.*-headers-.*", UpstreamName: "linux", Type: string(syftPkg.DebPkg)}, MatchType: match.ExactIndirectMatch},
+	{Package: match.IgnoreRulePackage{Name: "linux-libc-dev", UpstreamName: "linux", Type: string(syftPkg.DebPkg)}, MatchType: match.ExactIndirectMatch},
+}
+
+// ignoreVEXFixedNotAffected are the rules grype applies with VEX documents, suppressing the matches of the
+// statements saying the image isn't affected or has the vulnerability fixed.
+var ignoreVEXFixedNotAffected = []match.IgnoreRule{
+	{VexStatus: string(openvex.StatusNotAffected)},
+	{VexStatus: string(openvex.StatusFixed)},
+}
+
+// runGrype scans the target of req, an image archive or a grype source such as sbom:<path>, in-process with the grype
+// library against the installed vulnerability database. When req.ToFile is set the report is also written to a file
+// in req.RunDir, leaving the raw output on disk. Cancelling ctx kills the cataloging of the target and stops the scan
+// at its next step, runGrype only returning once it stopped so that its grype slot is free and its files can be
+// removed.
+func runGrype(ctx context.Context, logger *zap.Logger, req ScanRequest) (GrypeOutput, error) {
+	if err := grypeSemaphore.Acquire(ctx, logger); err != nil {
+		return GrypeOutput{}, err
+	}
+	defer grypeSemaphore.Release()
+	defer attachGrypeLogger(logger)()
+
+	output, err := scanWithGrype(ctx, logger, req)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return GrypeOutput{}, fmt.Errorf("grype scan of %s cancelled: %w", req.Target, ctxErr)
+	}
+	return output, err
+}
+
+func scanWithGrype(ctx context.Context, logger *zap.Logger, req ScanRequest) (GrypeOutput, error) {
+	var grypeOutput GrypeOutput
+
+	store, status, err := loadGrypeDB(logger)
+	if err != nil {
+		return grypeOutput, err
+	}
+	defer store.Close()
+	if err := ctx.Err(); err != nil {
+		return grypeOutput, err
+	}
+
+	packages, pkgContext, sbom, err := catalogPackages(ctx, req.Target, req.RunDir, grypeProviderConfig())
+	if err != nil {
+		return grypeOutput, fmt.Errorf("failed to catalog %s: %w", req.Target, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return grypeOutput, err
+	}
+
+	vulnMatcher := grype.VulnerabilityMatcher{
+		Store:       *store,
+		IgnoreRules: append(append([]match.IgnoreRule(nil), ignoreLinuxKernelHeaders...), req.IgnoreRules...),
+		Matchers:    grypeMatchers(),
+	}
+	if len(req.VEXDocuments) > 0 {
+		// Statements name the image the way it's known in registries, which an image archive doesn't record
+		if metadata, ok := pkgContext.Source.Metadata.(source.ImageMetadata); ok {
+			metadata.RepoDigests = append(metadata.RepoDigests, req.ProductIdentifiers...)
+			pkgContext.Source.Metadata = metadata
+			vulnMatcher.IgnoreRules = append(vulnMatcher.IgnoreRules, ignoreVEXFixedNotAffected...)
+			vulnMatcher.VexProcessor = vex.NewProcessor(vex.ProcessorOptions{
+				Documents:   req.VEXDocuments,
+				IgnoreRules: vulnMatcher.IgnoreRules,
+			})
+		} else {
+			logger.Warn("vex documents are only applied to image scans, ignoring them", zap.String("target", req.Target))
+		}
+	}
+	matches, ignoredMatches, err := vulnMatcher.FindMatches(packages, pkgContext)
+	if err != nil {
+		return grypeOutput, fmt.Errorf("failed to match vulnerabilities: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return grypeOutput, err
+	}
+
+	doc, err := models.NewDocument(grypeID(), packages, pkgContext, *matches, ignoredMatches, store, nil, status)
+	if err != nil {
+		return grypeOutput, fmt.Errorf("failed to build grype report: %w", err)
+	}
+	logger.Info("grype scan done", zap.String("target", req.Target), zap.Int("packages", len(packages)),
+		zap.Int("matches", len(doc.Matches)), zap.Int("ignoredMatches", len(doc.IgnoredMatches)))
+
+	if req.ToFile {
+		outputPath := filepath.Join(req.RunDir, GrypeOutputFileName)
+		if err := writeGrypeReport(outputPath, doc); err != nil {
+			return grypeOutput, err
+		}
+		logger.Info("grype report written", zap.String("file", outputPath))
+	}
+
+	grypeOutput, err = grypeOutputFromDocument(doc)
+	if err != nil {
+		return grypeOutput, err
+	}
+	if req.ReportFormat != ScanOutputJSON {
+		grypeOutput.Report, err = renderGrypeReport(req.ReportFormat, models.PresenterConfig{
+			ID:               grypeID(),
+			Matches:          *matches,
+			IgnoredMatches:   ignoredMatches,
+			Packages:         packages,
+			Context:          pkgContext,
+			MetadataProvider: store,
+			SBOM:             sbom,
+			DBStatus:         status,
+		})
+		if err != nil {
+			return grypeOutput, err
+		}
+	}
+	if req.SBOMFormat != "" && sbom != nil {
+		payload, err := encodeSBOM(*sbom, req.SBOMFormat)
+		if err != nil {
+			return grypeOutput, err
+		}
+		grypeOutput.SBOM = &GeneratedSBOM{Format: req.SBOMFormat, Payload: payload, PackageCount: len(packages)}
+	}
+	dbStatus := grypeDBStatus(*status)
+	grypeOutput.DBStatus = &dbStatus
+	grypeOutput.Warnings = grypeWarnings(packages, pkgContext)
+	packageCount := len(packages)
+	grypeOutput.PackageCount = &packageCount
+	return grypeOutput, nil
+}
+
+// grypeProviderConfig is how grype catalogs packages by default, dropping packages without version which can't be
+// matched anyway.
+func grypeProviderConfig() pkg.ProviderConfig {
+	cfg := syft.DefaultCreateSBOMConfig()
+	cfg.Compliance.MissingVersion = cataloging.ComplianceActionDrop
+	return pkg.ProviderConfig{
+		SyftProviderConfig: pkg.SyftProviderConfig{
+			SBOMOptions: cfg,
+		},
+	}
+}
+
+// grypeMatchers are the matchers with the grype defaults: CPEs are only used for packages without ecosystem
+// specific data, and for the go standard library.
+func grypeMatchers() []matcher.Matcher {
+	return matcher.NewDefaultMatchers(matcher.Config{
+		Java:   java.MatcherConfig{UseCPEs: false},
+		Golang: golang.MatcherConfig{AlwaysUseCPEForStdlib: true},
+		Stock:  stock.MatcherConfig{UseCPEs: true},
+	})
+}
+
+// grypeWarnings returns the warnings about the scan of packages, such as OS packages found without the distribution
+// they belong to, whose vulnerabilities are then missed.
+func grypeWarnings(packages []pkg.Package, pkgContext pkg.Context) []string {
+	if pkgContext.Distro != nil {
+		return nil
+	}
+	for _, p := range packages {
+		switch p.Type {
+		case syftPkg.AlpmPkg, syftPkg.DebPkg, syftPkg.RpmPkg, syftPkg.KbPkg:
+			return []string{"Unable to determine the OS distribution. This may result in missing vulnerabilities."}
+		}
+	}
+	return nil
+}
+
+func writeGrypeReport(path string, doc models.Document) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create grype output file: %w", err)
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(doc); err != nil {
+		return fmt.Errorf("failed to write grype output file: %w", err)
+	}
+	return nil
+}
+
+// renderGrypeReport renders the scan in a scan output format other than json with the grype presenters.
+func renderGrypeReport(format string, cfg models.PresenterConfig) (*ScanReport, error) {
+	var presenter interface {
+		Present(io.Writer) error
+	}
+	switch format {
+	case ScanOutputSARIF:
+		presenter = sarif.NewPresenter(cfg)
+	case ScanOutputCycloneDXJSON:
+		presenter = cyclonedx.NewJSONPresenter(cfg)
+	case ScanOutputTable:
+		presenter = table.NewPresenter(cfg, false)
+	default:
+		return nil, fmt.Errorf("unsupported scan output format %q", format)
+	}
+	var buf bytes.Buffer
+	if err := presenter.Present(&buf); err != nil {
+		return nil, fmt.Errorf("failed to render %s report: %w", format, err)
+	}
+	return &ScanReport{Format: format, Payload: buf.String()}, nil
+}
+
+// grypeOutputFromDocument converts the grype report. Artifacts are kept as JSON objects, their form for trivy
+// findings and for matches read back from the index.
+func grypeOutputFromDocument(doc models.Document) (GrypeOutput, error) {
+	output := GrypeOutput{
+		Distro: GrypeDistro{
+			Name:    doc.Distro.Name,
+			Version: doc.Distro.Version,
+			IDLike:  doc.Distro.IDLike,
+		},
+	}
+	if doc.Source != nil {
+		output.Source = GrypeSource{Type: doc.Source.Type, Target: doc.Source.Target}
+	}
+	for _, m := range doc.Matches {
+		converted, err := convertGrypeMatch(m)
+		if err != nil {
+			return output, err
+		}
+		output.Matches = append(output.Matches, converted)
+	}
+	for _, m := range doc.IgnoredMatches {
+		converted, err := convertGrypeMatch(m.Match)
+		if err != nil {
+			return output, err
+		}
+		ignored := IgnoredMatch{VulnerabilityMatch: converted}
+		for _, r := range m.AppliedIgnoreRules {
+			rule := IgnoreRule{
+				Vulnerability:    r.Vulnerability,
+				Reason:           r.Reason,
+				FixState:         r.FixState,
+				VexStatus:        r.VexStatus,
+				VexJustification: r.VexJustification,
+				MatchType:        r.MatchType,
+			}
+			if r.Package != nil {
+				rule.Package = &IgnoreRulePackage{
+					Name:         r.Package.Name,
+					Version:      r.Package.Version,
+					Type:         r.Package.Type,
+					Location:     r.Package.Location,
+					UpstreamName: r.Package.UpstreamName,
+				}
+			}
+			ignored.AppliedIgnoreRules = append(ignored.AppliedIgnoreRules, rule)
+		}
+		output.IgnoredMatches = append(output.IgnoredMatches, ignored)
+	}
+	return output, nil
+}
+
+func convertGrypeMatch(m models.Match) (VulnerabilityMatch, error) {
+	artifact, err := json.Marshal(m.Artifact)
+	if err != nil {
+		return VulnerabilityMatch{}, fmt.Errorf("failed to convert grype artifact: %w", err)
+	}
+	converted := VulnerabilityMatch{
+		Vulnerability: convertGrypeVulnerability(m.Vulnerability.VulnerabilityMetadata),
+	}
+	if err := json.Unmarshal(artifact, &converted.Artifact); err != nil {
+		return VulnerabilityMatch{}, fmt.Errorf("failed to convert grype artifact: %w", err)
+	}
+	converted.Vulnerability.Fix = VulnerabilityFix{
+		Versions: m.Vulnerability.Fix.Versions,
+		State:    m.Vulnerability.Fix.State,
+	}
+	converted.Vulnerability.Advisories = m.Vulnerability.Advisories
+	for _, related := range m.RelatedVulnerabilities {
+		converted.RelatedVulnerabilities = append(converted.RelatedVulnerabilities, convertGrypeVulnerability(related))
+	}
+	for _, d := range m.MatchDetails {
+		converted.MatchDetails = append(converted.MatchDetails, MatchDetail{
+			Type:       d.Type,
+			Matcher:    d.Matcher,
+			SearchedBy: d.SearchedBy,
+			Found:      d.Found,
+		})
+	}
+	return converted, nil
+}
+
+func convertGrypeVulnerability(v models.VulnerabilityMetadata) Vulnerability {
+	converted := Vulnerability{
+		ID:          v.ID,
+		DataSource:  v.DataSource,
+		Namespace:   v.Namespace,
+		Severity:    v.Severity,
+		URLs:        v.URLs,
+		Description: v.Description,
+	}
+	for _, c := range v.Cvss {
+		converted.CVSs = append(converted.CVSs, VulnerabilityCVS{
+			Source:  c.Source,
+			Type:    c.Type,
+			Version: c.Version,
+			Vector:  c.Vector,
+			Metrics: VulnerabilityCVSMetrics{
+				BaseScore:           c.Metrics.BaseScore,
+				ExploitabilityScore: c.Metrics.ExploitabilityScore,
+				ImpactScore:         c.Metrics.ImpactScore,
+			},
+			VendorMetadata: stringMap(c.VendorMetadata),
+		})
+	}
+	return converted
+}
+
+// stringMap returns the string values of a JSON object, nil when v isn't one.
+func stringMap(v interface{}) map[string]string {
+	switch m := v.(type) {
+	case map[string]string:
+		return m
+	case map[string]interface{}:
+		result := make(map[string]string, len(m))
+		for k, value := range m {
+			if s, ok := value.(string); ok {
+				result[k] = s
+			}
+		}
+		return result
+	default:
+		return nil
+	}
+}
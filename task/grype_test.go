@@ -0,0 +1,57 @@
+package task
+
+import (
+	"encoding/json"
+	"github.com/anchore/grype/grype/presenter/models"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestGrypeOutputDistroAndSource(t *testing.T) {
+	report, err := os.ReadFile("testdata/grype-report-distro.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc models.Document
+	if err := json.Unmarshal(report, &doc); err != nil {
+		t.Fatal(err)
+	}
+	fromDocument, err := grypeOutputFromDocument(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reports read back from files and the index are decoded as is
+	var decoded GrypeOutput
+	if err := json.Unmarshal(report, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, output := range map[string]GrypeOutput{"document": fromDocument, "decoded": decoded} {
+		expectedDistro := GrypeDistro{Name: "alpine", Version: "3.19.1", IDLike: []string{"busybox"}}
+		if !reflect.DeepEqual(output.Distro, expectedDistro) {
+			t.Errorf("%s: expected distro %+v, got %+v", name, expectedDistro, output.Distro)
+		}
+		if output.Source.Type != "image" {
+			t.Errorf("%s: expected source type image, got %q", name, output.Source.Type)
+		}
+		target, err := json.Marshal(output.Source.Target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var image struct {
+			UserInput      string `json:"userInput"`
+			ManifestDigest string `json:"manifestDigest"`
+		}
+		if err := json.Unmarshal(target, &image); err != nil {
+			t.Fatalf("%s: source target isn't an image: %s", name, target)
+		}
+		if image.UserInput != "docker.io/library/alpine:3.19" ||
+			image.ManifestDigest != "sha256:6457d53fb065d6f250e1504b9bc42d5b6c65941d57532c072d929dd0628977d0" {
+			t.Errorf("%s: unexpected source target %s", name, target)
+		}
+		if len(output.Matches) != 1 || output.Matches[0].Vulnerability.ID != "CVE-2024-5535" {
+			t.Errorf("%s: expected the CVE-2024-5535 match, got %+v", name, output.Matches)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/opengovern/og-util/pkg/opengovernance-es-sdk"
+	"github.com/opengovern/og-util/pkg/tasks"
+	"github.com/opengovern/opencomply/services/tasks/scheduler"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// HelmPath is the helm binary rendering the charts of scan-helm-chart, helm on the PATH by default.
+var HelmPath = os.Getenv("HELM_PATH")
+
+// DefaultHelmReleaseName is the release name charts are rendered with (helm_release_name).
+const DefaultHelmReleaseName = "scan"
+
+// maxHelmReleaseNameLength is the longest release name helm accepts, leaving room for the suffixes charts add.
+const maxHelmReleaseNameLength = 53
+
+// dns1123LabelPattern matches the DNS-1123 labels namespaces are, dns1123SubdomainPattern the DNS-1123 subdomains
+// helm requires release names to be.
+var (
+	dns1123LabelPattern     = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	dns1123SubdomainPattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+)
+
+// helmChart is a chart of scan-helm-chart, as given and as pulled.
+type helmChart struct {
+	// Reference is the chart as given in helm_chart: an oci:// reference, a chart of the helm_repo_url repository, a
+	// chart archive URL or a local chart path.
+	Reference string
+	RepoURL   string
+	Version   string
+	// Path is the chart pulled, or the local chart, and Metadata its Chart.yaml.
+	Path     string
+	Metadata helmChartMetadata
+}
+
+type helmChartMetadata struct {
+	Name       string `yaml:"name"`
+	Version    string `yaml:"version"`
+	AppVersion string `yaml:"appVersion"`
+}
+
+// manifestName is the name of the chart in the artifact_source_manifest of its images, name-version as helm names
+// chart packages.
+func (c helmChart) manifestName() string {
+	return c.Metadata.Name + "-" + c.Metadata.Version
+}
+
+// HelmChartScanResult is the result of a scan-helm-chart run, the ScanRunResult of all the images of the charts along
+// with the summary of each chart.
+type HelmChartScanResult struct {
+	ScanRunResult
+	Charts []HelmChartScanSummary `json:"charts"`
+}
+
+// HelmChartScanSummary sums up the scans of the images a chart renders, keyed by its name and version.
+type HelmChartScanSummary struct {
+	Chart          string         `json:"chart"`
+	Version        string         `json:"version"`
+	AppVersion     string         `json:"appVersion,omitempty"`
+	Reference      string         `json:"reference"`
+	Images         []string       `json:"images"`
+	ScannedImages  int            `json:"scannedImages"`
+	FailedImages   int            `json:"failedImages"`
+	TotalMatches   int            `json:"totalMatches"`
+	SeverityCounts map[string]int `json:"severityCounts"`
+	FixableCount   int            `json:"fixableCount"`
+	KnownExploited int            `json:"knownExploited"`
+}
+
+// runScanHelmChartTask renders the charts of helm_chart with helm template, with the values of helm_values (inline
+// YAML, by position), and scans the images of the rendered manifests as scan-manifest does, summing the results up
+// per chart. helm_repo_url and helm_chart_version (by position) select charts of a repository, OCI charts are pulled
+// with the registry credentials of the task.
+func runScanHelmChartTask(ctx context.Context, esClient opengovernance.Client, logger *zap.Logger, request tasks.TaskRequest, response *scheduler.TaskResponse, publish ProgressPublisher, publishFindings FindingsPublisher) error {
+	params := request.TaskDefinition.Params
+	refs := params["helm_chart"]
+	if len(refs) == 0 {
+		return newTaskError(ErrorKindConfig, fmt.Errorf("helm_chart parameter is not provided"))
+	}
+
+	release := getParamValue(params, "helm_release_name", DefaultHelmReleaseName)
+	if err := validateHelmReleaseName(release); err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+	namespace := getParamValue(params, "helm_namespace", "default")
+	if err := validateHelmNamespace(namespace); err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+	for _, ref := range refs {
+		if err := validateHelmChartReference(ref); err != nil {
+			return newTaskError(ErrorKindConfig, err)
+		}
+	}
+
+	dir, err := os.MkdirTemp(WorkDirRoot, "helm-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	env, cleanup, err := helmEnv(ctx, dir, params, refs)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	charts := make([]helmChart, len(refs))
+	var manifests, names []string
+	for i, ref := range refs {
+		chart := helmChart{
+			Reference: ref,
+			RepoURL:   paramAt(params, "helm_repo_url", i, ""),
+			Version:   paramAt(params, "helm_chart_version", i, ""),
+		}
+		if err := pullHelmChart(ctx, env, filepath.Join(dir, fmt.Sprintf("chart-%d", i)), &chart); err != nil {
+			return newTaskError(ErrorKindPull, err)
+		}
+		valuesPath := ""
+		if values := paramAt(params, "helm_values", i, ""); values != "" {
+			valuesPath = filepath.Join(dir, fmt.Sprintf("values-%d.yaml", i))
+			if err := os.WriteFile(valuesPath, []byte(values), 0600); err != nil {
+				return err
+			}
+		}
+		rendered, err := renderHelmChart(ctx, env, chart, release, namespace, valuesPath)
+		if err != nil {
+			return newTaskError(ErrorKindConfig, err)
+		}
+		logger.Info("Rendered helm chart", zap.String("chart", ref), zap.String("name", chart.Metadata.Name),
+			zap.String("version", chart.Metadata.Version))
+		charts[i] = chart
+		manifests = append(manifests, rendered)
+		names = append(names, chart.manifestName())
+	}
+
+	manifestParams := copyParams(params)
+	manifestParams["manifest"] = manifests
+	manifestParams["manifest_name"] = names
+	scanParams, err := manifestScanParams(ctx, logger, manifestParams)
+	if err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+	delete(scanParams, "manifest")
+	delete(scanParams, "helm_values")
+	if len(scanParams["oci_artifact_url"]) == 0 {
+		response.Result = []byte("No images found in the charts")
+		return nil
+	}
+
+	scanRequest := request
+	scanRequest.TaskDefinition.Params = scanParams
+	scanErr := runScanTask(ctx, esClient, logger, scanRequest, response, publish, publishFindings)
+	if result, ok := helmChartScanResult(response.Result, charts, scanParams["artifact_source_manifest"]); ok {
+		response.Result = result
+	}
+	return scanErr
+}
+
+// validateHelmReleaseName checks that helm_release_name is a release name helm accepts. Being a DNS-1123 subdomain,
+// it can't be taken for a flag of the helm commands either.
+func validateHelmReleaseName(release string) error {
+	if len(release) > maxHelmReleaseNameLength || !dns1123SubdomainPattern.MatchString(release) {
+		return fmt.Errorf("invalid helm_release_name %q: expected a lowercase DNS-1123 name of at most %d characters",
+			release, maxHelmReleaseNameLength)
+	}
+	return nil
+}
+
+// validateHelmNamespace checks that helm_namespace is a Kubernetes namespace name, a DNS-1123 label.
+func validateHelmNamespace(namespace string) error {
+	if len(namespace) > 63 || !dns1123LabelPattern.MatchString(namespace) {
+		return fmt.Errorf("invalid helm_namespace %q: expected a lowercase DNS-1123 label of at most 63 characters", namespace)
+	}
+	return nil
+}
+
+// validateHelmChartReference rejects the helm_chart values helm would parse as flags.
+func validateHelmChartReference(ref string) error {
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return fmt.Errorf("invalid helm_chart %q: expected a chart reference, URL or path", ref)
+	}
+	return nil
+}
+
+// helmEnv returns the environment of the helm commands, keeping their cache, config and data in dir, and the registry
+// credentials of the task for OCI charts, in a secret file cleanup removes.
+func helmEnv(ctx context.Context, dir string, params map[string][]string, refs []string) ([]string, func(), error) {
+	env := append(os.Environ(),
+		"HELM_CACHE_HOME="+filepath.Join(dir, "cache"),
+		"HELM_CONFIG_HOME="+filepath.Join(dir, "config"),
+		"HELM_DATA_HOME="+filepath.Join(dir, "data"),
+	)
+
+	registryType := getParamValue(params, "registry_type", string(RegistryGHCR))
+	needsAuth := false
+	for _, ref := range refs {
+		needsAuth = needsAuth || strings.HasPrefix(ref, "oci://")
+	}
+	if !needsAuth || RegistryType(registryType) == RegistryPublic {
+		return env, func() {}, nil
+	}
+	creds := getCredsFromParams(params)
+	if err := creds.ValidateFor(registryType); err != nil {
+		return nil, nil, newTaskError(ErrorKindConfig, err)
+	}
+	auths, err := getRegistryAuths(ctx, registryType, creds)
+	if err != nil {
+		return nil, nil, newTaskError(ErrorKindAuth, err)
+	}
+	configJson, err := json.Marshal(DockerConfig{Auths: auths})
+	if err != nil {
+		return nil, nil, err
+	}
+	registryConfig, err := writeSecretFile("helm-registry-*.json", configJson)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(env, "HELM_REGISTRY_CONFIG="+registryConfig), func() { os.Remove(registryConfig) }, nil
+}
+
+// pullHelmChart pulls the chart into dir, unless it's a local chart, and reads its Chart.yaml.
+func pullHelmChart(ctx context.Context, env []string, dir string, chart *helmChart) error {
+	chart.Path = chart.Reference
+	if filepath.IsAbs(chart.Reference) {
+		if chart.RepoURL != "" || chart.Version != "" {
+			return fmt.Errorf("chart %s: helm_repo_url and helm_chart_version don't apply to local charts", chart.Reference)
+		}
+	} else {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		// Flags take their values inline and positional arguments follow --, so no param is parsed as a flag
+		args := []string{"pull", "--destination=" + dir}
+		if chart.RepoURL != "" {
+			args = append(args, "--repo="+chart.RepoURL)
+		}
+		if chart.Version != "" {
+			args = append(args, "--version="+chart.Version)
+		}
+		args = append(args, "--", chart.Reference)
+		if _, err := runHelm(ctx, env, args...); err != nil {
+			return fmt.Errorf("failed to pull chart %s: %w", chart.Reference, err)
+		}
+		pulled, err := filepath.Glob(filepath.Join(dir, "*.tgz"))
+		if err != nil {
+			return err
+		}
+		if len(pulled) != 1 {
+			return fmt.Errorf("failed to pull chart %s: expected one chart archive, found %d", chart.Reference, len(pulled))
+		}
+		chart.Path = pulled[0]
+	}
+
+	output, err := runHelm(ctx, env, "show", "chart", "--", chart.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read chart %s: %w", chart.Reference, err)
+	}
+	if err := yaml.Unmarshal(output, &chart.Metadata); err != nil {
+		return fmt.Errorf("failed to parse the Chart.yaml of %s: %w", chart.Reference, err)
+	}
+	if chart.Metadata.Name == "" {
+		return fmt.Errorf("chart %s has no name", chart.Reference)
+	}
+	return nil
+}
+
+// renderHelmChart renders the manifests of the pulled chart with helm template.
+func renderHelmChart(ctx context.Context, env []string, chart helmChart, release, namespace, valuesPath string) (string, error) {
+	args := []string{"template", "--namespace=" + namespace}
+	if valuesPath != "" {
+		args = append(args, "--values="+valuesPath)
+	}
+	args = append(args, "--", release, chart.Path)
+	output, err := runHelm(ctx, env, args...)
+	if err != nil {
+		return "", fmt.Errorf("failed to render chart %s: %w", chart.Reference, err)
+	}
+	return string(output), nil
+}
+
+// runHelm runs HelmPath with args, returning its output, or its stderr in the error.
+func runHelm(ctx context.Context, env []string, args ...string) ([]byte, error) {
+	helm := HelmPath
+	if helm == "" {
+		helm = "helm"
+	}
+	cmd := exec.CommandContext(ctx, helm, args...)
+	cmd.Env = env
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, truncateForLog([]byte(msg)))
+		}
+		return nil, err
+	}
+	return output, nil
+}
+
+// helmChartScanResult returns the HelmChartScanResult of the ScanRunResult of the images of the charts, sources being
+// the comma separated manifest names (artifact_source_manifest) of each image scanned. Other results, e.g. of a
+// breached severity gate, aren't.
+func helmChartScanResult(runResult []byte, charts []helmChart, sources []string) ([]byte, bool) {
+	var result HelmChartScanResult
+	if err := json.Unmarshal(runResult, &result.ScanRunResult); err != nil || len(result.Statuses) != len(sources) {
+		return nil, false
+	}
+	images := make(map[string]ImageScanSummary, len(result.Images))
+	for _, image := range result.Images {
+		images[image.ImageURL] = image
+	}
+
+	summaries := make([]HelmChartScanSummary, len(charts))
+	byName := make(map[string][]int, len(charts))
+	for i, chart := range charts {
+		summaries[i] = HelmChartScanSummary{
+			Chart:          chart.Metadata.Name,
+			Version:        chart.Metadata.Version,
+			AppVersion:     chart.Metadata.AppVersion,
+			Reference:      chart.Reference,
+			Images:         []string{},
+			SeverityCounts: map[string]int{},
+		}
+		byName[chart.manifestName()] = append(byName[chart.manifestName()], i)
+	}
+	for pos, status := range result.Statuses {
+		image, scanned := images[status.ImageURL]
+		for _, name := range strings.Split(sources[pos], ",") {
+			for _, i := range byName[name] {
+				summary := &summaries[i]
+				summary.Images = append(summary.Images, status.ImageURL)
+				switch status.Status {
+				case ImageStatusSucceeded:
+					summary.ScannedImages++
+				case ImageStatusFailed:
+					summary.FailedImages++
+				}
+				if !scanned {
+					continue
+				}
+				summary.TotalMatches += image.TotalMatches
+				summary.FixableCount += image.FixableCount
+				summary.KnownExploited += image.KnownExploited
+				for severity, count := range image.SeverityCounts {
+					summary.SeverityCounts[severity] += count
+				}
+			}
+		}
+	}
+	result.Charts = summaries
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
@@ -0,0 +1,97 @@
+package task
+
+import (
+	"golang.org/x/net/context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateHelmParams(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		validate func(string) error
+		value    string
+		valid    bool
+	}{
+		{name: "release name", validate: validateHelmReleaseName, value: "my-release", valid: true},
+		{name: "dotted release name", validate: validateHelmReleaseName, value: "team.my-release", valid: true},
+		{name: "release name of 53 characters", validate: validateHelmReleaseName, value: strings.Repeat("a", 53), valid: true},
+		{name: "release name of 54 characters", validate: validateHelmReleaseName, value: strings.Repeat("a", 54)},
+		{name: "release name flag", validate: validateHelmReleaseName, value: "--post-renderer=/bin/sh"},
+		{name: "release name leading dash", validate: validateHelmReleaseName, value: "-release"},
+		{name: "release name uppercase", validate: validateHelmReleaseName, value: "Release"},
+		{name: "release name with spaces", validate: validateHelmReleaseName, value: "my release"},
+		{name: "empty release name", validate: validateHelmReleaseName, value: ""},
+		{name: "namespace", validate: validateHelmNamespace, value: "kube-system", valid: true},
+		{name: "namespace of 64 characters", validate: validateHelmNamespace, value: strings.Repeat("n", 64)},
+		{name: "dotted namespace", validate: validateHelmNamespace, value: "team.prod"},
+		{name: "namespace flag", validate: validateHelmNamespace, value: "--kubeconfig=/etc/passwd"},
+		{name: "oci chart", validate: validateHelmChartReference, value: "oci://ghcr.io/org/charts/app", valid: true},
+		{name: "repository chart", validate: validateHelmChartReference, value: "nginx", valid: true},
+		{name: "local chart", validate: validateHelmChartReference, value: "/charts/app", valid: true},
+		{name: "chart flag", validate: validateHelmChartReference, value: "--post-renderer=/bin/sh"},
+		{name: "empty chart", validate: validateHelmChartReference, value: ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.validate(tc.value); (err == nil) != tc.valid {
+				t.Errorf("expected %q valid %t, got %v", tc.value, tc.valid, err)
+			}
+		})
+	}
+}
+
+// fakeHelm installs a helm recording its arguments, one per line and a blank line per command, to the returned file.
+func fakeHelm(t *testing.T) string {
+	dir := t.TempDir()
+	argsPath := filepath.Join(dir, "args")
+	script := `#!/bin/sh
+printf '%s\n' "$@" >> "` + argsPath + `"
+echo >> "` + argsPath + `"
+case "$1" in
+pull) touch "${2#--destination=}/app-1.0.0.tgz" ;;
+show) printf 'name: app\nversion: 1.0.0\n' ;;
+esac
+`
+	helm := filepath.Join(dir, "helm")
+	if err := os.WriteFile(helm, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	previous := HelmPath
+	t.Cleanup(func() { HelmPath = previous })
+	HelmPath = helm
+	return argsPath
+}
+
+func TestHelmCommandsSeparatePositionalArguments(t *testing.T) {
+	argsPath := fakeHelm(t)
+
+	dir := filepath.Join(t.TempDir(), "chart-0")
+	chart := helmChart{Reference: "app", RepoURL: "https://charts.example.com", Version: "1.0.0"}
+	if err := pullHelmChart(context.Background(), os.Environ(), dir, &chart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := renderHelmChart(context.Background(), os.Environ(), chart, "my-release", "default", "/values.yaml"); err != nil {
+		t.Fatal(err)
+	}
+
+	recorded, err := os.ReadFile(argsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commands [][]string
+	for _, command := range strings.Split(strings.TrimSuffix(string(recorded), "\n\n"), "\n\n") {
+		commands = append(commands, strings.Split(command, "\n"))
+	}
+	chartPath := filepath.Join(dir, "app-1.0.0.tgz")
+	expected := [][]string{
+		{"pull", "--destination=" + dir, "--repo=https://charts.example.com", "--version=1.0.0", "--", "app"},
+		{"show", "chart", "--", chartPath},
+		{"template", "--namespace=default", "--values=/values.yaml", "--", "my-release", chartPath},
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected helm commands %q, got %q", expected, commands)
+	}
+}
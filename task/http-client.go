@@ -0,0 +1,54 @@
+package task
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// Outbound proxy configuration applied to every HTTP client used by the task (registry pulls, token exchanges,
+// cloud SDKs and downloads). Credentials are sent as Proxy-Authorization, including on CONNECT for https targets.
+var (
+	ProxyURL      = os.Getenv("OUTBOUND_PROXY_URL")
+	ProxyUsername = os.Getenv("OUTBOUND_PROXY_USERNAME")
+	ProxyPassword = os.Getenv("OUTBOUND_PROXY_PASSWORD")
+)
+
+var (
+	outboundClientOnce sync.Once
+	outboundClient     *http.Client
+	outboundClientErr  error
+)
+
+// outboundHTTPClient returns the shared HTTP client for outbound requests, going through the configured proxy.
+func outboundHTTPClient() (*http.Client, error) {
+	outboundClientOnce.Do(func() {
+		outboundClient, outboundClientErr = newOutboundHTTPClient(ProxyURL, ProxyUsername, ProxyPassword)
+	})
+	return outboundClient, outboundClientErr
+}
+
+func newOutboundHTTPClient(proxyURL, username, password string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if proxyURL == "" {
+		return &http.Client{Transport: transport}, nil
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid outbound proxy url %q", proxyURL)
+	}
+	if username != "" {
+		// Userinfo covers plain http requests, ProxyConnectHeader the CONNECT tunnel for https
+		u.User = url.UserPassword(username, password)
+		transport.ProxyConnectHeader = http.Header{
+			"Proxy-Authorization": []string{"Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))},
+		}
+	}
+	transport.Proxy = http.ProxyURL(u)
+
+	return &http.Client{Transport: transport}, nil
+}
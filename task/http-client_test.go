@@ -0,0 +1,100 @@
+package task
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// connectProxy is an https proxy tunnelling CONNECT requests, recording their Proxy-Authorization headers.
+type connectProxy struct {
+	mu    sync.Mutex
+	auths []string
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "expected CONNECT", http.StatusMethodNotAllowed)
+		return
+	}
+	p.mu.Lock()
+	p.auths = append(p.auths, r.Header.Get("Proxy-Authorization"))
+	p.mu.Unlock()
+
+	upstream, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func TestOutboundProxyConnectAuthorization(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("proxy-user:proxy-p@ss"))
+	for _, tc := range []struct {
+		name               string
+		url                func(proxyAddr string) string
+		username, password string
+	}{
+		{
+			name: "credentials in the proxy url",
+			url:  func(proxyAddr string) string { return "http://proxy-user:proxy-p%40ss@" + proxyAddr },
+		},
+		{
+			name:     "proxy username and password",
+			url:      func(proxyAddr string) string { return "http://" + proxyAddr },
+			username: "proxy-user",
+			password: "proxy-p@ss",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			proxy := &connectProxy{}
+			proxyServer := httptest.NewServer(proxy)
+			defer proxyServer.Close()
+
+			client, err := newOutboundHTTPClient(tc.url(strings.TrimPrefix(proxyServer.URL, "http://")), tc.username, tc.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.Transport.(*http.Transport).TLSClientConfig = target.Client().Transport.(*http.Transport).TLSClientConfig
+			resp, err := client.Get(target.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "ok" {
+				t.Errorf("expected the response of the target, got %q", body)
+			}
+
+			proxy.mu.Lock()
+			defer proxy.mu.Unlock()
+			if len(proxy.auths) != 1 {
+				t.Fatalf("expected 1 CONNECT request, got %d", len(proxy.auths))
+			}
+			if proxy.auths[0] != expected {
+				t.Errorf("expected Proxy-Authorization %q on CONNECT, got %q", expected, proxy.auths[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package task
+
+import (
+	"fmt"
+	"github.com/anchore/grype/grype/match"
+	"gopkg.in/yaml.v2"
+	"strings"
+)
+
+// parseGrypeIgnoreRules parses grype_ignore_rules, a YAML or JSON list of grype ignore rules, or a .grype.yaml
+// document with an ignore list. Besides the rule objects of grype (vulnerability, fix-state, package with name,
+// version, type, location, ...) strings are accepted as shorthands: paths (starting with /, possibly globs) ignore
+// the packages found there, anything else is a vulnerability id such as CVE-2024-1234.
+func parseGrypeIgnoreRules(value string) ([]match.IgnoreRule, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	// YAML is a superset of JSON, so this reads both
+	var raw interface{}
+	if err := yaml.Unmarshal([]byte(value), &raw); err != nil {
+		return nil, fmt.Errorf("invalid grype_ignore_rules: %w", err)
+	}
+	if doc, ok := raw.(map[interface{}]interface{}); ok {
+		raw = doc["ignore"]
+	}
+	items, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid grype_ignore_rules: expected a list of rules or a document with an ignore list")
+	}
+
+	rules := make([]match.IgnoreRule, 0, len(items))
+	for i, item := range items {
+		var rule match.IgnoreRule
+		switch v := item.(type) {
+		case string:
+			v = strings.TrimSpace(v)
+			if strings.HasPrefix(v, "/") {
+				rule.Package.Location = v
+			} else {
+				rule.Vulnerability = v
+			}
+		case map[interface{}]interface{}:
+			data, err := yaml.Marshal(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid grype_ignore_rules rule %d: %w", i, err)
+			}
+			if err := yaml.UnmarshalStrict(data, &rule); err != nil {
+				return nil, fmt.Errorf("invalid grype_ignore_rules rule %d: %w", i, err)
+			}
+		default:
+			return nil, fmt.Errorf("invalid grype_ignore_rules rule %d: expected a string or a rule object", i)
+		}
+		// A rule without conditions would ignore every match
+		conditions := rule
+		conditions.Reason = ""
+		if conditions == (match.IgnoreRule{}) {
+			return nil, fmt.Errorf("invalid grype_ignore_rules rule %d: no condition given", i)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -0,0 +1,52 @@
+package task
+
+import (
+	"fmt"
+)
+
+// IgnoredMatch is a match suppressed by an ignore rule (grype config, task or global rules), stored with the rules
+// that caused the suppression for auditing.
+type IgnoredMatch struct {
+	VulnerabilityMatch
+	AppliedIgnoreRules []IgnoreRule `json:"appliedIgnoreRules"`
+}
+
+// IgnoreRule is a grype ignore rule as reported on an ignored match.
+type IgnoreRule struct {
+	Vulnerability    string             `json:"vulnerability,omitempty"`
+	Reason           string             `json:"reason,omitempty"`
+	Namespace        string             `json:"namespace,omitempty"`
+	FixState         string             `json:"fix-state,omitempty"`
+	Package          *IgnoreRulePackage `json:"package,omitempty"`
+	VexStatus        string             `json:"vex-status,omitempty"`
+	VexJustification string             `json:"vex-justification,omitempty"`
+	MatchType        string             `json:"match-type,omitempty"`
+}
+
+type IgnoreRulePackage struct {
+	Name         string `json:"name,omitempty"`
+	Version      string `json:"version,omitempty"`
+	Language     string `json:"language,omitempty"`
+	Type         string `json:"type,omitempty"`
+	Location     string `json:"location,omitempty"`
+	UpstreamName string `json:"upstream-name,omitempty"`
+}
+
+// How ignored matches are reported (ignored_matches param).
+const (
+	// IgnoredMatchesStore stores the ignored matches with their rules and counts them in the summary.
+	IgnoredMatchesStore = "store"
+	// IgnoredMatchesCount only counts them in the summary.
+	IgnoredMatchesCount = "count"
+)
+
+func parseIgnoredMatchesMode(value string) (string, error) {
+	switch value {
+	case "":
+		return IgnoredMatchesStore, nil
+	case IgnoredMatchesStore, IgnoredMatchesCount:
+		return value, nil
+	default:
+		return "", fmt.Errorf("invalid ignored_matches %q: expected %s or %s", value, IgnoredMatchesStore, IgnoredMatchesCount)
+	}
+}
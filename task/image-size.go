@@ -0,0 +1,113 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"oras.land/oras-go/v2/content"
+	"os"
+	"strconv"
+)
+
+// Limits of the images pulled, checked against the sizes their manifest lists before any layer is downloaded.
+// MAX_IMAGE_SIZE_MIB is the maximum size of an image, its config and layers as listed (MaxSizeMiB by default), which
+// the max_image_size_mib param may lower for a run. MIN_FREE_DISK_MIB is the space to leave free on the volume of the
+// work directory once the image is written out (512 by default).
+var (
+	MaxImageSizeMiB = os.Getenv("MAX_IMAGE_SIZE_MIB")
+	MinFreeDiskMiB  = os.Getenv("MIN_FREE_DISK_MIB")
+)
+
+const defaultMinFreeDiskMiB = 512
+
+var (
+	maxSizeBytes     = parseMiBEnv("MAX_IMAGE_SIZE_MIB", MaxImageSizeMiB, MaxSizeMiB)
+	minFreeDiskBytes = parseMiBEnv("MIN_FREE_DISK_MIB", MinFreeDiskMiB, defaultMinFreeDiskMiB)
+)
+
+// parseMiBEnv returns the bytes of the MiB count of the env var name, def when it isn't set or valid.
+func parseMiBEnv(name, value string, def int) int64 {
+	mib := def
+	if value != "" {
+		v, err := strconv.Atoi(value)
+		if err != nil || v < 0 {
+			fmt.Fprintf(os.Stderr, "Invalid %s %q, using %d\n", name, value, def)
+		} else {
+			mib = v
+		}
+	}
+	return int64(mib) * 1024 * 1024
+}
+
+// parseMaxImageSize parses max_image_size_mib, which can't raise the MAX_IMAGE_SIZE_MIB limit.
+func parseMaxImageSize(params map[string][]string) (int64, error) {
+	mib, err := getIntParam(params, "max_image_size_mib", 0)
+	if err != nil {
+		return 0, err
+	}
+	if mib < 0 {
+		return 0, fmt.Errorf("max_image_size_mib must be positive")
+	}
+	size := int64(mib) * 1024 * 1024
+	if size > maxSizeBytes {
+		return 0, fmt.Errorf("max_image_size_mib %d exceeds the limit of %d MiB (MAX_IMAGE_SIZE_MIB)", mib, maxSizeBytes/1024/1024)
+	}
+	return size, nil
+}
+
+// imageSize is the size of the config and layers the manifest lists.
+func imageSize(manifest ocispec.Manifest) int64 {
+	size := manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+	return size
+}
+
+// checkImageSize fails the pull of an image whose manifest lists more than the maximum size, or more than the free
+// space of the volume of outputDir can take once written out.
+func checkImageSize(manifest ocispec.Manifest, outputDir string, opts pullOptions) error {
+	size := imageSize(manifest)
+	if limit := opts.maxSize(); size > limit {
+		return fmt.Errorf("%w: the image is %d bytes, over the maximum of %d bytes", ErrImageTooLarge, size, limit)
+	}
+
+	required := size + minFreeDiskBytes
+	if opts.Layout == ImageLayoutDockerArchive {
+		// The layers are written out and then archived
+		required += size
+	}
+	available, err := freeDiskBytes(outputDir)
+	if err != nil {
+		opts.logger().Warn("skipping the free disk space check", zap.String("dir", outputDir), zap.Error(err))
+		return nil
+	}
+	if available < required {
+		return fmt.Errorf("%w: writing out the image of %d bytes needs %d bytes free in %s, %d available", ErrInsufficientDiskSpace,
+			size, required, outputDir, available)
+	}
+	return nil
+}
+
+// sizeCheckingSuccessors wraps the FindSuccessors func of a pull to check the size of the image (checkImageSize) once
+// its manifest is fetched, before the layers are.
+func sizeCheckingSuccessors(find func(context.Context, content.Fetcher, ocispec.Descriptor) ([]ocispec.Descriptor, error), outputDir string, opts pullOptions) func(context.Context, content.Fetcher, ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	return func(ctx context.Context, fetcher content.Fetcher, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		if isManifestMediaType(desc.MediaType) && !isImageIndex(desc.MediaType) {
+			manifestContent, err := content.FetchAll(ctx, fetcher, desc)
+			if err != nil {
+				return nil, err
+			}
+			var manifest ocispec.Manifest
+			if err := json.Unmarshal(manifestContent, &manifest); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
+			}
+			if err := checkImageSize(manifest, outputDir, opts); err != nil {
+				return nil, err
+			}
+		}
+		return find(ctx, fetcher, desc)
+	}
+}
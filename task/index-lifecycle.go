@@ -0,0 +1,202 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/opensearch-project/opensearch-go/v2"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time-based result indices. With RESULT_INDEX_ROLLOVER set to monthly or daily the results are stored in indices
+// suffixed with the month (-YYYY.MM) or day (-YYYY.MM.DD) of the scan, in UTC, e.g. grype-results-2024.05. With
+// RESULT_RETENTION_DAYS also set, a lifecycle policy (ISM on OpenSearch, ILM on Elasticsearch) deletes the dated
+// indices of INDEX_TEMPLATE_PATTERNS that many days after their creation.
+var (
+	ResultIndexRollover = os.Getenv("RESULT_INDEX_ROLLOVER")
+	ResultRetentionDays = os.Getenv("RESULT_RETENTION_DAYS")
+)
+
+const (
+	IndexRolloverMonthly = "monthly"
+	IndexRolloverDaily   = "daily"
+)
+
+// retentionPolicyName is the id of the lifecycle policy of the dated result indices.
+const retentionPolicyName = "og-task-container-vulnerability-retention"
+
+// getIndexRollover returns the suffix layout of the dated result indices, empty when they aren't rotated.
+func getIndexRollover() (string, error) {
+	switch ResultIndexRollover {
+	case "":
+		return "", nil
+	case IndexRolloverMonthly:
+		return "2006.01", nil
+	case IndexRolloverDaily:
+		return "2006.01.02", nil
+	default:
+		return "", fmt.Errorf("invalid RESULT_INDEX_ROLLOVER %q: must be %s or %s", ResultIndexRollover, IndexRolloverMonthly, IndexRolloverDaily)
+	}
+}
+
+// getRetentionDays returns the days dated result indices are kept, 0 when they're kept forever.
+func getRetentionDays() (int, error) {
+	if ResultRetentionDays == "" {
+		return 0, nil
+	}
+	days, err := strconv.Atoi(ResultRetentionDays)
+	if err != nil || days < 1 {
+		return 0, fmt.Errorf("invalid RESULT_RETENTION_DAYS %q: must be a positive integer", ResultRetentionDays)
+	}
+	if ResultIndexRollover == "" {
+		return 0, fmt.Errorf("RESULT_RETENTION_DAYS requires RESULT_INDEX_ROLLOVER, undated indices would be deleted whole")
+	}
+	return days, nil
+}
+
+// datedIndex returns the index of the results of a scan at t, index itself when the indices aren't rotated.
+func datedIndex(index, layout string, t time.Time) string {
+	if layout == "" {
+		return index
+	}
+	return index + "-" + t.UTC().Format(layout)
+}
+
+// datedIndices returns the indices the results stored in index over time are in, for lookups across them.
+func datedIndices(index, layout string) []string {
+	if layout == "" {
+		return []string{index}
+	}
+	return []string{index, index + "-*"}
+}
+
+// datedPatterns returns the patterns of the dated indices of patterns.
+func datedPatterns(patterns []string) []string {
+	dated := make([]string, 0, len(patterns))
+	for _, p := range patterns {
+		dated = append(dated, strings.TrimSuffix(p, "*")+"-*")
+	}
+	return dated
+}
+
+// ensureRetentionPolicy installs the lifecycle policy deleting the dated indices of patterns once they're days old.
+// Elasticsearch indices get the policy from the index.lifecycle.name setting of their template, OpenSearch ones from
+// the ISM template of the policy.
+func ensureRetentionPolicy(ctx context.Context, logger *zap.Logger, client *opensearch.Client, isOpenSearch bool, patterns []string, days int) error {
+	minAge := fmt.Sprintf("%dd", days)
+	var path string
+	var policy map[string]interface{}
+	if isOpenSearch {
+		path = "/_plugins/_ism/policies/" + retentionPolicyName
+		policy = map[string]interface{}{
+			"description":   "Deletes the scan results older than " + minAge,
+			"default_state": "hot",
+			"states": []map[string]interface{}{
+				{
+					"name":        "hot",
+					"actions":     []interface{}{},
+					"transitions": []map[string]interface{}{{"state_name": "delete", "conditions": map[string]string{"min_index_age": minAge}}},
+				},
+				{
+					"name":        "delete",
+					"actions":     []map[string]interface{}{{"delete": map[string]interface{}{}}},
+					"transitions": []interface{}{},
+				},
+			},
+			"ism_template": []map[string]interface{}{{"index_patterns": patterns, "priority": resultIndexTemplatePriority}},
+		}
+	} else {
+		path = "/_ilm/policy/" + retentionPolicyName
+		policy = map[string]interface{}{
+			"phases": map[string]interface{}{
+				"hot":    map[string]interface{}{"actions": map[string]interface{}{}},
+				"delete": map[string]interface{}{"min_age": minAge, "actions": map[string]interface{}{"delete": map[string]interface{}{}}},
+			},
+		}
+	}
+	body, err := json.Marshal(map[string]interface{}{"policy": policy})
+	if err != nil {
+		return err
+	}
+
+	err = withRetry(ctx, logger, "put retention policy", func() error {
+		query := url.Values{}
+		if isOpenSearch {
+			// ISM policies are updated with the sequence number of the stored version
+			seqNo, primaryTerm, found, err := getISMPolicyVersion(ctx, client, path)
+			if err != nil {
+				return err
+			}
+			if found {
+				query.Set("if_seq_no", strconv.FormatInt(seqNo, 10))
+				query.Set("if_primary_term", strconv.FormatInt(primaryTerm, 10))
+			}
+		}
+		_, err := performJSON(ctx, client, http.MethodPut, path, query, body)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to install retention policy: %w", err)
+	}
+	logger.Info("installed retention policy", zap.String("policy", retentionPolicyName), zap.String("minAge", minAge),
+		zap.Strings("patterns", patterns))
+	return nil
+}
+
+// getISMPolicyVersion returns the sequence number and primary term of the ISM policy at path, found being false when
+// there's none.
+func getISMPolicyVersion(ctx context.Context, client *opensearch.Client, path string) (seqNo, primaryTerm int64, found bool, err error) {
+	body, err := performJSON(ctx, client, http.MethodGet, path, nil, nil)
+	if err != nil {
+		var statusErr *statusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+			return 0, 0, false, nil
+		}
+		return 0, 0, false, err
+	}
+	var version struct {
+		SeqNo       int64 `json:"_seq_no"`
+		PrimaryTerm int64 `json:"_primary_term"`
+	}
+	if err := json.Unmarshal(body, &version); err != nil {
+		return 0, 0, false, fmt.Errorf("failed to parse retention policy: %w", err)
+	}
+	return version.SeqNo, version.PrimaryTerm, true, nil
+}
+
+// performJSON sends a request with a JSON body to an API opensearchapi has no request for, returning the response
+// body.
+func performJSON(ctx context.Context, client *opensearch.Client, method, path string, query url.Values, body []byte) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = strings.NewReader(string(body))
+	}
+	req, err := http.NewRequestWithContext(ctx, method, (&url.URL{Path: path, RawQuery: query.Encode()}).String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := client.Perform(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= http.StatusMultipleChoices {
+		return nil, &statusError{StatusCode: res.StatusCode, Err: fmt.Errorf("%s %s: %d %s", method, path, res.StatusCode, resBody)}
+	}
+	return resBody, nil
+}
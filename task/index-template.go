@@ -0,0 +1,328 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/opensearch-project/opensearch-go/v2"
+	"github.com/opensearch-project/opensearch-go/v2/opensearchapi"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"os"
+	"strings"
+)
+
+// Index templates of the result indices, installed or updated at startup so the results get explicit mappings
+// rather than dynamic ones. INDEX_TEMPLATE_PATTERNS are the comma separated patterns of the indices the image results
+// are stored in, e.g. "ociartifactvulnerabilities*", no template being installed when unset.
+// MATCH_INDEX_TEMPLATE_PATTERNS are those of the match indices (result_mode=fanout), each image pattern suffixed with
+// _matches by default. The SBOM indices (generate_sbom) are those of the image patterns suffixed with _sboms.
+var (
+	IndexTemplatePatterns      = os.Getenv("INDEX_TEMPLATE_PATTERNS")
+	MatchIndexTemplatePatterns = os.Getenv("MATCH_INDEX_TEMPLATE_PATTERNS")
+)
+
+const (
+	resultIndexTemplateName = "og-task-container-vulnerability-results"
+	matchIndexTemplateName  = "og-task-container-vulnerability-matches"
+	sbomIndexTemplateName   = "og-task-container-vulnerability-sboms"
+	// the match and SBOM templates win over the result one on the indices both patterns cover, e.g. with a result
+	// pattern ending in *
+	resultIndexTemplatePriority = 100
+	matchIndexTemplatePriority  = 101
+)
+
+// EnsureIndexTemplates installs the index templates of the result and match indices, replacing older versions, and
+// the retention policy of the dated ones (RESULT_RETENTION_DAYS).
+func EnsureIndexTemplates(ctx context.Context, logger *zap.Logger, client *opensearch.Client, isOpenSearch bool) error {
+	layout, err := getIndexRollover()
+	if err != nil {
+		return err
+	}
+	retentionDays, err := getRetentionDays()
+	if err != nil {
+		return err
+	}
+	resultPatterns := splitPatterns(IndexTemplatePatterns)
+	if len(resultPatterns) == 0 {
+		if retentionDays > 0 {
+			return fmt.Errorf("RESULT_RETENTION_DAYS requires INDEX_TEMPLATE_PATTERNS")
+		}
+		return nil
+	}
+	matchPatterns := splitPatterns(MatchIndexTemplatePatterns)
+	if len(matchPatterns) == 0 {
+		for _, p := range resultPatterns {
+			matchPatterns = append(matchPatterns, strings.TrimSuffix(p, "*")+matchIndexSuffix+"*")
+		}
+	}
+	var sbomPatterns []string
+	for _, p := range resultPatterns {
+		sbomPatterns = append(sbomPatterns, strings.TrimSuffix(p, "*")+sbomIndexSuffix+"*")
+	}
+	// a dated index gets a single template, that of the dated patterns the lifecycle policy applies to
+	if layout != "" {
+		resultPatterns = datedPatterns(resultPatterns)
+		matchPatterns = datedPatterns(matchPatterns)
+		sbomPatterns = datedPatterns(sbomPatterns)
+	}
+
+	settings := map[string]interface{}{}
+	if retentionDays > 0 {
+		if err := ensureRetentionPolicy(ctx, logger, client, isOpenSearch, append(append(append([]string{}, resultPatterns...), matchPatterns...), sbomPatterns...), retentionDays); err != nil {
+			return err
+		}
+		if !isOpenSearch {
+			settings["index.lifecycle.name"] = retentionPolicyName
+		}
+	}
+
+	for _, t := range []struct {
+		name     string
+		patterns []string
+		priority int
+		mapping  map[string]interface{}
+	}{
+		{resultIndexTemplateName, resultPatterns, resultIndexTemplatePriority, resultMapping()},
+		{matchIndexTemplateName, matchPatterns, matchIndexTemplatePriority, matchDocumentMapping()},
+		{sbomIndexTemplateName, sbomPatterns, matchIndexTemplatePriority, sbomDocumentMapping()},
+	} {
+		err := withRetry(ctx, logger, "put index template", func() error {
+			return putIndexTemplate(ctx, client, t.name, t.patterns, t.priority, settings, t.mapping)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to install index template %s: %w", t.name, err)
+		}
+		logger.Info("installed index template", zap.String("template", t.name), zap.Strings("patterns", t.patterns))
+	}
+	return nil
+}
+
+func splitPatterns(value string) []string {
+	var patterns []string
+	for _, p := range strings.Split(value, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
+
+// putIndexTemplate creates or updates the composable index template name.
+func putIndexTemplate(ctx context.Context, client *opensearch.Client, name string, patterns []string, priority int, settings, mapping map[string]interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"index_patterns": patterns,
+		"priority":       priority,
+		"version":        ResultSchemaVersion,
+		"template":       map[string]interface{}{"settings": settings, "mappings": mapping},
+		"_meta":          map[string]interface{}{"managed_by": "og-task-container-vulnerability"},
+	})
+	if err != nil {
+		return err
+	}
+	res, err := opensearchapi.IndicesPutIndexTemplateRequest{
+		Name: name,
+		Body: strings.NewReader(string(body)),
+	}.Do(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return &statusError{StatusCode: res.StatusCode, Err: fmt.Errorf("%s", res.String())}
+	}
+	return nil
+}
+
+var (
+	keywordField = map[string]interface{}{"type": "keyword"}
+	textField    = map[string]interface{}{"type": "text"}
+	intField     = map[string]interface{}{"type": "integer"}
+	floatField   = map[string]interface{}{"type": "float"}
+	boolField    = map[string]interface{}{"type": "boolean"}
+	dateField    = map[string]interface{}{"type": "date"}
+	// opaqueField is stored but not indexed, for values whose shape varies between scanners and matches
+	opaqueField = map[string]interface{}{"type": "object", "enabled": false}
+)
+
+// taskResultMapping maps the documents of es.TaskResult with the description, strings not mapped explicitly being
+// keywords.
+func taskResultMapping(description map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"dynamic_templates": []map[string]interface{}{{
+			"strings_as_keywords": map[string]interface{}{
+				"match_mapping_type": "string",
+				"mapping":            map[string]interface{}{"type": "keyword", "ignore_above": 1024},
+			},
+		}},
+		"properties": map[string]interface{}{
+			"es_id":         keywordField,
+			"es_index":      keywordField,
+			"platform_id":   keywordField,
+			"resource_id":   keywordField,
+			"resource_name": keywordField,
+			"task_type":     keywordField,
+			"result_type":   keywordField,
+			"described_by":  keywordField,
+			"described_at":  map[string]interface{}{"type": "date", "format": "epoch_second"},
+			"metadata":      map[string]interface{}{"type": "object", "dynamic": true},
+			"description":   description,
+		},
+	}
+}
+
+// resultMapping maps the image result documents, OciArtifactVulnerabilities, with the matches nested so a query or
+// aggregation on several fields of a match considers them within the same match.
+func resultMapping() map[string]interface{} {
+	return taskResultMapping(map[string]interface{}{
+		"properties": map[string]interface{}{
+			"schemaVersion":   intField,
+			"imageUrl":        keywordField,
+			"artifactDigest":  keywordField,
+			"verifiedDigest":  keywordField,
+			"Vulnerabilities": map[string]interface{}{"type": "nested", "properties": matchProperties()},
+			"summary": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"totalMatches":        intField,
+					"storedMatches":       intField,
+					"truncated":           boolField,
+					"severityCounts":      map[string]interface{}{"type": "object", "dynamic": true},
+					"fixableCount":        intField,
+					"ignoredMatches":      intField,
+					"knownExploitedCount": intField,
+				},
+			},
+			"osName":                       keywordField,
+			"osVersion":                    keywordField,
+			"sourceType":                   keywordField,
+			"scanPath":                     keywordField,
+			"scanWarnings":                 textField,
+			"packageCount":                 intField,
+			"noPackagesDetected":           boolField,
+			"distroDetected":               boolField,
+			"dbBuiltAt":                    dateField,
+			"dbSchemaVersion":              keywordField,
+			"newSinceLastScan":             map[string]interface{}{"type": "nested", "properties": matchProperties()},
+			"vulnerabilitiesIndexTemplate": keywordField,
+			"generatedSbom": map[string]interface{}{
+				"properties": map[string]interface{}{
+					"format":  keywordField,
+					"esIndex": keywordField,
+					"esId":    keywordField,
+				},
+			},
+			"ownerTeam": keywordField,
+			"service":   keywordField,
+			"onCall":    keywordField,
+			"report":    opaqueField,
+		},
+	})
+}
+
+// matchDocumentMapping maps the MatchDocument documents of the match indices.
+func matchDocumentMapping() map[string]interface{} {
+	return taskResultMapping(map[string]interface{}{
+		"properties": map[string]interface{}{
+			"schemaVersion":  intField,
+			"imageUrl":       keywordField,
+			"artifactDigest": keywordField,
+			"imageDigest":    keywordField,
+			"severity":       keywordField,
+			"match":          map[string]interface{}{"properties": matchProperties()},
+		},
+	})
+}
+
+// sbomDocumentMapping maps the SBOMDocument documents of the SBOM indices, the payload being kept in the source only.
+func sbomDocumentMapping() map[string]interface{} {
+	return taskResultMapping(map[string]interface{}{
+		"properties": map[string]interface{}{
+			"schemaVersion":  intField,
+			"imageUrl":       keywordField,
+			"artifactDigest": keywordField,
+			"imageDigest":    keywordField,
+			"format":         keywordField,
+			"packageCount":   intField,
+			"payload":        map[string]interface{}{"type": "keyword", "index": false, "doc_values": false},
+		},
+	})
+}
+
+// matchProperties are the mappings of a VulnerabilityMatch.
+func matchProperties() map[string]interface{} {
+	return map[string]interface{}{
+		"vulnerability":          map[string]interface{}{"properties": vulnerabilityProperties()},
+		"relatedVulnerabilities": map[string]interface{}{"properties": vulnerabilityProperties()},
+		"matchDetails": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"type":       keywordField,
+				"matcher":    keywordField,
+				"searchedBy": opaqueField,
+				"found":      opaqueField,
+			},
+		},
+		"artifact": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"id":           keywordField,
+				"name":         keywordField,
+				"version":      keywordField,
+				"type":         keywordField,
+				"language":     keywordField,
+				"purl":         keywordField,
+				"cpes":         keywordField,
+				"licenses":     keywordField,
+				"locations":    opaqueField,
+				"upstreams":    opaqueField,
+				"metadataType": keywordField,
+				"metadata":     opaqueField,
+			},
+		},
+		"exploitAvailable":  boolField,
+		"exploitReferences": keywordField,
+		"epssScore":         floatField,
+		"epssPercentile":    floatField,
+		"knownExploited":    boolField,
+		"kev": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"dateAdded":                  dateField,
+				"dueDate":                    dateField,
+				"requiredAction":             textField,
+				"knownRansomwareCampaignUse": keywordField,
+			},
+		},
+	}
+}
+
+// vulnerabilityProperties are the mappings of a Vulnerability.
+func vulnerabilityProperties() map[string]interface{} {
+	return map[string]interface{}{
+		"id":          keywordField,
+		"dataSource":  keywordField,
+		"namespace":   keywordField,
+		"severity":    keywordField,
+		"urls":        keywordField,
+		"description": textField,
+		"cvss": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"source":  keywordField,
+				"type":    keywordField,
+				"version": keywordField,
+				"vector":  keywordField,
+				"metrics": map[string]interface{}{
+					"properties": map[string]interface{}{
+						"baseScore":           floatField,
+						"exploitabilityScore": floatField,
+						"impactScore":         floatField,
+					},
+				},
+				"vendorMetadata": opaqueField,
+			},
+		},
+		"fix": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"versions": keywordField,
+				"state":    keywordField,
+			},
+		},
+		"advisories": opaqueField,
+	}
+}
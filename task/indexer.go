@@ -0,0 +1,337 @@
+package task
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/opengovern/og-util/pkg/es"
+	"github.com/opensearch-project/opensearch-go/v2"
+	"github.com/opensearch-project/opensearch-go/v2/opensearchapi"
+	"github.com/opensearch-project/opensearch-go/v2/opensearchutil"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultIndexFlushInterval bounds how long a partial batch waits in the indexer before it's written.
+	defaultIndexFlushInterval = 5 * time.Second
+	// defaultIndexFlushBytes is the size of the bulk requests, as for the opensearchutil default.
+	defaultIndexFlushBytes = 5 * 1024 * 1024
+	// maxReportedIndexFailures bounds the documents listed in the error of a run whose documents failed to index.
+	maxReportedIndexFailures = 5
+)
+
+// indexItem is a scan result queued for indexing, pos being the position of the artifact in the task params.
+type indexItem struct {
+	pos            int
+	scan           OciArtifactVulnerabilities
+	manifestDigest string
+	result         *es.TaskResult
+	// linkedDocs are stored along with result: the documents of its matches (result_mode=fanout) and of the SBOM
+	// of the image (generate_sbom)
+	linkedDocs   []es.Doc
+	notification ImageResultNotification
+	// scanDuration is how long pulling and scanning the image took
+	scanDuration time.Duration
+}
+
+// resultIndexer funnels scan results from concurrent scans through a bulk indexer of index_workers writers (default
+// 1), each flushing its documents once they reach index_flush_bytes (5 MiB) or index_flush_interval passed (5s).
+// Scan throughput is thereby decoupled from the write pressure on OpenSearch, and with a single writer no two writes
+// of the run ever race. Documents rejected with a retryable status (e.g. 429 when the write queue is full) are
+// written again once the bulk indexer is closed.
+type resultIndexer struct {
+	// traceCtx parents the spans of the writes to the run's, without its cancellation
+	traceCtx  context.Context
+	logger    *zap.Logger
+	client    *opensearch.Client
+	refresh   string
+	bulk      opensearchutil.BulkIndexer
+	onIndexed func(item indexItem)
+
+	mu       sync.Mutex
+	flushErr error
+	failures []string
+	retries  []retriedDoc
+}
+
+// pendingItem is an item whose documents are being written.
+type pendingItem struct {
+	item      indexItem
+	remaining int
+	failed    bool
+}
+
+// retriedDoc is a document of item rejected with a retryable status.
+type retriedDoc struct {
+	item *pendingItem
+	doc  es.Doc
+}
+
+// newResultIndexer starts the bulk indexer of the run, writing with the index_refresh policy of the bulk API (false
+// by default, true or wait_for). onIndexed is called, serialized, for every item once all its documents are stored.
+func newResultIndexer(ctx context.Context, logger *zap.Logger, client *opensearch.Client, params map[string][]string, onIndexed func(item indexItem)) (*resultIndexer, error) {
+	workers, err := getIntParam(params, "index_workers", 1)
+	if err != nil {
+		return nil, err
+	}
+	flushBytes, err := getIntParam(params, "index_flush_bytes", defaultIndexFlushBytes)
+	if err != nil {
+		return nil, err
+	}
+	if workers < 1 || flushBytes < 1 {
+		return nil, fmt.Errorf("index_workers and index_flush_bytes must be positive")
+	}
+	flushInterval := defaultIndexFlushInterval
+	if v := getParamValue(params, "index_flush_interval", ""); v != "" {
+		if flushInterval, err = time.ParseDuration(v); err != nil || flushInterval <= 0 {
+			return nil, fmt.Errorf("invalid index_flush_interval %q: must be a positive duration", v)
+		}
+	}
+	refresh := getParamValue(params, "index_refresh", "false")
+	if refresh != "true" && refresh != "false" && refresh != "wait_for" {
+		return nil, fmt.Errorf("invalid index_refresh %q: must be true, false or wait_for", refresh)
+	}
+
+	x := &resultIndexer{
+		traceCtx:  trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx)),
+		logger:    logger,
+		client:    client,
+		refresh:   refresh,
+		onIndexed: onIndexed,
+	}
+	x.bulk, err = opensearchutil.NewBulkIndexer(opensearchutil.BulkIndexerConfig{
+		NumWorkers:    workers,
+		FlushBytes:    flushBytes,
+		FlushInterval: flushInterval,
+		Client:        client,
+		Refresh:       refresh,
+		OnError:       x.onError,
+		OnFlushStart: func(ctx context.Context) context.Context {
+			ctx, _ = startSpan(trace.ContextWithSpan(ctx, trace.SpanFromContext(x.traceCtx)), "opensearch.index")
+			return ctx
+		},
+		OnFlushEnd: func(ctx context.Context) {
+			trace.SpanFromContext(ctx).End()
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// Submit queues the documents of the item for indexing. It fails once indexing has failed, so callers can stop
+// scanning early.
+func (x *resultIndexer) Submit(ctx context.Context, item indexItem) error {
+	if err := x.Err(); err != nil {
+		return err
+	}
+	docs := append([]es.Doc{routedResult{TaskResult: item.result}}, item.linkedDocs...)
+	p := &pendingItem{item: item, remaining: len(docs)}
+	for _, doc := range docs {
+		keys, index := doc.KeysAndIndex()
+		docJSON, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		if err := x.bulk.Add(ctx, opensearchutil.BulkIndexerItem{
+			Index:      index,
+			Action:     "index",
+			DocumentID: es.HashOf(keys...),
+			Body:       bytes.NewReader(docJSON),
+			OnSuccess: func(context.Context, opensearchutil.BulkIndexerItem, opensearchutil.BulkIndexerResponseItem) {
+				x.mu.Lock()
+				defer x.mu.Unlock()
+				x.indexedLocked(p)
+			},
+			OnFailure: func(_ context.Context, bulkItem opensearchutil.BulkIndexerItem, res opensearchutil.BulkIndexerResponseItem, err error) {
+				x.onFailure(p, doc, bulkItem, res, err)
+			},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close flushes the queued documents, writes the ones to retry and returns the indexing error.
+func (x *resultIndexer) Close() error {
+	if err := x.bulk.Close(context.Background()); err != nil {
+		x.onError(context.Background(), err)
+	}
+
+	x.mu.Lock()
+	retries := x.retries
+	x.retries = nil
+	x.mu.Unlock()
+	if len(retries) > 0 && x.Err() == nil {
+		docs := make([]es.Doc, 0, len(retries))
+		for _, r := range retries {
+			docs = append(docs, r.doc)
+		}
+		ctx, span := startSpan(x.traceCtx, "opensearch.index", attribute.Int("documents", len(docs)))
+		err := withRetry(ctx, x.logger, "index results", func() error {
+			return bulkSendDataToOpensearch(x.client, docs, x.refresh)
+		})
+		endSpan(span, err)
+
+		x.mu.Lock()
+		if err != nil {
+			x.flushErr = fmt.Errorf("failed to index results: %w", err)
+		} else {
+			for _, r := range retries {
+				x.indexedLocked(r.item)
+			}
+		}
+		x.mu.Unlock()
+	}
+	return x.Err()
+}
+
+// Err returns the indexing error, listing the first documents that failed.
+func (x *resultIndexer) Err() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.flushErr != nil {
+		return x.flushErr
+	}
+	if len(x.failures) == 0 {
+		return nil
+	}
+	reported := x.failures
+	if len(reported) > maxReportedIndexFailures {
+		reported = reported[:maxReportedIndexFailures]
+	}
+	return fmt.Errorf("failed to index %d documents: %s", len(x.failures), strings.Join(reported, "; "))
+}
+
+// indexedLocked records that a document of p is stored, reporting p once all are.
+func (x *resultIndexer) indexedLocked(p *pendingItem) {
+	p.remaining--
+	if p.remaining == 0 && !p.failed && x.onIndexed != nil {
+		x.onIndexed(p.item)
+	}
+}
+
+func (x *resultIndexer) onFailure(p *pendingItem, doc es.Doc, bulkItem opensearchutil.BulkIndexerItem, res opensearchutil.BulkIndexerResponseItem, err error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err == nil && isRetryableStatus(res.Status) {
+		x.retries = append(x.retries, retriedDoc{item: p, doc: doc})
+		return
+	}
+	p.failed = true
+	failure := fmt.Sprintf("%s (%s): status %d", bulkItem.DocumentID, bulkItem.Index, res.Status)
+	if res.Error.Type != "" {
+		failure += fmt.Sprintf(" %s: %s", res.Error.Type, res.Error.Reason)
+	}
+	if err != nil {
+		failure += ": " + err.Error()
+	}
+	x.logger.Error("failed to index document", zap.String("failure", failure))
+	x.failures = append(x.failures, failure)
+}
+
+// onError records a failure of a whole bulk request, its items left unstored.
+func (x *resultIndexer) onError(_ context.Context, err error) {
+	if errors.Is(err, context.Canceled) {
+		// The run is failing already
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.flushErr == nil {
+		x.flushErr = fmt.Errorf("failed to index results: %w", err)
+	}
+}
+
+// routedResult stores a result in its EsIndex, which may be overridden per artifact, rather than the index derived
+// from its result type.
+type routedResult struct {
+	*es.TaskResult
+}
+
+func (r routedResult) KeysAndIndex() ([]string, string) {
+	keys, index := r.TaskResult.KeysAndIndex()
+	if r.EsIndex != "" {
+		index = r.EsIndex
+	}
+	return keys, index
+}
+
+// bulkSendDataToOpensearch indexes the documents with a single bulk request, with the refresh policy.
+func bulkSendDataToOpensearch(client *opensearch.Client, docs []es.Doc, refresh string) error {
+	var body bytes.Buffer
+	for _, doc := range docs {
+		keys, index := doc.KeysAndIndex()
+		action, err := json.Marshal(map[string]map[string]string{
+			"index": {"_index": index, "_id": es.HashOf(keys...)},
+		})
+		if err != nil {
+			return err
+		}
+		docJSON, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(docJSON)
+		body.WriteByte('\n')
+	}
+
+	req := opensearchapi.BulkRequest{
+		Body:    &body,
+		Refresh: refresh,
+	}
+	res, err := req.Do(context.Background(), client)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return &statusError{StatusCode: res.StatusCode, Err: fmt.Errorf("error indexing documents: %s", res.String())}
+	}
+
+	// A bulk request succeeds as a whole even when single items fail
+	respBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	var bulkResp struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			ID     string          `json:"_id"`
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(respBody, &bulkResp); err != nil {
+		return fmt.Errorf("failed to parse bulk response: %w", err)
+	}
+	if bulkResp.Errors {
+		// A throttled item is reported over the others, retrying the batch may store it
+		var failed error
+		for _, item := range bulkResp.Items {
+			for _, r := range item {
+				if len(r.Error) > 0 && (failed == nil || isRetryableStatus(r.Status)) {
+					failed = &statusError{StatusCode: r.Status, Err: fmt.Errorf("error indexing document %s: status %d: %s", r.ID, r.Status, string(r.Error))}
+				}
+			}
+		}
+		if failed != nil {
+			return failed
+		}
+		return fmt.Errorf("error indexing documents")
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/opengovern/og-util/pkg/opengovernance-es-sdk"
+	"github.com/opengovern/og-util/pkg/tasks"
+	"github.com/opengovern/opencomply/services/tasks/scheduler"
+	"github.com/opensearch-project/opensearch-go/v2"
+	"github.com/opensearch-project/opensearch-go/v2/opensearchapi"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// inventoryPageSize is the number of hits fetched per scroll page.
+	inventoryPageSize = 500
+	// inventoryScrollKeepAlive is how long the scroll context is kept between pages.
+	inventoryScrollKeepAlive = time.Minute
+)
+
+// runScanInventoryTask runs inventory_query against inventory_index, extracts the image references found at
+// inventory_image_field (and digests at inventory_digest_field, if set) from the hits, and scans them as a batch.
+func runScanInventoryTask(ctx context.Context, esClient opengovernance.Client, logger *zap.Logger, request tasks.TaskRequest, response *scheduler.TaskResponse, publish ProgressPublisher, publishFindings FindingsPublisher) error {
+	params := request.TaskDefinition.Params
+	index := getParamValue(params, "inventory_index", "")
+	if index == "" {
+		return fmt.Errorf("inventory index parameter is not provided")
+	}
+	query := getParamValue(params, "inventory_query", `{"query": {"match_all": {}}}`)
+	imageField := getParamValue(params, "inventory_image_field", "image")
+	digestField := getParamValue(params, "inventory_digest_field", "")
+
+	images, digests, err := queryInventoryImages(ctx, esClient.ES(), index, query, imageField, digestField)
+	if err != nil {
+		return err
+	}
+	logger.Info("Found images in inventory", zap.String("index", index), zap.Int("count", len(images)))
+	if len(images) == 0 {
+		response.Result = []byte(fmt.Sprintf("No images found in inventory index %s", index))
+		return nil
+	}
+
+	scanRequest := request
+	scanRequest.TaskDefinition.Params = copyParams(params)
+	scanRequest.TaskDefinition.Params["oci_artifact_url"] = images
+	scanRequest.TaskDefinition.Params["artifact_digest"] = digests
+
+	return runScanTask(ctx, esClient, logger, scanRequest, response, publish, publishFindings)
+}
+
+// queryInventoryImages pages through all hits of query with the scroll API and returns the unique image references
+// with their digest (empty when unknown).
+func queryInventoryImages(ctx context.Context, client *opensearch.Client, index, query, imageField, digestField string) ([]string, []string, error) {
+	size := inventoryPageSize
+	res, err := opensearchapi.SearchRequest{
+		Index:  []string{index},
+		Body:   strings.NewReader(query),
+		Size:   &size,
+		Scroll: inventoryScrollKeepAlive,
+	}.Do(ctx, client)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query inventory index: %w", err)
+	}
+
+	var images, digests []string
+	seen := make(map[string]bool)
+	var scrollID string
+	defer func() {
+		if scrollID != "" {
+			clearRes, err := opensearchapi.ClearScrollRequest{ScrollID: []string{scrollID}}.Do(context.Background(), client)
+			if err == nil {
+				clearRes.Body.Close()
+			}
+		}
+	}()
+
+	for {
+		page, err := decodeInventoryPage(res)
+		if err != nil {
+			return nil, nil, err
+		}
+		scrollID = page.ScrollID
+		if len(page.Hits.Hits) == 0 {
+			break
+		}
+
+		for _, hit := range page.Hits.Hits {
+			hitDigest := ""
+			if digestField != "" {
+				if d := fieldValues(hit.Source, digestField); len(d) > 0 {
+					hitDigest = d[0]
+				}
+			}
+			for _, image := range fieldValues(hit.Source, imageField) {
+				if seen[image] {
+					continue
+				}
+				seen[image] = true
+				images = append(images, image)
+				digests = append(digests, hitDigest)
+			}
+		}
+
+		res, err = opensearchapi.ScrollRequest{
+			ScrollID: scrollID,
+			Scroll:   inventoryScrollKeepAlive,
+		}.Do(ctx, client)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to scroll inventory index: %w", err)
+		}
+	}
+
+	return images, digests, nil
+}
+
+type inventoryPage struct {
+	ScrollID string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []struct {
+			Source map[string]interface{} `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+func decodeInventoryPage(res *opensearchapi.Response) (inventoryPage, error) {
+	var page inventoryPage
+	defer res.Body.Close()
+	if res.IsError() {
+		return page, fmt.Errorf("error querying inventory index: %s", res.String())
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return page, err
+	}
+	if err := json.Unmarshal(body, &page); err != nil {
+		return page, fmt.Errorf("failed to unmarshal inventory search response: %w", err)
+	}
+	return page, nil
+}
+
+// fieldValues returns the string values found at the dotted path in doc, descending into arrays.
+func fieldValues(doc interface{}, path string) []string {
+	if path == "" {
+		switch v := doc.(type) {
+		case string:
+			if v != "" {
+				return []string{v}
+			}
+		case []interface{}:
+			var values []string
+			for _, item := range v {
+				values = append(values, fieldValues(item, "")...)
+			}
+			return values
+		}
+		return nil
+	}
+
+	key, rest, _ := strings.Cut(path, ".")
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		return fieldValues(v[key], rest)
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			values = append(values, fieldValues(item, path)...)
+		}
+		return values
+	}
+	return nil
+}
+
+// copyParams returns a shallow copy of the task params so they can be modified without affecting the request.
+func copyParams(params map[string][]string) map[string][]string {
+	c := make(map[string][]string, len(params))
+	for k, v := range params {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,200 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CISA Known Exploited Vulnerabilities catalog used to flag matches of vulnerabilities exploited in the wild.
+// KEV_CATALOG is "cisa" for the catalog published by CISA, or the path or http(s) URL of a copy of its JSON feed. The
+// catalog is reloaded once older than KEV_CATALOG_REFRESH (a duration, 24h by default). Downloaded catalogs are
+// cached in KEV_CACHE_DIR (the system temp directory by default), the cached copy being used when the download fails.
+var (
+	KEVCatalog        = os.Getenv("KEV_CATALOG")
+	KEVCatalogRefresh = os.Getenv("KEV_CATALOG_REFRESH")
+	KEVCacheDir       = os.Getenv("KEV_CACHE_DIR")
+)
+
+const (
+	kevCatalogCISA           = "cisa"
+	kevCatalogCISAURL        = "https://www.cisa.gov/sites/default/files/feeds/known_exploited_vulnerabilities.json"
+	defaultKEVCatalogRefresh = 24 * time.Hour
+	kevCacheFile             = "known_exploited_vulnerabilities.json"
+)
+
+// KEVEntry is the catalog entry of a known exploited vulnerability. DueDate is when US federal agencies must have
+// applied RequiredAction.
+type KEVEntry struct {
+	DateAdded                  string `json:"dateAdded"`
+	DueDate                    string `json:"dueDate"`
+	RequiredAction             string `json:"requiredAction,omitempty"`
+	KnownRansomwareCampaignUse string `json:"knownRansomwareCampaignUse,omitempty"`
+}
+
+// kevIndex maps upper-cased CVE IDs to their catalog entry.
+type kevIndex map[string]KEVEntry
+
+// kevCache holds the loaded catalog. A failed reload keeps serving the previous catalog.
+var kevCache struct {
+	mu       sync.Mutex
+	index    kevIndex
+	loadedAt time.Time
+}
+
+// getKEVIndex returns the KEV catalog, (re)loading it when it's stale. It returns nil when no catalog is configured or
+// it never loaded.
+func getKEVIndex(ctx context.Context, logger *zap.Logger) kevIndex {
+	if KEVCatalog == "" {
+		return nil
+	}
+	refresh, err := time.ParseDuration(KEVCatalogRefresh)
+	if err != nil || refresh <= 0 {
+		refresh = defaultKEVCatalogRefresh
+	}
+
+	kevCache.mu.Lock()
+	defer kevCache.mu.Unlock()
+	if kevCache.index != nil && time.Since(kevCache.loadedAt) < refresh {
+		return kevCache.index
+	}
+
+	index, err := loadKEVCatalog(ctx, logger, KEVCatalog)
+	if err != nil {
+		logger.Warn("failed to load KEV catalog, known exploited flags may be stale or missing", zap.String("catalog", KEVCatalog), zap.Error(err))
+		if kevCache.index != nil {
+			// Retry the stale catalog no sooner than a tenth of the refresh interval
+			kevCache.loadedAt = time.Now().Add(-refresh + refresh/10)
+		}
+		return kevCache.index
+	}
+	logger.Info("loaded KEV catalog", zap.String("catalog", KEVCatalog), zap.Int("vulnerabilities", len(index)))
+	kevCache.index = index
+	kevCache.loadedAt = time.Now()
+	return index
+}
+
+func loadKEVCatalog(ctx context.Context, logger *zap.Logger, location string) (kevIndex, error) {
+	if location == kevCatalogCISA {
+		location = kevCatalogCISAURL
+	}
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		data, err := os.ReadFile(location)
+		if err != nil {
+			return nil, err
+		}
+		return parseKEVCatalog(data)
+	}
+
+	cachePath := filepath.Join(kevCacheDir(), kevCacheFile)
+	data, err := downloadKEVCatalog(ctx, location)
+	if err == nil {
+		var index kevIndex
+		if index, err = parseKEVCatalog(data); err == nil {
+			if err := writeKEVCache(cachePath, data); err != nil {
+				logger.Warn("failed to cache KEV catalog", zap.String("path", cachePath), zap.Error(err))
+			}
+			return index, nil
+		}
+	}
+
+	cached, cacheErr := os.ReadFile(cachePath)
+	if cacheErr != nil {
+		return nil, err
+	}
+	logger.Warn("failed to download KEV catalog, using the cached copy", zap.String("catalog", location), zap.Error(err))
+	return parseKEVCatalog(cached)
+}
+
+func kevCacheDir() string {
+	if KEVCacheDir != "" {
+		return KEVCacheDir
+	}
+	return filepath.Join(os.TempDir(), "kev")
+}
+
+func downloadKEVCatalog(ctx context.Context, location string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := retryingHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d downloading %s", resp.StatusCode, location)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// writeKEVCache replaces the cached catalog with data, never leaving a partial copy behind.
+func writeKEVCache(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), kevCacheFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func parseKEVCatalog(data []byte) (kevIndex, error) {
+	var catalog struct {
+		Vulnerabilities []struct {
+			CVEID string `json:"cveID"`
+			KEVEntry
+		} `json:"vulnerabilities"`
+	}
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return nil, fmt.Errorf("failed to parse KEV catalog: %w", err)
+	}
+	if catalog.Vulnerabilities == nil {
+		return nil, fmt.Errorf("failed to parse KEV catalog: no vulnerabilities")
+	}
+	index := make(kevIndex, len(catalog.Vulnerabilities))
+	for _, v := range catalog.Vulnerabilities {
+		index[strings.ToUpper(strings.TrimSpace(v.CVEID))] = v.KEVEntry
+	}
+	return index, nil
+}
+
+// flagKnownExploited sets KnownExploited and KEV on the matches whose vulnerability, or one of its related
+// vulnerabilities (e.g. the CVE of a GHSA), is in the catalog.
+func flagKnownExploited(matches []VulnerabilityMatch, index kevIndex) {
+	if index == nil {
+		return
+	}
+	for i := range matches {
+		m := &matches[i]
+		for _, id := range matchVulnerabilityIDs(*m) {
+			if entry, ok := index[strings.ToUpper(id)]; ok {
+				m.KnownExploited = true
+				m.KEV = &entry
+				break
+			}
+		}
+	}
+}
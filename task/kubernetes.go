@@ -0,0 +1,711 @@
+package task
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/opengovern/og-util/pkg/opengovernance-es-sdk"
+	"github.com/opengovern/og-util/pkg/tasks"
+	"github.com/opengovern/opencomply/services/tasks/scheduler"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+	"net"
+	"net/http"
+	"net/url"
+	"oras.land/oras-go/v2/registry"
+	"os"
+	"strings"
+	"time"
+)
+
+// Service account files mounted into pods, read for in-cluster access to the API.
+const (
+	serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+const (
+	// kubeListPageSize is the number of objects requested per page of the list calls.
+	kubeListPageSize = 500
+	// kubeRequestTimeout bounds each request to the API server.
+	kubeRequestTimeout = 30 * time.Second
+)
+
+// ClusterScanResult is the result of a scan-cluster run, the ScanRunResult of all the images running in the cluster
+// along with the summary of each namespace.
+type ClusterScanResult struct {
+	ScanRunResult
+	Cluster    string                        `json:"cluster,omitempty"`
+	Pods       int                           `json:"pods"`
+	Namespaces []ClusterNamespaceScanSummary `json:"namespaces"`
+}
+
+// ClusterNamespaceScanSummary sums up the scans of the images running in the pods of a namespace, Workloads being the
+// workloads (kind/name) running them.
+type ClusterNamespaceScanSummary struct {
+	Namespace      string         `json:"namespace"`
+	Pods           int            `json:"pods"`
+	Workloads      []string       `json:"workloads"`
+	Images         []string       `json:"images"`
+	ScannedImages  int            `json:"scannedImages"`
+	FailedImages   int            `json:"failedImages"`
+	TotalMatches   int            `json:"totalMatches"`
+	SeverityCounts map[string]int `json:"severityCounts"`
+	FixableCount   int            `json:"fixableCount"`
+	KnownExploited int            `json:"knownExploited"`
+}
+
+// clusterImage is a unique image running in the cluster, pulled by the digest the pods run when known, with the
+// workloads running it and the auths of their image pull secrets.
+type clusterImage struct {
+	Reference string
+	Digest    string
+	Workloads []string
+	Auths     map[string]AuthConfig
+}
+
+// runScanClusterTask lists the images of the running pods of a cluster, reached with the kubeconfig param (inline,
+// at kubeconfig_context or its current context) or the service account of the task when running in the cluster, and
+// scans each unique image once, with the image pull secrets of the pods running it. namespace (repeatable) or
+// namespace_selector selects the namespaces, all of them by default but exclude_namespace, and pod_selector the
+// pods. Results carry the workloads running the image and their namespaces, and cluster_name.
+func runScanClusterTask(ctx context.Context, esClient opengovernance.Client, logger *zap.Logger, request tasks.TaskRequest, response *scheduler.TaskResponse, publish ProgressPublisher, publishFindings FindingsPublisher) error {
+	params := request.TaskDefinition.Params
+	if len(params["namespace"]) > 0 && getParamValue(params, "namespace_selector", "") != "" {
+		return newTaskError(ErrorKindConfig, fmt.Errorf("namespace and namespace_selector are mutually exclusive"))
+	}
+	client, err := newKubeClient(getParamValue(params, "kubeconfig", ""), getParamValue(params, "kubeconfig_context", ""))
+	if err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+
+	namespaces := params["namespace"]
+	if selector := getParamValue(params, "namespace_selector", ""); selector != "" {
+		if namespaces, err = client.listNamespaces(ctx, selector); err != nil {
+			return clusterError(err)
+		}
+		if len(namespaces) == 0 {
+			response.Result = []byte("No namespaces match the namespace selector")
+			return nil
+		}
+	}
+	pods, err := listClusterPods(ctx, client, namespaces, params["exclude_namespace"], getParamValue(params, "pod_selector", ""))
+	if err != nil {
+		return clusterError(err)
+	}
+	images := clusterImages(ctx, logger, client, pods)
+	logger.Info("Listed cluster images", zap.Int("pods", len(pods)), zap.Int("images", len(images)))
+	if len(images) == 0 {
+		response.Result = []byte("No running pods found in the cluster")
+		return nil
+	}
+
+	scanParams := copyParams(params)
+	for _, key := range []string{"kubeconfig", "kubeconfig_context", "namespace", "namespace_selector", "exclude_namespace", "pod_selector"} {
+		delete(scanParams, key)
+	}
+	if getParamValue(params, "registry_type", "") == "" {
+		// Private images are pulled with the image pull secrets of their pods
+		scanParams["registry_type"] = []string{string(RegistryPublic)}
+	}
+	var urls, digests, workloads, pullAuths []string
+	for _, image := range images {
+		auths := ""
+		if len(image.Auths) > 0 {
+			data, err := json.Marshal(image.Auths)
+			if err != nil {
+				return err
+			}
+			auths = string(data)
+		}
+		urls = append(urls, image.Reference)
+		digests = append(digests, image.Digest)
+		workloads = append(workloads, strings.Join(image.Workloads, ","))
+		pullAuths = append(pullAuths, auths)
+	}
+	scanParams["oci_artifact_url"] = urls
+	scanParams["artifact_digest"] = digests
+	scanParams["artifact_workloads"] = workloads
+	scanParams["artifact_pull_auths"] = pullAuths
+
+	scanRequest := request
+	scanRequest.TaskDefinition.Params = scanParams
+	// The pull secrets are credentials of the scan params now
+	scanErr := runScanTask(ctx, esClient, RedactingLogger(logger, scanParams), scanRequest, response, publish, publishFindings)
+	if result, ok := clusterScanResult(response.Result, getParamValue(params, "cluster_name", ""), pods, images); ok {
+		response.Result = result
+	}
+	return scanErr
+}
+
+// clusterError classifies a failed request to the Kubernetes API, denied requests being auth errors.
+func clusterError(err error) error {
+	var se *statusError
+	if errors.As(err, &se) && (se.StatusCode == http.StatusUnauthorized || se.StatusCode == http.StatusForbidden) {
+		return newTaskError(ErrorKindAuth, err)
+	}
+	return err
+}
+
+// listClusterPods returns the running pods of namespaces, of all namespaces when empty except excluded, matching the
+// pod selector.
+func listClusterPods(ctx context.Context, client *kubeClient, namespaces, excluded []string, selector string) ([]kubePod, error) {
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+	var pods []kubePod
+	for _, namespace := range namespaces {
+		listed, err := client.listRunningPods(ctx, namespace, selector)
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range listed {
+			if !containsString(excluded, pod.Metadata.Namespace) {
+				pods = append(pods, pod)
+			}
+		}
+	}
+	return pods, nil
+}
+
+// clusterImages returns the unique images of the containers of the pods, init and ephemeral containers included.
+// Images are told apart by the digest the pods run, from the image ID of their container status, or by their
+// reference when it isn't known yet. Pull secrets which can't be read are skipped with a warning, the image may be
+// public or pulled with the credentials of registry_type.
+func clusterImages(ctx context.Context, logger *zap.Logger, client *kubeClient, pods []kubePod) []*clusterImage {
+	var images []*clusterImage
+	byKey := map[string]*clusterImage{}
+	secrets := map[string]map[string]AuthConfig{}
+	for _, pod := range pods {
+		statuses := map[string]kubeContainerStatus{}
+		for _, list := range [][]kubeContainerStatus{pod.Status.ContainerStatuses, pod.Status.InitContainerStatuses, pod.Status.EphemeralContainerStatuses} {
+			for _, status := range list {
+				statuses[status.Name] = status
+			}
+		}
+
+		var auths map[string]AuthConfig
+		for _, secret := range pod.Spec.ImagePullSecrets {
+			key := pod.Metadata.Namespace + "/" + secret.Name
+			secretAuths, ok := secrets[key]
+			if !ok {
+				var err error
+				if secretAuths, err = client.getPullSecretAuths(ctx, pod.Metadata.Namespace, secret.Name); err != nil {
+					logger.Warn("failed to read image pull secret", zap.String("secret", key), zap.Error(err))
+				}
+				secrets[key] = secretAuths
+			}
+			if len(secretAuths) > 0 && auths == nil {
+				auths = map[string]AuthConfig{}
+			}
+			mergeAuths(auths, secretAuths)
+		}
+
+		workload := podWorkload(pod)
+		var containers []kubeContainer
+		containers = append(containers, pod.Spec.Containers...)
+		containers = append(containers, pod.Spec.InitContainers...)
+		containers = append(containers, pod.Spec.EphemeralContainers...)
+		for _, container := range containers {
+			reference, err := normalizeImageReference(container.Image)
+			if err != nil {
+				logger.Warn("skipping invalid image reference", zap.String("pod", pod.Metadata.Namespace+"/"+pod.Metadata.Name),
+					zap.String("image", container.Image), zap.Error(err))
+				continue
+			}
+			digest := imageIDDigest(statuses[container.Name].ImageID)
+			key := reference
+			if digest != "" {
+				// The pods run the digest, whatever the tag points to by now
+				if reference, err = digestReference(reference, digest); err != nil {
+					continue
+				}
+				key = digest
+			}
+			image, ok := byKey[key]
+			if !ok {
+				image = &clusterImage{Reference: reference, Digest: digest}
+				byKey[key] = image
+				images = append(images, image)
+			}
+			if !containsString(image.Workloads, workload) {
+				image.Workloads = append(image.Workloads, workload)
+			}
+			if len(auths) > 0 && image.Auths == nil {
+				image.Auths = map[string]AuthConfig{}
+			}
+			mergeAuths(image.Auths, auths)
+		}
+	}
+	return images
+}
+
+// imageIDDigest returns the digest of the image ID of a container status, e.g. docker-pullable://nginx@sha256:...,
+// empty for the IDs of local images, which have no repository digest.
+func imageIDDigest(imageID string) string {
+	_, digest, ok := strings.Cut(imageID, "@")
+	if !ok {
+		return ""
+	}
+	normalized, err := normalizeDigest(digest)
+	if err != nil {
+		return ""
+	}
+	return normalized
+}
+
+// digestReference returns the reference of the image of reference at digest.
+func digestReference(reference, digest string) (string, error) {
+	ref, err := registry.ParseReference(reference)
+	if err != nil {
+		return "", err
+	}
+	ref.Reference = digest
+	return ref.String(), nil
+}
+
+// podWorkload returns the workload of the pod, namespace/kind/name: the deployment of the replica set owning it, its
+// controller or the pod itself.
+func podWorkload(pod kubePod) string {
+	kind, name := "Pod", pod.Metadata.Name
+	for _, owner := range pod.Metadata.OwnerReferences {
+		if !owner.Controller {
+			continue
+		}
+		kind, name = owner.Kind, owner.Name
+		if hash := pod.Metadata.Labels["pod-template-hash"]; owner.Kind == "ReplicaSet" && hash != "" && strings.HasSuffix(owner.Name, "-"+hash) {
+			// Deployments name their replica sets after the hash of the pod template
+			kind, name = "Deployment", strings.TrimSuffix(owner.Name, "-"+hash)
+		}
+		break
+	}
+	return pod.Metadata.Namespace + "/" + kind + "/" + name
+}
+
+// workloadNamespaces returns the namespaces of the comma separated workloads (artifact_workloads).
+func workloadNamespaces(workloads string) []string {
+	var namespaces []string
+	for _, workload := range strings.Split(workloads, ",") {
+		namespace, _, _ := strings.Cut(workload, "/")
+		if !containsString(namespaces, namespace) {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces
+}
+
+// clusterScanResult returns the ClusterScanResult of the ScanRunResult of the images running in the cluster, in the
+// order they were listed in. Other results, e.g. of a breached severity gate, aren't.
+func clusterScanResult(runResult []byte, cluster string, pods []kubePod, images []*clusterImage) ([]byte, bool) {
+	var result ClusterScanResult
+	if err := json.Unmarshal(runResult, &result.ScanRunResult); err != nil || len(result.Statuses) != len(images) {
+		return nil, false
+	}
+	scanned := make(map[string]ImageScanSummary, len(result.Images))
+	for _, image := range result.Images {
+		scanned[image.ImageURL] = image
+	}
+
+	var summaries []*ClusterNamespaceScanSummary
+	byNamespace := map[string]*ClusterNamespaceScanSummary{}
+	summaryOf := func(namespace string) *ClusterNamespaceScanSummary {
+		summary, ok := byNamespace[namespace]
+		if !ok {
+			summary = &ClusterNamespaceScanSummary{Namespace: namespace, Workloads: []string{}, Images: []string{}, SeverityCounts: map[string]int{}}
+			byNamespace[namespace] = summary
+			summaries = append(summaries, summary)
+		}
+		return summary
+	}
+	for _, pod := range pods {
+		summaryOf(pod.Metadata.Namespace).Pods++
+	}
+	for pos, status := range result.Statuses {
+		image, ok := scanned[status.ImageURL]
+		counted := map[string]bool{}
+		for _, workload := range images[pos].Workloads {
+			namespace, kindName, _ := strings.Cut(workload, "/")
+			summary := summaryOf(namespace)
+			if !containsString(summary.Workloads, kindName) {
+				summary.Workloads = append(summary.Workloads, kindName)
+			}
+			if counted[namespace] {
+				continue
+			}
+			counted[namespace] = true
+			summary.Images = append(summary.Images, status.ImageURL)
+			switch status.Status {
+			case ImageStatusSucceeded:
+				summary.ScannedImages++
+			case ImageStatusFailed:
+				summary.FailedImages++
+			}
+			if !ok {
+				continue
+			}
+			summary.TotalMatches += image.TotalMatches
+			summary.FixableCount += image.FixableCount
+			summary.KnownExploited += image.KnownExploited
+			for severity, count := range image.SeverityCounts {
+				summary.SeverityCounts[severity] += count
+			}
+		}
+	}
+	result.Cluster = cluster
+	result.Pods = len(pods)
+	result.Namespaces = make([]ClusterNamespaceScanSummary, len(summaries))
+	for i, summary := range summaries {
+		result.Namespaces[i] = *summary
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// kubeClient is a minimal client of the Kubernetes API, reading the namespaces, pods and image pull secrets of a
+// cluster.
+type kubeClient struct {
+	server     string
+	token      string
+	httpClient *http.Client
+}
+
+// kubeconfig holds the parts of a kubeconfig file the kubeClient uses. Credentials are tokens or client
+// certificates, exec and auth-provider plugins aren't run.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string      `yaml:"token"`
+			ClientCertificateData string      `yaml:"client-certificate-data"`
+			ClientKeyData         string      `yaml:"client-key-data"`
+			Exec                  interface{} `yaml:"exec"`
+			AuthProvider          interface{} `yaml:"auth-provider"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+// newKubeClient returns the client of the cluster of the kubeconfig content, at contextName or its current context,
+// or of the cluster the task runs in with its service account when content is empty.
+func newKubeClient(content, contextName string) (*kubeClient, error) {
+	if content == "" {
+		return newInClusterKubeClient()
+	}
+
+	var cfg kubeconfig
+	if err := yaml.Unmarshal([]byte(content), &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse kubeconfig: %w", err)
+	}
+	if contextName == "" {
+		contextName = cfg.CurrentContext
+	}
+	var clusterName, userName string
+	found := false
+	for _, c := range cfg.Contexts {
+		if c.Name == contextName {
+			clusterName, userName, found = c.Context.Cluster, c.Context.User, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("kubeconfig has no context %q", contextName)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	var server string
+	for _, c := range cfg.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		server = c.Cluster.Server
+		tlsConfig.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+		if c.Cluster.CertificateAuthorityData != "" {
+			ca, err := base64.StdEncoding.DecodeString(c.Cluster.CertificateAuthorityData)
+			if err != nil {
+				return nil, fmt.Errorf("kubeconfig cluster %s: invalid certificate-authority-data: %w", clusterName, err)
+			}
+			if tlsConfig.RootCAs, err = certPool(ca); err != nil {
+				return nil, fmt.Errorf("kubeconfig cluster %s: %w", clusterName, err)
+			}
+		}
+	}
+	if server == "" {
+		return nil, fmt.Errorf("kubeconfig has no server for cluster %q", clusterName)
+	}
+
+	var token string
+	for _, u := range cfg.Users {
+		if u.Name != userName {
+			continue
+		}
+		if u.User.Exec != nil || u.User.AuthProvider != nil {
+			return nil, fmt.Errorf("kubeconfig user %s: exec and auth-provider credentials aren't supported, use a token or a client certificate", userName)
+		}
+		token = u.User.Token
+		if u.User.ClientCertificateData != "" {
+			certPEM, err := base64.StdEncoding.DecodeString(u.User.ClientCertificateData)
+			if err != nil {
+				return nil, fmt.Errorf("kubeconfig user %s: invalid client-certificate-data: %w", userName, err)
+			}
+			keyPEM, err := base64.StdEncoding.DecodeString(u.User.ClientKeyData)
+			if err != nil {
+				return nil, fmt.Errorf("kubeconfig user %s: invalid client-key-data: %w", userName, err)
+			}
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				return nil, fmt.Errorf("kubeconfig user %s: %w", userName, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+	return newKubeClientWithTLS(server, token, tlsConfig), nil
+}
+
+func newInClusterKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("no kubeconfig given and not running in a cluster (KUBERNETES_SERVICE_HOST is not set)")
+	}
+	token, err := os.ReadFile(serviceAccountTokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the service account token: %w", err)
+	}
+	ca, err := os.ReadFile(serviceAccountCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the service account CA: %w", err)
+	}
+	pool, err := certPool(ca)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool}
+	return newKubeClientWithTLS("https://"+net.JoinHostPort(host, port), strings.TrimSpace(string(token)), tlsConfig), nil
+}
+
+func newKubeClientWithTLS(server, token string, tlsConfig *tls.Config) *kubeClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &kubeClient{
+		server:     strings.TrimSuffix(server, "/"),
+		token:      token,
+		httpClient: &http.Client{Transport: transport, Timeout: kubeRequestTimeout},
+	}
+}
+
+func certPool(pemCerts []byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return nil, fmt.Errorf("no valid CA certificate found")
+	}
+	return pool, nil
+}
+
+// get decodes the JSON object at the API path, with the query, into out.
+func (c *kubeClient) get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	u := c.server + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("kubernetes API request %s failed: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{StatusCode: resp.StatusCode, Err: fmt.Errorf("kubernetes API request %s: unexpected status %d", path, resp.StatusCode)}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type kubeObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	Labels          map[string]string `json:"labels"`
+	OwnerReferences []struct {
+		Kind       string `json:"kind"`
+		Name       string `json:"name"`
+		Controller bool   `json:"controller"`
+	} `json:"ownerReferences"`
+}
+
+type kubeListMeta struct {
+	Continue string `json:"continue"`
+}
+
+type kubeContainer struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+type kubeContainerStatus struct {
+	Name    string `json:"name"`
+	Image   string `json:"image"`
+	ImageID string `json:"imageID"`
+}
+
+type kubePod struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+	Spec     struct {
+		Containers          []kubeContainer `json:"containers"`
+		InitContainers      []kubeContainer `json:"initContainers"`
+		EphemeralContainers []kubeContainer `json:"ephemeralContainers"`
+		ImagePullSecrets    []struct {
+			Name string `json:"name"`
+		} `json:"imagePullSecrets"`
+	} `json:"spec"`
+	Status struct {
+		ContainerStatuses          []kubeContainerStatus `json:"containerStatuses"`
+		InitContainerStatuses      []kubeContainerStatus `json:"initContainerStatuses"`
+		EphemeralContainerStatuses []kubeContainerStatus `json:"ephemeralContainerStatuses"`
+	} `json:"status"`
+}
+
+type kubeSecret struct {
+	Type string            `json:"type"`
+	Data map[string][]byte `json:"data"`
+}
+
+// listNamespaces returns the names of the namespaces matching the label selector.
+func (c *kubeClient) listNamespaces(ctx context.Context, selector string) ([]string, error) {
+	var names []string
+	query := url.Values{"limit": {fmt.Sprint(kubeListPageSize)}}
+	if selector != "" {
+		query.Set("labelSelector", selector)
+	}
+	for {
+		// Only the metadata of the namespaces is decoded
+		var list struct {
+			Metadata kubeListMeta `json:"metadata"`
+			Items    []struct {
+				Metadata kubeObjectMeta `json:"metadata"`
+			} `json:"items"`
+		}
+		if err := c.get(ctx, "/api/v1/namespaces", query, &list); err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			names = append(names, item.Metadata.Name)
+		}
+		if list.Metadata.Continue == "" {
+			return names, nil
+		}
+		query.Set("continue", list.Metadata.Continue)
+	}
+}
+
+// listRunningPods returns the running pods of namespace, of all namespaces when empty, matching the label selector.
+func (c *kubeClient) listRunningPods(ctx context.Context, namespace, selector string) ([]kubePod, error) {
+	path := "/api/v1/pods"
+	if namespace != "" {
+		path = "/api/v1/namespaces/" + url.PathEscape(namespace) + "/pods"
+	}
+	query := url.Values{
+		"limit":         {fmt.Sprint(kubeListPageSize)},
+		"fieldSelector": {"status.phase=Running"},
+	}
+	if selector != "" {
+		query.Set("labelSelector", selector)
+	}
+
+	var pods []kubePod
+	for {
+		var list struct {
+			Metadata kubeListMeta `json:"metadata"`
+			Items    []kubePod    `json:"items"`
+		}
+		if err := c.get(ctx, path, query, &list); err != nil {
+			return nil, err
+		}
+		pods = append(pods, list.Items...)
+		if list.Metadata.Continue == "" {
+			return pods, nil
+		}
+		query.Set("continue", list.Metadata.Continue)
+	}
+}
+
+// getPullSecretAuths returns the registry auths of the image pull secret name of namespace, a
+// kubernetes.io/dockerconfigjson or kubernetes.io/dockercfg secret.
+func (c *kubeClient) getPullSecretAuths(ctx context.Context, namespace, name string) (map[string]AuthConfig, error) {
+	var secret kubeSecret
+	if err := c.get(ctx, "/api/v1/namespaces/"+url.PathEscape(namespace)+"/secrets/"+url.PathEscape(name), nil, &secret); err != nil {
+		return nil, err
+	}
+
+	type entry struct {
+		Auth     string `json:"auth"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	var entries map[string]entry
+	switch secret.Type {
+	case "kubernetes.io/dockerconfigjson":
+		var cfg struct {
+			Auths map[string]entry `json:"auths"`
+		}
+		if err := json.Unmarshal(secret.Data[".dockerconfigjson"], &cfg); err != nil {
+			return nil, fmt.Errorf("invalid .dockerconfigjson: %w", err)
+		}
+		entries = cfg.Auths
+	case "kubernetes.io/dockercfg":
+		if err := json.Unmarshal(secret.Data[".dockercfg"], &entries); err != nil {
+			return nil, fmt.Errorf("invalid .dockercfg: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("not an image pull secret: type %s", secret.Type)
+	}
+
+	auths := make(map[string]AuthConfig, len(entries))
+	for host, e := range entries {
+		auth := e.Auth
+		if auth == "" && e.Username != "" {
+			auth = base64.StdEncoding.EncodeToString([]byte(e.Username + ":" + e.Password))
+		}
+		if auth == "" {
+			continue
+		}
+		auths[pullSecretHost(host)] = AuthConfig{Auth: auth}
+	}
+	return auths, nil
+}
+
+// pullSecretHost returns the registry host of a docker config key, which may be a URL, keeping the legacy Docker Hub
+// index URL the credentials of Docker Hub are looked up by.
+func pullSecretHost(key string) string {
+	if key == dockerHubAuthKey || isDockerHubHost(strings.TrimSuffix(strings.TrimPrefix(key, "https://"), "/v1/")) {
+		return dockerHubAuthKey
+	}
+	host := strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	host, _, _ = strings.Cut(host, "/")
+	return host
+}
@@ -0,0 +1,155 @@
+package task
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPullSecretHost(t *testing.T) {
+	for _, tc := range []struct {
+		key      string
+		expected string
+	}{
+		{key: "https://index.docker.io/v1/", expected: dockerHubAuthKey},
+		{key: "docker.io", expected: dockerHubAuthKey},
+		{key: "https://registry-1.docker.io", expected: dockerHubAuthKey},
+		{key: "index.docker.io/v1/", expected: dockerHubAuthKey},
+		{key: "ghcr.io", expected: "ghcr.io"},
+		{key: "https://ghcr.io/v2/", expected: "ghcr.io"},
+		{key: "http://registry.local:5000/path", expected: "registry.local:5000"},
+		{key: "https://docker.io.example.com", expected: "docker.io.example.com"},
+	} {
+		t.Run(tc.key, func(t *testing.T) {
+			if host := pullSecretHost(tc.key); host != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, host)
+			}
+		})
+	}
+}
+
+func TestPodWorkload(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		metadata string
+		expected string
+	}{
+		{name: "bare pod", metadata: `{"name":"debug","namespace":"ns"}`, expected: "ns/Pod/debug"},
+		{name: "deployment", metadata: `{"name":"web-7d9f8-abcde","namespace":"ns","labels":{"pod-template-hash":"7d9f8"},
+			"ownerReferences":[{"kind":"ReplicaSet","name":"web-7d9f8","controller":true}]}`, expected: "ns/Deployment/web"},
+		{name: "replica set not named after the hash", metadata: `{"name":"web-abcde","namespace":"ns",
+			"labels":{"pod-template-hash":"7d9f8"},"ownerReferences":[{"kind":"ReplicaSet","name":"web","controller":true}]}`,
+			expected: "ns/ReplicaSet/web"},
+		{name: "replica set without hash label", metadata: `{"name":"web-7d9f8-abcde","namespace":"ns",
+			"ownerReferences":[{"kind":"ReplicaSet","name":"web-7d9f8","controller":true}]}`, expected: "ns/ReplicaSet/web-7d9f8"},
+		{name: "stateful set", metadata: `{"name":"db-0","namespace":"ns",
+			"ownerReferences":[{"kind":"StatefulSet","name":"db","controller":true}]}`, expected: "ns/StatefulSet/db"},
+		{name: "owner that isn't the controller", metadata: `{"name":"job-x","namespace":"ns",
+			"ownerReferences":[{"kind":"ConfigMap","name":"cfg"},{"kind":"Job","name":"job","controller":true}]}`,
+			expected: "ns/Job/job"},
+		{name: "no controller", metadata: `{"name":"job-x","namespace":"ns",
+			"ownerReferences":[{"kind":"ConfigMap","name":"cfg"}]}`, expected: "ns/Pod/job-x"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var pod kubePod
+			if err := json.Unmarshal([]byte(tc.metadata), &pod.Metadata); err != nil {
+				t.Fatal(err)
+			}
+			if workload := podWorkload(pod); workload != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, workload)
+			}
+		})
+	}
+}
+
+func TestImageIDDigest(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	for _, tc := range []struct {
+		imageID  string
+		expected string
+	}{
+		{imageID: "docker-pullable://nginx@" + digest, expected: digest},
+		{imageID: "ghcr.io/org/app@" + strings.ToUpper(digest[:7]) + digest[7:], expected: digest},
+		{imageID: "sha256:" + strings.Repeat("cd", 32)},
+		{imageID: "nginx@sha256:short"},
+		{imageID: ""},
+	} {
+		t.Run(tc.imageID, func(t *testing.T) {
+			if d := imageIDDigest(tc.imageID); d != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, d)
+			}
+		})
+	}
+}
+
+func TestGetPullSecretAuths(t *testing.T) {
+	basic := func(user, password string) string {
+		return base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+	}
+	dockerConfigJSON, err := json.Marshal(map[string]interface{}{"auths": map[string]interface{}{
+		"https://index.docker.io/v1/": map[string]string{"auth": basic("hub", "secret")},
+		"https://ghcr.io":             map[string]string{"username": "user", "password": "token"},
+		"registry.local:5000":         map[string]string{},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dockerCfg, err := json.Marshal(map[string]interface{}{
+		"quay.io": map[string]string{"auth": basic("robot", "pw")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets := map[string]kubeSecret{
+		"config-json": {Type: "kubernetes.io/dockerconfigjson", Data: map[string][]byte{".dockerconfigjson": dockerConfigJSON}},
+		"legacy":      {Type: "kubernetes.io/dockercfg", Data: map[string][]byte{".dockercfg": dockerCfg}},
+		"malformed":   {Type: "kubernetes.io/dockerconfigjson", Data: map[string][]byte{".dockerconfigjson": []byte("{")}},
+		"opaque":      {Type: "Opaque", Data: map[string][]byte{"password": []byte("pw")}},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret, ok := secrets[strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/ns/secrets/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(secret)
+	}))
+	defer server.Close()
+	client := newKubeClientWithTLS(server.URL, "token", nil)
+
+	for _, tc := range []struct {
+		secret   string
+		expected map[string]AuthConfig
+		invalid  bool
+	}{
+		{secret: "config-json", expected: map[string]AuthConfig{
+			dockerHubAuthKey: {Auth: basic("hub", "secret")},
+			"ghcr.io":        {Auth: basic("user", "token")},
+		}},
+		{secret: "legacy", expected: map[string]AuthConfig{"quay.io": {Auth: basic("robot", "pw")}}},
+		{secret: "malformed", invalid: true},
+		{secret: "opaque", invalid: true},
+		{secret: "missing", invalid: true},
+	} {
+		t.Run(tc.secret, func(t *testing.T) {
+			auths, err := client.getPullSecretAuths(context.Background(), "ns", tc.secret)
+			if tc.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got auths %v", auths)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(auths, tc.expected) {
+				t.Errorf("expected auths %v, got %v", tc.expected, auths)
+			}
+		})
+	}
+}
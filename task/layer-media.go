@@ -0,0 +1,101 @@
+package task
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"strings"
+)
+
+// zstdMagic starts zstd frames.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// isZstdLayer reports whether the layer media type is that of a zstd compressed tar, which docker archive readers
+// don't all decompress, unlike gzip.
+func isZstdLayer(desc ocispec.Descriptor) bool {
+	return strings.HasSuffix(desc.MediaType, "+zstd")
+}
+
+// configDiffIDs returns the diff IDs of the layers listed in the image config, nil when they don't match the layers of
+// the manifest one to one.
+func configDiffIDs(configContent []byte, layers []ocispec.Descriptor) []digest.Digest {
+	var config ocispec.Image
+	if err := json.Unmarshal(configContent, &config); err != nil {
+		return nil
+	}
+	if len(config.RootFS.DiffIDs) != len(layers) {
+		return nil
+	}
+	return config.RootFS.DiffIDs
+}
+
+// layerSources returns the LayerSources of the docker archive manifest.json, the descriptors of the foreign layers by
+// diff ID, as docker save records them so loaders know the origin of the layers.
+func layerSources(layers []ocispec.Descriptor, diffIDs []digest.Digest) map[digest.Digest]ocispec.Descriptor {
+	if diffIDs == nil {
+		return nil
+	}
+	sources := map[digest.Digest]ocispec.Descriptor{}
+	for i, layer := range layers {
+		if isForeignLayer(layer) {
+			sources[diffIDs[i]] = ocispec.Descriptor{
+				MediaType: layer.MediaType,
+				Digest:    layer.Digest,
+				Size:      layer.Size,
+				URLs:      layer.URLs,
+			}
+		}
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+	return sources
+}
+
+// maybeDecompress returns a reader decompressing r if it's gzip or zstd compressed, and r as is otherwise.
+func maybeDecompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err == nil && string(magic) == string(zstdMagic) {
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	if len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return io.NopCloser(br), nil
+}
+
+// writeDecompressedLayer writes the zstd compressed layer read from r to w as a plain tar, verifying it against the
+// diff ID of the layer in the config when known.
+func writeDecompressedLayer(w io.Writer, r io.Reader, layerDesc ocispec.Descriptor, diffID digest.Digest) error {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to decompress layer %s: %w", layerDesc.Digest, err)
+	}
+	defer zr.Close()
+
+	var verifier digest.Verifier
+	if diffID != "" {
+		if err := diffID.Validate(); err != nil {
+			return fmt.Errorf("invalid diff ID of layer %s: %w", layerDesc.Digest, err)
+		}
+		verifier = diffID.Verifier()
+		w = io.MultiWriter(w, verifier)
+	}
+	if _, err := io.Copy(w, zr); err != nil {
+		return fmt.Errorf("failed to decompress layer %s: %w", layerDesc.Digest, err)
+	}
+	if verifier != nil && !verifier.Verified() {
+		return fmt.Errorf("layer %s doesn't decompress to its diff ID %s", layerDesc.Digest, diffID)
+	}
+	return nil
+}
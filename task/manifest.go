@@ -0,0 +1,220 @@
+package task
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/opengovern/og-util/pkg/opengovernance-es-sdk"
+	"github.com/opengovern/og-util/pkg/tasks"
+	"github.com/opengovern/opencomply/services/tasks/scheduler"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+	"io"
+	"oras.land/oras-go/v2/registry"
+	"sort"
+	"strings"
+)
+
+// DefaultRegistry is the registry of image references without one, as with docker.
+const DefaultRegistry = "docker.io"
+
+// runScanManifestTask extracts the image references of the docker compose files or kubernetes manifests given in the
+// manifest param (inline YAML, multiple documents allowed), resolves their digests and scans them as a batch. Each
+// result records the manifests (manifest_name, by position) referencing the image.
+func runScanManifestTask(ctx context.Context, esClient opengovernance.Client, logger *zap.Logger, request tasks.TaskRequest, response *scheduler.TaskResponse, publish ProgressPublisher, publishFindings FindingsPublisher) error {
+	params := request.TaskDefinition.Params
+	if len(params["manifest"]) == 0 {
+		return newTaskError(ErrorKindConfig, fmt.Errorf("manifest parameter is not provided"))
+	}
+	scanParams, err := manifestScanParams(ctx, logger, params)
+	if err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+	if len(scanParams["oci_artifact_url"]) == 0 {
+		response.Result = []byte("No images found in the manifests")
+		return nil
+	}
+
+	scanRequest := request
+	scanRequest.TaskDefinition.Params = scanParams
+	return runScanTask(ctx, esClient, logger, scanRequest, response, publish, publishFindings)
+}
+
+// manifestScanParams extracts the images of the manifest params, returning the params scanning them, without any
+// oci_artifact_url when none was found. Each image records the manifests referencing it (artifact_source_manifest,
+// comma separated).
+func manifestScanParams(ctx context.Context, logger *zap.Logger, params map[string][]string) (map[string][]string, error) {
+	manifests := params["manifest"]
+	var images []string
+	sources := make(map[string][]string)
+	for i, content := range manifests {
+		name := paramAt(params, "manifest_name", i, fmt.Sprintf("manifest-%d", i))
+		refs, err := extractManifestImages([]byte(content))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse manifest %s: %w", name, err)
+		}
+		for _, ref := range refs {
+			image, err := normalizeImageReference(ref)
+			if err != nil {
+				logger.Warn("skipping image reference", zap.String("manifest", name), zap.String("image", ref), zap.Error(err))
+				continue
+			}
+			if _, ok := sources[image]; !ok {
+				images = append(images, image)
+			}
+			if !containsString(sources[image], name) {
+				sources[image] = append(sources[image], name)
+			}
+		}
+	}
+	logger.Info("Found images in manifests", zap.Int("manifests", len(manifests)), zap.Int("count", len(images)))
+	scanParams := copyParams(params)
+	if len(images) == 0 {
+		delete(scanParams, "oci_artifact_url")
+		return scanParams, nil
+	}
+
+	digests := resolveImageDigests(ctx, logger, params, images)
+
+	// References resolving to the same digest (e.g. a tag and its digest) are scanned once
+	var scanImages, scanDigests, scanSources []string
+	seenDigests := make(map[string]int)
+	for i, image := range images {
+		if d := digests[i]; d != "" {
+			if j, ok := seenDigests[d]; ok {
+				for _, name := range sources[image] {
+					if !strings.Contains(","+scanSources[j]+",", ","+name+",") {
+						scanSources[j] += "," + name
+					}
+				}
+				continue
+			}
+			seenDigests[d] = len(scanImages)
+		}
+		scanImages = append(scanImages, image)
+		scanDigests = append(scanDigests, digests[i])
+		scanSources = append(scanSources, strings.Join(sources[image], ","))
+	}
+
+	scanParams["oci_artifact_url"] = scanImages
+	scanParams["artifact_digest"] = scanDigests
+	scanParams["artifact_source_manifest"] = scanSources
+	return scanParams, nil
+}
+
+// extractManifestImages returns the values of all "image" keys of the YAML documents in content, which covers the
+// services of compose files as well as the (init and ephemeral) containers of kubernetes workloads.
+func extractManifestImages(content []byte) ([]string, error) {
+	var images []string
+	dec := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var doc interface{}
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, findImageValues(doc)...)
+	}
+	return images, nil
+}
+
+func findImageValues(node interface{}) []string {
+	var images []string
+	switch n := node.(type) {
+	case map[interface{}]interface{}:
+		// Keys are visited in order so the images come out in a stable order
+		keys := make([]string, 0, len(n))
+		byKey := make(map[string]interface{}, len(n))
+		for k, v := range n {
+			key := fmt.Sprint(k)
+			keys = append(keys, key)
+			byKey[key] = v
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			v := byKey[key]
+			if key == "image" {
+				if image, ok := v.(string); ok && image != "" {
+					images = append(images, image)
+					continue
+				}
+			}
+			images = append(images, findImageValues(v)...)
+		}
+	case []interface{}:
+		for _, v := range n {
+			images = append(images, findImageValues(v)...)
+		}
+	}
+	return images
+}
+
+// normalizeImageReference qualifies an image reference the way docker does: references without a registry are on
+// Docker Hub (official images under library/) and references without a tag or digest use latest.
+func normalizeImageReference(image string) (string, error) {
+	image = strings.TrimSpace(image)
+	if strings.Contains(image, "${") || strings.Contains(image, "{{") {
+		return "", fmt.Errorf("unresolved template variable in image reference")
+	}
+
+	name, digest, hasDigest := strings.Cut(image, "@")
+	firstPart, _, hasSlash := strings.Cut(name, "/")
+	switch {
+	case !hasSlash:
+		name = DefaultRegistry + "/library/" + name
+	case !strings.ContainsAny(firstPart, ".:") && firstPart != "localhost":
+		name = DefaultRegistry + "/" + name
+	}
+
+	if hasDigest {
+		name += "@" + digest
+	} else if lastPart := name[strings.LastIndex(name, "/")+1:]; !strings.Contains(lastPart, ":") {
+		name += ":latest"
+	}
+
+	ref, err := registry.ParseReference(name)
+	if err != nil {
+		return "", err
+	}
+	return ref.String(), nil
+}
+
+// resolveImageDigests resolves the manifest digest of each image with the task credentials. Images which can't be
+// resolved get an empty digest and are resolved when fetched instead.
+func resolveImageDigests(ctx context.Context, logger *zap.Logger, params map[string][]string, images []string) []string {
+	digests := make([]string, len(images))
+
+	registryType := getParamValue(params, "registry_type", string(RegistryGHCR))
+	auths, err := getRegistryAuths(ctx, registryType, getCredsFromParams(params))
+	if err != nil {
+		logger.Warn("failed to get registry credentials to resolve digests", zap.Error(err))
+		return digests
+	}
+	cfg := DockerConfig{Auths: auths}
+	opts := pullOptions{Anonymous: RegistryType(registryType) == RegistryPublic}
+
+	for i, image := range images {
+		ref, err := registry.ParseReference(image)
+		if err != nil {
+			continue
+		}
+		if ref.ValidateReferenceAsDigest() == nil {
+			digests[i] = ref.Reference
+			continue
+		}
+		repo, err := newRemoteRepository(ref, cfg, opts)
+		if err != nil {
+			continue
+		}
+		desc, err := repo.Resolve(ctx, ref.Reference)
+		if err != nil {
+			logger.Warn("failed to resolve image digest", zap.String("image", image), zap.Error(err))
+			continue
+		}
+		digests[i] = desc.Digest.String()
+	}
+	return digests
+}
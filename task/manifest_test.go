@@ -0,0 +1,157 @@
+package task
+
+import (
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractManifestImages(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		content  string
+		expected []string
+		invalid  bool
+	}{
+		{name: "compose file", content: `
+services:
+  web:
+    image: nginx:1.25
+    build: .
+  db:
+    image: postgres@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+  worker:
+    build: ./worker
+`, expected: []string{"postgres@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", "nginx:1.25"}},
+		{name: "kubernetes workloads", content: `
+apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      initContainers:
+      - name: init
+        image: busybox
+      containers:
+      - name: app
+        image: ghcr.io/org/app:v1
+      - name: sidecar
+        image: ghcr.io/org/proxy:v2
+---
+apiVersion: batch/v1
+kind: CronJob
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+          - name: job
+            image: ghcr.io/org/job:v3
+`, expected: []string{"ghcr.io/org/app:v1", "ghcr.io/org/proxy:v2", "busybox", "ghcr.io/org/job:v3"}},
+		{name: "image that isn't a string", content: "image:\n  repository: nginx\n  tag: latest\n"},
+		{name: "empty image", content: "image: ''\n"},
+		{name: "empty documents", content: "---\n---\n"},
+		{name: "bad yaml", content: "services:\n  web:\n    image: [nginx\n", invalid: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			images, err := extractManifestImages([]byte(tc.content))
+			if tc.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got images %v", images)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(images, tc.expected) {
+				t.Errorf("expected images %q, got %q", tc.expected, images)
+			}
+		})
+	}
+}
+
+func TestNormalizeImageReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	for _, tc := range []struct {
+		image    string
+		expected string
+		invalid  bool
+	}{
+		{image: "nginx", expected: "docker.io/library/nginx:latest"},
+		{image: " nginx:1.25 ", expected: "docker.io/library/nginx:1.25"},
+		{image: "bitnami/redis:7", expected: "docker.io/bitnami/redis:7"},
+		{image: "ghcr.io/org/app", expected: "ghcr.io/org/app:latest"},
+		{image: "localhost/app:dev", expected: "localhost/app:dev"},
+		{image: "registry:5000/app", expected: "registry:5000/app:latest"},
+		{image: "nginx@" + digest, expected: "docker.io/library/nginx@" + digest},
+		{image: "ghcr.io/org/app:${TAG}", invalid: true},
+		{image: "ghcr.io/org/{{ .Values.image }}", invalid: true},
+		{image: "nginx@sha256:short", invalid: true},
+		{image: "Nginx", invalid: true},
+	} {
+		t.Run(tc.image, func(t *testing.T) {
+			ref, err := normalizeImageReference(tc.image)
+			if tc.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", ref)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ref != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, ref)
+			}
+		})
+	}
+}
+
+func TestManifestScanParams(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	other := "sha256:" + strings.Repeat("cd", 32)
+	params := map[string][]string{
+		"registry_type": {string(RegistryPublic)},
+		"manifest": {
+			"image: nginx@" + digest + "\n",
+			"services:\n  web:\n    image: docker.io/library/nginx@" + digest + "\n  api:\n    image: ${API_IMAGE}\n" +
+				"  app:\n    image: ghcr.io/org/app@" + other + "\n",
+			"image: nginx@" + digest + "\n",
+		},
+		"manifest_name": {"a.yaml", "", "c.yaml"},
+	}
+	scanParams, err := manifestScanParams(context.Background(), zap.NewNop(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The image referenced by the three manifests is scanned once, the unresolved template skipped
+	expected := map[string][]string{
+		"oci_artifact_url":         {"docker.io/library/nginx@" + digest, "ghcr.io/org/app@" + other},
+		"artifact_digest":          {digest, other},
+		"artifact_source_manifest": {"a.yaml,manifest-1,c.yaml", "manifest-1"},
+	}
+	for key, values := range expected {
+		if !reflect.DeepEqual(scanParams[key], values) {
+			t.Errorf("expected %s %q, got %q", key, values, scanParams[key])
+		}
+	}
+
+	scanParams, err = manifestScanParams(context.Background(), zap.NewNop(), map[string][]string{
+		"manifest": {"kind: ConfigMap\n"}, "oci_artifact_url": {"ghcr.io/org/app:v1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := scanParams["oci_artifact_url"]; ok {
+		t.Errorf("expected no oci_artifact_url without images, got %q", scanParams["oci_artifact_url"])
+	}
+
+	_, err = manifestScanParams(context.Background(), zap.NewNop(), map[string][]string{
+		"manifest": {"image: [nginx\n"}, "manifest_name": {"bad.yaml"}})
+	if err == nil || !strings.Contains(err.Error(), "bad.yaml") {
+		t.Errorf("expected an error naming bad.yaml, got %v", err)
+	}
+}
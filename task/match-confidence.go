@@ -0,0 +1,81 @@
+package task
+
+import (
+	"fmt"
+)
+
+// MatchConfidence ranks how reliable a match is, from the type of its match details.
+type MatchConfidence int
+
+const (
+	// MatchConfidenceLow are CPE-based matches, which are prone to false positives.
+	MatchConfidenceLow MatchConfidence = iota
+	// MatchConfidenceMedium are exact matches on a package related to the vulnerable one, e.g. the source package
+	// of a binary package.
+	MatchConfidenceMedium
+	// MatchConfidenceHigh are exact matches on the package itself, and matches of scanners not reporting match types.
+	MatchConfidenceHigh
+)
+
+var matchConfidenceNames = map[MatchConfidence]string{
+	MatchConfidenceLow:    "low",
+	MatchConfidenceMedium: "medium",
+	MatchConfidenceHigh:   "high",
+}
+
+func (c MatchConfidence) String() string {
+	return matchConfidenceNames[c]
+}
+
+// parseMatchConfidence parses the min_match_confidence param, low (the default) keeping all matches.
+func parseMatchConfidence(s string) (MatchConfidence, error) {
+	if s == "" {
+		return MatchConfidenceLow, nil
+	}
+	for c, name := range matchConfidenceNames {
+		if s == name {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid min_match_confidence %q: expected low, medium or high", s)
+}
+
+// matchDetailConfidence returns the confidence of a single grype match detail.
+func matchDetailConfidence(d MatchDetail) MatchConfidence {
+	switch d.Type {
+	case "cpe-match":
+		return MatchConfidenceLow
+	case "exact-indirect-match":
+		return MatchConfidenceMedium
+	default:
+		return MatchConfidenceHigh
+	}
+}
+
+// matchConfidence returns the highest confidence across the details of the match.
+func matchConfidence(m VulnerabilityMatch) MatchConfidence {
+	if len(m.MatchDetails) == 0 {
+		return MatchConfidenceHigh
+	}
+	best := MatchConfidenceLow
+	for _, d := range m.MatchDetails {
+		if c := matchDetailConfidence(d); c > best {
+			best = c
+		}
+	}
+	return best
+}
+
+// filterMatchConfidence drops the matches below min and returns the kept matches along with how many were dropped.
+func filterMatchConfidence(matches []VulnerabilityMatch, min MatchConfidence) ([]VulnerabilityMatch, int) {
+	if min == MatchConfidenceLow {
+		return matches, 0
+	}
+	var kept []VulnerabilityMatch
+	for _, m := range matches {
+		if matchConfidence(m) >= min {
+			kept = append(kept, m)
+		}
+	}
+	return kept, len(matches) - len(kept)
+}
@@ -0,0 +1,90 @@
+package task
+
+import (
+	"testing"
+)
+
+func TestParseMatchConfidence(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected MatchConfidence
+		invalid  bool
+	}{
+		{value: "", expected: MatchConfidenceLow},
+		{value: "low", expected: MatchConfidenceLow},
+		{value: "medium", expected: MatchConfidenceMedium},
+		{value: "high", expected: MatchConfidenceHigh},
+		{value: "High", invalid: true},
+		{value: "exact", invalid: true},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			confidence, err := parseMatchConfidence(tc.value)
+			if tc.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", confidence)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if confidence != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, confidence)
+			}
+		})
+	}
+}
+
+func TestFilterMatchConfidence(t *testing.T) {
+	match := func(types ...string) VulnerabilityMatch {
+		var m VulnerabilityMatch
+		for _, typ := range types {
+			m.MatchDetails = append(m.MatchDetails, MatchDetail{Type: typ})
+		}
+		return m
+	}
+	cpe := match("cpe-match")
+	indirect := match("exact-indirect-match")
+	direct := match("exact-direct-match")
+	// The highest confidence of the details wins, whatever their order
+	mixed := match("cpe-match", "exact-indirect-match", "cpe-match")
+	untyped := match()
+	unknownType := match("dpkg-match")
+	matches := []VulnerabilityMatch{cpe, indirect, direct, mixed, untyped, unknownType}
+
+	for _, tc := range []struct {
+		name     string
+		match    VulnerabilityMatch
+		expected MatchConfidence
+	}{
+		{name: "cpe", match: cpe, expected: MatchConfidenceLow},
+		{name: "indirect", match: indirect, expected: MatchConfidenceMedium},
+		{name: "direct", match: direct, expected: MatchConfidenceHigh},
+		{name: "mixed details", match: mixed, expected: MatchConfidenceMedium},
+		{name: "no details", match: untyped, expected: MatchConfidenceHigh},
+		{name: "unknown type", match: unknownType, expected: MatchConfidenceHigh},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if confidence := matchConfidence(tc.match); confidence != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, confidence)
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		min     MatchConfidence
+		kept    int
+		dropped int
+	}{
+		{min: MatchConfidenceLow, kept: 6},
+		{min: MatchConfidenceMedium, kept: 5, dropped: 1},
+		{min: MatchConfidenceHigh, kept: 3, dropped: 3},
+	} {
+		t.Run("min "+tc.min.String(), func(t *testing.T) {
+			kept, dropped := filterMatchConfidence(matches, tc.min)
+			if len(kept) != tc.kept || dropped != tc.dropped {
+				t.Errorf("expected %d kept and %d dropped, got %d and %d", tc.kept, tc.dropped, len(kept), dropped)
+			}
+		})
+	}
+}
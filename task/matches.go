@@ -0,0 +1,111 @@
+package task
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// severityRanks orders grype severities from most to least severe.
+var severityRanks = map[string]int{
+	"critical":   5,
+	"high":       4,
+	"medium":     3,
+	"low":        2,
+	"negligible": 1,
+	"unknown":    0,
+}
+
+const (
+	MatchSortKeySeverity = "severity"
+	MatchSortKeyCVSS     = "cvss"
+)
+
+// DefaultMatchSortOrder sorts by severity first, then by the highest CVSS base score.
+var DefaultMatchSortOrder = []string{MatchSortKeySeverity, MatchSortKeyCVSS}
+
+func severityRank(severity string) int {
+	return severityRanks[strings.ToLower(severity)]
+}
+
+// maxCVSSScore returns the highest CVSS base score reported for the vulnerability.
+func maxCVSSScore(v Vulnerability) float64 {
+	var score float64
+	for _, cvss := range v.CVSs {
+		if cvss.Metrics.BaseScore > score {
+			score = cvss.Metrics.BaseScore
+		}
+	}
+	return score
+}
+
+// parseMatchSortOrder parses a comma separated list of sort keys (e.g. "severity,cvss").
+func parseMatchSortOrder(value string) ([]string, error) {
+	if value == "" {
+		return DefaultMatchSortOrder, nil
+	}
+	var order []string
+	for _, key := range strings.Split(value, ",") {
+		key = strings.ToLower(strings.TrimSpace(key))
+		switch key {
+		case MatchSortKeySeverity, MatchSortKeyCVSS:
+			order = append(order, key)
+		default:
+			return nil, fmt.Errorf("invalid match sort key %q: expected %s or %s", key, MatchSortKeySeverity, MatchSortKeyCVSS)
+		}
+	}
+	return order, nil
+}
+
+// sortMatches orders the matches from most to least important according to the given sort keys.
+func sortMatches(matches []VulnerabilityMatch, order []string) {
+	sort.SliceStable(matches, func(i, j int) bool {
+		for _, key := range order {
+			switch key {
+			case MatchSortKeySeverity:
+				ri, rj := severityRank(matches[i].Vulnerability.Severity), severityRank(matches[j].Vulnerability.Severity)
+				if ri != rj {
+					return ri > rj
+				}
+			case MatchSortKeyCVSS:
+				si, sj := maxCVSSScore(matches[i].Vulnerability), maxCVSSScore(matches[j].Vulnerability)
+				if si != sj {
+					return si > sj
+				}
+			}
+		}
+		return false
+	})
+}
+
+// summarizeMatches computes the scan totals for the full (untruncated) set of matches.
+func summarizeMatches(matches []VulnerabilityMatch, fixStatePolicy FixStatePolicy) ScanSummary {
+	summary := ScanSummary{
+		TotalMatches:   len(matches),
+		StoredMatches:  len(matches),
+		SeverityCounts: make(map[string]int),
+		FixStatePolicy: fixStatePolicy,
+	}
+	for _, m := range matches {
+		summary.SeverityCounts[m.Vulnerability.Severity]++
+		if strings.EqualFold(m.Vulnerability.Fix.State, FixStateFixed) && fixStatePolicy.Includes(m.Vulnerability.Fix.State) {
+			summary.FixableCount++
+		}
+		if m.KnownExploited {
+			summary.KnownExploitedCount++
+		}
+	}
+	return summary
+}
+
+// capMatches keeps the top maxMatches matches according to order and records the truncation in summary.
+// A maxMatches of zero or less keeps all matches.
+func capMatches(matches []VulnerabilityMatch, maxMatches int, order []string, summary *ScanSummary) []VulnerabilityMatch {
+	if maxMatches <= 0 || len(matches) <= maxMatches {
+		return matches
+	}
+	sortMatches(matches, order)
+	summary.Truncated = true
+	summary.StoredMatches = maxMatches
+	return matches[:maxMatches]
+}
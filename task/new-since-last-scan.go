@@ -0,0 +1,180 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/opengovern/og-util/pkg/es"
+	"github.com/opengovern/og-util/pkg/tasks"
+	"github.com/opensearch-project/opensearch-go/v2"
+	"github.com/opensearch-project/opensearch-go/v2/opensearchapi"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"io"
+	"strings"
+)
+
+// previousScanCandidates is the number of most recent results of an image reference fetched to find the previous
+// scan, results of the current run being skipped.
+const previousScanCandidates = 5
+
+// ComparisonBasis records the previous scan of the image reference the matches were compared with, for
+// NewSinceLastScan.
+type ComparisonBasis struct {
+	// Found is false when the image reference wasn't scanned before (or no result store was available), in which case
+	// every match counts as new.
+	Found          bool   `json:"found"`
+	EsID           string `json:"esId,omitempty"`
+	ArtifactDigest string `json:"artifactDigest,omitempty"`
+	RunID          string `json:"runId,omitempty"`
+	ScannedAt      int64  `json:"scannedAt,omitempty"`
+	// BaselineTruncated is set when the previous result only stored part of its matches (max_matches), matches
+	// beyond those are reported as new.
+	BaselineTruncated bool `json:"baselineTruncated,omitempty"`
+	// NewMatches is the number of new matches, NewSinceLastScan may hold fewer when capped by max_matches.
+	NewMatches int `json:"newMatches"`
+	// Error is set when the previous scan couldn't be looked up, no comparison was made then.
+	Error string `json:"error,omitempty"`
+}
+
+// previousScan is the stored result of an earlier scan of an image reference.
+type previousScan struct {
+	EsID         string                     `json:"-"`
+	ResourceName string                     `json:"resource_name"`
+	DescribedBy  string                     `json:"described_by"`
+	DescribedAt  int64                      `json:"described_at"`
+	Description  OciArtifactVulnerabilities `json:"description"`
+}
+
+// findPreviousScan returns the most recent result stored in indices for imageURL by another run than runID, or nil
+// when there's none.
+func findPreviousScan(ctx context.Context, client *opensearch.Client, indices []string, imageURL, runID string) (*previousScan, error) {
+	query, err := json.Marshal(map[string]interface{}{
+		"size": previousScanCandidates,
+		"sort": []map[string]interface{}{{"described_at": map[string]string{"order": "desc"}}},
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []map[string]interface{}{{"match_phrase": map[string]string{"resource_name": imageURL}}},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the undated index may be missing when the indices are dated
+	ignoreUnavailable := true
+	res, err := opensearchapi.SearchRequest{
+		Index:             indices,
+		IgnoreUnavailable: &ignoreUnavailable,
+		Body:              strings.NewReader(string(query)),
+	}.Do(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query previous scan: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 404 {
+		// The index is created with the first result stored in it
+		return nil, nil
+	}
+	if res.IsError() {
+		return nil, fmt.Errorf("failed to query previous scan: %s", res.String())
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	var page struct {
+		Hits struct {
+			Hits []struct {
+				ID     string       `json:"_id"`
+				Source previousScan `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.Unmarshal(body, &page); err != nil {
+		return nil, fmt.Errorf("failed to parse previous scan: %w", err)
+	}
+	for _, hit := range page.Hits.Hits {
+		// match_phrase also matches references the image URL is part of
+		if hit.Source.ResourceName != imageURL || hit.Source.DescribedBy == runID {
+			continue
+		}
+		prev := hit.Source
+		prev.EsID = hit.ID
+		return &prev, nil
+	}
+	return nil, nil
+}
+
+// matchIdentity identifies a finding across scans: the vulnerability in a package version.
+func matchIdentity(m VulnerabilityMatch) string {
+	return strings.ToUpper(m.Vulnerability.ID) + "|" + matchPackageName(m) + "|" + matchPackageVersion(m)
+}
+
+// newSinceLastScan returns the matches not found by the previous scan, with the comparison basis. Every match is new
+// when there's no previous scan.
+func newSinceLastScan(matches []VulnerabilityMatch, prev *previousScan) ([]VulnerabilityMatch, *ComparisonBasis) {
+	basis := &ComparisonBasis{}
+	known := make(map[string]bool)
+	if prev != nil {
+		basis.Found = true
+		basis.EsID = prev.EsID
+		basis.ArtifactDigest = prev.Description.ArtifactDigest
+		basis.RunID = prev.DescribedBy
+		basis.ScannedAt = prev.DescribedAt
+		basis.BaselineTruncated = prev.Description.Summary.Truncated
+		for _, m := range prev.Description.Vulnerabilities {
+			known[matchIdentity(m)] = true
+		}
+	}
+
+	var fresh []VulnerabilityMatch
+	for _, m := range matches {
+		if !known[matchIdentity(m)] {
+			fresh = append(fresh, m)
+		}
+	}
+	basis.NewMatches = len(fresh)
+	return fresh, basis
+}
+
+// compareWithPreviousScan looks up the previous scan of the artifact in the index its result is stored in and returns
+// the matches new since then, and the diff with it when diff_with_previous is set. A failed lookup is recorded on the
+// basis rather than failing the scan, no diff being returned then.
+func compareWithPreviousScan(ctx context.Context, logger *zap.Logger, request tasks.TaskRequest, opts scanOptions, artifact artifactRef, matches []VulnerabilityMatch) ([]VulnerabilityMatch, *ComparisonBasis, *ScanDiff) {
+	var prev *previousScan
+	if opts.resultStore != nil {
+		index := artifact.OutputIndex
+		if index == "" {
+			index = es.ResourceTypeToESIndex(strings.ToLower(request.TaskDefinition.ResultType))
+		}
+		var err error
+		prev, err = findPreviousScan(ctx, opts.resultStore, datedIndices(index, opts.indexRollover), artifact.URL, FormatRunID(request.TaskDefinition.RunID))
+		if err != nil {
+			logger.Warn("failed to look up the previous scan, not comparing", zap.String("image", artifact.URL), zap.Error(err))
+			return nil, &ComparisonBasis{Error: err.Error()}, nil
+		}
+		// the matches of a fanned out scan are in their own documents
+		if prev != nil && prev.Description.VulnerabilitiesIndexTemplate != "" {
+			prev.Description.Vulnerabilities, err = loadRoutedMatches(ctx, opts.resultStore, prev.Description.VulnerabilitiesIndexTemplate,
+				prev.Description.ArtifactDigest, prev.DescribedBy)
+			if err != nil {
+				logger.Warn("failed to load the matches of the previous scan, not comparing", zap.String("image", artifact.URL), zap.Error(err))
+				return nil, &ComparisonBasis{Error: err.Error()}, nil
+			}
+		}
+	}
+
+	fresh, basis := newSinceLastScan(matches, prev)
+	logger.Info("compared with the previous scan", zap.String("image", artifact.URL), zap.Bool("found", basis.Found),
+		zap.String("previousDigest", basis.ArtifactDigest), zap.Int("newMatches", basis.NewMatches))
+	if !opts.diffWithPrevious {
+		return fresh, basis, nil
+	}
+	var previous []VulnerabilityMatch
+	if prev != nil {
+		previous = prev.Description.Vulnerabilities
+	}
+	return fresh, basis, diffScans(matches, previous, opts.maxMatches)
+}
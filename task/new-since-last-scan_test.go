@@ -0,0 +1,133 @@
+package task
+
+import (
+	"fmt"
+	"github.com/opensearch-project/opensearch-go/v2"
+	"golang.org/x/net/context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testMatch is a match of vulnerability id in version of package name.
+func testMatch(id, name, version string) VulnerabilityMatch {
+	return VulnerabilityMatch{
+		Vulnerability: Vulnerability{ID: id},
+		Artifact:      map[string]interface{}{"name": name, "version": version},
+	}
+}
+
+func TestNewSinceLastScan(t *testing.T) {
+	prev := &previousScan{EsID: "prev", DescribedBy: "run-1", DescribedAt: 100}
+	prev.Description.ArtifactDigest = "sha256:prev"
+	prev.Description.Vulnerabilities = []VulnerabilityMatch{
+		testMatch("CVE-2024-0001", "openssl", "3.0.1"),
+		testMatch("cve-2024-0002", "zlib", "1.2.13"),
+	}
+	truncated := *prev
+	truncated.Description.Summary.Truncated = true
+
+	for _, tc := range []struct {
+		name     string
+		matches  []VulnerabilityMatch
+		prev     *previousScan
+		expected []string
+	}{
+		{name: "no previous scan", matches: []VulnerabilityMatch{testMatch("CVE-2024-0001", "openssl", "3.0.1")},
+			expected: []string{"CVE-2024-0001"}},
+		{name: "same matches", prev: prev, matches: []VulnerabilityMatch{
+			testMatch("CVE-2024-0001", "openssl", "3.0.1"), testMatch("CVE-2024-0002", "zlib", "1.2.13")}},
+		{name: "new vulnerability", prev: prev, matches: []VulnerabilityMatch{
+			testMatch("CVE-2024-0001", "openssl", "3.0.1"), testMatch("CVE-2024-0003", "openssl", "3.0.1")},
+			expected: []string{"CVE-2024-0003"}},
+		{name: "same vulnerability in another version", prev: prev, matches: []VulnerabilityMatch{
+			testMatch("CVE-2024-0001", "openssl", "3.0.2")}, expected: []string{"CVE-2024-0001"}},
+		{name: "same vulnerability in another package", prev: prev, matches: []VulnerabilityMatch{
+			testMatch("CVE-2024-0002", "libz", "1.2.13")}, expected: []string{"CVE-2024-0002"}},
+		{name: "truncated baseline", prev: &truncated, matches: []VulnerabilityMatch{
+			testMatch("CVE-2024-0004", "curl", "8.0.0")}, expected: []string{"CVE-2024-0004"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fresh, basis := newSinceLastScan(tc.matches, tc.prev)
+			var ids []string
+			for _, m := range fresh {
+				ids = append(ids, m.Vulnerability.ID)
+			}
+			if !reflect.DeepEqual(ids, tc.expected) {
+				t.Errorf("expected new matches %v, got %v", tc.expected, ids)
+			}
+			if basis.NewMatches != len(tc.expected) {
+				t.Errorf("expected %d new matches, got %d", len(tc.expected), basis.NewMatches)
+			}
+			if basis.Found != (tc.prev != nil) {
+				t.Errorf("expected found %t, got %t", tc.prev != nil, basis.Found)
+			}
+			if tc.prev != nil && (basis.EsID != "prev" || basis.RunID != "run-1" || basis.ArtifactDigest != "sha256:prev" ||
+				basis.ScannedAt != 100 || basis.BaselineTruncated != tc.prev.Description.Summary.Truncated) {
+				t.Errorf("unexpected comparison basis %+v", basis)
+			}
+		})
+	}
+}
+
+func TestFindPreviousScan(t *testing.T) {
+	hit := func(id, name, runID string) string {
+		return fmt.Sprintf(`{"_id":%q,"_source":{"resource_name":%q,"described_by":%q,"described_at":1}}`, id, name, runID)
+	}
+	const image = "ghcr.io/org/repo:tag"
+	for _, tc := range []struct {
+		name     string
+		status   int
+		body     string
+		expected string
+		invalid  bool
+	}{
+		{name: "most recent scan", status: http.StatusOK,
+			body: `{"hits":{"hits":[` + hit("a", image, "run-1") + `,` + hit("b", image, "run-0") + `]}}`, expected: "a"},
+		{name: "current run skipped", status: http.StatusOK,
+			body: `{"hits":{"hits":[` + hit("a", image, "run-2") + `,` + hit("b", image, "run-1") + `]}}`, expected: "b"},
+		{name: "other image skipped", status: http.StatusOK,
+			body: `{"hits":{"hits":[` + hit("a", image+"-debug", "run-1") + `,` + hit("b", image, "run-1") + `]}}`, expected: "b"},
+		{name: "no previous scan", status: http.StatusOK, body: `{"hits":{"hits":[` + hit("a", image, "run-2") + `]}}`},
+		{name: "missing index", status: http.StatusNotFound, body: `{"error":{"type":"index_not_found_exception"}}`},
+		{name: "search error", status: http.StatusBadRequest, body: `{"error":{"type":"parsing_exception"}}`, invalid: true},
+		{name: "malformed response", status: http.StatusOK, body: `{"hits":[]}`, invalid: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if body, _ := io.ReadAll(r.Body); !strings.Contains(string(body), image) {
+					t.Errorf("expected a query on %s, got %s", image, body)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tc.status)
+				_, _ = io.WriteString(w, tc.body)
+			}))
+			defer server.Close()
+			client, err := opensearch.NewClient(opensearch.Config{Addresses: []string{server.URL}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			prev, err := findPreviousScan(context.Background(), client, []string{"index"}, image, "run-2")
+			if tc.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", prev)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var id string
+			if prev != nil {
+				id = prev.EsID
+			}
+			if id != tc.expected {
+				t.Errorf("expected previous scan %q, got %q", tc.expected, id)
+			}
+		})
+	}
+}
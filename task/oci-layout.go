@@ -0,0 +1,96 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/oci"
+	"os"
+	"path/filepath"
+)
+
+// Layouts the pulled image is handed to the scanner in (image_layout). The OCI layout keeps the blobs as pulled, the
+// docker archive is assembled from them, rewriting the manifest.
+const (
+	ImageLayoutOCIDir        = "oci-dir"
+	ImageLayoutDockerArchive = "docker-archive"
+)
+
+// ociLayoutDirName is the directory of the image OCI layout in the output directory of the image.
+const ociLayoutDirName = "oci"
+
+// parseImageLayout parses image_layout. Setting the archive options (reproducible_tar, tar_compression_level)
+// without it keeps the docker archive they configure.
+func parseImageLayout(params map[string][]string) (string, error) {
+	if layout := getParamValue(params, "image_layout", ""); layout != "" {
+		if layout != ImageLayoutOCIDir && layout != ImageLayoutDockerArchive {
+			return "", fmt.Errorf("invalid image_layout %q: expected %s or %s", layout, ImageLayoutOCIDir, ImageLayoutDockerArchive)
+		}
+		return layout, nil
+	}
+	if getParamValue(params, "reproducible_tar", "") != "" || getParamValue(params, "tar_compression_level", "") != "" {
+		return ImageLayoutDockerArchive, nil
+	}
+	return ImageLayoutOCIDir, nil
+}
+
+// writeOCILayout copies the image manifest root and its blobs from store to an OCI layout at layoutDir, tagged with
+// the first of repoTags (its digest without).
+func writeOCILayout(ctx context.Context, store content.ReadOnlyStorage, root ocispec.Descriptor, layoutDir string, repoTags []string, concurrency int) error {
+	if err := os.RemoveAll(layoutDir); err != nil {
+		return fmt.Errorf("failed to remove existing OCI layout: %w", err)
+	}
+	layout, err := oci.NewWithContext(ctx, layoutDir)
+	if err != nil {
+		return fmt.Errorf("failed to create OCI layout: %w", err)
+	}
+	copyOpts := oras.DefaultCopyGraphOptions
+	copyOpts.Concurrency = concurrency
+	if err := oras.CopyGraph(ctx, store, layout, root, copyOpts); err != nil {
+		return fmt.Errorf("failed to write OCI layout: %w", err)
+	}
+	tag := root.Digest.String()
+	if len(repoTags) > 0 {
+		tag = repoTags[0]
+	}
+	if err := layout.Tag(ctx, root, tag); err != nil {
+		return fmt.Errorf("failed to tag OCI layout: %w", err)
+	}
+	return nil
+}
+
+// readLayoutLayers returns the paths of the layer blobs of the image in the OCI layout at layoutDir, in manifest
+// order.
+func readLayoutLayers(layoutDir string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(layoutDir, ocispec.ImageIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", ocispec.ImageIndexFile, err)
+	}
+	if len(index.Manifests) != 1 {
+		return nil, fmt.Errorf("expected one image in %s, found %d", ocispec.ImageIndexFile, len(index.Manifests))
+	}
+	data, err = os.ReadFile(layoutBlobPath(layoutDir, index.Manifests[0]))
+	if err != nil {
+		return nil, err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse image manifest: %w", err)
+	}
+	layers := make([]string, len(manifest.Layers))
+	for i, layer := range manifest.Layers {
+		layers[i] = layoutBlobPath(layoutDir, layer)
+	}
+	return layers, nil
+}
+
+func layoutBlobPath(layoutDir string, desc ocispec.Descriptor) string {
+	return filepath.Join(layoutDir, ocispec.ImageBlobsDir, desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+}
@@ -0,0 +1,64 @@
+package task
+
+import (
+	"bytes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content/memory"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWithLayoutDigest(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	push := func(mediaType string, data []byte) ocispec.Descriptor {
+		desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+		if err := store.Push(ctx, desc, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		return desc
+	}
+	config := push(ocispec.MediaTypeImageConfig, []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers"}}`))
+	layer := push(ocispec.MediaTypeImageLayerGzip, []byte("layer content"))
+	root, err := oras.PackManifest(ctx, store, oras.PackManifestVersion1_1, "", oras.PackManifestOptions{
+		ConfigDescriptor: &config,
+		Layers:           []ocispec.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	layout := func() *FetchedImage {
+		layoutDir := filepath.Join(t.TempDir(), ociLayoutDirName)
+		if err := writeOCILayout(ctx, store, root, layoutDir, []string{"ghcr.io/org/repo:tag"}, 1); err != nil {
+			t.Fatal(err)
+		}
+		fetched, err := withLayoutDigest(&FetchedImage{LayoutPath: layoutDir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fetched
+	}
+	first, second := layout(), layout()
+	if first.LayoutDigest == "" || first.LayoutDigest != second.LayoutDigest {
+		t.Fatalf("expected the same layout digest for the same image, got %q and %q", first.LayoutDigest, second.LayoutDigest)
+	}
+	if first.TarDigest != "" {
+		t.Errorf("expected no tar digest for a layout, got %s", first.TarDigest)
+	}
+
+	if err := os.WriteFile(layoutBlobPath(second.LayoutPath, layer), []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tampered, err := withLayoutDigest(&FetchedImage{LayoutPath: second.LayoutPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tampered.LayoutDigest == first.LayoutDigest {
+		t.Error("expected the layout digest to change with the content of a blob")
+	}
+}
@@ -0,0 +1,41 @@
+package task
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// hasOIDCToken reports whether an OIDC token was provided, either inline or as a (projected service-account) token file.
+func (c Credentials) hasOIDCToken() bool {
+	return c.OIDCToken != "" || c.OIDCTokenFile != ""
+}
+
+// readOIDCToken returns the inline OIDC token, or reads it from the token file. The file is read on every call since
+// projected service-account tokens are rotated by the kubelet.
+func (c Credentials) readOIDCToken() ([]byte, error) {
+	if c.OIDCToken != "" {
+		return []byte(c.OIDCToken), nil
+	}
+	if c.OIDCTokenFile == "" {
+		return nil, fmt.Errorf("no OIDC token provided")
+	}
+	b, err := os.ReadFile(c.OIDCTokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OIDC token file: %w", err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return nil, fmt.Errorf("OIDC token file %s is empty", c.OIDCTokenFile)
+	}
+	return []byte(token), nil
+}
+
+// oidcTokenRetriever adapts Credentials to the stscreds.IdentityTokenRetriever interface.
+type oidcTokenRetriever struct {
+	creds Credentials
+}
+
+func (r oidcTokenRetriever) GetIdentityToken() ([]byte, error) {
+	return r.creds.readOIDCToken()
+}
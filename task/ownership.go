@@ -0,0 +1,236 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ownership (CMDB) metadata attached to the results, looked up by image repository (registry host and repository
+// path, e.g. ghcr.io/org/app). OWNERSHIP_MAPPING is a path to a YAML or JSON map of repositories to an Ownership,
+// keys possibly being path.Match patterns such as ghcr.io/org/*: the exact key wins, then the longest matching
+// pattern. OWNERSHIP_ENDPOINT is an http(s) URL queried with ?repository=<repository> for repositories the mapping
+// doesn't cover, answering an Ownership as JSON or 404. Lookups are cached for OWNERSHIP_CACHE_TTL (a duration, 1h by
+// default).
+var (
+	OwnershipMapping  = os.Getenv("OWNERSHIP_MAPPING")
+	OwnershipEndpoint = os.Getenv("OWNERSHIP_ENDPOINT")
+	OwnershipCacheTTL = os.Getenv("OWNERSHIP_CACHE_TTL")
+)
+
+const (
+	defaultOwnershipCacheTTL = time.Hour
+	// ownershipLookupTimeout bounds a lookup on the ownership endpoint, the scan going on without ownership after it.
+	ownershipLookupTimeout = 5 * time.Second
+	// maxOwnershipResponseBytes bounds the ownership endpoint response.
+	maxOwnershipResponseBytes = 1024 * 1024 // 1 MiB
+)
+
+// Ownership is who owns an image repository.
+type Ownership struct {
+	OwnerTeam string `json:"team" yaml:"team"`
+	Service   string `json:"service" yaml:"service"`
+	OnCall    string `json:"onCall" yaml:"onCall"`
+}
+
+// OwnershipResolver looks up the owner of an image repository, returning nil when it has none.
+type OwnershipResolver interface {
+	Lookup(ctx context.Context, repository string) (*Ownership, error)
+}
+
+// staticOwnership resolves owners from the OWNERSHIP_MAPPING file.
+type staticOwnership struct {
+	exact    map[string]Ownership
+	patterns []string
+	byGlob   map[string]Ownership
+}
+
+func loadStaticOwnership(location string) (*staticOwnership, error) {
+	data, err := os.ReadFile(location)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]Ownership
+	// YAML is a superset of JSON, so this reads both
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse ownership mapping: %w", err)
+	}
+
+	s := &staticOwnership{exact: make(map[string]Ownership), byGlob: make(map[string]Ownership)}
+	for key, owner := range raw {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !strings.ContainsAny(key, "*?[") {
+			s.exact[key] = owner
+			continue
+		}
+		if _, err := path.Match(key, ""); err != nil {
+			return nil, fmt.Errorf("invalid ownership mapping pattern %q: %w", key, err)
+		}
+		s.patterns = append(s.patterns, key)
+		s.byGlob[key] = owner
+	}
+	// The most specific pattern first
+	sort.Slice(s.patterns, func(i, j int) bool {
+		if len(s.patterns[i]) != len(s.patterns[j]) {
+			return len(s.patterns[i]) > len(s.patterns[j])
+		}
+		return s.patterns[i] < s.patterns[j]
+	})
+	return s, nil
+}
+
+func (s *staticOwnership) Lookup(_ context.Context, repository string) (*Ownership, error) {
+	repository = strings.ToLower(repository)
+	if owner, ok := s.exact[repository]; ok {
+		return &owner, nil
+	}
+	for _, pattern := range s.patterns {
+		if ok, _ := path.Match(pattern, repository); ok {
+			owner := s.byGlob[pattern]
+			return &owner, nil
+		}
+	}
+	return nil, nil
+}
+
+// httpOwnership resolves owners from the OWNERSHIP_ENDPOINT.
+type httpOwnership struct {
+	endpoint string
+}
+
+func (h httpOwnership) Lookup(ctx context.Context, repository string) (*Ownership, error) {
+	u, err := url.Parse(h.endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ownership endpoint: %w", err)
+	}
+	q := u.Query()
+	q.Set("repository", repository)
+	u.RawQuery = q.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, ownershipLookupTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	httpClient, err := outboundHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %d from ownership endpoint", resp.StatusCode)
+	}
+
+	var owner Ownership
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxOwnershipResponseBytes)).Decode(&owner); err != nil {
+		return nil, fmt.Errorf("failed to parse ownership: %w", err)
+	}
+	return &owner, nil
+}
+
+// chainedOwnership asks its resolvers in order, returning the first owner found.
+type chainedOwnership []OwnershipResolver
+
+func (c chainedOwnership) Lookup(ctx context.Context, repository string) (*Ownership, error) {
+	for _, resolver := range c {
+		owner, err := resolver.Lookup(ctx, repository)
+		if err != nil || owner != nil {
+			return owner, err
+		}
+	}
+	return nil, nil
+}
+
+type ownershipEntry struct {
+	owner   *Ownership
+	expires time.Time
+}
+
+// ownershipCache holds the configured resolver and the owners looked up, including repositories without owner. A
+// failed lookup keeps serving the previous owner of the repository.
+var ownershipCache struct {
+	mu       sync.Mutex
+	resolver OwnershipResolver
+	loadedAt time.Time
+	byRepo   map[string]ownershipEntry
+}
+
+// lookupOwnership returns the owner of the image repository, or nil when there's none, no ownership source is
+// configured or the lookup failed (logged, the scan going on without ownership).
+func lookupOwnership(ctx context.Context, logger *zap.Logger, repository string) *Ownership {
+	if OwnershipMapping == "" && OwnershipEndpoint == "" {
+		return nil
+	}
+	ttl, err := time.ParseDuration(OwnershipCacheTTL)
+	if err != nil || ttl <= 0 {
+		ttl = defaultOwnershipCacheTTL
+	}
+
+	ownershipCache.mu.Lock()
+	defer ownershipCache.mu.Unlock()
+	if entry, ok := ownershipCache.byRepo[repository]; ok && time.Now().Before(entry.expires) {
+		return entry.owner
+	}
+
+	if ownershipCache.resolver == nil || time.Since(ownershipCache.loadedAt) >= ttl {
+		// The mapping file is reloaded along with the cache so edits are picked up
+		var resolvers chainedOwnership
+		if OwnershipMapping != "" {
+			static, err := loadStaticOwnership(OwnershipMapping)
+			if err != nil {
+				logger.Warn("failed to load ownership mapping", zap.String("mapping", OwnershipMapping), zap.Error(err))
+			} else {
+				resolvers = append(resolvers, static)
+			}
+		}
+		if OwnershipEndpoint != "" {
+			resolvers = append(resolvers, httpOwnership{endpoint: OwnershipEndpoint})
+		}
+		ownershipCache.resolver = resolvers
+		ownershipCache.loadedAt = time.Now()
+		if ownershipCache.byRepo == nil {
+			ownershipCache.byRepo = make(map[string]ownershipEntry)
+		}
+	}
+
+	owner, err := ownershipCache.resolver.Lookup(ctx, repository)
+	if err != nil {
+		logger.Warn("failed to look up image ownership, using the previous owner if any", zap.String("repository", repository), zap.Error(err))
+		stale := ownershipCache.byRepo[repository]
+		// Retry no sooner than a tenth of the TTL
+		ownershipCache.byRepo[repository] = ownershipEntry{owner: stale.owner, expires: time.Now().Add(ttl / 10)}
+		return stale.owner
+	}
+	ownershipCache.byRepo[repository] = ownershipEntry{owner: owner, expires: time.Now().Add(ttl)}
+	return owner
+}
+
+// imageRepository returns the repository ownership is keyed on for an image reference, e.g. ghcr.io/org/app.
+func imageRepository(uri string) string {
+	ref, err := parseImageReference(uri)
+	if err != nil {
+		return ""
+	}
+	return ref.Registry + "/" + ref.Repository
+}
@@ -0,0 +1,90 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+	"oras.land/oras-go/v2/content"
+	"strings"
+)
+
+// DefaultImagePlatform is the platform selected from multi-arch images (image_platform).
+const DefaultImagePlatform = "linux/amd64"
+
+// dockerManifestListMediaType is the Docker equivalent of an OCI image index.
+const dockerManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+// maxIndexDepth bounds the nesting of image indices followed to a platform manifest.
+const maxIndexDepth = 4
+
+// errPlatformNotFound fails the pull of multi-arch images without a manifest for the requested platform, without
+// retrying.
+var errPlatformNotFound = errors.New("no manifest for the platform")
+
+// parseImagePlatform parses an image_platform such as linux/amd64 or linux/arm64/v8.
+func parseImagePlatform(v string) (ocispec.Platform, error) {
+	p, err := platforms.Parse(v)
+	if err != nil {
+		return ocispec.Platform{}, fmt.Errorf("invalid image_platform %q: %w", v, err)
+	}
+	return platforms.Normalize(p), nil
+}
+
+func isImageIndex(mediaType string) bool {
+	return mediaType == ocispec.MediaTypeImageIndex || mediaType == dockerManifestListMediaType
+}
+
+// platformSelection selects the manifest of a platform when an image reference resolves to an image index or a Docker
+// manifest list. Image manifests are used as they are, whatever their platform.
+type platformSelection struct {
+	Platform ocispec.Platform
+	// IndexDigest is the digest of the index the manifest was selected from, empty for single-platform images.
+	IndexDigest string
+}
+
+// mapRoot is an oras MapRoot func replacing an index by its manifest best matching the platform.
+func (s *platformSelection) mapRoot(ctx context.Context, src content.ReadOnlyStorage, root ocispec.Descriptor) (ocispec.Descriptor, error) {
+	matcher := platforms.Only(s.Platform)
+	for depth := 0; isImageIndex(root.MediaType); depth++ {
+		if depth == maxIndexDepth {
+			return ocispec.Descriptor{}, fmt.Errorf("image index nested more than %d levels deep", maxIndexDepth)
+		}
+		if s.IndexDigest == "" {
+			s.IndexDigest = root.Digest.String()
+		}
+
+		data, err := content.FetchAll(ctx, src, root)
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to fetch image index: %w", err)
+		}
+		var index ocispec.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to unmarshal image index: %w", err)
+		}
+
+		var selected *ocispec.Descriptor
+		var available []string
+		for i, m := range index.Manifests {
+			// Entries without platform are attestations and the like
+			if m.Platform == nil {
+				continue
+			}
+			available = append(available, platforms.Format(*m.Platform))
+			if !matcher.Match(*m.Platform) {
+				continue
+			}
+			if selected == nil || matcher.Less(*m.Platform, *selected.Platform) {
+				selected = &index.Manifests[i]
+			}
+		}
+		if selected == nil {
+			return ocispec.Descriptor{}, fmt.Errorf("%w %s in %s (available: %s)", errPlatformNotFound,
+				platforms.Format(s.Platform), root.Digest, strings.Join(available, ", "))
+		}
+		root = *selected
+	}
+	return root, nil
+}
@@ -0,0 +1,253 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/opengovern/opencomply/services/tasks/db/models"
+	"github.com/opengovern/opencomply/services/tasks/scheduler"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ProgressPublisher publishes an intermediate (in-progress) task response to the result topic.
+// The final response is still published by the worker once RunTask returns.
+type ProgressPublisher func(ctx context.Context, response *scheduler.TaskResponse) error
+
+// DefaultResultMaxMessageBytes keeps batched notifications below the default NATS max payload (1 MiB).
+const DefaultResultMaxMessageBytes = 900 * 1024
+
+// ImageResultNotification reports that the results of one image of the task were stored.
+type ImageResultNotification struct {
+	ImageURL       string `json:"imageUrl"`
+	ArtifactDigest string `json:"artifactDigest"`
+	EsID           string `json:"esId"`
+	EsIndex        string `json:"esIndex"`
+	TotalMatches   int    `json:"totalMatches"`
+}
+
+// Types of the Result payloads of in-progress responses, which share the result topic and status: ProgressUpdate and
+// ImageResultBatch.
+const (
+	ResultTypeProgress     = "progress"
+	ResultTypeImageResults = "image_results"
+)
+
+// ImageResultBatch is the Result payload of a batched in-progress notification, of Type ResultTypeImageResults.
+type ImageResultBatch struct {
+	Type   string                    `json:"type"`
+	Images []ImageResultNotification `json:"images"`
+}
+
+// resultBatcher groups per-image notifications into messages of up to batchSize images, splitting a batch further
+// when its encoded size would exceed maxMessageBytes.
+type resultBatcher struct {
+	publish         ProgressPublisher
+	runID           uint
+	batchSize       int
+	maxMessageBytes int
+
+	pending []ImageResultNotification
+}
+
+func newResultBatcher(publish ProgressPublisher, runID uint, params map[string][]string) (*resultBatcher, error) {
+	batchSize, err := getIntParam(params, "result_batch_size", 1)
+	if err != nil {
+		return nil, err
+	}
+	maxMessageBytes, err := getIntParam(params, "result_max_message_bytes", DefaultResultMaxMessageBytes)
+	if err != nil {
+		return nil, err
+	}
+	if batchSize < 1 || maxMessageBytes < 1 {
+		return nil, fmt.Errorf("result_batch_size and result_max_message_bytes must be positive")
+	}
+	return &resultBatcher{
+		publish:         publish,
+		runID:           runID,
+		batchSize:       batchSize,
+		maxMessageBytes: maxMessageBytes,
+	}, nil
+}
+
+// Add queues the notification, publishing the batch once it's full.
+func (b *resultBatcher) Add(ctx context.Context, n ImageResultNotification) error {
+	if b == nil || b.publish == nil {
+		return nil
+	}
+	b.pending = append(b.pending, n)
+	if len(b.pending) >= b.batchSize {
+		return b.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush publishes all pending notifications.
+func (b *resultBatcher) Flush(ctx context.Context) error {
+	if b == nil || b.publish == nil || len(b.pending) == 0 {
+		return nil
+	}
+	pending := b.pending
+	b.pending = nil
+	return b.publishChunk(ctx, pending)
+}
+
+func (b *resultBatcher) publishChunk(ctx context.Context, images []ImageResultNotification) error {
+	payload, err := json.Marshal(ImageResultBatch{Type: ResultTypeImageResults, Images: images})
+	if err != nil {
+		return err
+	}
+
+	// Split oversized batches in half until every message fits; a single image is always sent as is
+	if len(payload) > b.maxMessageBytes && len(images) > 1 {
+		mid := len(images) / 2
+		if err := b.publishChunk(ctx, images[:mid]); err != nil {
+			return err
+		}
+		return b.publishChunk(ctx, images[mid:])
+	}
+
+	return b.publish(ctx, &scheduler.TaskResponse{
+		RunID:  b.runID,
+		Status: models.TaskRunStatusInProgress,
+		Result: payload,
+	})
+}
+
+// ProgressStage is a stage of a scan run, or of one of its images.
+type ProgressStage string
+
+const (
+	StageQueued          ProgressStage = "queued"
+	StagePullingImage    ProgressStage = "pulling_image"
+	StageBuildingArchive ProgressStage = "building_archive"
+	StageScanning        ProgressStage = "scanning"
+	StageIndexing        ProgressStage = "indexing"
+	StageDone            ProgressStage = "done"
+	// StageFailed is reached by the images whose scan failed, the others still being scanned.
+	StageFailed ProgressStage = "failed"
+)
+
+// stageShares is the share of the work on an image done once it reaches the stage, pulls and scans taking the most.
+var stageShares = map[ProgressStage]float64{
+	StagePullingImage:    0,
+	StageBuildingArchive: 0.4,
+	StageScanning:        0.5,
+	StageIndexing:        0.9,
+	StageDone:            1,
+	StageFailed:          1,
+}
+
+// ProgressUpdate is the Result payload of the in-progress response published whenever an image of the run reaches a
+// stage, and once the run is queued and done (without Image). Its Type is ResultTypeProgress.
+type ProgressUpdate struct {
+	Type        string        `json:"type"`
+	Stage       ProgressStage `json:"stage"`
+	Image       string        `json:"image,omitempty"`
+	Percent     int           `json:"percent"`
+	ImagesDone  int           `json:"imagesDone"`
+	TotalImages int           `json:"totalImages"`
+	StartedAt   time.Time     `json:"startedAt"`
+	Timestamp   time.Time     `json:"timestamp"`
+}
+
+// QueuedProgressResult is the Result of the first in-progress response of a run, published once its job is received.
+func QueuedProgressResult() []byte {
+	now := time.Now().UTC()
+	result, _ := json.Marshal(ProgressUpdate{Type: ResultTypeProgress, Stage: StageQueued, StartedAt: now, Timestamp: now})
+	return result
+}
+
+// progressTracker publishes the ProgressUpdates of the images of a run, which reach their stages concurrently.
+type progressTracker struct {
+	logger    *zap.Logger
+	publish   ProgressPublisher
+	runID     uint
+	images    []string
+	startedAt time.Time
+
+	mu     sync.Mutex
+	shares []float64
+	done   int
+}
+
+// newProgressTracker returns the tracker of the images of the run, nil when progress_updates is off (it's on by
+// default) or there's no publisher.
+func newProgressTracker(logger *zap.Logger, publish ProgressPublisher, runID uint, params map[string][]string, images []string) (*progressTracker, error) {
+	enabled, err := strconv.ParseBool(getParamValue(params, "progress_updates", "true"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid progress_updates: %w", err)
+	}
+	if !enabled || publish == nil {
+		return nil, nil
+	}
+	return &progressTracker{
+		logger:    logger,
+		publish:   publish,
+		runID:     runID,
+		images:    images,
+		startedAt: time.Now().UTC(),
+		shares:    make([]float64, len(images)),
+	}, nil
+}
+
+// Stage publishes that the image at pos reached stage.
+func (t *progressTracker) Stage(ctx context.Context, pos int, stage ProgressStage) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if (stage == StageDone || stage == StageFailed) && t.shares[pos] < 1 {
+		t.done++
+	}
+	t.shares[pos] = stageShares[stage]
+	t.publishLocked(ctx, stage, t.images[pos])
+}
+
+// Done publishes that the run is done.
+func (t *progressTracker) Done(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.shares {
+		t.shares[i] = 1
+	}
+	t.done = len(t.images)
+	t.publishLocked(ctx, StageDone, "")
+}
+
+func (t *progressTracker) publishLocked(ctx context.Context, stage ProgressStage, image string) {
+	var sum float64
+	for _, share := range t.shares {
+		sum += share
+	}
+	percent := 100
+	if len(t.shares) > 0 {
+		percent = int(sum * 100 / float64(len(t.shares)))
+	}
+	payload, err := json.Marshal(ProgressUpdate{
+		Type:        ResultTypeProgress,
+		Stage:       stage,
+		Image:       image,
+		Percent:     percent,
+		ImagesDone:  t.done,
+		TotalImages: len(t.images),
+		StartedAt:   t.startedAt,
+		Timestamp:   time.Now().UTC(),
+	})
+	if err != nil {
+		return
+	}
+	if err := t.publish(ctx, &scheduler.TaskResponse{
+		RunID:  t.runID,
+		Status: models.TaskRunStatusInProgress,
+		Result: payload,
+	}); err != nil {
+		t.logger.Error("failed to publish progress update", zap.String("stage", string(stage)), zap.Error(err))
+	}
+}
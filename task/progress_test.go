@@ -0,0 +1,110 @@
+package task
+
+import (
+	"encoding/json"
+	"github.com/opengovern/opencomply/services/tasks/scheduler"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+func TestInProgressResultTypes(t *testing.T) {
+	var results [][]byte
+	publish := func(ctx context.Context, response *scheduler.TaskResponse) error {
+		results = append(results, response.Result)
+		return nil
+	}
+	ctx := context.Background()
+
+	tracker, err := newProgressTracker(zap.NewNop(), publish, 1, nil, []string{"ghcr.io/org/repo:tag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.Stage(ctx, 0, StagePullingImage)
+	batcher, err := newResultBatcher(publish, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := batcher.Add(ctx, ImageResultNotification{ImageURL: "ghcr.io/org/repo:tag"}); err != nil {
+		t.Fatal(err)
+	}
+	tracker.Done(ctx)
+	results = append([][]byte{QueuedProgressResult()}, results...)
+
+	expected := []string{ResultTypeProgress, ResultTypeProgress, ResultTypeImageResults, ResultTypeProgress}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d in-progress results, got %d", len(expected), len(results))
+	}
+	for i, result := range results {
+		var typed struct {
+			Type   string          `json:"type"`
+			Stage  ProgressStage   `json:"stage"`
+			Images json.RawMessage `json:"images"`
+		}
+		if err := json.Unmarshal(result, &typed); err != nil {
+			t.Fatal(err)
+		}
+		if typed.Type != expected[i] {
+			t.Errorf("result %d: expected type %q, got %q in %s", i, expected[i], typed.Type, result)
+		}
+		// Each type only has the fields of its payload
+		if (typed.Type == ResultTypeProgress) != (typed.Stage != "" && typed.Images == nil) {
+			t.Errorf("result %d: fields don't match type %q: %s", i, typed.Type, result)
+		}
+	}
+}
+
+func TestResultBatcherSplitsOversizedBatches(t *testing.T) {
+	image := ImageResultNotification{ImageURL: "ghcr.io/org/repo:tag", EsID: "id", EsIndex: "index"}
+	single, err := json.Marshal(ImageResultBatch{Type: ResultTypeImageResults, Images: []ImageResultNotification{image}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name            string
+		batchSize       string
+		maxMessageBytes int
+		images          int
+		messages        int
+	}{
+		{name: "one image per message", batchSize: "1", maxMessageBytes: DefaultResultMaxMessageBytes, images: 3, messages: 3},
+		{name: "full batch", batchSize: "4", maxMessageBytes: DefaultResultMaxMessageBytes, images: 4, messages: 1},
+		{name: "partial batch flushed", batchSize: "4", maxMessageBytes: DefaultResultMaxMessageBytes, images: 6, messages: 2},
+		{name: "batch split in halves", batchSize: "4", maxMessageBytes: 3 * len(single), images: 4, messages: 2},
+		{name: "batch split to single images", batchSize: "4", maxMessageBytes: len(single) + 1, images: 4, messages: 4},
+		{name: "image larger than the limit", batchSize: "1", maxMessageBytes: 1, images: 1, messages: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var messages, images int
+			publish := func(ctx context.Context, response *scheduler.TaskResponse) error {
+				var batch ImageResultBatch
+				if err := json.Unmarshal(response.Result, &batch); err != nil {
+					return err
+				}
+				if len(batch.Images) > 1 && len(response.Result) > tc.maxMessageBytes {
+					t.Errorf("batch of %d images exceeds %d bytes", len(batch.Images), tc.maxMessageBytes)
+				}
+				messages++
+				images += len(batch.Images)
+				return nil
+			}
+			params := map[string][]string{"result_batch_size": {tc.batchSize}}
+			batcher, err := newResultBatcher(publish, 1, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			batcher.maxMessageBytes = tc.maxMessageBytes
+			for i := 0; i < tc.images; i++ {
+				if err := batcher.Add(context.Background(), image); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := batcher.Flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if messages != tc.messages || images != tc.images {
+				t.Errorf("expected %d images in %d messages, got %d in %d", tc.images, tc.messages, images, messages)
+			}
+		})
+	}
+}
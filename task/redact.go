@@ -0,0 +1,229 @@
+package task
+
+import (
+	"encoding/json"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RedactedValue replaces sensitive values in logs.
+const RedactedValue = "[REDACTED]"
+
+// LogMaxOutputBytes caps how much of the raw output of external commands (grype) is logged, defaults to 4 KiB.
+var LogMaxOutputBytes = os.Getenv("LOG_MAX_OUTPUT_BYTES")
+
+const defaultLogMaxOutputBytes = 4 * 1024
+
+// sensitiveKeyPattern matches the names of params and fields whose values are secrets.
+var sensitiveKeyPattern = regexp.MustCompile(`(?i)(token|password|passwd|secret|auth|credential|private_?key|api_?key|assertion|kubeconfig)`)
+
+// minRedactedSecretLength keeps short values (e.g. "true") from being scrubbed from every log line.
+const minRedactedSecretLength = 4
+
+func isSensitiveKey(key string) bool {
+	return sensitiveKeyPattern.MatchString(key)
+}
+
+// tokenPatterns match values that look like credentials wherever they appear, e.g. in the response of a registry
+// quoted by an error, whether or not they were given as params. Replacements keep what tells the value apart.
+var tokenPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	// Authorization header values
+	{regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9._~+/=-]{8,}`), "${1} " + RedactedValue},
+	// Passwords in URLs
+	{regexp.MustCompile(`(://[^/\s:@]+):[^/\s@]{3,}@`), "${1}:" + RedactedValue + "@"},
+	// Docker config auths
+	{regexp.MustCompile(`("(auth|registrytoken|identitytoken)"\s*:\s*")[^"]+`), "${1}" + RedactedValue},
+	// Signatures and session tokens of presigned and SAS URLs
+	{regexp.MustCompile(`(?i)([?&](sig|x-amz-signature|x-amz-security-token|x-goog-signature)=)[^&\s"]+`), "${1}" + RedactedValue},
+	// JWTs: OIDC, service account and ACR tokens
+	{regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]*`), RedactedValue},
+	// GitHub, AWS access key and Google OAuth2 tokens
+	{regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{20,}|github_pat_[A-Za-z0-9_]{20,}|(AKIA|ASIA)[A-Z0-9]{16}|ya29\.[A-Za-z0-9_-]{20,})`), RedactedValue},
+	// PEM private keys
+	{regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`), RedactedValue},
+}
+
+// redactTokens scrubs the values matching tokenPatterns from s.
+func redactTokens(s string) string {
+	for _, p := range tokenPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+// sensitiveValues returns the values of the sensitive params, and the outbound proxy password, long enough to be
+// scrubbed.
+func sensitiveValues(params map[string][]string) []string {
+	var secrets []string
+	for k, values := range params {
+		if !isSensitiveKey(k) {
+			continue
+		}
+		for _, v := range values {
+			if len(v) >= minRedactedSecretLength {
+				secrets = append(secrets, v)
+			}
+		}
+	}
+	if len(ProxyPassword) >= minRedactedSecretLength {
+		secrets = append(secrets, ProxyPassword)
+	}
+	return secrets
+}
+
+// RedactingLogger returns a logger scrubbing the values of the sensitive params (and the outbound proxy password),
+// and values looking like tokens, from every message and field it writes, and redacting fields with sensitive names
+// altogether.
+func RedactingLogger(logger *zap.Logger, params map[string][]string) *zap.Logger {
+	r := newRedactor(sensitiveValues(params))
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return &redactingCore{Core: core, redactor: r}
+	}))
+}
+
+// RedactError returns err with the values RedactingLogger scrubs scrubbed from its message too, e.g. for the failure
+// message of the run. The kind of the error is kept.
+func RedactError(err error, params map[string][]string) error {
+	if err == nil {
+		return nil
+	}
+	msg := newRedactor(sensitiveValues(params)).String(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{err: err, msg: msg}
+}
+
+// redactedError is an error with a scrubbed message, unwrapping to the original error.
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e *redactedError) Error() string { return e.msg }
+
+func (e *redactedError) Unwrap() error { return e.err }
+
+// redactor replaces known secrets in strings and sensitive values in structures.
+type redactor struct {
+	replacer *strings.Replacer
+}
+
+func newRedactor(secrets []string) redactor {
+	var pairs []string
+	for _, s := range secrets {
+		pairs = append(pairs, s, RedactedValue)
+	}
+	return redactor{replacer: strings.NewReplacer(pairs...)}
+}
+
+func (r redactor) String(s string) string {
+	return redactTokens(r.replacer.Replace(s))
+}
+
+// Value redacts a decoded JSON value, dropping the values of sensitive keys.
+func (r redactor) Value(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, val := range t {
+			if isSensitiveKey(k) {
+				t[k] = RedactedValue
+			} else {
+				t[k] = r.Value(val)
+			}
+		}
+		return t
+	case []interface{}:
+		for i, val := range t {
+			t[i] = r.Value(val)
+		}
+		return t
+	case string:
+		return r.String(t)
+	default:
+		return v
+	}
+}
+
+func (r redactor) Field(f zapcore.Field) zapcore.Field {
+	if isSensitiveKey(f.Key) {
+		return zap.String(f.Key, RedactedValue)
+	}
+	switch f.Type {
+	case zapcore.StringType:
+		return zap.String(f.Key, r.String(f.String))
+	case zapcore.ErrorType:
+		if err, ok := f.Interface.(error); ok {
+			return zap.String(f.Key, r.String(err.Error()))
+		}
+	case zapcore.ByteStringType:
+		if b, ok := f.Interface.([]byte); ok {
+			return zap.String(f.Key, r.String(string(b)))
+		}
+	case zapcore.StringerType:
+		if s, ok := f.Interface.(interface{ String() string }); ok {
+			return zap.String(f.Key, r.String(s.String()))
+		}
+	case zapcore.ReflectType, zapcore.ArrayMarshalerType, zapcore.ObjectMarshalerType:
+		// Structures are logged as their redacted JSON form
+		b, err := json.Marshal(f.Interface)
+		if err != nil {
+			return zap.String(f.Key, RedactedValue)
+		}
+		var v interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			return zap.String(f.Key, RedactedValue)
+		}
+		return zap.Any(f.Key, r.Value(v))
+	}
+	return f
+}
+
+// redactingCore is a zapcore.Core redacting entries before handing them to the wrapped core.
+type redactingCore struct {
+	zapcore.Core
+	redactor redactor
+}
+
+func (c *redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactingCore{Core: c.Core.With(c.redactFields(fields)), redactor: c.redactor}
+}
+
+func (c *redactingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c *redactingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	entry.Message = c.redactor.String(entry.Message)
+	return c.Core.Write(entry, c.redactFields(fields))
+}
+
+func (c *redactingCore) redactFields(fields []zapcore.Field) []zapcore.Field {
+	redacted := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		redacted[i] = c.redactor.Field(f)
+	}
+	return redacted
+}
+
+// truncateForLog shortens the raw output of a command to at most LogMaxOutputBytes for logging.
+func truncateForLog(output []byte) string {
+	max, err := strconv.Atoi(LogMaxOutputBytes)
+	if err != nil || max < 0 {
+		max = defaultLogMaxOutputBytes
+	}
+	if len(output) <= max {
+		return string(output)
+	}
+	return string(output[:max]) + "... (" + strconv.Itoa(len(output)-max) + " more bytes truncated)"
+}
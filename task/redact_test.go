@@ -0,0 +1,84 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"strings"
+	"testing"
+)
+
+const (
+	testRegistryPassword = "hunter2-registry-password"
+	testBearerToken      = "dGhpcy1pcy1hLWJlYXJlci10b2tlbg"
+	testVaultRef         = "vault://secret/data/ci#github_token"
+)
+
+func testRedactParams() map[string][]string {
+	return map[string][]string{
+		"registry_type":     {"ghcr"},
+		"registry_password": {testRegistryPassword},
+		"github_token":      {testVaultRef},
+	}
+}
+
+func assertRedacted(t *testing.T, output string) {
+	t.Helper()
+	for _, secret := range []string{testRegistryPassword, testBearerToken, testVaultRef} {
+		if strings.Contains(output, secret) {
+			t.Errorf("output contains %q: %s", secret, output)
+		}
+	}
+	if !strings.Contains(output, RedactedValue) {
+		t.Errorf("output doesn't contain %s: %s", RedactedValue, output)
+	}
+}
+
+func TestRedactingLogger(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	logger := RedactingLogger(zap.New(core), testRedactParams())
+
+	pullErr := fmt.Errorf("GET https://ghcr.io/token: Authorization: Bearer %s: denied for %s", testBearerToken, testVaultRef)
+	logger.Info("logging in with "+testRegistryPassword, zap.String("registry", "ghcr.io"))
+	logger.Error("failed to pull", zap.Error(pullErr))
+	logger.Warn("request", zap.String("header", "Bearer "+testBearerToken), zap.String("password", "short"))
+	logger.With(zap.Strings("refs", []string{testVaultRef})).Info("resolving references")
+	logger.Debug("params", zap.Any("params", map[string]interface{}{
+		"registry_password": testRegistryPassword,
+		"nested":            map[string]string{"note": "uses " + testVaultRef},
+	}))
+
+	entries := logs.All()
+	if len(entries) != 5 {
+		t.Fatalf("expected 5 entries, got %d", len(entries))
+	}
+	for _, entry := range entries {
+		assertRedacted(t, fmt.Sprint(entry.Message, " ", entry.ContextMap()))
+	}
+	if got := entries[0].ContextMap()["registry"]; got != "ghcr.io" {
+		t.Errorf("non sensitive field changed: %v", got)
+	}
+}
+
+func TestRedactError(t *testing.T) {
+	inner := fmt.Errorf("login with %s (%s) failed: Bearer %s", testRegistryPassword, testVaultRef, testBearerToken)
+	err := RedactError(newTaskError(ErrorKindAuth, inner), testRedactParams())
+	assertRedacted(t, err.Error())
+	if kind := ErrorKindOf(err); kind != ErrorKindAuth {
+		t.Errorf("expected kind %s, got %s", ErrorKindAuth, kind)
+	}
+	if !errors.Is(err, inner) {
+		t.Error("redacted error doesn't unwrap to the original error")
+	}
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	zap.New(core).Error("run failed", zap.Error(err))
+	assertRedacted(t, fmt.Sprint(logs.All()[0].ContextMap()))
+
+	plain := errors.New("image not found")
+	if RedactError(plain, testRedactParams()) != plain {
+		t.Error("errors without secrets should be returned as is")
+	}
+}
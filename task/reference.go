@@ -0,0 +1,65 @@
+package task
+
+import (
+	"fmt"
+	"oras.land/oras-go/v2/registry"
+	"strings"
+)
+
+// DefaultTag is the tag pulled for image references with neither a tag nor a digest, as docker does.
+const DefaultTag = "latest"
+
+// imageReference is an image reference resolved for pulling.
+type imageReference struct {
+	registry.Reference
+	// DefaultTagApplied is set when the reference had neither a tag nor a digest and DefaultTag was used.
+	DefaultTagApplied bool
+	// Tag is the tag of the reference, also when given along with a digest (repo:tag@sha256:...) in which case the
+	// digest is pulled and the tag only names the image in the archive.
+	Tag string
+}
+
+// IsDigest reports whether the reference pulls an exact digest.
+func (r imageReference) IsDigest() bool {
+	return r.ValidateReferenceAsDigest() == nil
+}
+
+// repoTags returns the RepoTags of the docker archive of the image. Docker only accepts repository:tag there, so
+// images referenced by digest alone have none, as docker save does for them.
+func (r imageReference) repoTags() []string {
+	if r.Tag == "" {
+		return nil
+	}
+	return []string{r.Registry + "/" + r.Repository + ":" + r.Tag}
+}
+
+// parseImageReference parses an oci_artifact_url such as ghcr.io/org/repo:tag, ghcr.io/org/repo@sha256:...,
+// ghcr.io/org/repo:tag@sha256:... (pulled by digest) or ghcr.io/org/repo, defaulting the latter to DefaultTag so it's
+// pulled, named in the archive and compared the same way as an explicitly tagged reference.
+func parseImageReference(uri string) (imageReference, error) {
+	uri = strings.TrimSpace(uri)
+	if !strings.Contains(uri, "/") {
+		// Docker Hub official images, e.g. nginx:1.27 for docker.io/library/nginx:1.27
+		uri = "docker.io/library/" + uri
+	}
+	ref, err := registry.ParseReference(uri)
+	if err != nil {
+		return imageReference{}, fmt.Errorf("invalid image reference %q: %w", uri, err)
+	}
+	r := imageReference{Reference: ref}
+	switch {
+	case ref.Reference == "":
+		r.Reference.Reference = DefaultTag
+		r.Tag = DefaultTag
+		r.DefaultTagApplied = true
+	case r.IsDigest():
+		// The tag of repo:tag@digest is dropped by the parser
+		name, _, _ := strings.Cut(uri, "@")
+		if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+			r.Tag = name[i+1:]
+		}
+	default:
+		r.Tag = ref.Reference
+	}
+	return r, nil
+}
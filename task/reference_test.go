@@ -0,0 +1,83 @@
+package task
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseImageReference(t *testing.T) {
+	const dgst = "sha256:6457d53fb065d6f250e1504b9bc42d5b6c65941d57532c072d929dd0628977d0"
+	for _, tc := range []struct {
+		uri               string
+		registry          string
+		repository        string
+		reference         string
+		tag               string
+		defaultTagApplied bool
+		isDigest          bool
+		repoTags          []string
+	}{
+		{
+			uri: "nginx", registry: "docker.io", repository: "library/nginx", reference: DefaultTag, tag: DefaultTag,
+			defaultTagApplied: true, repoTags: []string{"docker.io/library/nginx:latest"},
+		},
+		{
+			uri: "nginx:1.27", registry: "docker.io", repository: "library/nginx", reference: "1.27", tag: "1.27",
+			repoTags: []string{"docker.io/library/nginx:1.27"},
+		},
+		{
+			uri: "nginx@" + dgst, registry: "docker.io", repository: "library/nginx", reference: dgst, isDigest: true,
+		},
+		{
+			uri: "nginx:1.27@" + dgst, registry: "docker.io", repository: "library/nginx", reference: dgst, tag: "1.27",
+			isDigest: true, repoTags: []string{"docker.io/library/nginx:1.27"},
+		},
+		{
+			uri: "localhost:5000/repo", registry: "localhost:5000", repository: "repo", reference: DefaultTag, tag: DefaultTag,
+			defaultTagApplied: true, repoTags: []string{"localhost:5000/repo:latest"},
+		},
+		{
+			uri: "localhost:5000/team/repo:v1", registry: "localhost:5000", repository: "team/repo", reference: "v1", tag: "v1",
+			repoTags: []string{"localhost:5000/team/repo:v1"},
+		},
+		{
+			uri: "registry.example.com:5000/repo:v1@" + dgst, registry: "registry.example.com:5000", repository: "repo",
+			reference: dgst, tag: "v1", isDigest: true, repoTags: []string{"registry.example.com:5000/repo:v1"},
+		},
+		{
+			uri: " ghcr.io/org/repo:tag ", registry: "ghcr.io", repository: "org/repo", reference: "tag", tag: "tag",
+			repoTags: []string{"ghcr.io/org/repo:tag"},
+		},
+	} {
+		t.Run(tc.uri, func(t *testing.T) {
+			ref, err := parseImageReference(tc.uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ref.Registry != tc.registry || ref.Repository != tc.repository || ref.Reference.Reference != tc.reference {
+				t.Errorf("expected %s/%s reference %s, got %s/%s reference %s", tc.registry, tc.repository, tc.reference,
+					ref.Registry, ref.Repository, ref.Reference.Reference)
+			}
+			if ref.Tag != tc.tag {
+				t.Errorf("expected tag %q, got %q", tc.tag, ref.Tag)
+			}
+			if ref.DefaultTagApplied != tc.defaultTagApplied {
+				t.Errorf("expected DefaultTagApplied %t", tc.defaultTagApplied)
+			}
+			if ref.IsDigest() != tc.isDigest {
+				t.Errorf("expected IsDigest %t", tc.isDigest)
+			}
+			if repoTags := ref.repoTags(); !reflect.DeepEqual(repoTags, tc.repoTags) {
+				t.Errorf("expected repo tags %v, got %v", tc.repoTags, repoTags)
+			}
+		})
+	}
+}
+
+func TestParseImageReferenceInvalid(t *testing.T) {
+	for _, uri := range []string{"", "ghcr.io/Org/Repo", "ghcr.io/org/repo@sha256:abc", "ghcr.io/org/repo:bad tag"} {
+		if ref, err := parseImageReference(uri); err == nil {
+			t.Errorf("expected an error for %q, got %+v", uri, ref)
+		}
+	}
+}
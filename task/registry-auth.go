@@ -0,0 +1,535 @@
+package task
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/ecr"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/opengovern/resilient-bridge/utils"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// acrRefreshTokenUsername is the fixed username ACR expects when authenticating with a refresh token.
+const acrRefreshTokenUsername = "00000000-0000-0000-0000-000000000000"
+
+// dockerHubAuthKey is the key of Docker Hub credentials in docker configs.
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// gcpAccessTokenUsername is the username Google registries expect along with an OAuth2 access token.
+const gcpAccessTokenUsername = "oauth2accesstoken"
+
+// gcpCloudPlatformScope is the OAuth2 scope of the access tokens used to pull from Google registries.
+const gcpCloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// gcrHosts are the Container Registry hosts, authenticated along with gcp_registry_host.
+var gcrHosts = []string{"gcr.io", "us.gcr.io", "eu.gcr.io", "asia.gcr.io"}
+
+// azureManagementScope is the AAD scope requested before exchanging for an ACR refresh token.
+const azureManagementScope = "https://management.azure.com/.default"
+
+// getRegistryAuths returns the docker auth entries for the given registry type.
+func getRegistryAuths(ctx context.Context, registryType string, creds Credentials) (map[string]AuthConfig, error) {
+	switch RegistryType(registryType) {
+	case RegistryGHCR:
+		return getGHCRAuth(ctx, creds)
+	case RegistryECR:
+		return getECRAuth(ctx, creds)
+	case RegistryECRPublic:
+		return getECRPublicAuth(ctx, creds)
+	case RegistryACR:
+		return getACRAuth(ctx, creds)
+	case RegistryDockerHub:
+		return getDockerHubAuth(creds)
+	case RegistryGCR, RegistryGAR:
+		return getGCPAuth(ctx, creds)
+	case RegistryGeneric:
+		return getGenericAuth(creds)
+	case RegistryPublic:
+		return map[string]AuthConfig{}, nil
+	default:
+		return nil, fmt.Errorf("Unsupported registry type: %s", registryType)
+	}
+}
+
+// getGHCRAuth returns the GHCR auth entries of github_username and github_token, or of an installation token minted
+// for the GitHub App of the credentials.
+func getGHCRAuth(ctx context.Context, creds Credentials) (map[string]AuthConfig, error) {
+	if creds.hasGitHubApp() {
+		token, err := githubAppInstallationToken(ctx, creds)
+		if err != nil {
+			return nil, fmt.Errorf("GHCR error: %w", err)
+		}
+		creds.GithubUsername, creds.GithubToken = githubAppTokenUsername, token
+	}
+	ghInputJSON := fmt.Sprintf(`{
+			"github": {
+				"username": %q,
+				"token": %q
+			}
+		}`, creds.GithubUsername, creds.GithubToken)
+
+	ghcrCreds, err := utils.GetAllCredentials([]byte(ghInputJSON), "")
+	if err != nil {
+		return nil, fmt.Errorf("GHCR error: %v", err)
+	}
+
+	ghcrAuth := map[string]AuthConfig{}
+	for host, val := range ghcrCreds {
+		ghcrAuth[host] = AuthConfig{Auth: val}
+	}
+	return ghcrAuth, nil
+}
+
+// getDockerHubAuth returns the Docker Hub auth entry, none (anonymous pulls, subject to the Docker Hub rate limits)
+// when no credentials are given.
+func getDockerHubAuth(creds Credentials) (map[string]AuthConfig, error) {
+	if creds.DockerHubUsername == "" && creds.DockerHubToken == "" {
+		return map[string]AuthConfig{}, nil
+	}
+	if creds.DockerHubUsername == "" || creds.DockerHubToken == "" {
+		return nil, fmt.Errorf("Docker Hub error: dockerhub_username and dockerhub_token are both required")
+	}
+	return map[string]AuthConfig{
+		dockerHubAuthKey: {Auth: base64.StdEncoding.EncodeToString([]byte(creds.DockerHubUsername + ":" + creds.DockerHubToken))},
+	}, nil
+}
+
+// getGenericAuth returns the basic auth entry of a self-hosted registry (Harbor, Nexus, JFrog, ...).
+func getGenericAuth(creds Credentials) (map[string]AuthConfig, error) {
+	if creds.RegistryHost == "" || creds.RegistryUsername == "" || creds.RegistryPassword == "" {
+		return nil, fmt.Errorf("registry error: registry_host, registry_username and registry_password are required")
+	}
+	// Keyed by host as looked up when pulling, a URL being accepted for convenience
+	host := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(creds.RegistryHost, "https://"), "http://"), "/")
+	return map[string]AuthConfig{
+		host: {Auth: base64.StdEncoding.EncodeToString([]byte(creds.RegistryUsername + ":" + creds.RegistryPassword))},
+	}, nil
+}
+
+// isDockerHubHost reports whether host is Docker Hub, which oras reaches as registry-1.docker.io for docker.io
+// references.
+func isDockerHubHost(host string) bool {
+	switch host {
+	case "docker.io", "index.docker.io", "registry-1.docker.io":
+		return true
+	}
+	return false
+}
+
+// The ECR Public API, served from us-east-1 only, and the host of the repositories of the Public Gallery.
+const (
+	ecrPublicRegion   = "us-east-1"
+	ecrPublicEndpoint = "https://api.ecr-public.us-east-1.amazonaws.com/"
+	ecrPublicHost     = "public.ecr.aws"
+)
+
+// getECRAuth obtains an ECR authorization token. When an OIDC token is provided, the role in OIDCRoleARN is assumed
+// with AssumeRoleWithWebIdentity, otherwise the default AWS credential chain is used. The role in ECRRoleARN, when
+// set, is assumed with these credentials in turn, e.g. to reach the registry of another account.
+func getECRAuth(ctx context.Context, creds Credentials) (map[string]AuthConfig, error) {
+	cfg, retries, err := loadECRConfig(ctx, creds)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := ecr.NewFromConfig(cfg).GetAuthorizationToken(ctx, &ecr.GetAuthorizationTokenInput{
+		RegistryIds: []string{creds.ECRAccountID},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ECR error: failed to get authorization token: %w", retryFailure(err, retries.MaxAttempts))
+	}
+	if len(out.AuthorizationData) == 0 || out.AuthorizationData[0].AuthorizationToken == nil {
+		return nil, fmt.Errorf("ECR error: no authorization data returned")
+	}
+
+	return map[string]AuthConfig{
+		ecrHost(creds): {Auth: aws.ToString(out.AuthorizationData[0].AuthorizationToken)},
+	}, nil
+}
+
+// ecrHost is the host of the ECR registry of the credentials.
+func ecrHost(creds Credentials) string {
+	return fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com", creds.ECRAccountID, creds.ECRRegion)
+}
+
+// loadECRConfig loads the AWS config of the ECR API calls of creds, along with the retry policy the SDK follows.
+func loadECRConfig(ctx context.Context, creds Credentials) (aws.Config, retryPolicy, error) {
+	if creds.ECRAccountID == "" || creds.ECRRegion == "" {
+		return aws.Config{}, retryPolicy{}, fmt.Errorf("ECR error: ecr_account_id and ecr_region are required")
+	}
+	return loadAWSConfig(ctx, creds, creds.ECRRegion)
+}
+
+// loadAWSConfig loads the AWS config of creds in region: the default AWS credential chain, or the role in
+// OIDCRoleARN assumed with the OIDC token, and the role in ECRRoleARN assumed with these in turn.
+func loadAWSConfig(ctx context.Context, creds Credentials, region string) (aws.Config, retryPolicy, error) {
+	httpClient, err := outboundHTTPClient()
+	if err != nil {
+		return aws.Config{}, retryPolicy{}, fmt.Errorf("ECR error: %w", err)
+	}
+	retries, err := getRetryPolicy()
+	if err != nil {
+		return aws.Config{}, retryPolicy{}, newTaskError(ErrorKindConfig, fmt.Errorf("ECR error: %w", err))
+	}
+
+	// The SDK retries throttling and 5xx responses itself, up to the attempts of the retry policy
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(region), config.WithHTTPClient(httpClient),
+		config.WithRetryMaxAttempts(retries.MaxAttempts))
+	if err != nil {
+		return aws.Config{}, retryPolicy{}, fmt.Errorf("ECR error: failed to load AWS config: %w", err)
+	}
+
+	if creds.hasOIDCToken() {
+		if creds.OIDCRoleARN == "" {
+			return aws.Config{}, retryPolicy{}, fmt.Errorf("ECR error: oidc_role_arn is required when an OIDC token is provided")
+		}
+		provider := stscreds.NewWebIdentityRoleProvider(sts.NewFromConfig(cfg), creds.OIDCRoleARN, oidcTokenRetriever{creds: creds},
+			func(o *stscreds.WebIdentityRoleOptions) {
+				o.RoleSessionName = "og-task-grype"
+			})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+	if creds.ECRRoleARN != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), creds.ECRRoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = "og-task-grype"
+			if creds.ECRExternalID != "" {
+				o.ExternalID = aws.String(creds.ECRExternalID)
+			}
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+	return cfg, retries, nil
+}
+
+// getECRPublicAuth obtains an authorization token of the ECR Public Gallery with the AWS credentials of creds, as
+// ECR does. Authenticated pulls get the higher rate limits of the gallery. The SDK has no ECR Public client here,
+// GetAuthorizationToken is called on the JSON API, signed with SigV4.
+func getECRPublicAuth(ctx context.Context, creds Credentials) (map[string]AuthConfig, error) {
+	cfg, retries, err := loadAWSConfig(ctx, creds, ecrPublicRegion)
+	if err != nil {
+		return nil, err
+	}
+	awsCreds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ECR error: failed to retrieve AWS credentials: %w", err)
+	}
+
+	body := []byte("{}")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ecrPublicEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("ECR error: failed to create authorization token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "SpencerFrontendService.GetAuthorizationToken")
+	payloadHash := sha256.Sum256(body)
+	if err := v4.NewSigner().SignHTTP(ctx, awsCreds, req, hex.EncodeToString(payloadHash[:]), "ecr-public", ecrPublicRegion, time.Now()); err != nil {
+		return nil, fmt.Errorf("ECR error: failed to sign authorization token request: %w", err)
+	}
+
+	httpClient, err := retryingHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ECR error: failed to get public authorization token: %w", retryFailure(err, retries.MaxAttempts))
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ECR error: failed to read authorization token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := &statusError{StatusCode: resp.StatusCode, Err: fmt.Errorf("ECR error: failed to get public authorization token: status %d: %s", resp.StatusCode, string(respBody))}
+		return nil, retryFailure(err, retries.MaxAttempts)
+	}
+
+	var out struct {
+		AuthorizationData struct {
+			AuthorizationToken string `json:"authorizationToken"`
+		} `json:"authorizationData"`
+	}
+	if err := json.Unmarshal(respBody, &out); err != nil {
+		return nil, fmt.Errorf("ECR error: failed to parse authorization token response: %w", err)
+	}
+	if out.AuthorizationData.AuthorizationToken == "" {
+		return nil, fmt.Errorf("ECR error: no authorization data returned")
+	}
+	return map[string]AuthConfig{
+		ecrPublicHost: {Auth: out.AuthorizationData.AuthorizationToken},
+	}, nil
+}
+
+// getGCPAuth obtains an OAuth2 access token for Google Container Registry and Artifact Registry hosts. The token is
+// issued for gcp_credentials_json when given, a service account key or a workload identity federation
+// (external_account) configuration, otherwise from the application default credentials (e.g. the GKE metadata
+// server with workload identity).
+func getGCPAuth(ctx context.Context, creds Credentials) (map[string]AuthConfig, error) {
+	httpClient, err := retryingHTTPClient()
+	if err != nil {
+		return nil, fmt.Errorf("GCP error: %w", err)
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, httpClient)
+
+	var gcpCreds *google.Credentials
+	if creds.GCPCredentialsJSON != "" {
+		gcpCreds, err = google.CredentialsFromJSON(ctx, []byte(creds.GCPCredentialsJSON), gcpCloudPlatformScope)
+	} else {
+		gcpCreds, err = google.FindDefaultCredentials(ctx, gcpCloudPlatformScope)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("GCP error: failed to load credentials: %w", err)
+	}
+	token, err := gcpCreds.TokenSource.Token()
+	if err != nil {
+		return nil, fmt.Errorf("GCP error: failed to get access token: %w", err)
+	}
+
+	entry := AuthConfig{Auth: base64.StdEncoding.EncodeToString([]byte(gcpAccessTokenUsername + ":" + token.AccessToken))}
+	auths := make(map[string]AuthConfig)
+	for _, host := range gcrHosts {
+		auths[host] = entry
+	}
+	if creds.GCPRegistryHost != "" {
+		auths[creds.GCPRegistryHost] = entry
+	}
+	return auths, nil
+}
+
+// getACRAuth obtains an ACR refresh token, exchanged for an AAD token of the Azure credential of acr_auth_method. When
+// pulling an image, or with acr_token_scope, the refresh token is exchanged in turn for an access token of the scopes
+// of the token (pull on the repository by default), so that leaked credentials can't push or reach other repositories.
+func getACRAuth(ctx context.Context, creds Credentials) (map[string]AuthConfig, error) {
+	if creds.ACRLoginServer == "" {
+		return nil, fmt.Errorf("ACR error: acr_login_server is required")
+	}
+
+	cred, err := newAzureCredential(creds)
+	if err != nil {
+		return nil, fmt.Errorf("ACR error: %w", err)
+	}
+	aadToken, err := cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{azureManagementScope}})
+	if err != nil {
+		return nil, fmt.Errorf("ACR error: failed to acquire AAD token: %w", err)
+	}
+
+	refreshToken, err := exchangeAADTokenForACRRefreshToken(ctx, creds.ACRLoginServer, creds.ACRTenantID, aadToken.Token)
+	if err != nil {
+		return nil, fmt.Errorf("ACR error: %w", err)
+	}
+
+	scopes := strings.Fields(creds.ACRTokenScope)
+	if len(scopes) == 0 && creds.acrRepository != "" {
+		scopes = []string{"repository:" + creds.acrRepository + ":pull"}
+	}
+	if len(scopes) == 0 {
+		return map[string]AuthConfig{
+			creds.ACRLoginServer: {Auth: base64.StdEncoding.EncodeToString([]byte(acrRefreshTokenUsername + ":" + refreshToken))},
+		}, nil
+	}
+	accessToken, err := exchangeACRRefreshTokenForAccessToken(ctx, creds.ACRLoginServer, refreshToken, scopes)
+	if err != nil {
+		return nil, fmt.Errorf("ACR error: %w", err)
+	}
+	return map[string]AuthConfig{
+		creds.ACRLoginServer: {RegistryToken: accessToken},
+	}, nil
+}
+
+// Azure credentials of ACR and Azure Blob Storage (acr_auth_method).
+const (
+	// AzureAuthDefault is DefaultAzureCredential, trying the environment, workload identity, managed identity and the
+	// Azure CLI in turn.
+	AzureAuthDefault = "default"
+	// AzureAuthServicePrincipal is the service principal of acr_client_id with acr_client_secret.
+	AzureAuthServicePrincipal = "service_principal"
+	// AzureAuthManagedIdentity is the managed identity of the host, user-assigned with
+	// acr_managed_identity_client_id.
+	AzureAuthManagedIdentity = "managed_identity"
+	// AzureAuthWorkloadIdentity is the app of acr_client_id federated with the OIDC token of the params, or with the
+	// AKS workload identity of the pod (AZURE_FEDERATED_TOKEN_FILE) without.
+	AzureAuthWorkloadIdentity = "workload_identity"
+)
+
+// azureAuthMethod returns the Azure credential of acr_auth_method, inferred from the credential params when it isn't
+// set: federated with an OIDC token, a service principal with a client secret, a managed identity with its client ID,
+// DefaultAzureCredential otherwise.
+func (c Credentials) azureAuthMethod() string {
+	switch {
+	case c.ACRAuthMethod != "":
+		return c.ACRAuthMethod
+	case c.hasOIDCToken():
+		return AzureAuthWorkloadIdentity
+	case c.ACRClientSecret != "":
+		return AzureAuthServicePrincipal
+	case c.ACRManagedIdentityClientID != "":
+		return AzureAuthManagedIdentity
+	}
+	return AzureAuthDefault
+}
+
+// newAzureCredential returns the Azure credential of creds, of its azureAuthMethod.
+func newAzureCredential(creds Credentials) (azcore.TokenCredential, error) {
+	httpClient, err := outboundHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	retries, err := getRetryPolicy()
+	if err != nil {
+		return nil, newTaskError(ErrorKindConfig, err)
+	}
+	maxRetries := int32(retries.MaxAttempts - 1)
+	if maxRetries == 0 {
+		// 0 stands for the azcore default
+		maxRetries = -1
+	}
+	clientOptions := azcore.ClientOptions{
+		Transport: httpClient,
+		Retry: policy.RetryOptions{
+			MaxRetries:    maxRetries,
+			RetryDelay:    retries.BaseDelay,
+			MaxRetryDelay: retries.MaxDelay,
+		},
+	}
+
+	var cred azcore.TokenCredential
+	switch method := creds.azureAuthMethod(); method {
+	case AzureAuthServicePrincipal:
+		if creds.ACRTenantID == "" || creds.ACRClientID == "" || creds.ACRClientSecret == "" {
+			return nil, fmt.Errorf("acr_tenant_id, acr_client_id and acr_client_secret are required for a service principal")
+		}
+		cred, err = azidentity.NewClientSecretCredential(creds.ACRTenantID, creds.ACRClientID, creds.ACRClientSecret,
+			&azidentity.ClientSecretCredentialOptions{ClientOptions: clientOptions})
+	case AzureAuthManagedIdentity:
+		options := &azidentity.ManagedIdentityCredentialOptions{ClientOptions: clientOptions}
+		if creds.ACRManagedIdentityClientID != "" {
+			options.ID = azidentity.ClientID(creds.ACRManagedIdentityClientID)
+		}
+		cred, err = azidentity.NewManagedIdentityCredential(options)
+	case AzureAuthWorkloadIdentity:
+		if !creds.hasOIDCToken() {
+			// The tenant, client ID and token file default to those AKS sets in the environment
+			cred, err = azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+				ClientOptions: clientOptions,
+				ClientID:      creds.ACRClientID,
+				TenantID:      creds.ACRTenantID,
+			})
+			break
+		}
+		if creds.ACRTenantID == "" || creds.ACRClientID == "" {
+			return nil, fmt.Errorf("acr_tenant_id and acr_client_id are required when an OIDC token is provided")
+		}
+		cred, err = azidentity.NewClientAssertionCredential(creds.ACRTenantID, creds.ACRClientID, func(ctx context.Context) (string, error) {
+			token, err := creds.readOIDCToken()
+			return string(token), err
+		}, &azidentity.ClientAssertionCredentialOptions{ClientOptions: clientOptions})
+	case AzureAuthDefault:
+		cred, err = azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{
+			ClientOptions: clientOptions,
+			TenantID:      creds.ACRTenantID,
+		})
+	default:
+		return nil, newTaskError(ErrorKindConfig, fmt.Errorf("invalid acr_auth_method %q", method))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create azure credential: %w", err)
+	}
+	return cred, nil
+}
+
+// exchangeAADTokenForACRRefreshToken exchanges an AAD access token for an ACR refresh token.
+func exchangeAADTokenForACRRefreshToken(ctx context.Context, loginServer, tenantID, aadToken string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "access_token")
+	form.Set("service", loginServer)
+	form.Set("access_token", aadToken)
+	if tenantID != "" {
+		form.Set("tenant", tenantID)
+	}
+
+	var tokenResp struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := postACRTokenForm(ctx, loginServer, "/oauth2/exchange", form, &tokenResp); err != nil {
+		return "", fmt.Errorf("failed to exchange AAD token: %w", err)
+	}
+	if tokenResp.RefreshToken == "" {
+		return "", fmt.Errorf("token exchange response did not contain a refresh token")
+	}
+	return tokenResp.RefreshToken, nil
+}
+
+// exchangeACRRefreshTokenForAccessToken exchanges an ACR refresh token for an access token of scopes, e.g.
+// repository:team/app:pull.
+func exchangeACRRefreshTokenForAccessToken(ctx context.Context, loginServer, refreshToken string, scopes []string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("service", loginServer)
+	form.Set("refresh_token", refreshToken)
+	for _, scope := range scopes {
+		form.Add("scope", scope)
+	}
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := postACRTokenForm(ctx, loginServer, "/oauth2/token", form, &tokenResp); err != nil {
+		return "", fmt.Errorf("failed to get access token of scope %s: %w", strings.Join(scopes, " "), err)
+	}
+	if tokenResp.AccessToken == "" {
+		return "", fmt.Errorf("token response did not contain an access token")
+	}
+	return tokenResp.AccessToken, nil
+}
+
+// postACRTokenForm posts form to the token endpoint of the ACR at loginServer, decoding the response into out.
+func postACRTokenForm(ctx context.Context, loginServer, path string, form url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("https://%s%s", loginServer, path), strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	httpClient, err := retryingHTTPClient()
+	if err != nil {
+		return err
+	}
+	// retryingHTTPClient already validated the policy
+	retries, _ := getRetryPolicy()
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return retryFailure(err, retries.MaxAttempts)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := &statusError{StatusCode: resp.StatusCode, Err: fmt.Errorf("token request failed with status %d: %s", resp.StatusCode, string(body))}
+		return retryFailure(err, retries.MaxAttempts)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("failed to unmarshal token response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/opengovern/og-util/pkg/opengovernance-es-sdk"
+	"github.com/opengovern/og-util/pkg/tasks"
+	"github.com/opengovern/opencomply/services/tasks/scheduler"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"oras.land/oras-go/v2/registry"
+)
+
+// Scopes of a scan (scan_scope): the images of oci_artifact_url, every tag of the repositories it lists, or of the
+// repositories discovered in the registry.
+const (
+	ScanScopeImage      = "image"
+	ScanScopeRepository = "repository"
+	ScanScopeRegistry   = "registry"
+)
+
+func parseScanScope(params map[string][]string) (string, error) {
+	scope := getParamValue(params, "scan_scope", ScanScopeImage)
+	if scope != ScanScopeImage && scope != ScanScopeRepository && scope != ScanScopeRegistry {
+		return "", fmt.Errorf("invalid scan_scope %q: expected %s, %s or %s", scope, ScanScopeImage, ScanScopeRepository, ScanScopeRegistry)
+	}
+	return scope, nil
+}
+
+// RepositoryScanResult is the result of a scan_scope=repository run, the ScanRunResult of all the tags scanned along
+// with the summary of each repository.
+type RepositoryScanResult struct {
+	ScanRunResult
+	Repositories []RepositoryScanSummary `json:"repositories"`
+}
+
+// RepositoryScanSummary sums up the scans of the tags of a repository. TagsConsidered is the number of tags listed
+// for the query, TagsTruncated being set when the listing stopped at max_tags, and Tags those selected.
+type RepositoryScanSummary struct {
+	Repository     string         `json:"repository"`
+	TagsConsidered int            `json:"tagsConsidered"`
+	TagsTruncated  bool           `json:"tagsTruncated,omitempty"`
+	Tags           []string       `json:"tags"`
+	ScannedTags    int            `json:"scannedTags"`
+	FailedTags     int            `json:"failedTags"`
+	TotalMatches   int            `json:"totalMatches"`
+	SeverityCounts map[string]int `json:"severityCounts"`
+	FixableCount   int            `json:"fixableCount"`
+	KnownExploited int            `json:"knownExploited"`
+}
+
+// runScanRepositoryTask lists the tags of the repositories of oci_artifact_url selected by the tag query (tag_regex,
+// tag_semver_only, tag_latest_n, max_tags) through the registry API and scans them all as a batch, summing the
+// results up per repository.
+func runScanRepositoryTask(ctx context.Context, esClient opengovernance.Client, logger *zap.Logger, request tasks.TaskRequest, response *scheduler.TaskResponse, publish ProgressPublisher, publishFindings FindingsPublisher) error {
+	params := request.TaskDefinition.Params
+	repositories := params["oci_artifact_url"]
+	if len(repositories) == 0 {
+		return newTaskError(ErrorKindConfig, fmt.Errorf("OCI artifact url parameter is not provided"))
+	}
+	query, err := getTagQueryFromParams(params)
+	if err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+
+	registryType := getParamValue(params, "registry_type", string(RegistryGHCR))
+	creds := getCredsFromParams(params)
+	if err := creds.ValidateFor(registryType); err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+	auths, err := getRegistryAuths(ctx, registryType, creds)
+	if err != nil {
+		return newTaskError(ErrorKindAuth, err)
+	}
+	cfg := DockerConfig{Auths: auths}
+	opts := pullOptions{Anonymous: RegistryType(registryType) == RegistryPublic}
+
+	var images []string
+	summaries := make([]RepositoryScanSummary, len(repositories))
+	for i, repository := range repositories {
+		ref, err := parseImageReference(repository)
+		if err != nil {
+			return newTaskError(ErrorKindConfig, err)
+		}
+		if !ref.DefaultTagApplied {
+			return newTaskError(ErrorKindConfig, fmt.Errorf("%s: oci_artifact_url must be a repository without tag or digest with scan_scope=%s", repository, ScanScopeRepository))
+		}
+		repo, err := newRemoteRepository(registry.Reference{Registry: ref.Registry, Repository: ref.Repository}, cfg, opts)
+		if err != nil {
+			return err
+		}
+		listed, err := listTags(ctx, repo, query)
+		if err != nil {
+			if isAccessError(err) {
+				return newTaskError(ErrorKindAuth, err)
+			}
+			return newTaskError(ErrorKindPull, err)
+		}
+		logger.Info("Listed repository tags", zap.String("repository", repository), zap.Int("considered", listed.Considered),
+			zap.Int("selected", len(listed.Tags)), zap.Bool("truncated", listed.Truncated))
+
+		summaries[i] = RepositoryScanSummary{
+			Repository:     ref.Registry + "/" + ref.Repository,
+			TagsConsidered: listed.Considered,
+			TagsTruncated:  listed.Truncated,
+			Tags:           listed.Tags,
+			SeverityCounts: map[string]int{},
+		}
+		for _, tag := range listed.Tags {
+			images = append(images, summaries[i].Repository+":"+tag)
+		}
+	}
+	if len(images) == 0 {
+		response.Result = []byte("No tags found in the repositories")
+		return nil
+	}
+
+	scanRequest := request
+	scanRequest.TaskDefinition.Params = copyParams(params)
+	delete(scanRequest.TaskDefinition.Params, "scan_scope")
+	scanRequest.TaskDefinition.Params["oci_artifact_url"] = images
+	// Tags are resolved when pulled
+	scanRequest.TaskDefinition.Params["artifact_digest"] = make([]string, len(images))
+
+	scanErr := runScanTask(ctx, esClient, logger, scanRequest, response, publish, publishFindings)
+	if result, ok := repositoryScanResult(response.Result, summaries); ok {
+		response.Result = result
+	}
+	return scanErr
+}
+
+// repositoryScanResult returns the RepositoryScanResult of the ScanRunResult of the tags of the repositories, in the
+// order they were listed in. Other results, e.g. of a breached severity gate, aren't.
+func repositoryScanResult(runResult []byte, summaries []RepositoryScanSummary) ([]byte, bool) {
+	var tags int
+	for _, summary := range summaries {
+		tags += len(summary.Tags)
+	}
+	var result RepositoryScanResult
+	if err := json.Unmarshal(runResult, &result.ScanRunResult); err != nil || len(result.Statuses) != tags {
+		return nil, false
+	}
+	images := make(map[string]ImageScanSummary, len(result.Images))
+	for _, image := range result.Images {
+		images[image.ImageURL] = image
+	}
+
+	pos := 0
+	for i := range summaries {
+		summary := &summaries[i]
+		for range summary.Tags {
+			status := result.Statuses[pos]
+			pos++
+			switch status.Status {
+			case ImageStatusSucceeded:
+				summary.ScannedTags++
+			case ImageStatusFailed:
+				summary.FailedTags++
+			}
+			image, ok := images[status.ImageURL]
+			if !ok {
+				continue
+			}
+			summary.TotalMatches += image.TotalMatches
+			summary.FixableCount += image.FixableCount
+			summary.KnownExploited += image.KnownExploited
+			for severity, count := range image.SeverityCounts {
+				summary.SeverityCounts[severity] += count
+			}
+		}
+	}
+	result.Repositories = summaries
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
@@ -1,9 +1,96 @@
 package task
 
+// ResultSchemaVersion is the version of the shape of the stored result documents.
+// Bump it whenever a field is added, removed or changes meaning so consumers can branch on it.
+const ResultSchemaVersion = 22
+
 type OciArtifactVulnerabilities struct {
+	SchemaVersion   int                  `json:"schemaVersion"`
 	ImageURL        string               `json:"imageUrl"`
 	ArtifactDigest  string               `json:"artifactDigest"`
 	Vulnerabilities []VulnerabilityMatch `json:"Vulnerabilities"`
+	Summary         ScanSummary          `json:"summary"`
+	TargetedFilter  *TargetedFilter      `json:"targetedFilter,omitempty"`
+
+	// VerifiedDigest is set to ArtifactDigest when the pulled image was checked to have it (verify_digest).
+	VerifiedDigest string `json:"verifiedDigest,omitempty"`
+
+	// Detected OS of the scanned image and the type of grype source scanned (image, sbom, dir, ...)
+	OSName     string `json:"osName,omitempty"`
+	OSVersion  string `json:"osVersion,omitempty"`
+	SourceType string `json:"sourceType,omitempty"`
+
+	// ScanPath is set when only this subtree of the image filesystem was scanned (scan_path). The OS is usually
+	// not detected in that case since the OS release files are outside the scanned tree.
+	ScanPath string `json:"scanPath,omitempty"`
+
+	// ScanWarnings are the warnings logged by the scanner, e.g. about package types it can't match. When set the
+	// scan may under-report for the affected ecosystems.
+	ScanWarnings []string `json:"scanWarnings,omitempty"`
+
+	// PackageCount is the number of packages the scanner found, when it reports it. NoPackagesDetected is set when it
+	// found none: along with DistroDetected it tells an empty (scratch) image from one whose packages couldn't be read.
+	PackageCount       *int `json:"packageCount,omitempty"`
+	NoPackagesDetected bool `json:"noPackagesDetected"`
+	DistroDetected     bool `json:"distroDetected"`
+
+	// DBBuiltAt and DBSchemaVersion describe the vulnerability database the image was scanned against, so consumers
+	// know how fresh the results are.
+	DBBuiltAt       string `json:"dbBuiltAt,omitempty"`
+	DBSchemaVersion string `json:"dbSchemaVersion,omitempty"`
+
+	// ForeignLayers are the digests of the image layers downloaded from the URLs in the manifest rather than the
+	// registry (foreign_layers).
+	ForeignLayers []string `json:"foreignLayers,omitempty"`
+
+	// NewSinceLastScan are the matches not found by the previous scan of the image reference described by
+	// ComparisonBasis (compare_with_previous, fail_on_new_severity).
+	NewSinceLastScan []VulnerabilityMatch `json:"newSinceLastScan,omitempty"`
+	ComparisonBasis  *ComparisonBasis     `json:"comparisonBasis,omitempty"`
+	// Diff is what changed since that scan (diff_with_previous).
+	Diff *ScanDiff `json:"diff,omitempty"`
+
+	// IgnoredMatches are the matches suppressed by ignore rules, with the rules applied (ignored_matches=store).
+	IgnoredMatches []IgnoredMatch `json:"ignoredMatches,omitempty"`
+
+	// VEXSuppressed are the matches suppressed by the statements of the VEX documents of the task (vex_documents),
+	// recorded whatever the ignored_matches mode.
+	VEXSuppressed []VEXSuppression `json:"vexSuppressed,omitempty"`
+
+	// VulnerabilitiesIndexTemplate is the index template of the MatchDocument documents the matches are stored as
+	// rather than in Vulnerabilities (result_mode=fanout).
+	VulnerabilitiesIndexTemplate string `json:"vulnerabilitiesIndexTemplate,omitempty"`
+
+	// GeneratedSBOM links to the SBOM generated for the image, stored as an SBOMDocument (generate_sbom).
+	GeneratedSBOM *SBOMRef `json:"generatedSbom,omitempty"`
+
+	// OwnerTeam, Service and OnCall are who owns the image repository, from the ownership mapping or endpoint
+	// (OWNERSHIP_MAPPING, OWNERSHIP_ENDPOINT). Unset when the lookup found no owner or failed.
+	OwnerTeam string `json:"ownerTeam,omitempty"`
+	Service   string `json:"service,omitempty"`
+	OnCall    string `json:"onCall,omitempty"`
+
+	// Report is the scanner report in the scan_output_format requested, when other than json.
+	Report *ScanReport `json:"report,omitempty"`
+}
+
+// ScanSummary holds the totals of a scan, computed before any truncation of the stored matches.
+type ScanSummary struct {
+	TotalMatches   int            `json:"totalMatches"`
+	StoredMatches  int            `json:"storedMatches"`
+	Truncated      bool           `json:"truncated"`
+	SeverityCounts map[string]int `json:"severityCounts"`
+	// FixableCount is the number of matches with an available fix whose fix state is included by FixStatePolicy.
+	FixableCount   int            `json:"fixableCount"`
+	FixStatePolicy FixStatePolicy `json:"fixStatePolicy"`
+	// SeverityGate is set when a fail_on_severity threshold was given.
+	SeverityGate *SeverityGate `json:"severityGate,omitempty"`
+	// NewSeverityGate is set when a fail_on_new_severity threshold was given, only new matches count against it.
+	NewSeverityGate *SeverityGate `json:"newSeverityGate,omitempty"`
+	// IgnoredMatches is the number of matches suppressed by ignore rules, which aren't counted in TotalMatches.
+	IgnoredMatches int `json:"ignoredMatches"`
+	// KnownExploitedCount is the number of matches of vulnerabilities in the KEV catalog.
+	KnownExploitedCount int `json:"knownExploitedCount"`
 }
 
 func (r OciArtifactVulnerabilities) UniqueID() string {
@@ -11,14 +98,63 @@ func (r OciArtifactVulnerabilities) UniqueID() string {
 }
 
 type GrypeOutput struct {
-	Matches []VulnerabilityMatch `json:"matches"`
+	Matches        []VulnerabilityMatch `json:"matches"`
+	IgnoredMatches []IgnoredMatch       `json:"ignoredMatches"`
+	Source         GrypeSource          `json:"source"`
+	Distro         GrypeDistro          `json:"distro"`
+
+	// Warnings logged by the scanner on stderr and the number of packages it found (nil when unknown), not part of
+	// the report itself.
+	Warnings     []string `json:"-"`
+	PackageCount *int     `json:"-"`
+	// Report is the report in the requested scan_output_format, nil for json.
+	Report *ScanReport `json:"-"`
+	// DBStatus is the vulnerability database scanned against, nil when unknown.
+	DBStatus *GrypeDBStatus `json:"-"`
+	// SBOM is the SBOM generated in the requested format, nil when none was.
+	SBOM *GeneratedSBOM `json:"-"`
+}
+
+type GrypeSource struct {
+	Type string `json:"type"`
+	// Target is an object describing the image for image sources, and a path for directory or file sources.
+	Target interface{} `json:"target"`
+}
+
+type GrypeDistro struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version"`
+	IDLike  []string `json:"idLike"`
 }
 
 type VulnerabilityMatch struct {
 	Vulnerability          Vulnerability   `json:"vulnerability"`
 	RelatedVulnerabilities []Vulnerability `json:"relatedVulnerabilities"`
-	MatchDetail            interface{}     `json:"matchDetail"`
+	MatchDetails           []MatchDetail   `json:"matchDetails"`
 	Artifact               interface{}     `json:"artifact"`
+
+	// ExploitAvailable is set when public exploit code is known for the vulnerability (EXPLOIT_DATASET), with
+	// ExploitReferences pointing to it.
+	ExploitAvailable  bool     `json:"exploitAvailable"`
+	ExploitReferences []string `json:"exploitReferences,omitempty"`
+
+	// EPSSScore is the EPSS probability of exploitation within 30 days of the vulnerability, EPSSPercentile its rank
+	// among all scored CVEs (EPSS_DATASET). Unset when the vulnerability has no score.
+	EPSSScore      *float64 `json:"epssScore,omitempty"`
+	EPSSPercentile *float64 `json:"epssPercentile,omitempty"`
+
+	// KnownExploited is set when the vulnerability is in the CISA KEV catalog (KEV_CATALOG), KEV being its entry.
+	KnownExploited bool      `json:"knownExploited"`
+	KEV            *KEVEntry `json:"kev,omitempty"`
+}
+
+// MatchDetail explains how the scanner matched the package to the vulnerability. Type is e.g. exact-direct-match,
+// exact-indirect-match or cpe-match for grype.
+type MatchDetail struct {
+	Type       string      `json:"type"`
+	Matcher    string      `json:"matcher"`
+	SearchedBy interface{} `json:"searchedBy"`
+	Found      interface{} `json:"found"`
 }
 
 type Vulnerability struct {
@@ -34,12 +170,18 @@ type Vulnerability struct {
 }
 
 type VulnerabilityCVS struct {
-	Source         string            `json:"source"`
-	Type           string            `json:"type"`
-	Version        string            `json:"version"`
-	Vector         string            `json:"vector"`
-	Metrics        map[string]string `json:"metrics"`
-	VendorMetadata map[string]string `json:"vendorMetadata"`
+	Source         string                  `json:"source"`
+	Type           string                  `json:"type"`
+	Version        string                  `json:"version"`
+	Vector         string                  `json:"vector"`
+	Metrics        VulnerabilityCVSMetrics `json:"metrics"`
+	VendorMetadata map[string]string       `json:"vendorMetadata"`
+}
+
+type VulnerabilityCVSMetrics struct {
+	BaseScore           float64  `json:"baseScore"`
+	ExploitabilityScore *float64 `json:"exploitabilityScore,omitempty"`
+	ImpactScore         *float64 `json:"impactScore,omitempty"`
 }
 
 type VulnerabilityFix struct {
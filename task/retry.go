@@ -0,0 +1,208 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"io"
+	"net"
+	"net/http"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+	"oras.land/oras-go/v2/registry/remote/retry"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Retries of transient failures (HTTP 408, 429 and 5xx, network timeouts and dropped connections) of registry pulls,
+// registry token exchanges and result indexing. An operation is attempted up to RETRY_MAX_ATTEMPTS times (default
+// 3), waiting RETRY_BASE_DELAY (default 2s) doubled on every further attempt and capped at RETRY_MAX_DELAY (default
+// 30s), or as long as the Retry-After of a 429 response asks.
+var (
+	RetryMaxAttempts = os.Getenv("RETRY_MAX_ATTEMPTS")
+	RetryBaseDelay   = os.Getenv("RETRY_BASE_DELAY")
+	RetryMaxDelay    = os.Getenv("RETRY_MAX_DELAY")
+)
+
+// retryPolicy is the parsed retry configuration.
+type retryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// getRetryPolicy returns the retry policy of RetryMaxAttempts, RetryBaseDelay and RetryMaxDelay.
+func getRetryPolicy() (retryPolicy, error) {
+	p := retryPolicy{MaxAttempts: 3, BaseDelay: 2 * time.Second, MaxDelay: 30 * time.Second}
+	if RetryMaxAttempts != "" {
+		n, err := strconv.Atoi(RetryMaxAttempts)
+		if err != nil || n < 1 {
+			return p, fmt.Errorf("invalid RETRY_MAX_ATTEMPTS %q: must be a positive integer", RetryMaxAttempts)
+		}
+		p.MaxAttempts = n
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"RETRY_BASE_DELAY", RetryBaseDelay, &p.BaseDelay},
+		{"RETRY_MAX_DELAY", RetryMaxDelay, &p.MaxDelay},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v < 0 {
+			return p, fmt.Errorf("invalid %s %q: must be a non-negative duration", d.name, d.value)
+		}
+		*d.dst = v
+	}
+	if p.MaxDelay < p.BaseDelay {
+		p.MaxDelay = p.BaseDelay
+	}
+	return p, nil
+}
+
+// delay returns the wait before the attempt following attempt (starting at 1).
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// transport wraps base with retries of the requests failing transiently. Requests with a body are retried only
+// when the body can be rewound.
+func (p retryPolicy) transport(base http.RoundTripper) http.RoundTripper {
+	policy := &retry.GenericPolicy{
+		Retryable: func(resp *http.Response, err error) (bool, error) {
+			if err != nil {
+				return isRetryable(err), nil
+			}
+			return isRetryableStatus(resp.StatusCode), nil
+		},
+		Backoff:  retry.ExponentialBackoff(p.BaseDelay, 2, 0.1),
+		MinWait:  p.BaseDelay,
+		MaxWait:  p.MaxDelay,
+		MaxRetry: p.MaxAttempts - 1,
+	}
+	return &retry.Transport{
+		Base:   base,
+		Policy: func() retry.Policy { return policy },
+	}
+}
+
+// retryingHTTPClient returns the outbound HTTP client with the retries of the retry policy.
+func retryingHTTPClient() (*http.Client, error) {
+	p, err := getRetryPolicy()
+	if err != nil {
+		return nil, newTaskError(ErrorKindConfig, err)
+	}
+	httpClient, err := outboundHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	client := *httpClient
+	client.Transport = p.transport(httpClient.Transport)
+	return &client, nil
+}
+
+// withRetry runs fn until it succeeds, fails with an error that isn't retryable or the attempts are exhausted. The
+// error returned tells which of the last two it was.
+func withRetry(ctx context.Context, logger *zap.Logger, op string, fn func() error) error {
+	p, err := getRetryPolicy()
+	if err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if !isRetryable(err) || attempt >= p.MaxAttempts {
+			return retryFailure(err, attempt)
+		}
+		delay := p.delay(attempt)
+		if logger != nil {
+			logger.Warn("transient failure, retrying", zap.String("operation", op), zap.Int("attempt", attempt),
+				zap.Duration("delay", delay), zap.Error(err))
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %w (last error: %v)", op, ctx.Err(), err)
+		}
+	}
+}
+
+// retriedByTransport reports whether err is a failure retryingHTTPClient retries itself when it's transient: a
+// response status or a refused connection. Failures once a response is being read, e.g. of a dropped blob
+// download, aren't.
+func retriedByTransport(err error) bool {
+	var statusErr *statusError
+	var errResp *errcode.ErrorResponse
+	var httpErr interface{ HTTPStatusCode() int }
+	return errors.As(err, &statusErr) || errors.As(err, &errResp) || errors.As(err, &httpErr) ||
+		errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// retryFailure describes err, the last failure of an operation after attempts attempts, as transient or permanent.
+func retryFailure(err error, attempts int) error {
+	if isRetryable(err) {
+		return fmt.Errorf("transient error, giving up after %d attempts: %w", attempts, err)
+	}
+	return fmt.Errorf("permanent error: %w", err)
+}
+
+// statusError is the failure of an HTTP request with the status of the response.
+type statusError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *statusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.Err
+}
+
+// isRetryableStatus tells whether a response with the status may succeed when the request is repeated.
+func isRetryableStatus(code int) bool {
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// isRetryable tells whether err is a transient failure: a retryable response status, a network timeout or a
+// dropped connection. Cancellations aren't.
+func isRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return isRetryableStatus(statusErr.StatusCode)
+	}
+	var errResp *errcode.ErrorResponse
+	if errors.As(err, &errResp) {
+		return isRetryableStatus(errResp.StatusCode)
+	}
+	// AWS SDK response errors
+	var httpErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &httpErr) {
+		return isRetryableStatus(httpErr.HTTPStatusCode())
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,46 @@
+package task
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// RunID helpers, so the run directory, the DescribedBy of stored results and the IDs of the messages published for a
+// run all format the scheduler's RunID the same way.
+
+// ValidateRunID checks that runID was set by the scheduler, run IDs start at 1.
+func ValidateRunID(runID uint) error {
+	if runID == 0 {
+		return fmt.Errorf("invalid run id %d: must be a positive integer", runID)
+	}
+	return nil
+}
+
+// FormatRunID formats runID in decimal.
+func FormatRunID(runID uint) string {
+	return strconv.FormatUint(uint64(runID), 10)
+}
+
+// RunDir is the name prefix of the working directory of the run, see NewWorkDir.
+func RunDir(runID uint) string {
+	return "run-" + FormatRunID(runID)
+}
+
+// ResultMessageID is the ID of the final result message of the run.
+func ResultMessageID(runID uint) string {
+	return "task-run-result-" + FormatRunID(runID)
+}
+
+// InProgressMessageID is the ID of an in-progress message of the run, seq distinguishing the messages of a run so
+// JetStream doesn't deduplicate them. The initial message has seq 0.
+func InProgressMessageID(runID uint, seq int) string {
+	if seq == 0 {
+		return "task-run-inprogress-" + FormatRunID(runID)
+	}
+	return "task-run-inprogress-" + FormatRunID(runID) + "-" + strconv.Itoa(seq)
+}
+
+// FindingsMessageID is the ID of a findings message of the run, seq starting at 1.
+func FindingsMessageID(runID uint, seq int) string {
+	return "task-run-findings-" + FormatRunID(runID) + "-" + strconv.Itoa(seq)
+}
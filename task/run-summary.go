@@ -0,0 +1,197 @@
+package task
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+)
+
+// topCVECount is the number of vulnerabilities listed in TopCVEs.
+const topCVECount = 5
+
+// ScanRunResult is the result of a successful scan run, summing up the scanned images so schedulers and UIs don't
+// need to query the stored results.
+type ScanRunResult struct {
+	StoredResults  string         `json:"storedResults"`
+	ScannedImages  int            `json:"scannedImages"`
+	TotalMatches   int            `json:"totalMatches"`
+	SeverityCounts map[string]int `json:"severityCounts"`
+	FixableCount   int            `json:"fixableCount"`
+	// KnownExploited is the number of matches of vulnerabilities in the KEV catalog.
+	KnownExploited int `json:"knownExploited"`
+	// TopCVEs are the most severe vulnerabilities found across the images.
+	TopCVEs []TopCVE `json:"topCves"`
+	// Duration is how long the run took, in seconds.
+	Duration float64 `json:"duration"`
+	// Images sums up the images scanned, FailedImages is the number of the others, Statuses tells how the scan of
+	// every image of the task went, in its order.
+	Images       []ImageScanSummary `json:"images"`
+	FailedImages int                `json:"failedImages"`
+	Statuses     []ImageStatus      `json:"statuses"`
+}
+
+// Statuses of the images of a run in ImageStatus.
+const (
+	ImageStatusSucceeded = "succeeded"
+	ImageStatusFailed    = "failed"
+	// ImageStatusSkipped is the status of the images not scanned because the run stopped early, e.g. at the first
+	// failure with fail_fast.
+	ImageStatusSkipped = "skipped"
+)
+
+// ImageStatus is the outcome of the scan of an image of the run, with the error, and its kind, it failed with.
+type ImageStatus struct {
+	ImageURL  string    `json:"imageUrl"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	ErrorKind ErrorKind `json:"errorKind,omitempty"`
+}
+
+// ImageScanSummary sums up the scan of an image in ScanRunResult. ScanDuration is how long pulling and scanning the
+// image took, in seconds. Diff is set with diff_with_previous.
+type ImageScanSummary struct {
+	ImageURL       string            `json:"imageUrl"`
+	ArtifactDigest string            `json:"artifactDigest"`
+	ManifestDigest string            `json:"manifestDigest,omitempty"`
+	EsID           string            `json:"esId"`
+	EsIndex        string            `json:"esIndex"`
+	TotalMatches   int               `json:"totalMatches"`
+	SeverityCounts map[string]int    `json:"severityCounts"`
+	FixableCount   int               `json:"fixableCount"`
+	KnownExploited int               `json:"knownExploited"`
+	Truncated      bool              `json:"truncated,omitempty"`
+	TopCVEs        []TopCVE          `json:"topCves"`
+	ScanDuration   float64           `json:"scanDuration"`
+	Diff           *ImageDiffSummary `json:"diff,omitempty"`
+}
+
+// TopCVE is a vulnerability of TopCVEs, with its highest CVSS base score and the number of its matches.
+type TopCVE struct {
+	ID        string  `json:"id"`
+	Severity  string  `json:"severity"`
+	CVSSScore float64 `json:"cvssScore"`
+	Matches   int     `json:"matches"`
+}
+
+// scanRunResult returns the result of the run of the indexed scans of artifactUrls, the images in the order of the
+// task, failures being the errors of those that failed by position. The diffs with the previous scans are summed up
+// with withDiffs (diff_with_previous).
+func scanRunResult(artifactUrls []string, indexed []indexItem, failures []error, storedResults string, duration time.Duration, withDiffs bool) ([]byte, error) {
+	items := append([]indexItem(nil), indexed...)
+	sort.Slice(items, func(i, j int) bool { return items[i].pos < items[j].pos })
+
+	result := ScanRunResult{
+		StoredResults:  storedResults,
+		ScannedImages:  len(items),
+		SeverityCounts: map[string]int{},
+		Duration:       duration.Seconds(),
+		Images:         []ImageScanSummary{},
+		Statuses:       imageStatuses(artifactUrls, items, failures),
+	}
+	for _, status := range result.Statuses {
+		if status.Status == ImageStatusFailed {
+			result.FailedImages++
+		}
+	}
+	var allMatches []VulnerabilityMatch
+	for _, item := range items {
+		scan := item.scan
+		summary := ImageScanSummary{
+			ImageURL:       scan.ImageURL,
+			ArtifactDigest: scan.ArtifactDigest,
+			ManifestDigest: item.manifestDigest,
+			EsID:           item.result.EsID,
+			EsIndex:        item.result.EsIndex,
+			TotalMatches:   scan.Summary.TotalMatches,
+			SeverityCounts: scan.Summary.SeverityCounts,
+			FixableCount:   scan.Summary.FixableCount,
+			KnownExploited: scan.Summary.KnownExploitedCount,
+			Truncated:      scan.Summary.Truncated,
+			TopCVEs:        topCVEs(scan.Vulnerabilities),
+			ScanDuration:   item.scanDuration.Seconds(),
+		}
+		if withDiffs {
+			summary.Diff = imageDiffSummary(scan)
+		}
+		result.Images = append(result.Images, summary)
+
+		result.TotalMatches += scan.Summary.TotalMatches
+		result.FixableCount += scan.Summary.FixableCount
+		result.KnownExploited += scan.Summary.KnownExploitedCount
+		for severity, count := range scan.Summary.SeverityCounts {
+			result.SeverityCounts[severity] += count
+		}
+		allMatches = append(allMatches, scan.Vulnerabilities...)
+	}
+	result.TopCVEs = topCVEs(allMatches)
+	return json.Marshal(result)
+}
+
+// imageStatuses returns the statuses of the images of artifactUrls, scanned when indexed, failed with their failure,
+// skipped otherwise.
+func imageStatuses(artifactUrls []string, indexed []indexItem, failures []error) []ImageStatus {
+	statuses := make([]ImageStatus, len(artifactUrls))
+	for i, url := range artifactUrls {
+		statuses[i] = ImageStatus{ImageURL: url, Status: ImageStatusSkipped}
+		if err := failures[i]; err != nil {
+			statuses[i].Status = ImageStatusFailed
+			statuses[i].Error = redactTokens(err.Error())
+			statuses[i].ErrorKind = ErrorKindOf(err)
+		}
+	}
+	for _, item := range indexed {
+		statuses[item.pos].Status = ImageStatusSucceeded
+	}
+	return statuses
+}
+
+// firstError returns the first of errs which isn't nil.
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// topCVEs returns the topCVECount most severe vulnerabilities of matches, by severity then CVSS score.
+func topCVEs(matches []VulnerabilityMatch) []TopCVE {
+	byID := make(map[string]*TopCVE)
+	var order []string
+	for _, m := range matches {
+		id := strings.ToUpper(m.Vulnerability.ID)
+		cve, ok := byID[id]
+		if !ok {
+			cve = &TopCVE{ID: m.Vulnerability.ID, Severity: strings.ToLower(m.Vulnerability.Severity)}
+			byID[id] = cve
+			order = append(order, id)
+		}
+		cve.Matches++
+		if score := maxCVSSScore(m.Vulnerability); score > cve.CVSSScore {
+			cve.CVSSScore = score
+		}
+		if severityRank(m.Vulnerability.Severity) > severityRank(cve.Severity) {
+			cve.Severity = strings.ToLower(m.Vulnerability.Severity)
+		}
+	}
+
+	top := make([]TopCVE, 0, len(order))
+	for _, id := range order {
+		top = append(top, *byID[id])
+	}
+	sort.SliceStable(top, func(i, j int) bool {
+		if ri, rj := severityRank(top[i].Severity), severityRank(top[j].Severity); ri != rj {
+			return ri > rj
+		}
+		if top[i].CVSSScore != top[j].CVSSScore {
+			return top[i].CVSSScore > top[j].CVSSScore
+		}
+		return top[i].ID < top[j].ID
+	})
+	if len(top) > topCVECount {
+		top = top[:topCVECount]
+	}
+	return top
+}
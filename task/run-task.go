@@ -3,103 +3,1045 @@ package task
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/anchore/grype/grype/match"
 	"github.com/opengovern/og-util/pkg/es"
 	"github.com/opengovern/og-util/pkg/opengovernance-es-sdk"
 	"github.com/opengovern/og-util/pkg/tasks"
 	"github.com/opengovern/opencomply/services/tasks/scheduler"
+	"github.com/opensearch-project/opensearch-go/v2"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 	"golang.org/x/net/context"
-	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-func RunTask(ctx context.Context, esClient opengovernance.Client, logger *zap.Logger, request tasks.TaskRequest, response *scheduler.TaskResponse) error {
+const (
+	ActionScan      = "scan"
+	ActionRefreshDB = "refresh-db"
+	// ActionValidateCredentials checks the configured registry credentials without pulling or scanning.
+	ActionValidateCredentials = "validate-credentials"
+	// ActionScanInventory scans the images referenced by the hits of an OpenSearch inventory query.
+	ActionScanInventory = "scan-inventory"
+	// ActionScanManifest scans the images referenced in docker compose files or kubernetes manifests.
+	ActionScanManifest = "scan-manifest"
+	// ActionScanSBOM scans SBOMs given by URL or inline instead of pulling the images.
+	ActionScanSBOM = "scan-sbom"
+	// ActionScanHelmChart scans the images referenced in the manifests rendered from Helm charts.
+	ActionScanHelmChart = "scan-helm-chart"
+	// ActionScanCluster scans the images running in the pods of a Kubernetes cluster.
+	ActionScanCluster = "scan-cluster"
+	// ActionDiscoverRepositories lists the repositories of a registry, for their scans to be enqueued.
+	ActionDiscoverRepositories = "discover-repositories"
+)
+
+func RunTask(ctx context.Context, esClient opengovernance.Client, logger *zap.Logger, request tasks.TaskRequest, response *scheduler.TaskResponse, publish ProgressPublisher, publishFindings FindingsPublisher) error {
+	params, err := mergeConfigRef(ctx, request.TaskDefinition.Params)
+	if err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+	if params, err = resolveCredentialRefs(ctx, params); err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+	request.TaskDefinition.Params = params
+
+	// Params carry credentials, keep them out of everything the task logs
+	logger = RedactingLogger(logger, request.TaskDefinition.Params)
+
+	if err := ValidateRunID(request.TaskDefinition.RunID); err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+
+	action := getParamValue(request.TaskDefinition.Params, "action", ActionScan)
+	ctx, span := startSpan(ctx, "task.run", attribute.Int("run_id", int(request.TaskDefinition.RunID)), attribute.String("action", action))
+	err = withRunTimeout(ctx, request.TaskDefinition.Params, func(ctx context.Context) error {
+		switch action {
+		case ActionScan:
+			targetType, err := parseScanTargetType(request.TaskDefinition.Params)
+			if err != nil {
+				return newTaskError(ErrorKindConfig, err)
+			}
+			switch targetType {
+			case ScanTargetDir:
+				return runScanDirTask(ctx, esClient, logger, request, response, publish, publishFindings)
+			case ScanTargetArchive:
+				return runScanArchiveTask(ctx, esClient, logger, request, response, publish, publishFindings)
+			}
+			scope, err := parseScanScope(request.TaskDefinition.Params)
+			if err != nil {
+				return newTaskError(ErrorKindConfig, err)
+			}
+			switch scope {
+			case ScanScopeRepository:
+				return runScanRepositoryTask(ctx, esClient, logger, request, response, publish, publishFindings)
+			case ScanScopeRegistry:
+				return runScanRegistryTask(ctx, esClient, logger, request, response, publish, publishFindings)
+			}
+			return runScanTask(ctx, esClient, logger, request, response, publish, publishFindings)
+		case ActionRefreshDB:
+			return runRefreshDBTask(ctx, logger, request, response)
+		case ActionValidateCredentials:
+			return runValidateCredentialsTask(ctx, logger, request, response)
+		case ActionScanInventory:
+			return runScanInventoryTask(ctx, esClient, logger, request, response, publish, publishFindings)
+		case ActionScanManifest:
+			return runScanManifestTask(ctx, esClient, logger, request, response, publish, publishFindings)
+		case ActionScanSBOM:
+			return runScanSBOMTask(ctx, esClient, logger, request, response, publish, publishFindings)
+		case ActionScanHelmChart:
+			return runScanHelmChartTask(ctx, esClient, logger, request, response, publish, publishFindings)
+		case ActionScanCluster:
+			return runScanClusterTask(ctx, esClient, logger, request, response, publish, publishFindings)
+		case ActionDiscoverRepositories:
+			return runDiscoverRepositoriesTask(ctx, logger, request, response)
+		default:
+			return fmt.Errorf("unsupported action: %s", action)
+		}
+	})
+	// Errors may quote credentials, e.g. in the response of a registry, the failure message of the run mustn't
+	err = RedactError(err, request.TaskDefinition.Params)
+	endSpan(span, err)
+	return err
+}
+
+func runScanTask(ctx context.Context, esClient opengovernance.Client, logger *zap.Logger, request tasks.TaskRequest, response *scheduler.TaskResponse, publish ProgressPublisher, publishFindings FindingsPublisher) error {
+	startedAt := time.Now()
+	opts, artifactDigests, err := getScanOptionsFromParams(ctx, logger, request.TaskDefinition.Params)
+	if err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+	scanParallelism, err := getIntParam(request.TaskDefinition.Params, "scan_parallelism", 1)
+	if err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+	if scanParallelism < 1 {
+		return newTaskError(ErrorKindConfig, fmt.Errorf("scan_parallelism must be positive"))
+	}
+	// The other images are still scanned when one fails unless fail_fast is set
+	failFast := getBoolParam(request.TaskDefinition.Params, "fail_fast")
+
+	batcher, err := newResultBatcher(publish, request.TaskDefinition.RunID, request.TaskDefinition.Params)
+	if err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+	progress, err := newProgressTracker(logger, publish, request.TaskDefinition.RunID, request.TaskDefinition.Params,
+		request.TaskDefinition.Params["oci_artifact_url"])
+	if err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+	opts.resultStore = esClient.ES()
+	opts.findings, err = newFindingsStreamer(publishFindings, request.TaskDefinition.RunID, request.TaskDefinition.Params)
+	if err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+
+	for _, index := range request.TaskDefinition.Params["artifact_output_index"] {
+		if index == "" {
+			continue
+		}
+		if err := validateIndexName(index); err != nil {
+			return newTaskError(ErrorKindConfig, err)
+		}
+	}
+
+	artifactUrls := request.TaskDefinition.Params["oci_artifact_url"]
+	ids := make([]string, len(artifactUrls))
+	indices := make([]string, len(artifactUrls))
+	failures := make([]error, len(artifactUrls))
+	var indexed []indexItem
+
+	// Scans run in parallel, storing the results is funneled through the indexer's writers
+	indexer, err := newResultIndexer(ctx, logger, esClient.ES(), request.TaskDefinition.Params, func(item indexItem) {
+		ids[item.pos] = item.result.EsID
+		indices[item.pos] = item.result.EsIndex
+		indexed = append(indexed, item)
+		if err := batcher.Add(ctx, item.notification); err != nil {
+			logger.Error("failed to publish image result notification", zap.Error(err))
+		}
+		progress.Stage(ctx, item.pos, StageDone)
+	})
+	if err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+
+	var scanErr error
+	workDir, err := NewWorkDir(request.TaskDefinition.RunID)
+	if err != nil {
+		return err
+	}
+	defer func() { opts.cleanup.runDone(logger, workDir, scanErr) }()
+
+	scanCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	slots := make(chan struct{}, scanParallelism)
+	for i, artifactUrl := range artifactUrls {
+		var artifactDigest string
+		if len(artifactDigests) >= (i + 1) {
+			artifactDigest = artifactDigests[i]
+		}
+
+		// Every image gets its own directory since the image archive is written under a fixed name
+		dir := workDir.Sub(fmt.Sprintf("image-%d", i))
+
+		select {
+		case slots <- struct{}{}:
+		case <-scanCtx.Done():
+		}
+		if scanCtx.Err() != nil {
+			break
+		}
+
+		artifact := artifactRef{
+			URL:            artifactUrl,
+			Digest:         artifactDigest,
+			SourceManifest: paramAt(request.TaskDefinition.Params, "artifact_source_manifest", i, ""),
+			OutputIndex:    paramAt(request.TaskDefinition.Params, "artifact_output_index", i, ""),
+			SBOM:           paramAt(request.TaskDefinition.Params, "artifact_sbom", i, ""),
+			Dir:            paramAt(request.TaskDefinition.Params, "artifact_dir", i, ""),
+			Archive:        paramAt(request.TaskDefinition.Params, "artifact_archive", i, ""),
+			ArchiveSHA256:  paramAt(request.TaskDefinition.Params, "artifact_archive_sha256", i, ""),
+			Workloads:      paramAt(request.TaskDefinition.Params, "artifact_workloads", i, ""),
+			PullAuths:      paramAt(request.TaskDefinition.Params, "artifact_pull_auths", i, ""),
+		}
+
+		wg.Add(1)
+		go func(i int, artifact artifactRef, dir string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			artifactOpts := opts
+			if progress != nil {
+				artifactOpts.progress = func(stage ProgressStage) { progress.Stage(scanCtx, i, stage) }
+			}
+			scanStartedAt := time.Now()
+			item, err := scanArtifact(scanCtx, logger, request, artifactOpts, dir, artifact)
+			opts.cleanup.imageDone(logger, dir, err)
+			if err != nil && !failFast && scanCtx.Err() == nil {
+				// Images failing don't fail the others, the run reports them
+				logger.Error("failed to scan image", zap.String("image", artifact.URL), zap.Error(err))
+				failures[i] = err
+				progress.Stage(scanCtx, i, StageFailed)
+				return
+			}
+			if err == nil {
+				item.pos = i
+				item.scanDuration = time.Since(scanStartedAt)
+				artifactOpts.stage(StageIndexing)
+				err = indexer.Submit(scanCtx, item)
+			}
+			if err != nil {
+				errOnce.Do(func() {
+					failures[i] = err
+					scanErr = err
+					cancel()
+				})
+			}
+		}(i, artifact, dir)
+	}
+	wg.Wait()
+
+	if err := indexer.Close(); err != nil && scanErr == nil {
+		scanErr = err
+	}
+	if err := batcher.Flush(ctx); err != nil {
+		logger.Error("failed to publish image result notifications", zap.Error(err))
+	}
+	storedResults := storedResultsMessage(indices, ids)
+	if scanErr == nil && len(indexed) == 0 && len(artifactUrls) > 0 {
+		scanErr = fmt.Errorf("all %d images failed, the first: %w", len(artifactUrls), firstError(failures))
+	}
+	if scanErr != nil {
+		if isRunTimeout(ctx) {
+			response.Result = runTimeoutResult(logger, request.TaskDefinition.Params, artifactUrls, indices, ids)
+		} else if result, err := scanRunResult(artifactUrls, indexed, failures, storedResults, time.Since(startedAt), opts.diffWithPrevious); err == nil {
+			response.Result = result
+		}
+		return scanErr
+	}
+	if failed := len(artifactUrls) - len(indexed); failed > 0 {
+		logger.Warn("some images failed, the run stored the results of the others", zap.Int("failedImages", failed),
+			zap.Int("scannedImages", len(indexed)))
+	}
+
+	if failure := severityGateFailure(indexed, storedResults); failure != nil {
+		resultJson, err := json.Marshal(failure)
+		if err != nil {
+			return err
+		}
+		response.Result = resultJson
+		logger.Info("severity gate breached, failing the run", zap.Int("images", len(failure.Images)), zap.Any("counts", failure.BreachingCounts))
+		return newTaskError(ErrorKindSeverityGate, failure.err())
+	}
+
+	// Images are only deleted once every result of the run is stored
+	if opts.deleteAfterScan {
+		deleteScannedImages(ctx, logger, opts, indexed)
+	}
+
+	response.Result, err = scanRunResult(artifactUrls, indexed, failures, storedResults, time.Since(startedAt), opts.diffWithPrevious)
+	if err != nil {
+		return err
+	}
+	progress.Done(ctx)
+
+	return nil
+}
+
+// getScanOptionsFromParams validates the scan params and builds the options shared by the scans of all artifacts,
+// along with the canonicalized artifact digests (empty where none was provided).
+func getScanOptionsFromParams(ctx context.Context, logger *zap.Logger, params map[string][]string) (scanOptions, []string, error) {
 	var registryType string
-	if v, ok := request.TaskDefinition.Params["oci_artifact_url"]; !(ok && len(v) > 0) {
-		return fmt.Errorf("OCI artifact url parameter is not provided")
+	if v, ok := params["oci_artifact_url"]; !(ok && len(v) > 0) {
+		return scanOptions{}, nil, fmt.Errorf("OCI artifact url parameter is not provided")
 	}
-	if v, ok := request.TaskDefinition.Params["registry_type"]; ok && len(v) > 0 {
+	if v, ok := params["registry_type"]; ok && len(v) > 0 {
 		registryType = v[0]
 	} else {
 		registryType = "ghcr"
 	}
-	if v, ok := request.TaskDefinition.Params["artifact_digest"]; !(ok && len(v) > 0) {
-		return fmt.Errorf("OCI artifact digest parameter is not provided")
+	if v, ok := params["artifact_digest"]; !(ok && len(v) > 0) {
+		return scanOptions{}, nil, fmt.Errorf("OCI artifact digest parameter is not provided")
 	}
 
-	var ids []string
-	var index string
-	for i, artifactUrl := range request.TaskDefinition.Params["oci_artifact_url"] {
-		var artifactDigest string
-		if len(request.TaskDefinition.Params["artifact_digest"]) >= (i + 1) {
-			artifactDigest = request.TaskDefinition.Params["artifact_digest"][i]
+	// Check credentials before fetching anything, pointing out params that look like misspelled credential params.
+	// SBOMs, filesystem bundles and image tarballs are scanned without accessing the registry, their image names being
+	// labels only.
+	creds := getCredsFromParams(params)
+	if len(params["artifact_sbom"]) == 0 && len(params["artifact_dir"]) == 0 && len(params["artifact_archive"]) == 0 {
+		suggestions := suggestCredentialParams(params)
+		if len(suggestions) > 0 {
+			logger.Warn("params look like misspelled credential params", zap.String("suggestions", formatSuggestions(suggestions)))
+		}
+		if err := creds.ValidateFor(registryType); err != nil {
+			if len(suggestions) > 0 {
+				return scanOptions{}, nil, fmt.Errorf("%v (did you mean: %s)", err, formatSuggestions(suggestions))
+			}
+			return scanOptions{}, nil, err
 		}
-		logger.Info("Fetching image", zap.String("image", artifactUrl))
 
-		err := fetchImage(registryType, fmt.Sprintf("run-%v", request.TaskDefinition.RunID), artifactUrl, getCredsFromParams(request.TaskDefinition.Params))
-		if err != nil {
-			logger.Error("failed to fetch image", zap.String("image", artifactUrl), zap.Error(err))
-			return err
+		// Unparseable references fail the run up front too, references without tag or digest are pulled as latest
+		for _, u := range params["oci_artifact_url"] {
+			if _, err := parseImageReference(u); err != nil {
+				return scanOptions{}, nil, err
+			}
 		}
+	}
 
-		err = showFiles(fmt.Sprintf("run-%v", request.TaskDefinition.RunID))
+	// Validate and canonicalize all digests up front so a malformed one fails the run before anything is pulled
+	artifactDigests := make([]string, len(params["artifact_digest"]))
+	for i, d := range params["artifact_digest"] {
+		if d == "" {
+			continue
+		}
+		normalized, err := normalizeDigest(d)
 		if err != nil {
-			logger.Error("failed to show files", zap.Error(err))
-			return err
+			return scanOptions{}, nil, err
 		}
+		artifactDigests[i] = normalized
+	}
 
-		logger.Info("Scanning image", zap.String("image", "image.tar"))
+	opts := scanOptions{
+		registryType:      registryType,
+		creds:             creds,
+		grypeOutputToFile: getBoolParam(params, "grype_output_to_file"),
+		strictMode:        getBoolParam(params, "strict_mode"),
+		onlyFixed:         getBoolParam(params, "only_fixed"),
+		deleteAfterScan:   getBoolParam(params, "delete_after_scan"),
+		cleanup:           getArtifactCleanupFromParams(params),
+	}
 
-		// Run the Grype command
-		cmd := exec.Command("grype", fmt.Sprintf("run-%v/%s", request.TaskDefinition.RunID, "image.tar"), "-o", "json")
+	var err error
+	opts.verifyDigest, err = strconv.ParseBool(getParamValue(params, "verify_digest", "true"))
+	if err != nil {
+		return scanOptions{}, nil, fmt.Errorf("invalid verify_digest: %w", err)
+	}
+	opts.scanner, err = newVulnerabilityScanner(ScannerBackend)
+	if err != nil {
+		return scanOptions{}, nil, err
+	}
+	opts.scanOutputFormat, err = parseScanOutputFormat(getParamValue(params, "scan_output_format", ""))
+	if err != nil {
+		return scanOptions{}, nil, err
+	}
+	opts.maxMatches, err = getIntParam(params, "max_matches", 0)
+	if err != nil {
+		return scanOptions{}, nil, err
+	}
+	opts.matchSortOrder, err = parseMatchSortOrder(getParamValue(params, "match_sort_order", ""))
+	if err != nil {
+		return scanOptions{}, nil, err
+	}
 
-		output, err := cmd.CombinedOutput()
-		logger.Info("output", zap.String("output", string(output)))
+	opts.fixStatePolicy, err = getFixStatePolicyFromParams(params)
+	if err != nil {
+		return scanOptions{}, nil, err
+	}
+
+	opts.targetedFilter = getTargetedFilterFromParams(params)
+	opts.ignoredMatches, err = parseIgnoredMatchesMode(getParamValue(params, "ignored_matches", ""))
+	if err != nil {
+		return scanOptions{}, nil, err
+	}
+	opts.ignoreRules, err = parseGrypeIgnoreRules(getParamValue(params, "grype_ignore_rules", ""))
+	if err != nil {
+		return scanOptions{}, nil, err
+	}
+	if len(opts.ignoreRules) > 0 && opts.scanner.Name() != ScannerGrype {
+		return scanOptions{}, nil, fmt.Errorf("grype_ignore_rules is only supported by the %s scanner", ScannerGrype)
+	}
+	opts.vexDocuments, err = loadVEXDocuments(ctx, params)
+	if err != nil {
+		return scanOptions{}, nil, err
+	}
+	if len(opts.vexDocuments) > 0 && opts.scanner.Name() != ScannerGrype {
+		return scanOptions{}, nil, fmt.Errorf("vex_documents is only supported by the %s scanner", ScannerGrype)
+	}
+	opts.sbomFormat, err = parseSBOMFormat(getParamValue(params, "generate_sbom", ""))
+	if err != nil {
+		return scanOptions{}, nil, err
+	}
+	if opts.sbomFormat != "" && opts.scanner.Name() != ScannerGrype {
+		return scanOptions{}, nil, fmt.Errorf("generate_sbom is only supported by the %s scanner", ScannerGrype)
+	}
+	if opts.sbomIndex = getParamValue(params, "sbom_index", ""); opts.sbomIndex != "" {
+		if err := validateIndexName(opts.sbomIndex); err != nil {
+			return scanOptions{}, nil, fmt.Errorf("invalid sbom_index: %w", err)
+		}
+	}
+	opts.minMatchConfidence, err = parseMatchConfidence(getParamValue(params, "min_match_confidence", ""))
+	if err != nil {
+		return scanOptions{}, nil, err
+	}
+	opts.pullOpts, err = getPullOptionsFromParams(params)
+	if err != nil {
+		return scanOptions{}, nil, err
+	}
+
+	// Provenance of the scan (schedule, manual, CI, ...), "source" is accepted as an alias of "triggered_by"
+	opts.triggeredBy = getParamValue(params, "triggered_by",
+		getParamValue(params, "source", "unknown"))
+
+	if v := getParamValue(params, "scan_path", ""); v != "" {
+		opts.scanPath, err = cleanScanPath(v)
 		if err != nil {
-			logger.Error("error running grype script", zap.Error(err))
-			return err
+			return scanOptions{}, nil, err
+		}
+	}
+
+	if v := getParamValue(params, "fail_on_severity", ""); v != "" {
+		opts.failOnSeverity, err = parseSeverityThreshold(v)
+		if err != nil {
+			return scanOptions{}, nil, err
+		}
+	}
+	if v := getParamValue(params, "fail_on_new_severity", ""); v != "" {
+		opts.failOnNewSeverity, err = parseSeverityThreshold(v)
+		if err != nil {
+			return scanOptions{}, nil, err
+		}
+	}
+	opts.diffWithPrevious = getBoolParam(params, "diff_with_previous")
+	opts.compareWithPrevious = getBoolParam(params, "compare_with_previous") || opts.failOnNewSeverity != "" || opts.diffWithPrevious
+
+	opts.fanoutMatches, opts.matchIndexTemplate, err = getMatchIndexTemplate(params)
+	if err != nil {
+		return scanOptions{}, nil, err
+	}
+	opts.indexRollover, err = getIndexRollover()
+	if err != nil {
+		return scanOptions{}, nil, err
+	}
+
+	return opts, artifactDigests, nil
+}
+
+// storedResultsMessage describes where the results were stored, grouping the ids by index when the results were
+// routed to several indices.
+func storedResultsMessage(indices, ids []string) string {
+	var order []string
+	byIndex := make(map[string][]string)
+	for i, index := range indices {
+		if _, ok := byIndex[index]; !ok {
+			order = append(order, index)
+		}
+		byIndex[index] = append(byIndex[index], ids[i])
+	}
+	if len(order) <= 1 {
+		var index string
+		if len(order) == 1 {
+			index = order[0]
 		}
+		return fmt.Sprintf("Responses stored in elasticsearch index %s by ids: %v", index, ids)
+	}
+	var parts []string
+	for _, index := range order {
+		parts = append(parts, fmt.Sprintf("index %s by ids: %v", index, byIndex[index]))
+	}
+	return "Responses stored in elasticsearch " + strings.Join(parts, "; ")
+}
+
+// scanOptions holds the per-run settings shared by the scans of all artifacts of the task.
+type scanOptions struct {
+	scanner           VulnerabilityScanner
+	registryType      string
+	creds             Credentials
+	pullOpts          pullOptions
+	grypeOutputToFile bool
+	maxMatches        int
+	matchSortOrder    []string
+	fixStatePolicy    FixStatePolicy
+	targetedFilter    *TargetedFilter
+	// ignoredMatches is how the matches suppressed by ignore rules are reported, IgnoredMatchesStore or
+	// IgnoredMatchesCount
+	ignoredMatches string
+	// minMatchConfidence drops less reliable (e.g. CPE-only) matches before storage (min_match_confidence).
+	minMatchConfidence MatchConfidence
+	triggeredBy        string
+	// scanPath limits the scan to the subtree of the image filesystem at this path (relative to the image root)
+	scanPath string
+	// failOnSeverity is the severity threshold of the severity gate, the gate isn't evaluated when empty
+	failOnSeverity string
+	// compareWithPrevious reports the matches new since the previous scan of the image reference, failOnNewSeverity
+	// being the threshold of the gate on those
+	compareWithPrevious bool
+	failOnNewSeverity   string
+	// diffWithPrevious also records the matches added and removed since the previous scan, and returns the diffs of
+	// the images as the result of the run (diff_with_previous)
+	diffWithPrevious bool
+	// fanoutMatches stores every match as a document of its own in the index matchIndexTemplate renders for its
+	// severity, the image index suffixed with _matches when empty, the image document only holding the summary
+	// (result_mode=fanout). All in a single document otherwise.
+	fanoutMatches      bool
+	matchIndexTemplate string
+	// indexRollover is the layout of the date suffix of the result indices (RESULT_INDEX_ROLLOVER), empty when they
+	// aren't dated
+	indexRollover string
+	// resultStore is where previous results are looked up, nil when scanning without storing (CLI)
+	resultStore *opensearch.Client
+	// strictMode fails the scan of an image when the scanner reports warnings
+	strictMode bool
+	// findings streams the findings of every scanned image, when requested with stream_findings
+	findings *findingsStreamer
+	// deleteAfterScan deletes the scanned manifests from the registry once the run succeeded
+	deleteAfterScan bool
+	// verifyDigest fails the scan of images whose pulled digest isn't their artifact_digest (verify_digest, on by
+	// default)
+	verifyDigest bool
+	// cleanup is when the files written for the scans are removed
+	cleanup artifactCleanup
+	// scanOutputFormat is the format of the scanner report stored with the matches (scan_output_format)
+	scanOutputFormat string
+	// sbomFormat is the format of the SBOM generated for every image and stored in sbomIndex, the image index
+	// suffixed with _sboms when empty (generate_sbom, sbom_index). No SBOM is generated when empty.
+	sbomFormat string
+	sbomIndex  string
+	// onlyFixed drops the matches without an available fix before storage (only_fixed)
+	onlyFixed bool
+	// ignoreRules are the grype ignore rules of the task (grype_ignore_rules), the matches they suppress being
+	// reported as ignored matches
+	ignoreRules []match.IgnoreRule
+	// vexDocuments are the OpenVEX documents of the task (vex_documents), suppressing the matches their statements
+	// say the image isn't affected by
+	vexDocuments [][]byte
+	// progress reports the stages the image reaches, nil when progress isn't published
+	progress func(stage ProgressStage)
+}
+
+// stage reports that the image reached stage.
+func (o scanOptions) stage(stage ProgressStage) {
+	if o.progress != nil {
+		o.progress(stage)
+	}
+}
 
-		var grypeOutput GrypeOutput
-		err = json.Unmarshal(output, &grypeOutput)
+// artifactRef is an artifact of the task to scan, along with its per-artifact params.
+type artifactRef struct {
+	URL    string
+	Digest string
+	// SourceManifest names the manifests referencing the image, for images found by scan-manifest.
+	SourceManifest string
+	// OutputIndex overrides the index the result is stored in (artifact_output_index), e.g. per team or tenant.
+	OutputIndex string
+	// SBOM is the content of the SBOM scanned instead of pulling the image, for SBOMs given to scan-sbom.
+	SBOM string
+	// Dir is the location of the filesystem bundle scanned instead of pulling an image (scan_target_type=dir), a path
+	// or a tarball URL.
+	Dir string
+	// Archive is the URL of the docker-archive or oci-archive tarball scanned instead of pulling the image (archive_url),
+	// ArchiveSHA256 the checksum its download is verified against.
+	Archive       string
+	ArchiveSHA256 string
+	// Workloads are the comma separated workloads (namespace/kind/name) running the image, for images found by
+	// scan-cluster, and PullAuths the JSON auths of their image pull secrets.
+	Workloads string
+	PullAuths string
+}
 
-		logger.Info("grypeOutput", zap.Any("grypeOutput", grypeOutput))
+// scanArtifact fetches and scans a single artifact into dir and builds the document to index.
+func scanArtifact(ctx context.Context, logger *zap.Logger, request tasks.TaskRequest, opts scanOptions, dir string, artifact artifactRef) (indexItem, error) {
+	artifactUrl, artifactDigest := artifact.URL, artifact.Digest
+	logger.Info("Fetching image", zap.String("image", artifactUrl))
 
-		result := OciArtifactVulnerabilities{
-			ImageURL:        artifactUrl,
-			ArtifactDigest:  artifactDigest,
-			Vulnerabilities: grypeOutput.Matches,
+	opts.stage(StagePullingImage)
+	pullOpts := opts.pullOpts
+	pullOpts.OnStage = opts.progress
+	pullOpts.Logger = logger
+	if artifact.PullAuths != "" {
+		if err := json.Unmarshal([]byte(artifact.PullAuths), &pullOpts.ExtraAuths); err != nil {
+			return indexItem{}, newTaskError(ErrorKindConfig, fmt.Errorf("invalid artifact_pull_auths: %w", err))
 		}
+	}
+	var fetched *FetchedImage
+	var err error
+	switch {
+	case artifact.SBOM != "":
+		fetched, err = fetchSBOMTarget(dir, artifact.SBOM)
+	case artifact.Dir != "":
+		fetched, err = fetchDirTarget(ctx, dir, artifact.Dir, pullOpts)
+	case artifact.Archive != "":
+		fetched, err = fetchArchiveTarget(ctx, dir, artifact.Archive, artifact.ArchiveSHA256, opts.creds, pullOpts)
+	default:
+		fetched, err = fetchImage(ctx, opts.registryType, dir, artifactUrl, opts.creds, pullOpts)
+	}
+	if err != nil {
+		logger.Error("failed to fetch image", zap.String("image", artifactUrl), zap.Error(err))
+		return indexItem{}, classifyFetchError(err)
+	}
 
-		esResult := &es.TaskResult{
-			PlatformID:   fmt.Sprintf("%s:::%s:::%s", request.TaskDefinition.TaskType, request.TaskDefinition.ResultType, result.UniqueID()),
-			ResourceID:   result.UniqueID(),
-			ResourceName: artifactUrl,
-			Description:  result,
-			ResultType:   strings.ToLower(request.TaskDefinition.ResultType),
-			TaskType:     request.TaskDefinition.TaskType,
-			Metadata:     nil,
-			DescribedAt:  time.Now().Unix(),
-			DescribedBy:  strconv.FormatUint(uint64(request.TaskDefinition.RunID), 10),
+	// Never index vulnerabilities against other content than the one the digest was given for. SBOMs and docker
+	// archives not recording the digest of their image can't be verified.
+	var verifiedDigest string
+	if artifactDigest != "" && opts.verifyDigest && (artifact.SBOM == "" && artifact.Archive == "" || fetched.ManifestDigest != "") {
+		if err := verifyArtifactDigest(artifactDigest, fetched); err != nil {
+			logger.Error("pulled image doesn't have the artifact digest", zap.String("image", artifactUrl), zap.Error(err))
+			return indexItem{}, newTaskError(ErrorKindPull, fmt.Errorf("%s: %w", artifactUrl, err))
 		}
+		verifiedDigest = artifactDigest
+	}
 
-		keys, idx := esResult.KeysAndIndex()
-		esResult.EsID = es.HashOf(keys...)
-		esResult.EsIndex = idx
+	err = showFiles(logger, dir)
+	if err != nil {
+		logger.Error("failed to show files", zap.Error(err))
+		return indexItem{}, err
+	}
 
-		err = sendDataToOpensearch(esClient.ES(), esResult)
-		if err != nil {
-			return err
+	scanTarget := fetched.scanTarget()
+	var scanPath string
+	if opts.scanPath != "" {
+		if fetched.SBOMPath != "" {
+			logger.Warn("scan_path is ignored when scanning an attached SBOM", zap.String("image", artifactUrl))
+		} else if fetched.DirPath != "" {
+			scanTarget = "dir:" + filepath.Join(fetched.DirPath, filepath.FromSlash(opts.scanPath))
+			scanPath = "/" + opts.scanPath
+		} else {
+			rootfsDir := filepath.Join(dir, "rootfs")
+			extract := extractImageSubtree
+			imagePath := fetched.ArchivePath
+			if fetched.LayoutPath != "" {
+				extract, imagePath = extractLayoutSubtree, fetched.LayoutPath
+			}
+			if err := extract(imagePath, opts.scanPath, rootfsDir); err != nil {
+				return indexItem{}, newTaskError(ErrorKindScan, fmt.Errorf("failed to extract scan path %s: %w", opts.scanPath, err))
+			}
+			scanTarget = "dir:" + rootfsDir
+			scanPath = "/" + opts.scanPath
 		}
+	}
 
-		ids = append(ids, es.HashOf(keys...))
-		index = idx
+	vexPaths, err := writeVEXDocuments(dir, opts.vexDocuments)
+	if err != nil {
+		return indexItem{}, newTaskError(ErrorKindScan, err)
 	}
 
-	resultMessage := fmt.Sprintf("Responses stored in elasticsearch index %s by ids: %v", index, ids)
-	response.Result = []byte(resultMessage)
+	logger.Info("Scanning image", zap.String("target", scanTarget))
 
-	return nil
+	opts.stage(StageScanning)
+	scanCtx, span := startSpan(ctx, "scan", attribute.String("scanner", opts.scanner.Name()), attribute.String("image", artifactUrl))
+	grypeOutput, err := opts.scanner.Scan(scanCtx, logger, ScanRequest{
+		Target:             scanTarget,
+		RunDir:             dir,
+		ToFile:             opts.grypeOutputToFile,
+		ReportFormat:       opts.scanOutputFormat,
+		IgnoreRules:        opts.ignoreRules,
+		VEXDocuments:       vexPaths,
+		ProductIdentifiers: vexProductIdentifiers(fetched),
+		SBOMFormat:         opts.sbomFormat,
+	})
+	endSpan(span, err)
+	if err != nil {
+		return indexItem{}, newTaskError(ErrorKindScan, err)
+	}
+
+	if len(grypeOutput.Warnings) > 0 {
+		logger.Warn("scanner reported warnings, results may be incomplete", zap.String("image", artifactUrl), zap.Strings("warnings", grypeOutput.Warnings))
+		if opts.strictMode {
+			return indexItem{}, newTaskError(ErrorKindScan, fmt.Errorf("scan of %s reported warnings in strict mode: %s", artifactUrl, strings.Join(grypeOutput.Warnings, "; ")))
+		}
+	}
+
+	// The full report is stored, only its outline is logged
+	logger.Info("grypeOutput", zap.String("image", artifactUrl), zap.Int("matches", len(grypeOutput.Matches)),
+		zap.String("sourceType", grypeOutput.Source.Type), zap.String("distro", grypeOutput.Distro.Name+" "+grypeOutput.Distro.Version))
+
+	matches, droppedMatches := filterMatchConfidence(grypeOutput.Matches, opts.minMatchConfidence)
+	var droppedUnfixed int
+	if opts.onlyFixed {
+		matches, droppedUnfixed = filterFixed(matches)
+	}
+	var appliedFilter *TargetedFilter
+	if opts.targetedFilter != nil {
+		f := *opts.targetedFilter
+		matches = f.Apply(matches)
+		appliedFilter = &f
+	}
+
+	flagExploitAvailable(matches, getExploitIndex(ctx, logger))
+	annotateEPSS(matches, getEPSSScores(ctx, logger, matches))
+	flagKnownExploited(matches, getKEVIndex(ctx, logger))
+
+	// Fall back to the resolved manifest digest when no digest was provided for the artifact, to the digest of the
+	// scanned SBOM or image tarball when it doesn't record the digest of its image, and to that of the content of
+	// filesystem bundles
+	if artifactDigest == "" {
+		artifactDigest = fetched.ManifestDigest
+	}
+	if artifactDigest == "" && artifact.SBOM != "" {
+		artifactDigest = fetched.SBOMDigest
+	}
+	if artifactDigest == "" && artifact.Archive != "" {
+		artifactDigest = fetched.ArchiveDigest
+	}
+	if artifactDigest == "" && artifact.Dir != "" {
+		artifactDigest = fetched.DirDigest
+	}
+
+	// Streaming is best effort, the stored results are authoritative
+	if err := opts.findings.Stream(ctx, artifactUrl, artifactDigest, matches); err != nil {
+		logger.Error("failed to stream findings", zap.String("image", artifactUrl), zap.Error(err))
+	}
+
+	summary := summarizeMatches(matches, opts.fixStatePolicy)
+	if opts.failOnSeverity != "" {
+		summary.SeverityGate = evaluateSeverityGate(matches, opts.failOnSeverity, opts.fixStatePolicy)
+	}
+
+	var fresh []VulnerabilityMatch
+	var basis *ComparisonBasis
+	var diff *ScanDiff
+	if opts.compareWithPrevious {
+		fresh, basis, diff = compareWithPreviousScan(ctx, logger, request, opts, artifact, matches)
+		if opts.failOnNewSeverity != "" && basis.Error == "" {
+			summary.NewSeverityGate = evaluateSeverityGate(fresh, opts.failOnNewSeverity, opts.fixStatePolicy)
+		}
+		if opts.maxMatches > 0 && len(fresh) > opts.maxMatches {
+			sortMatches(fresh, opts.matchSortOrder)
+			fresh = fresh[:opts.maxMatches]
+		}
+	}
+
+	matches = capMatches(matches, opts.maxMatches, opts.matchSortOrder, &summary)
+
+	summary.IgnoredMatches = len(grypeOutput.IgnoredMatches)
+	var ignored []IgnoredMatch
+	if opts.ignoredMatches == IgnoredMatchesStore {
+		ignored = grypeOutput.IgnoredMatches
+		if opts.maxMatches > 0 && len(ignored) > opts.maxMatches {
+			ignored = ignored[:opts.maxMatches]
+		}
+	}
+
+	result := OciArtifactVulnerabilities{
+		SchemaVersion:   ResultSchemaVersion,
+		ImageURL:        artifactUrl,
+		ArtifactDigest:  artifactDigest,
+		VerifiedDigest:  verifiedDigest,
+		Vulnerabilities: matches,
+		Summary:         summary,
+		TargetedFilter:  appliedFilter,
+		OSName:          grypeOutput.Distro.Name,
+		OSVersion:       grypeOutput.Distro.Version,
+		SourceType:      grypeOutput.Source.Type,
+		ScanPath:        scanPath,
+		ScanWarnings:    grypeOutput.Warnings,
+		PackageCount:    grypeOutput.PackageCount,
+		DistroDetected:  grypeOutput.Distro.Name != "",
+		ForeignLayers:   fetched.ForeignLayers,
+
+		NewSinceLastScan: fresh,
+		ComparisonBasis:  basis,
+		Diff:             diff,
+		IgnoredMatches:   ignored,
+		VEXSuppressed:    vexSuppressions(grypeOutput.IgnoredMatches),
+		Report:           grypeOutput.Report,
+	}
+	if owner := lookupOwnership(ctx, logger, imageRepository(artifactUrl)); owner != nil {
+		result.OwnerTeam = owner.OwnerTeam
+		result.Service = owner.Service
+		result.OnCall = owner.OnCall
+	}
+	if grypeOutput.DBStatus != nil {
+		result.DBBuiltAt = grypeOutput.DBStatus.Built
+		result.DBSchemaVersion = grypeOutput.DBStatus.SchemaVersion
+	}
+	if grypeOutput.PackageCount != nil && *grypeOutput.PackageCount == 0 {
+		result.NoPackagesDetected = true
+		logger.Info("no packages detected in image", zap.String("image", artifactUrl), zap.Bool("distroDetected", result.DistroDetected))
+	}
+
+	metadata := map[string]string{
+		"triggered_by": opts.triggeredBy,
+		"image_digest": fetched.ManifestDigest,
+		"image_source": fetched.Source,
+		"scanner":      opts.scanner.Name(),
+	}
+	if fetched.TarDigest != "" {
+		metadata["image_tar_digest"] = fetched.TarDigest
+	}
+	if fetched.LayoutDigest != "" {
+		metadata["image_layout_digest"] = fetched.LayoutDigest
+	}
+	if fetched.Platform != "" {
+		metadata["image_platform"] = fetched.Platform
+	}
+	if fetched.IndexDigest != "" {
+		metadata["image_index_digest"] = fetched.IndexDigest
+	}
+	if fetched.LayoutPath != "" {
+		metadata["image_layout"] = ImageLayoutOCIDir
+	}
+	if fetched.BlobCache.Enabled {
+		metadata["blob_cache_hits"] = strconv.Itoa(fetched.BlobCache.Hits)
+		metadata["blob_cache_misses"] = strconv.Itoa(fetched.BlobCache.Misses)
+		metadata["blob_cache_hit_bytes"] = strconv.FormatInt(fetched.BlobCache.HitBytes, 10)
+	}
+	if fetched.ResolvedReference != "" {
+		metadata["resolved_reference"] = fetched.ResolvedReference
+	}
+	if fetched.DefaultTagApplied {
+		metadata["default_tag_applied"] = "true"
+		logger.Info("image reference has no tag or digest, scanned "+DefaultTag, zap.String("image", artifactUrl), zap.String("resolved", fetched.ResolvedReference))
+	}
+	if opts.minMatchConfidence != MatchConfidenceLow {
+		metadata["min_match_confidence"] = opts.minMatchConfidence.String()
+		metadata["low_confidence_matches_dropped"] = strconv.Itoa(droppedMatches)
+	}
+	if opts.onlyFixed {
+		metadata["only_fixed"] = "true"
+		metadata["unfixed_matches_dropped"] = strconv.Itoa(droppedUnfixed)
+	}
+	if len(opts.vexDocuments) > 0 {
+		metadata["vex_documents"] = strconv.Itoa(len(opts.vexDocuments))
+		metadata["vex_suppressed_matches"] = strconv.Itoa(len(result.VEXSuppressed))
+	}
+	if artifact.SourceManifest != "" {
+		metadata["source_manifest"] = artifact.SourceManifest
+	}
+	if result.OwnerTeam != "" {
+		metadata["owner_team"] = result.OwnerTeam
+	}
+	if fetched.DirPath != "" {
+		metadata["dir_location"] = artifact.Dir
+	}
+	if artifact.Workloads != "" {
+		metadata["workloads"] = artifact.Workloads
+		metadata["namespaces"] = strings.Join(workloadNamespaces(artifact.Workloads), ",")
+		if cluster := getParamValue(request.TaskDefinition.Params, "cluster_name", ""); cluster != "" {
+			metadata["cluster"] = cluster
+		}
+	}
+	if artifact.Archive != "" {
+		metadata["archive_url"] = archiveName(artifact.Archive)
+		metadata["archive_digest"] = fetched.ArchiveDigest
+		if artifact.ArchiveSHA256 != "" {
+			metadata["archive_checksum_verified"] = "true"
+		}
+	}
+	if fetched.SBOMPath != "" {
+		metadata["sbom_format"] = fetched.SBOMFormat
+		metadata["sbom_digest"] = fetched.SBOMDigest
+		if fetched.SBOMVerified {
+			metadata["sbom_verified"] = "true"
+		}
+	}
+
+	esResult := &es.TaskResult{
+		PlatformID:   fmt.Sprintf("%s:::%s:::%s", request.TaskDefinition.TaskType, request.TaskDefinition.ResultType, result.UniqueID()),
+		ResourceID:   result.UniqueID(),
+		ResourceName: artifactUrl,
+		Description:  result,
+		ResultType:   strings.ToLower(request.TaskDefinition.ResultType),
+		TaskType:     request.TaskDefinition.TaskType,
+		Metadata:     metadata,
+		DescribedAt:  time.Now().Unix(),
+		DescribedBy:  FormatRunID(request.TaskDefinition.RunID),
+	}
+
+	keys, idx := esResult.KeysAndIndex()
+	esResult.EsID = es.HashOf(keys...)
+	esResult.EsIndex = idx
+	if artifact.OutputIndex != "" {
+		esResult.EsIndex = artifact.OutputIndex
+	}
+	scannedAt := time.Unix(esResult.DescribedAt, 0)
+	imageDigest := result.ArtifactDigest
+	if imageDigest == "" {
+		imageDigest = fetched.ManifestDigest
+	}
+
+	var linkedDocs []es.Doc
+	if grypeOutput.SBOM != nil {
+		index := opts.sbomIndex
+		if index == "" {
+			index = esResult.EsIndex + sbomIndexSuffix
+		}
+		var doc es.Doc
+		doc, result.GeneratedSBOM = sbomDoc(datedIndex(index, opts.indexRollover, scannedAt), esResult, result, imageDigest, grypeOutput.SBOM)
+		esResult.Description = result
+		linkedDocs = append(linkedDocs, doc)
+	}
+	if opts.fanoutMatches {
+		template := opts.matchIndexTemplate
+		if template == "" {
+			template = esResult.EsIndex + matchIndexSuffix
+		}
+		template = datedIndex(template, opts.indexRollover, scannedAt)
+		image := result
+		image.Vulnerabilities = nil
+		image.VulnerabilitiesIndexTemplate = template
+		esResult.Description = image
+		linkedDocs = append(linkedDocs, severityMatchDocs(template, esResult, result, imageDigest)...)
+	}
+	esResult.EsIndex = datedIndex(esResult.EsIndex, opts.indexRollover, scannedAt)
+
+	return indexItem{
+		scan:           result,
+		manifestDigest: fetched.ManifestDigest,
+		result:         esResult,
+		linkedDocs:     linkedDocs,
+		notification: ImageResultNotification{
+			ImageURL:       artifactUrl,
+			ArtifactDigest: artifactDigest,
+			EsID:           esResult.EsID,
+			EsIndex:        esResult.EsIndex,
+			TotalMatches:   summary.TotalMatches,
+		},
+	}, nil
+}
+
+// ScanArtifacts fetches and scans the artifacts given in params, scan_parallelism at once, in directories of runDir,
+// returning the results in their order without storing them. The SBOMs of sbom_url and sbom are scanned instead when
+// given, as with scan-sbom, filesystem bundles with scan_target_type=dir and the image tarballs of archive_url. It's
+// the entrypoint of the one-shot CLI, errors are classified as TaskError.
+func ScanArtifacts(ctx context.Context, logger *zap.Logger, params map[string][]string, runDir string) ([]OciArtifactVulnerabilities, error) {
+	params, err := mergeConfigRef(ctx, params)
+	if err != nil {
+		return nil, newTaskError(ErrorKindConfig, err)
+	}
+	if params, err = resolveCredentialRefs(ctx, params); err != nil {
+		return nil, newTaskError(ErrorKindConfig, err)
+	}
+	logger = RedactingLogger(logger, params)
+	if len(params["sbom_url"]) > 0 || len(params["sbom"]) > 0 {
+		if params, err = sbomScanParams(ctx, logger, params); err != nil {
+			return nil, newTaskError(ErrorKindConfig, err)
+		}
+	}
+	targetType, err := parseScanTargetType(params)
+	if err != nil {
+		return nil, newTaskError(ErrorKindConfig, err)
+	}
+	switch targetType {
+	case ScanTargetDir:
+		params, err = dirScanParams(params)
+	case ScanTargetArchive:
+		params, err = archiveScanParams(params)
+	}
+	if err != nil {
+		return nil, newTaskError(ErrorKindConfig, err)
+	}
+	opts, artifactDigests, err := getScanOptionsFromParams(ctx, logger, params)
+	if err != nil {
+		return nil, newTaskError(ErrorKindConfig, err)
+	}
+
+	scanParallelism, err := getIntParam(params, "scan_parallelism", 1)
+	if err != nil {
+		return nil, newTaskError(ErrorKindConfig, err)
+	}
+	if scanParallelism < 1 {
+		return nil, newTaskError(ErrorKindConfig, fmt.Errorf("scan_parallelism must be positive"))
+	}
+
+	request := tasks.TaskRequest{TaskDefinition: tasks.TaskDefinition{Params: params}}
+	artifactUrls := params["oci_artifact_url"]
+	scans := make([]*OciArtifactVulnerabilities, len(artifactUrls))
+	err = withRunTimeout(ctx, params, func(ctx context.Context) error {
+		scanCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		var scanErr error
+		var wg sync.WaitGroup
+		var errOnce sync.Once
+		slots := make(chan struct{}, scanParallelism)
+		for i, artifactUrl := range artifactUrls {
+			var artifactDigest string
+			if len(artifactDigests) >= (i + 1) {
+				artifactDigest = artifactDigests[i]
+			}
+			dir := filepath.Join(runDir, fmt.Sprintf("image-%d", i))
+
+			select {
+			case slots <- struct{}{}:
+			case <-scanCtx.Done():
+			}
+			if scanCtx.Err() != nil {
+				break
+			}
+
+			artifact := artifactRef{
+				URL:           artifactUrl,
+				Digest:        artifactDigest,
+				SBOM:          paramAt(params, "artifact_sbom", i, ""),
+				Dir:           paramAt(params, "artifact_dir", i, ""),
+				Archive:       paramAt(params, "artifact_archive", i, ""),
+				ArchiveSHA256: paramAt(params, "artifact_archive_sha256", i, ""),
+			}
+			wg.Add(1)
+			go func(i int, artifact artifactRef, dir string) {
+				defer wg.Done()
+				defer func() { <-slots }()
+
+				item, err := scanArtifact(scanCtx, logger, request, opts, dir, artifact)
+				opts.cleanup.imageDone(logger, dir, err)
+				if err != nil {
+					errOnce.Do(func() {
+						scanErr = err
+						cancel()
+					})
+					return
+				}
+				scans[i] = &item.scan
+			}(i, artifact, dir)
+		}
+		wg.Wait()
+		if scanErr == nil {
+			scanErr = ctx.Err()
+		}
+		return scanErr
+	})
+
+	// The results of the images scanned before a failure are still returned
+	var results []OciArtifactVulnerabilities
+	for _, scan := range scans {
+		if scan != nil {
+			results = append(results, *scan)
+		}
+	}
+	return results, RedactError(err, params)
 }
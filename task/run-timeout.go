@@ -0,0 +1,97 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"os"
+	"time"
+)
+
+// RunTimeout is the default timeout of a run (a duration, e.g. 2h), overridden by the run_timeout param. Runs don't
+// time out when neither is set.
+var RunTimeout = os.Getenv("RUN_TIMEOUT")
+
+// RunTimeoutDiagnostics is the result of a scan run cut short by its timeout: what was stored before the deadline,
+// and the images that weren't scanned.
+type RunTimeoutDiagnostics struct {
+	Reason        string `json:"reason"`
+	Timeout       string `json:"timeout"`
+	StoredResults string `json:"storedResults"`
+	ScannedImages int    `json:"scannedImages"`
+	// UnfinishedImages are the images whose scan was cancelled or never started.
+	UnfinishedImages []string `json:"unfinishedImages"`
+}
+
+// getRunTimeout returns the timeout of the run from run_timeout or RunTimeout, 0 when it has none.
+func getRunTimeout(params map[string][]string) (time.Duration, error) {
+	value := getParamValue(params, "run_timeout", RunTimeout)
+	if value == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid run_timeout: %w", err)
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("invalid run_timeout: must not be negative")
+	}
+	return timeout, nil
+}
+
+// withRunTimeout runs fn with a context cancelled once the run timeout elapsed, which cancels the pulls and scans in
+// flight. Runs cut short by the timeout fail with an ErrorKindTimeout error whatever fn returned.
+func withRunTimeout(ctx context.Context, params map[string][]string, fn func(ctx context.Context) error) error {
+	timeout, err := getRunTimeout(params)
+	if err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+	if timeout == 0 {
+		return fn(ctx)
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err = fn(runCtx)
+	if err != nil && isRunTimeout(runCtx) && ctx.Err() == nil {
+		return &TaskError{Kind: ErrorKindTimeout, Err: fmt.Errorf("run timed out after %s: %w", timeout, err)}
+	}
+	return err
+}
+
+// isRunTimeout tells whether ctx was cancelled by its deadline.
+func isRunTimeout(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.DeadlineExceeded)
+}
+
+// runTimeoutResult returns the RunTimeoutDiagnostics of a scan run of the artifacts, indices and ids being where
+// their results were stored (empty for the unfinished ones).
+func runTimeoutResult(logger *zap.Logger, params map[string][]string, artifactUrls, indices, ids []string) []byte {
+	timeout, _ := getRunTimeout(params)
+	diagnostics := RunTimeoutDiagnostics{
+		Reason:           "run timed out",
+		Timeout:          timeout.String(),
+		UnfinishedImages: []string{},
+	}
+	var storedIndices, storedIDs []string
+	for i, id := range ids {
+		if id == "" {
+			diagnostics.UnfinishedImages = append(diagnostics.UnfinishedImages, artifactUrls[i])
+			continue
+		}
+		storedIndices = append(storedIndices, indices[i])
+		storedIDs = append(storedIDs, id)
+	}
+	diagnostics.ScannedImages = len(storedIDs)
+	diagnostics.StoredResults = storedResultsMessage(storedIndices, storedIDs)
+	logger.Warn("run timed out", zap.String("timeout", diagnostics.Timeout), zap.Int("scannedImages", diagnostics.ScannedImages),
+		zap.Int("unfinishedImages", len(diagnostics.UnfinishedImages)))
+
+	result, err := json.Marshal(diagnostics)
+	if err != nil {
+		return nil
+	}
+	return result
+}
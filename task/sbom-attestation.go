@@ -0,0 +1,257 @@
+package task
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry/remote"
+	"path/filepath"
+	"strings"
+)
+
+// Media types and annotations of the in-toto attestations attached to images, as OCI referrers or by cosign attest
+// under the sha256-<digest>.att tag.
+const (
+	dsseEnvelopeMediaType         = "application/vnd.dsse.envelope.v1+json"
+	inTotoStatementMediaType      = "application/vnd.in-toto+json"
+	cosignAttestationTagSuffix    = ".att"
+	cosignPredicateTypeAnnotation = "predicateType"
+	inTotoPredicateTypeAnnotation = "in-toto.io/predicate-type"
+)
+
+// errUnverifiedAttestation is returned for attestations not signed by the sbom_attestation_key.
+var errUnverifiedAttestation = errors.New("attestation isn't signed by the sbom_attestation_key")
+
+// isAttestationMediaType tells whether an artifact or layer media type is that of an in-toto attestation.
+func isAttestationMediaType(mediaType string) bool {
+	return mediaType == dsseEnvelopeMediaType || mediaType == inTotoStatementMediaType
+}
+
+// sbomPredicateFormat returns the SBOM format of an in-toto predicate type, empty when it isn't an SBOM predicate.
+func sbomPredicateFormat(predicateType string) string {
+	switch {
+	case strings.HasPrefix(predicateType, "https://spdx.dev/Document"):
+		return SBOMFormatSPDXJSON
+	case strings.HasPrefix(predicateType, "https://cyclonedx.org/bom"):
+		return SBOMFormatCycloneDXJSON
+	default:
+		return ""
+	}
+}
+
+// parseAttestationKey parses the PEM encoded public key attestations must be signed with (sbom_attestation_key).
+func parseAttestationKey(value string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(value))
+	if block == nil {
+		return nil, fmt.Errorf("invalid sbom_attestation_key: expected a PEM encoded public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sbom_attestation_key: %w", err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("invalid sbom_attestation_key: unsupported key type %T", key)
+	}
+}
+
+// fetchSBOMAttestation scans the first SBOM attestation of subject, from the attestation referrers listed for it, then
+// from the cosign attestation tag, downloading it to outputDir.
+func fetchSBOMAttestation(ctx context.Context, repo *remote.Repository, subject ocispec.Descriptor, referrers []ocispec.Descriptor, outputDir string, opts pullOptions) (*FetchedImage, error) {
+	manifests := referrers
+	cosignTag := strings.Replace(subject.Digest.String(), ":", "-", 1) + cosignAttestationTagSuffix
+	if desc, err := repo.Resolve(ctx, cosignTag); err == nil {
+		manifests = append(manifests, desc)
+	}
+
+	lastErr := errNoAttachedSBOM
+	for _, manifestDesc := range manifests {
+		manifestContent, err := content.FetchAll(ctx, repo, manifestDesc)
+		if err != nil {
+			lastErr = fmt.Errorf("failed to fetch attestation manifest: %w", err)
+			continue
+		}
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(manifestContent, &manifest); err != nil {
+			lastErr = fmt.Errorf("failed to unmarshal attestation manifest: %w", err)
+			continue
+		}
+		for _, layer := range manifest.Layers {
+			if !isAttestationMediaType(layer.MediaType) {
+				continue
+			}
+			// Skip the attestations of other predicates (provenance, vulnerability scans, ...) without downloading
+			// them when the predicate type is annotated
+			predicateType := layer.Annotations[cosignPredicateTypeAnnotation]
+			if predicateType == "" {
+				predicateType = layer.Annotations[inTotoPredicateTypeAnnotation]
+			}
+			if predicateType != "" && !opts.acceptsSBOMFormat(sbomPredicateFormat(predicateType)) {
+				continue
+			}
+			if layer.Size > maxSizeBytes {
+				lastErr = fmt.Errorf("attestation size %d bytes exceeds maximum allowed size of %d bytes", layer.Size, maxSizeBytes)
+				continue
+			}
+			envelope, err := content.FetchAll(ctx, repo, layer)
+			if err != nil {
+				lastErr = fmt.Errorf("failed to fetch attestation: %w", err)
+				continue
+			}
+			format, sbomContent, verified, err := extractAttestedSBOM(envelope, subject, opts.SBOMAttestationKey)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if !opts.acceptsSBOMFormat(format) {
+				continue
+			}
+			if _, err := decodeSBOMTarget(sbomContent); err != nil {
+				lastErr = fmt.Errorf("attested SBOM: %w", err)
+				continue
+			}
+
+			sbomPath := filepath.Join(outputDir, "sbom.json")
+			if err := writeFile(sbomPath, sbomContent); err != nil {
+				return nil, fmt.Errorf("failed to write sbom.json: %w", err)
+			}
+			return &FetchedImage{
+				ManifestDigest: subject.Digest.String(),
+				Source:         ImageSourceSBOMAttestation,
+				SBOMPath:       sbomPath,
+				SBOMFormat:     format,
+				SBOMDigest:     layer.Digest.String(),
+				SBOMVerified:   verified,
+			}, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// dsseEnvelope is a DSSE envelope, signing an in-toto statement.
+type dsseEnvelope struct {
+	PayloadType string `json:"payloadType"`
+	Payload     string `json:"payload"`
+	Signatures  []struct {
+		KeyID string `json:"keyid"`
+		Sig   string `json:"sig"`
+	} `json:"signatures"`
+}
+
+// inTotoStatement is an in-toto statement about its subjects, the predicate being the SBOM of SBOM attestations.
+type inTotoStatement struct {
+	PredicateType string `json:"predicateType"`
+	Subject       []struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+	Predicate json.RawMessage `json:"predicate"`
+}
+
+// extractAttestedSBOM returns the format and content of the SBOM an attestation of subject holds, either a DSSE
+// envelope or a bare in-toto statement. With key set, only envelopes signed by it are accepted, verified being set.
+func extractAttestedSBOM(data []byte, subject ocispec.Descriptor, key crypto.PublicKey) (format string, sbom []byte, verified bool, err error) {
+	statementContent := data
+	var envelope dsseEnvelope
+	if err := json.Unmarshal(data, &envelope); err == nil && envelope.PayloadType != "" {
+		payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+		if err != nil {
+			return "", nil, false, fmt.Errorf("failed to decode attestation payload: %w", err)
+		}
+		if key != nil {
+			for _, s := range envelope.Signatures {
+				sig, err := base64.StdEncoding.DecodeString(s.Sig)
+				if err == nil && verifyDSSESignature(key, envelope.PayloadType, payload, sig) {
+					verified = true
+					break
+				}
+			}
+		}
+		statementContent = payload
+	}
+	if key != nil && !verified {
+		return "", nil, false, errUnverifiedAttestation
+	}
+
+	var statement inTotoStatement
+	if err := json.Unmarshal(statementContent, &statement); err != nil {
+		return "", nil, false, fmt.Errorf("failed to unmarshal attestation statement: %w", err)
+	}
+	format = sbomPredicateFormat(statement.PredicateType)
+	if format == "" {
+		return "", nil, false, fmt.Errorf("attestation predicate %q isn't an SBOM", statement.PredicateType)
+	}
+
+	// Never scan the SBOM of another image
+	if len(statement.Subject) > 0 {
+		matched := false
+		for _, s := range statement.Subject {
+			if s.Digest[string(subject.Digest.Algorithm())] == subject.Digest.Encoded() {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return "", nil, false, fmt.Errorf("attestation subject isn't %s", subject.Digest)
+		}
+	}
+
+	sbom, err = attestedPredicate(statement.Predicate)
+	if err != nil {
+		return "", nil, false, err
+	}
+	return format, sbom, verified, nil
+}
+
+// attestedPredicate returns the SBOM of a predicate: the document itself, a string holding it, or the Data of the
+// legacy cosign predicate wrapper.
+func attestedPredicate(predicate json.RawMessage) ([]byte, error) {
+	var text string
+	if err := json.Unmarshal(predicate, &text); err == nil {
+		return []byte(text), nil
+	}
+	var wrapper struct {
+		Data json.RawMessage `json:"Data"`
+	}
+	if err := json.Unmarshal(predicate, &wrapper); err == nil && len(wrapper.Data) > 0 {
+		if err := json.Unmarshal(wrapper.Data, &text); err == nil {
+			return []byte(text), nil
+		}
+		return wrapper.Data, nil
+	}
+	if len(predicate) == 0 {
+		return nil, fmt.Errorf("attestation has no predicate")
+	}
+	return predicate, nil
+}
+
+// verifyDSSESignature verifies sig over the DSSE pre-authentication encoding of the payload.
+func verifyDSSESignature(key crypto.PublicKey, payloadType string, payload, sig []byte) bool {
+	pae := []byte(fmt.Sprintf("DSSEv1 %d %s %d ", len(payloadType), payloadType, len(payload)))
+	pae = append(pae, payload...)
+	digest := sha256.Sum256(pae)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, digest[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil ||
+			rsa.VerifyPSS(k, crypto.SHA256, digest[:], sig, nil) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, pae, sig)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,111 @@
+package task
+
+import (
+	"fmt"
+	"github.com/anchore/syft/syft/format"
+	"github.com/anchore/syft/syft/format/cyclonedxjson"
+	"github.com/anchore/syft/syft/format/spdxjson"
+	"github.com/anchore/syft/syft/format/syftjson"
+	"github.com/anchore/syft/syft/sbom"
+	"github.com/opengovern/og-util/pkg/es"
+)
+
+// Formats of the SBOM generated alongside the scan (generate_sbom).
+const (
+	SBOMFormatSPDXJSON      = "spdx-json"
+	SBOMFormatCycloneDXJSON = "cyclonedx-json"
+	SBOMFormatSyftJSON      = "syft-json"
+)
+
+// sbomIndexSuffix is appended to the image index to name the SBOM index when sbom_index isn't set.
+const sbomIndexSuffix = "_sboms"
+
+// GeneratedSBOM is the SBOM of the packages the scanner cataloged, encoded in the generate_sbom format.
+type GeneratedSBOM struct {
+	Format       string
+	Payload      []byte
+	PackageCount int
+}
+
+// SBOMDocument is the document the SBOM generated for an image is stored as (generate_sbom), in sbom_index (the image
+// index suffixed with _sboms by default). Payload is the SBOM as encoded, stored as a string so its free-form content
+// isn't mapped by the index.
+type SBOMDocument struct {
+	SchemaVersion  int    `json:"schemaVersion"`
+	ImageURL       string `json:"imageUrl"`
+	ArtifactDigest string `json:"artifactDigest"`
+	ImageDigest    string `json:"imageDigest"`
+	Format         string `json:"format"`
+	PackageCount   int    `json:"packageCount"`
+	Payload        string `json:"payload"`
+}
+
+// SBOMRef links the result of a scan to the SBOMDocument of the image.
+type SBOMRef struct {
+	Format  string `json:"format"`
+	EsIndex string `json:"esIndex"`
+	EsID    string `json:"esId"`
+}
+
+func parseSBOMFormat(value string) (string, error) {
+	switch value {
+	case "", SBOMFormatSPDXJSON, SBOMFormatCycloneDXJSON, SBOMFormatSyftJSON:
+		return value, nil
+	default:
+		return "", fmt.Errorf("invalid generate_sbom %q: expected %s, %s or %s", value,
+			SBOMFormatSPDXJSON, SBOMFormatCycloneDXJSON, SBOMFormatSyftJSON)
+	}
+}
+
+// encodeSBOM encodes s in the format, the latest version of it syft supports.
+func encodeSBOM(s sbom.SBOM, sbomFormat string) ([]byte, error) {
+	var encoder sbom.FormatEncoder
+	var err error
+	switch sbomFormat {
+	case SBOMFormatSPDXJSON:
+		encoder, err = spdxjson.NewFormatEncoderWithConfig(spdxjson.DefaultEncoderConfig())
+	case SBOMFormatCycloneDXJSON:
+		encoder, err = cyclonedxjson.NewFormatEncoderWithConfig(cyclonedxjson.DefaultEncoderConfig())
+	case SBOMFormatSyftJSON:
+		encoder = syftjson.NewFormatEncoder()
+	default:
+		return nil, fmt.Errorf("unsupported SBOM format %q", sbomFormat)
+	}
+	if err != nil {
+		return nil, err
+	}
+	payload, err := format.Encode(s, encoder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s SBOM: %w", sbomFormat, err)
+	}
+	return payload, nil
+}
+
+// sbomDoc returns the document of the SBOM generated for image, stored in index, and the reference to it recorded in
+// the result. imageDigest is the digest the SBOM was generated from.
+func sbomDoc(index string, image *es.TaskResult, result OciArtifactVulnerabilities, imageDigest string, generated *GeneratedSBOM) (es.Doc, *SBOMRef) {
+	id := imageDigest + "|sbom|" + generated.Format
+	doc := &es.TaskResult{
+		PlatformID:   fmt.Sprintf("%s:::%s:::%s", image.TaskType, image.ResultType, id),
+		ResourceID:   id,
+		ResourceName: image.ResourceName,
+		Description: SBOMDocument{
+			SchemaVersion:  ResultSchemaVersion,
+			ImageURL:       result.ImageURL,
+			ArtifactDigest: result.ArtifactDigest,
+			ImageDigest:    imageDigest,
+			Format:         generated.Format,
+			PackageCount:   generated.PackageCount,
+			Payload:        string(generated.Payload),
+		},
+		ResultType:  image.ResultType,
+		TaskType:    image.TaskType,
+		Metadata:    image.Metadata,
+		DescribedAt: image.DescribedAt,
+		DescribedBy: image.DescribedBy,
+	}
+	keys, _ := doc.KeysAndIndex()
+	doc.EsID = es.HashOf(keys...)
+	doc.EsIndex = index
+	return routedResult{TaskResult: doc}, &SBOMRef{Format: generated.Format, EsIndex: doc.EsIndex, EsID: doc.EsID}
+}
@@ -0,0 +1,110 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/net/context"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry"
+	"path/filepath"
+)
+
+// sbomArtifactTypes maps the supported SBOM referrer artifact types to their format name.
+var sbomArtifactTypes = map[string]string{
+	"application/spdx+json":          "spdx-json",
+	"application/vnd.cyclonedx+json": "cyclonedx-json",
+	"application/vnd.syft+json":      "syft-json",
+}
+
+// errNoAttachedSBOM is returned when the image has no attached SBOM referrer in an accepted format.
+var errNoAttachedSBOM = errors.New("no attached SBOM found")
+
+// errStopReferrers stops the referrers listing once an SBOM has been found.
+var errStopReferrers = errors.New("stop listing referrers")
+
+// fetchAttachedSBOM looks up SBOM referrers of the image (OCI referrers API, falling back to the referrers tag schema)
+// and downloads the first one in an accepted format to outputDir. Without one, the SBOM attestations of the image are
+// looked up, from the attestation referrers then the cosign attestation tag. Only attestations signed by the
+// sbom_attestation_key are scanned when it's set, SBOM referrers not being signed.
+func fetchAttachedSBOM(ctx context.Context, ociArtifactURI string, cfg DockerConfig, outputDir string, opts pullOptions) (*FetchedImage, error) {
+	ref, err := registry.ParseReference(ociArtifactURI)
+	if err != nil {
+		return nil, fmt.Errorf("invalid oci-artifact-uri: %w", err)
+	}
+
+	repo, err := newRemoteRepository(ref, cfg, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	subject, err := repo.Resolve(ctx, ref.Reference)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", ociArtifactURI, err)
+	}
+
+	var sbomDesc *ocispec.Descriptor
+	var format string
+	var attestations []ocispec.Descriptor
+	err = repo.Referrers(ctx, subject, "", func(referrers []ocispec.Descriptor) error {
+		for _, r := range referrers {
+			if isAttestationMediaType(r.ArtifactType) {
+				attestations = append(attestations, r)
+				continue
+			}
+			f, ok := sbomArtifactTypes[r.ArtifactType]
+			if !ok || !opts.acceptsSBOMFormat(f) || opts.SBOMAttestationKey != nil {
+				continue
+			}
+			r := r
+			sbomDesc, format = &r, f
+			return errStopReferrers
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStopReferrers) {
+		// The cosign attestation tag doesn't depend on the referrers API
+		fetched, attErr := fetchSBOMAttestation(ctx, repo, subject, nil, outputDir, opts)
+		if attErr == nil {
+			return fetched, nil
+		}
+		return nil, fmt.Errorf("failed to list referrers: %w", err)
+	}
+	if sbomDesc == nil {
+		return fetchSBOMAttestation(ctx, repo, subject, attestations, outputDir, opts)
+	}
+
+	manifestContent, err := content.FetchAll(ctx, repo, *sbomDesc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch SBOM manifest: %w", err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestContent, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal SBOM manifest: %w", err)
+	}
+	if len(manifest.Layers) == 0 {
+		return nil, fmt.Errorf("SBOM artifact %s has no layers", sbomDesc.Digest)
+	}
+	if manifest.Layers[0].Size > maxSizeBytes {
+		return nil, fmt.Errorf("SBOM size %d bytes exceeds maximum allowed size of %d bytes", manifest.Layers[0].Size, maxSizeBytes)
+	}
+
+	sbomContent, err := content.FetchAll(ctx, repo, manifest.Layers[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch SBOM: %w", err)
+	}
+
+	sbomPath := filepath.Join(outputDir, "sbom.json")
+	if err := writeFile(sbomPath, sbomContent); err != nil {
+		return nil, fmt.Errorf("failed to write sbom.json: %w", err)
+	}
+
+	return &FetchedImage{
+		ManifestDigest: subject.Digest.String(),
+		Source:         ImageSourceSBOM,
+		SBOMPath:       sbomPath,
+		SBOMFormat:     format,
+		SBOMDigest:     sbomDesc.Digest.String(),
+	}, nil
+}
@@ -0,0 +1,182 @@
+package task
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/anchore/syft/syft/format"
+	"github.com/anchore/syft/syft/source"
+	"github.com/opengovern/og-util/pkg/opengovernance-es-sdk"
+	"github.com/opengovern/og-util/pkg/tasks"
+	"github.com/opengovern/opencomply/services/tasks/scheduler"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ImageSourceSBOMTarget is the source of images scanned from an SBOM given to the task (scan-sbom) instead of the
+// image itself.
+const ImageSourceSBOMTarget = "sbom"
+
+// sbomTarget is an SBOM given to scan-sbom, decoded to tell its format and the image it describes.
+type sbomTarget struct {
+	Content []byte
+	Format  string
+	// ImageName and ManifestDigest are those of the image the SBOM was generated from, when it records them.
+	ImageName      string
+	ManifestDigest string
+}
+
+// runScanSBOMTask scans the SBOMs (CycloneDX, SPDX or Syft JSON) downloaded from the sbom_url params or given inline
+// in the sbom params, for images built and cataloged elsewhere. Each SBOM is stored as the result of the image
+// sbom_image names (by position, SBOMs of URLs first), by default the image recorded in the SBOM, else its URL.
+// Registry credentials aren't needed, no image is pulled.
+func runScanSBOMTask(ctx context.Context, esClient opengovernance.Client, logger *zap.Logger, request tasks.TaskRequest, response *scheduler.TaskResponse, publish ProgressPublisher, publishFindings FindingsPublisher) error {
+	params, err := sbomScanParams(ctx, logger, request.TaskDefinition.Params)
+	if err != nil {
+		return newTaskError(ErrorKindConfig, err)
+	}
+	scanRequest := request
+	scanRequest.TaskDefinition.Params = params
+	return runScanTask(ctx, esClient, logger, scanRequest, response, publish, publishFindings)
+}
+
+// sbomScanParams loads and decodes the SBOMs of params, returning the params scanning them as artifacts.
+func sbomScanParams(ctx context.Context, logger *zap.Logger, params map[string][]string) (map[string][]string, error) {
+	type loaded struct {
+		name   string
+		target *sbomTarget
+	}
+	var sboms []loaded
+	for _, u := range params["sbom_url"] {
+		content, err := downloadSBOM(ctx, u)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download SBOM %s: %w", u, err)
+		}
+		target, err := decodeSBOMTarget(content)
+		if err != nil {
+			return nil, fmt.Errorf("SBOM %s: %w", u, err)
+		}
+		sboms = append(sboms, loaded{name: u, target: target})
+	}
+	for i, content := range params["sbom"] {
+		target, err := decodeSBOMTarget([]byte(content))
+		if err != nil {
+			return nil, fmt.Errorf("sbom %d: %w", i, err)
+		}
+		sboms = append(sboms, loaded{name: fmt.Sprintf("sbom-%d", i), target: target})
+	}
+	if len(sboms) == 0 {
+		return nil, fmt.Errorf("sbom_url or sbom parameter is not provided")
+	}
+	if getBoolParam(params, "delete_after_scan") {
+		return nil, fmt.Errorf("delete_after_scan is not supported when scanning SBOMs")
+	}
+
+	scanParams := copyParams(params)
+	delete(scanParams, "sbom_url")
+	delete(scanParams, "sbom")
+	var images, digests, contents []string
+	for i, s := range sboms {
+		name := s.target.ImageName
+		if name == "" {
+			name = s.name
+		}
+		images = append(images, paramAt(params, "sbom_image", i, name))
+		digests = append(digests, paramAt(params, "artifact_digest", i, s.target.ManifestDigest))
+		contents = append(contents, string(s.target.Content))
+		logger.Info("Loaded SBOM", zap.String("sbom", s.name), zap.String("format", s.target.Format), zap.String("image", images[i]))
+	}
+	scanParams["oci_artifact_url"] = images
+	scanParams["artifact_digest"] = digests
+	scanParams["artifact_sbom"] = contents
+	return scanParams, nil
+}
+
+func downloadSBOM(ctx context.Context, location string) ([]byte, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		return nil, fmt.Errorf("expected an http(s) URL")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := retryingHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{StatusCode: resp.StatusCode, Err: fmt.Errorf("unexpected status %d downloading %s", resp.StatusCode, location)}
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxSizeBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > maxSizeBytes {
+		return nil, fmt.Errorf("SBOM exceeds maximum allowed size of %d bytes", maxSizeBytes)
+	}
+	return content, nil
+}
+
+// decodeSBOMTarget decodes content as an SBOM in one of the formats grype scans.
+func decodeSBOMTarget(content []byte) (*sbomTarget, error) {
+	if int64(len(content)) > maxSizeBytes {
+		return nil, fmt.Errorf("SBOM size %d bytes exceeds maximum allowed size of %d bytes", len(content), maxSizeBytes)
+	}
+	s, formatID, _, err := format.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode SBOM: %w", err)
+	}
+	if s == nil {
+		return nil, fmt.Errorf("failed to decode SBOM: unrecognized format, expected %s, %s or %s",
+			SBOMFormatSPDXJSON, SBOMFormatCycloneDXJSON, SBOMFormatSyftJSON)
+	}
+	target := &sbomTarget{Content: content, Format: string(formatID)}
+	if metadata, ok := s.Source.Metadata.(source.ImageMetadata); ok {
+		target.ImageName = metadata.UserInput
+		// Some formats only have a version field the digest may or may not be in
+		if digest, err := normalizeDigest(metadata.ManifestDigest); err == nil {
+			target.ManifestDigest = digest
+		}
+	}
+	if target.ImageName == "" && s.Source.Name != "" {
+		target.ImageName = s.Source.Name
+		if s.Source.Version != "" {
+			target.ImageName += ":" + s.Source.Version
+		}
+	}
+	return target, nil
+}
+
+// fetchSBOMTarget writes the SBOM of a scan-sbom artifact to outputDir as the target of the scan.
+func fetchSBOMTarget(outputDir string, content string) (*FetchedImage, error) {
+	target, err := decodeSBOMTarget([]byte(content))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(outputDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	sbomPath := filepath.Join(outputDir, "sbom.json")
+	if err := writeFile(sbomPath, target.Content); err != nil {
+		return nil, fmt.Errorf("failed to write sbom.json: %w", err)
+	}
+	sum := sha256.Sum256(target.Content)
+	return &FetchedImage{
+		ManifestDigest: target.ManifestDigest,
+		Source:         ImageSourceSBOMTarget,
+		SBOMPath:       sbomPath,
+		SBOMFormat:     target.Format,
+		SBOMDigest:     "sha256:" + hex.EncodeToString(sum[:]),
+	}, nil
+}
@@ -0,0 +1,123 @@
+package task
+
+import (
+	"sort"
+	"strings"
+)
+
+// ScanDiff is what changed since the previous scan of the image reference (diff_with_previous), matches being told
+// apart by vulnerability and package version. Every match is added when there's no previous scan. Added and Removed
+// are capped by max_matches, the counts aren't.
+type ScanDiff struct {
+	AddedCount     int         `json:"addedCount"`
+	RemovedCount   int         `json:"removedCount"`
+	UnchangedCount int         `json:"unchangedCount"`
+	Added          []DiffEntry `json:"added"`
+	Removed        []DiffEntry `json:"removed"`
+}
+
+// DiffEntry identifies a match added or removed since the previous scan.
+type DiffEntry struct {
+	VulnerabilityID string `json:"vulnerabilityId"`
+	Severity        string `json:"severity"`
+	PackageName     string `json:"packageName"`
+	PackageVersion  string `json:"packageVersion"`
+}
+
+// ImageDiffSummary sums up the diff of an image in the result of the run. PreviousFound is false when the image
+// reference wasn't scanned before, Error set when the previous scan couldn't be looked up.
+type ImageDiffSummary struct {
+	PreviousFound  bool   `json:"previousFound"`
+	PreviousDigest string `json:"previousDigest,omitempty"`
+	PreviousRunID  string `json:"previousRunId,omitempty"`
+	Added          int    `json:"added"`
+	Removed        int    `json:"removed"`
+	Unchanged      int    `json:"unchanged"`
+	Error          string `json:"error,omitempty"`
+}
+
+// diffScans returns the diff of matches with those of the previous scan.
+func diffScans(matches, previous []VulnerabilityMatch, maxEntries int) *ScanDiff {
+	current := make(map[string]bool, len(matches))
+	for _, m := range matches {
+		current[matchIdentity(m)] = true
+	}
+	known := make(map[string]bool, len(previous))
+	for _, m := range previous {
+		known[matchIdentity(m)] = true
+	}
+
+	diff := &ScanDiff{Added: []DiffEntry{}, Removed: []DiffEntry{}}
+	seen := make(map[string]bool)
+	for _, m := range matches {
+		id := matchIdentity(m)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if known[id] {
+			diff.UnchangedCount++
+			continue
+		}
+		diff.AddedCount++
+		diff.Added = append(diff.Added, diffEntry(m))
+	}
+	seen = make(map[string]bool)
+	for _, m := range previous {
+		id := matchIdentity(m)
+		if current[id] || seen[id] {
+			continue
+		}
+		seen[id] = true
+		diff.RemovedCount++
+		diff.Removed = append(diff.Removed, diffEntry(m))
+	}
+
+	for _, entries := range []*[]DiffEntry{&diff.Added, &diff.Removed} {
+		sortDiffEntries(*entries)
+		if maxEntries > 0 && len(*entries) > maxEntries {
+			*entries = (*entries)[:maxEntries]
+		}
+	}
+	return diff
+}
+
+func diffEntry(m VulnerabilityMatch) DiffEntry {
+	return DiffEntry{
+		VulnerabilityID: m.Vulnerability.ID,
+		Severity:        strings.ToLower(m.Vulnerability.Severity),
+		PackageName:     matchPackageName(m),
+		PackageVersion:  matchPackageVersion(m),
+	}
+}
+
+// sortDiffEntries orders entries by descending severity, then vulnerability and package.
+func sortDiffEntries(entries []DiffEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if ra, rb := severityRanks[a.Severity], severityRanks[b.Severity]; ra != rb {
+			return ra > rb
+		}
+		if a.VulnerabilityID != b.VulnerabilityID {
+			return a.VulnerabilityID < b.VulnerabilityID
+		}
+		return a.PackageName+"|"+a.PackageVersion < b.PackageName+"|"+b.PackageVersion
+	})
+}
+
+// imageDiffSummary returns the diff summary of a scan with diff_with_previous.
+func imageDiffSummary(scan OciArtifactVulnerabilities) *ImageDiffSummary {
+	summary := &ImageDiffSummary{}
+	if basis := scan.ComparisonBasis; basis != nil {
+		summary.PreviousFound = basis.Found
+		summary.PreviousDigest = basis.ArtifactDigest
+		summary.PreviousRunID = basis.RunID
+		summary.Error = basis.Error
+	}
+	if diff := scan.Diff; diff != nil {
+		summary.Added = diff.AddedCount
+		summary.Removed = diff.RemovedCount
+		summary.Unchanged = diff.UnchangedCount
+	}
+	return summary
+}
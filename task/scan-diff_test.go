@@ -0,0 +1,81 @@
+package task
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffScans(t *testing.T) {
+	match := func(id, severity, name, version string) VulnerabilityMatch {
+		m := testMatch(id, name, version)
+		m.Vulnerability.Severity = severity
+		return m
+	}
+	entry := func(id, severity, name, version string) DiffEntry {
+		return DiffEntry{VulnerabilityID: id, Severity: severity, PackageName: name, PackageVersion: version}
+	}
+	previous := []VulnerabilityMatch{
+		match("CVE-1", "High", "openssl", "3.0.1"),
+		match("CVE-2", "Low", "zlib", "1.2.13"),
+		match("CVE-3", "Critical", "curl", "8.0.0"),
+	}
+	matches := []VulnerabilityMatch{
+		match("CVE-1", "High", "openssl", "3.0.1"),
+		// Same vulnerability in another version
+		match("CVE-2", "Low", "zlib", "1.3.0"),
+		// Added twice, e.g. found in two locations
+		match("CVE-4", "medium", "bash", "5.2"),
+		match("CVE-4", "medium", "bash", "5.2"),
+		// Tie on severity and vulnerability broken by package
+		match("CVE-5", "Critical", "libb", "1.0"),
+		match("CVE-5", "Critical", "liba", "2.0"),
+	}
+
+	for _, tc := range []struct {
+		name       string
+		matches    []VulnerabilityMatch
+		previous   []VulnerabilityMatch
+		maxEntries int
+		expected   ScanDiff
+	}{
+		{name: "no previous scan", matches: matches[:2], expected: ScanDiff{AddedCount: 2,
+			Added:   []DiffEntry{entry("CVE-1", "high", "openssl", "3.0.1"), entry("CVE-2", "low", "zlib", "1.3.0")},
+			Removed: []DiffEntry{}}},
+		{name: "unchanged", matches: previous, previous: previous, expected: ScanDiff{UnchangedCount: 3,
+			Added: []DiffEntry{}, Removed: []DiffEntry{}}},
+		{name: "added and removed, by severity then vulnerability and package", matches: matches, previous: previous,
+			expected: ScanDiff{AddedCount: 4, RemovedCount: 2, UnchangedCount: 1,
+				Added: []DiffEntry{entry("CVE-5", "critical", "liba", "2.0"), entry("CVE-5", "critical", "libb", "1.0"),
+					entry("CVE-4", "medium", "bash", "5.2"), entry("CVE-2", "low", "zlib", "1.3.0")},
+				Removed: []DiffEntry{entry("CVE-3", "critical", "curl", "8.0.0"), entry("CVE-2", "low", "zlib", "1.2.13")}}},
+		{name: "entries capped, counts not", matches: matches, previous: previous, maxEntries: 1,
+			expected: ScanDiff{AddedCount: 4, RemovedCount: 2, UnchangedCount: 1,
+				Added:   []DiffEntry{entry("CVE-5", "critical", "liba", "2.0")},
+				Removed: []DiffEntry{entry("CVE-3", "critical", "curl", "8.0.0")}}},
+		{name: "everything removed", previous: previous, expected: ScanDiff{RemovedCount: 3, Added: []DiffEntry{},
+			Removed: []DiffEntry{entry("CVE-3", "critical", "curl", "8.0.0"), entry("CVE-1", "high", "openssl", "3.0.1"),
+				entry("CVE-2", "low", "zlib", "1.2.13")}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			diff := diffScans(tc.matches, tc.previous, tc.maxEntries)
+			if !reflect.DeepEqual(*diff, tc.expected) {
+				t.Errorf("expected diff %+v, got %+v", tc.expected, *diff)
+			}
+		})
+	}
+}
+
+func TestImageDiffSummary(t *testing.T) {
+	var scan OciArtifactVulnerabilities
+	if summary := imageDiffSummary(scan); !reflect.DeepEqual(*summary, ImageDiffSummary{}) {
+		t.Errorf("expected an empty summary without a comparison, got %+v", summary)
+	}
+
+	scan.ComparisonBasis = &ComparisonBasis{Found: true, ArtifactDigest: "sha256:prev", RunID: "run-1"}
+	scan.Diff = &ScanDiff{AddedCount: 2, RemovedCount: 1, UnchangedCount: 3}
+	expected := ImageDiffSummary{PreviousFound: true, PreviousDigest: "sha256:prev", PreviousRunID: "run-1", Added: 2,
+		Removed: 1, Unchanged: 3}
+	if summary := imageDiffSummary(scan); !reflect.DeepEqual(*summary, expected) {
+		t.Errorf("expected %+v, got %+v", expected, *summary)
+	}
+}
@@ -0,0 +1,294 @@
+package task
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// cleanScanPath normalizes the scan_path param into a path relative to the image root, e.g. "/app/" -> "app".
+func cleanScanPath(scanPath string) (string, error) {
+	p := strings.TrimPrefix(path.Clean("/"+scanPath), "/")
+	if p == "" {
+		return "", fmt.Errorf("invalid scan_path %q: must be a directory below the image root", scanPath)
+	}
+	return p, nil
+}
+
+// withinPath reports whether name is p or below p, everything being below the root p "".
+func withinPath(name, p string) bool {
+	return p == "" || name == p || strings.HasPrefix(name, p+"/")
+}
+
+// extractImageSubtree assembles the part of the image filesystem below scanPath into rootfsDir, applying the layers
+// of the docker archive at archivePath in order along with their whiteouts. Everything outside scanPath is skipped.
+func extractImageSubtree(archivePath, scanPath, rootfsDir string) error {
+	layers, err := readArchiveLayerNames(archivePath)
+	if err != nil {
+		return err
+	}
+
+	// Layers are copied out of the archive first since they must be applied in manifest order
+	layersDir := rootfsDir + "-layers"
+	if err := os.MkdirAll(layersDir, 0700); err != nil {
+		return err
+	}
+	defer os.RemoveAll(layersDir)
+
+	wanted := make(map[string]int, len(layers))
+	for i, name := range layers {
+		wanted[name] = i
+	}
+	err = walkArchive(archivePath, func(hdr *tar.Header, r io.Reader) (bool, error) {
+		i, ok := wanted[path.Clean(hdr.Name)]
+		if !ok {
+			return false, nil
+		}
+		f, err := os.Create(filepath.Join(layersDir, strconv.Itoa(i)))
+		if err != nil {
+			return true, err
+		}
+		defer f.Close()
+		_, err = io.Copy(f, r)
+		return false, err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read layers: %w", err)
+	}
+
+	layerPaths := make([]string, len(layers))
+	for i := range layers {
+		layerPaths[i] = filepath.Join(layersDir, strconv.Itoa(i))
+	}
+	return applyLayersSubtree(layerPaths, layers, scanPath, rootfsDir)
+}
+
+// extractLayoutSubtree is extractImageSubtree for an image pulled into the OCI layout at layoutDir, whose layer blobs
+// are applied in place.
+func extractLayoutSubtree(layoutDir, scanPath, rootfsDir string) error {
+	layerPaths, err := readLayoutLayers(layoutDir)
+	if err != nil {
+		return fmt.Errorf("failed to read layers: %w", err)
+	}
+	names := make([]string, len(layerPaths))
+	for i, p := range layerPaths {
+		names[i] = filepath.Base(p)
+	}
+	return applyLayersSubtree(layerPaths, names, scanPath, rootfsDir)
+}
+
+// applyLayersSubtree assembles rootfsDir from the layer tars at layerPaths, in order, named by names in errors.
+func applyLayersSubtree(layerPaths, names []string, scanPath, rootfsDir string) error {
+	if err := os.RemoveAll(rootfsDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(rootfsDir, scanPath), 0755); err != nil {
+		return err
+	}
+	for i, layerPath := range layerPaths {
+		if err := applyLayerSubtree(layerPath, scanPath, rootfsDir); err != nil {
+			return fmt.Errorf("failed to apply layer %s: %w", names[i], err)
+		}
+	}
+	return nil
+}
+
+// readArchiveLayerNames returns the layer paths listed in the manifest.json of a docker archive.
+func readArchiveLayerNames(archivePath string) ([]string, error) {
+	var layers []string
+	found := false
+	err := walkArchive(archivePath, func(hdr *tar.Header, r io.Reader) (bool, error) {
+		if path.Clean(hdr.Name) != "manifest.json" {
+			return false, nil
+		}
+		var manifest []struct {
+			Layers []string `json:"Layers"`
+		}
+		if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+			return true, fmt.Errorf("failed to parse manifest.json: %w", err)
+		}
+		if len(manifest) != 1 {
+			return true, fmt.Errorf("expected one image in manifest.json, found %d", len(manifest))
+		}
+		for _, l := range manifest[0].Layers {
+			layers = append(layers, path.Clean(l))
+		}
+		found = true
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("manifest.json not found in %s", filepath.Base(archivePath))
+	}
+	return layers, nil
+}
+
+// walkArchive calls fn for every entry of the (optionally gzip or zstd compressed) tar at tarPath until fn returns stop.
+func walkArchive(tarPath string, fn func(hdr *tar.Header, r io.Reader) (stop bool, err error)) error {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := maybeDecompress(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		stop, err := fn(hdr, tr)
+		if err != nil || stop {
+			return err
+		}
+	}
+}
+
+// applyLayerSubtree applies the entries of the layer tar at layerPath that fall below scanPath onto rootfsDir.
+func applyLayerSubtree(layerPath, scanPath, rootfsDir string) error {
+	// Paths written by this layer, which its own opaque whiteouts don't hide
+	written := make(map[string]bool)
+	return walkArchive(layerPath, func(hdr *tar.Header, r io.Reader) (bool, error) {
+		// Cleaning against the root drops any ".." so entries can't escape rootfsDir
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		dir, base := path.Split(name)
+		dir = strings.TrimSuffix(dir, "/")
+
+		if base == whiteoutOpaque {
+			return false, applyWhiteout(rootfsDir, scanPath, dir, true, written)
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			return false, applyWhiteout(rootfsDir, scanPath, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), false, written)
+		}
+		if !withinPath(name, scanPath) {
+			return false, nil
+		}
+		written[name] = true
+
+		target := filepath.Join(rootfsDir, filepath.FromSlash(name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			return false, os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			if err := replaceWith(target); err != nil {
+				return true, err
+			}
+			mode := os.FileMode(0644)
+			if hdr.FileInfo().Mode()&0111 != 0 {
+				mode = 0755
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return true, err
+			}
+			_, err = io.Copy(f, r)
+			f.Close()
+			return false, err
+		case tar.TypeSymlink:
+			if err := replaceWith(target); err != nil {
+				return true, err
+			}
+			// Absolute links are made relative so they resolve inside the extracted tree, not on the host
+			linkname := hdr.Linkname
+			if path.IsAbs(linkname) {
+				rel, err := filepath.Rel(filepath.FromSlash(path.Dir("/"+name)), filepath.FromSlash(path.Clean(linkname)))
+				if err != nil {
+					return false, nil
+				}
+				linkname = rel
+			}
+			return false, os.Symlink(linkname, target)
+		case tar.TypeLink:
+			linked := strings.TrimPrefix(path.Clean("/"+hdr.Linkname), "/")
+			if !withinPath(linked, scanPath) {
+				return false, nil
+			}
+			if err := replaceWith(target); err != nil {
+				return true, err
+			}
+			if err := os.Link(filepath.Join(rootfsDir, filepath.FromSlash(linked)), target); err != nil && !os.IsNotExist(err) {
+				return true, err
+			}
+			return false, nil
+		default:
+			// Devices, fifos etc. carry no package metadata
+			return false, nil
+		}
+	})
+}
+
+// applyWhiteout removes what a whiteout entry for name hides from lower layers, limited to scanPath. An opaque
+// whiteout hides the contents of the directory name rather than name itself, except for what the layer wrote.
+func applyWhiteout(rootfsDir, scanPath, name string, opaque bool, written map[string]bool) error {
+	var hidden string
+	switch {
+	case withinPath(name, scanPath):
+		hidden = name
+	case name == "" || withinPath(scanPath, name):
+		// A parent of scanPath is removed or made opaque, hiding all of scanPath
+		hidden = scanPath
+		opaque = true
+	default:
+		return nil
+	}
+
+	target := filepath.Join(rootfsDir, filepath.FromSlash(hidden))
+	if !opaque {
+		return os.RemoveAll(target)
+	}
+
+	entries, err := os.ReadDir(target)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		child := path.Join(hidden, e.Name())
+		if written[child] {
+			if e.IsDir() {
+				if err := applyWhiteout(rootfsDir, scanPath, child, true, written); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(target, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceWith makes room for a new entry at target, creating its parent directories.
+func replaceWith(target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+	return nil
+}
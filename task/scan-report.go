@@ -0,0 +1,34 @@
+package task
+
+import (
+	"fmt"
+)
+
+// Formats of the scanner report stored along with the parsed matches (scan_output_format).
+const (
+	// ScanOutputJSON is the default: no report is stored, the matches being the JSON report.
+	ScanOutputJSON          = "json"
+	ScanOutputSARIF         = "sarif"
+	ScanOutputCycloneDXJSON = "cyclonedx-json"
+	ScanOutputTable         = "table"
+)
+
+// ScanReport is the scanner report in the requested scan_output_format, for tools consuming it as is (GitHub code
+// scanning for SARIF, DefectDojo for CycloneDX). Payload is the report as written by the scanner, stored as a string
+// so its free-form content isn't mapped by the index.
+type ScanReport struct {
+	Format  string `json:"format"`
+	Payload string `json:"payload"`
+}
+
+func parseScanOutputFormat(value string) (string, error) {
+	switch value {
+	case "":
+		return ScanOutputJSON, nil
+	case ScanOutputJSON, ScanOutputSARIF, ScanOutputCycloneDXJSON, ScanOutputTable:
+		return value, nil
+	default:
+		return "", fmt.Errorf("invalid scan_output_format %q: expected %s, %s, %s or %s", value,
+			ScanOutputJSON, ScanOutputSARIF, ScanOutputCycloneDXJSON, ScanOutputTable)
+	}
+}
@@ -0,0 +1,30 @@
+package task
+
+import (
+	"regexp"
+	"strings"
+)
+
+// scannerWarningPattern matches the level of warning lines logged by scanner processes, e.g. trivy
+// ("<time>\tWARN\t...").
+var scannerWarningPattern = regexp.MustCompile(`\bWARN(ING)?\b`)
+
+// parseScannerWarnings returns the distinct warning messages found in the stderr output of a scanner process, e.g. the
+// package types it can't match and which are therefore not reported on.
+func parseScannerWarnings(stderr []byte) []string {
+	var warnings []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(stderr), "\n") {
+		loc := scannerWarningPattern.FindStringIndex(line)
+		if loc == nil {
+			continue
+		}
+		msg := strings.TrimSpace(line[loc[1]:])
+		if msg == "" || seen[msg] {
+			continue
+		}
+		seen[msg] = true
+		warnings = append(warnings, msg)
+	}
+	return warnings
+}
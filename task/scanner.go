@@ -0,0 +1,66 @@
+package task
+
+import (
+	"fmt"
+	"github.com/anchore/grype/grype/match"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"os"
+)
+
+// ScannerBackend selects the vulnerability scanner run on fetched images, grype (default) or trivy.
+var ScannerBackend = os.Getenv("SCANNER_BACKEND")
+
+const (
+	ScannerGrype = "grype"
+	ScannerTrivy = "trivy"
+)
+
+// VulnerabilityScanner scans a fetched image. Findings are returned in the grype report schema, whatever the
+// backend, so the rest of the pipeline (filters, summary, indexing) is scanner agnostic.
+type VulnerabilityScanner interface {
+	Name() string
+	Scan(ctx context.Context, logger *zap.Logger, req ScanRequest) (GrypeOutput, error)
+}
+
+// ScanRequest is a scan to run.
+type ScanRequest struct {
+	// Target is an image archive path or a grype style source (sbom:<path>, dir:<path>).
+	Target string
+	// RunDir is where the scanner writes its files, such as the raw report when ToFile is set.
+	RunDir string
+	ToFile bool
+	// ReportFormat is the scan output format the report is also returned in (GrypeOutput.Report), unless it's
+	// ScanOutputJSON.
+	ReportFormat string
+	// IgnoreRules suppress matches, which are reported in GrypeOutput.IgnoredMatches (grype_ignore_rules).
+	IgnoreRules []match.IgnoreRule
+	// VEXDocuments are the paths of OpenVEX documents whose not_affected and fixed statements suppress matches
+	// (vex_documents), ProductIdentifiers being the references the statements can name the scanned image by.
+	VEXDocuments       []string
+	ProductIdentifiers []string
+	// SBOMFormat is the format the SBOM of the cataloged packages is generated in (GrypeOutput.SBOM), none when empty.
+	SBOMFormat string
+}
+
+// newVulnerabilityScanner returns the scanner for the given backend name, grype when empty.
+func newVulnerabilityScanner(backend string) (VulnerabilityScanner, error) {
+	switch backend {
+	case "", ScannerGrype:
+		return grypeScanner{}, nil
+	case ScannerTrivy:
+		return trivyScanner{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported scanner backend %q: expected %s or %s", backend, ScannerGrype, ScannerTrivy)
+	}
+}
+
+type grypeScanner struct{}
+
+func (grypeScanner) Name() string {
+	return ScannerGrype
+}
+
+func (grypeScanner) Scan(ctx context.Context, logger *zap.Logger, req ScanRequest) (GrypeOutput, error) {
+	return runGrype(ctx, logger, req)
+}
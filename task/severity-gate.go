@@ -0,0 +1,130 @@
+package task
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SeverityGate is the outcome of checking the matches of an image against the fail_on_severity threshold. A breach
+// fails the run, as `grype --fail-on` does, once the results of all images are stored.
+type SeverityGate struct {
+	Threshold string `json:"threshold"`
+	Breached  bool   `json:"breached"`
+	// BreachingMatches counts the matches at or above Threshold that count under the fix-state policy.
+	BreachingMatches int            `json:"breachingMatches"`
+	BreachingCounts  map[string]int `json:"breachingCounts,omitempty"`
+}
+
+// parseSeverityThreshold validates a severity threshold such as "high", returning it lowercased.
+func parseSeverityThreshold(value string) (string, error) {
+	threshold := strings.ToLower(strings.TrimSpace(value))
+	if _, ok := severityRanks[threshold]; !ok || threshold == "unknown" {
+		return "", fmt.Errorf("invalid severity threshold %q: expected negligible, low, medium, high or critical", value)
+	}
+	return threshold, nil
+}
+
+// evaluateSeverityGate checks the matches eligible under fixStatePolicy against threshold.
+func evaluateSeverityGate(matches []VulnerabilityMatch, threshold string, fixStatePolicy FixStatePolicy) *SeverityGate {
+	gate := &SeverityGate{Threshold: threshold}
+	for _, m := range fixStatePolicy.gateEligibleMatches(matches) {
+		if severityRank(m.Vulnerability.Severity) < severityRanks[threshold] {
+			continue
+		}
+		if gate.BreachingCounts == nil {
+			gate.BreachingCounts = make(map[string]int)
+		}
+		gate.BreachingCounts[strings.ToLower(m.Vulnerability.Severity)]++
+		gate.BreachingMatches++
+	}
+	gate.Breached = gate.BreachingMatches > 0
+	return gate
+}
+
+// gateEligibleMatches returns the matches that count towards the severity gate under the policy.
+func (p FixStatePolicy) gateEligibleMatches(matches []VulnerabilityMatch) []VulnerabilityMatch {
+	var eligible []VulnerabilityMatch
+	for _, m := range matches {
+		if p.Includes(m.Vulnerability.Fix.State) {
+			eligible = append(eligible, m)
+		}
+	}
+	return eligible
+}
+
+// SeverityGateFailure is the task result of a run failed by its severity gates, reporting the images that breached
+// them along with where the results were stored.
+type SeverityGateFailure struct {
+	Reason        ErrorKind `json:"reason"`
+	StoredResults string    `json:"storedResults"`
+	ScannedImages int       `json:"scannedImages"`
+	// BreachingCounts totals the breaching matches of the images by severity.
+	BreachingCounts map[string]int       `json:"breachingCounts"`
+	Images          []SeverityGateBreach `json:"images"`
+}
+
+// SeverityGateBreach is an image whose matches breached the fail_on_severity gate, the fail_on_new_severity one or
+// both.
+type SeverityGateBreach struct {
+	ImageURL        string        `json:"imageUrl"`
+	ArtifactDigest  string        `json:"artifactDigest"`
+	EsID            string        `json:"esId"`
+	SeverityGate    *SeverityGate `json:"severityGate,omitempty"`
+	NewSeverityGate *SeverityGate `json:"newSeverityGate,omitempty"`
+}
+
+// severityGateFailure returns the failure of the run when a scanned image breached a severity gate, nil otherwise.
+func severityGateFailure(indexed []indexItem, storedResults string) *SeverityGateFailure {
+	failure := &SeverityGateFailure{
+		Reason:          ErrorKindSeverityGate,
+		StoredResults:   storedResults,
+		ScannedImages:   len(indexed),
+		BreachingCounts: make(map[string]int),
+	}
+	items := append([]indexItem(nil), indexed...)
+	sort.Slice(items, func(i, j int) bool { return items[i].pos < items[j].pos })
+	for _, item := range items {
+		summary := item.scan.Summary
+		breach := SeverityGateBreach{
+			ImageURL:       item.scan.ImageURL,
+			ArtifactDigest: item.scan.ArtifactDigest,
+			EsID:           item.result.EsID,
+		}
+		// New matches are a subset of the matches, they're only counted when the other gate isn't breached
+		var counts map[string]int
+		if gate := summary.NewSeverityGate; gate != nil && gate.Breached {
+			breach.NewSeverityGate = gate
+			counts = gate.BreachingCounts
+		}
+		if gate := summary.SeverityGate; gate != nil && gate.Breached {
+			breach.SeverityGate = gate
+			counts = gate.BreachingCounts
+		}
+		if counts == nil {
+			continue
+		}
+		for severity, n := range counts {
+			failure.BreachingCounts[severity] += n
+		}
+		failure.Images = append(failure.Images, breach)
+	}
+	if len(failure.Images) == 0 {
+		return nil
+	}
+	return failure
+}
+
+// err describes the failure, e.g. "severity gate breached by 2 of 5 images (critical: 1, high: 3)".
+func (f *SeverityGateFailure) err() error {
+	severities := make([]string, 0, len(f.BreachingCounts))
+	for severity := range f.BreachingCounts {
+		severities = append(severities, severity)
+	}
+	sort.Slice(severities, func(i, j int) bool { return severityRank(severities[i]) > severityRank(severities[j]) })
+	counts := make([]string, 0, len(severities))
+	for _, severity := range severities {
+		counts = append(counts, fmt.Sprintf("%s: %d", severity, f.BreachingCounts[severity]))
+	}
+	return fmt.Errorf("%w by %d of %d images (%s)", ErrSeverityGateBreached, len(f.Images), f.ScannedImages, strings.Join(counts, ", "))
+}
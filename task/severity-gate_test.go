@@ -0,0 +1,127 @@
+package task
+
+import (
+	"errors"
+	"github.com/opengovern/og-util/pkg/es"
+	"reflect"
+	"testing"
+)
+
+func TestParseSeverityThreshold(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected string
+		invalid  bool
+	}{
+		{value: "high", expected: "high"},
+		{value: " Critical ", expected: "critical"},
+		{value: "NEGLIGIBLE", expected: "negligible"},
+		{value: "unknown", invalid: true},
+		{value: "severe", invalid: true},
+		{value: "", invalid: true},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			threshold, err := parseSeverityThreshold(tc.value)
+			if tc.invalid {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", threshold)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if threshold != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, threshold)
+			}
+		})
+	}
+}
+
+func TestEvaluateSeverityGate(t *testing.T) {
+	match := func(severity, state string) VulnerabilityMatch {
+		return VulnerabilityMatch{Vulnerability: Vulnerability{Severity: severity, Fix: VulnerabilityFix{State: state}}}
+	}
+	matches := []VulnerabilityMatch{
+		match("Critical", FixStateFixed),
+		match("high", FixStateNotFixed),
+		match("high", FixStateWontFix),
+		match("medium", ""),
+		match("Unknown", FixStateFixed),
+	}
+	for _, tc := range []struct {
+		name      string
+		threshold string
+		policy    FixStatePolicy
+		expected  map[string]int
+	}{
+		{name: "at and above the threshold", threshold: "high", expected: map[string]int{"critical": 1, "high": 2}},
+		{name: "lowest threshold", threshold: "negligible", expected: map[string]int{"critical": 1, "high": 2, "medium": 1}},
+		{name: "below the threshold", threshold: "critical", expected: map[string]int{"critical": 1}},
+		{name: "excluded fix state", threshold: "high", policy: FixStatePolicy{ExcludedStates: []string{FixStateWontFix}},
+			expected: map[string]int{"critical": 1, "high": 1}},
+		{name: "included fix state", threshold: "medium", policy: FixStatePolicy{IncludedStates: []string{FixStateUnknown}},
+			expected: map[string]int{"medium": 1}},
+		{name: "no eligible match", threshold: "high", policy: FixStatePolicy{IncludedStates: []string{FixStateUnknown}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gate := evaluateSeverityGate(matches, tc.threshold, tc.policy)
+			total := 0
+			for _, n := range tc.expected {
+				total += n
+			}
+			if gate.Breached != (total > 0) || gate.BreachingMatches != total {
+				t.Errorf("expected %d breaching matches, got %d (breached %t)", total, gate.BreachingMatches, gate.Breached)
+			}
+			if !reflect.DeepEqual(gate.BreachingCounts, tc.expected) {
+				t.Errorf("expected counts %v, got %v", tc.expected, gate.BreachingCounts)
+			}
+		})
+	}
+}
+
+func TestSeverityGateFailure(t *testing.T) {
+	breached := func(counts map[string]int) *SeverityGate {
+		return &SeverityGate{Threshold: "high", Breached: true, BreachingCounts: counts}
+	}
+	item := func(pos int, url string, gate, newGate *SeverityGate) indexItem {
+		var item indexItem
+		item.pos = pos
+		item.result = &es.TaskResult{EsID: "id-" + url}
+		item.scan.ImageURL = url
+		item.scan.Summary.SeverityGate = gate
+		item.scan.Summary.NewSeverityGate = newGate
+		return item
+	}
+
+	if failure := severityGateFailure([]indexItem{item(0, "a", &SeverityGate{Threshold: "high"}, nil)}, "index"); failure != nil {
+		t.Fatalf("expected no failure without a breach, got %+v", failure)
+	}
+
+	// Images are reported in scan order and new matches only counted for images not breaching fail_on_severity
+	failure := severityGateFailure([]indexItem{
+		item(2, "c", nil, breached(map[string]int{"high": 1})),
+		item(0, "a", breached(map[string]int{"critical": 1, "high": 2}), breached(map[string]int{"high": 1})),
+		item(1, "b", nil, nil),
+	}, "index")
+	if failure == nil {
+		t.Fatal("expected a failure")
+	}
+	var urls []string
+	for _, image := range failure.Images {
+		urls = append(urls, image.ImageURL)
+	}
+	if !reflect.DeepEqual(urls, []string{"a", "c"}) {
+		t.Errorf("expected breaching images [a c], got %v", urls)
+	}
+	if expected := map[string]int{"critical": 1, "high": 3}; !reflect.DeepEqual(failure.BreachingCounts, expected) {
+		t.Errorf("expected counts %v, got %v", expected, failure.BreachingCounts)
+	}
+	err := failure.err()
+	if !errors.Is(err, ErrSeverityGateBreached) {
+		t.Errorf("expected %v, got %v", ErrSeverityGateBreached, err)
+	}
+	if expected := ErrSeverityGateBreached.Error() + " by 2 of 3 images (critical: 1, high: 3)"; err.Error() != expected {
+		t.Errorf("expected %q, got %q", expected, err.Error())
+	}
+}
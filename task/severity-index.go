@@ -0,0 +1,191 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/opengovern/og-util/pkg/es"
+	"github.com/opensearch-project/opensearch-go/v2"
+	"github.com/opensearch-project/opensearch-go/v2/opensearchapi"
+	"golang.org/x/net/context"
+	"io"
+	"strings"
+)
+
+// severityPlaceholder is replaced with the lowercased severity of a match in severity_index_template.
+const severityPlaceholder = "{severity}"
+
+// maxRoutedMatches bounds how many match documents of a previous scan are read back for comparisons.
+const maxRoutedMatches = 10000
+
+// Result modes (result_mode). Nested stores the matches in the image document, fanout stores every match as a
+// MatchDocument of its own, keyed by the image digest, the vulnerability and the package, in match_index (the image
+// index suffixed with _matches by default), {severity} in it standing for the severity of the match.
+// severity_index_template implies fanout to the severity indices it names.
+const (
+	ResultModeNested = "nested"
+	ResultModeFanout = "fanout"
+)
+
+// matchIndexSuffix is appended to the image index to name the match index when match_index isn't set.
+const matchIndexSuffix = "_matches"
+
+// MatchDocument is the document of a single match stored in the match index (result_mode=fanout). DescribedBy on
+// the TaskResult wrapping it is the run, so match documents of older scans of the same digest can be told apart from
+// those of the scan summarized in the image document.
+type MatchDocument struct {
+	SchemaVersion  int    `json:"schemaVersion"`
+	ImageURL       string `json:"imageUrl"`
+	ArtifactDigest string `json:"artifactDigest"`
+	// ImageDigest is the digest the match was found in, the pulled manifest's when artifact_digest wasn't given.
+	ImageDigest string             `json:"imageDigest"`
+	Severity    string             `json:"severity"`
+	Match       VulnerabilityMatch `json:"match"`
+}
+
+// getMatchIndexTemplate tells from result_mode, match_index and severity_index_template whether the matches fan out,
+// and the index template of their documents. The template is empty when they go to the default match index, which
+// depends on the image index.
+func getMatchIndexTemplate(params map[string][]string) (fanout bool, template string, err error) {
+	severityTemplate := getParamValue(params, "severity_index_template", "")
+	mode := getParamValue(params, "result_mode", "")
+	switch mode {
+	case "":
+		if severityTemplate == "" {
+			return false, "", nil
+		}
+	case ResultModeNested:
+		if severityTemplate != "" {
+			return false, "", fmt.Errorf("severity_index_template requires result_mode %s", ResultModeFanout)
+		}
+		return false, "", nil
+	case ResultModeFanout:
+	default:
+		return false, "", fmt.Errorf("invalid result_mode %q: must be %s or %s", mode, ResultModeNested, ResultModeFanout)
+	}
+
+	if severityTemplate != "" {
+		if getParamValue(params, "match_index", "") != "" {
+			return false, "", fmt.Errorf("match_index and severity_index_template are mutually exclusive")
+		}
+		template, err = parseMatchIndexTemplate("severity_index_template", severityTemplate)
+		return err == nil, template, err
+	}
+	if template = getParamValue(params, "match_index", ""); template != "" {
+		template, err = parseMatchIndexTemplate("match_index", template)
+	}
+	return err == nil, template, err
+}
+
+// parseMatchIndexTemplate validates the index template of the param, e.g. "vulnerabilities-{severity}", against the
+// index naming rules for every severity. The placeholder is required by severity_index_template only.
+func parseMatchIndexTemplate(param, template string) (string, error) {
+	if param == "severity_index_template" && !strings.Contains(template, severityPlaceholder) {
+		return "", fmt.Errorf("invalid %s %q: must contain %s", param, template, severityPlaceholder)
+	}
+	for severity := range severityRanks {
+		if err := validateIndexName(severityIndex(template, severity)); err != nil {
+			return "", fmt.Errorf("invalid %s %q: %w", param, template, err)
+		}
+	}
+	return template, nil
+}
+
+// severityIndex renders the index of the matches of the given severity.
+func severityIndex(template, severity string) string {
+	severity = strings.ToLower(severity)
+	if _, ok := severityRanks[severity]; !ok {
+		severity = "unknown"
+	}
+	return strings.ReplaceAll(template, severityPlaceholder, severity)
+}
+
+// severityMatchDocs returns the documents of the matches of image, each routed to the index template renders for
+// its severity. imageDigest is the digest the matches were found in.
+func severityMatchDocs(template string, image *es.TaskResult, result OciArtifactVulnerabilities, imageDigest string) []es.Doc {
+	docs := make([]es.Doc, 0, len(result.Vulnerabilities))
+	for _, m := range result.Vulnerabilities {
+		id := imageDigest + "|" + matchIdentity(m)
+		doc := &es.TaskResult{
+			PlatformID:   fmt.Sprintf("%s:::%s:::%s", image.TaskType, image.ResultType, id),
+			ResourceID:   id,
+			ResourceName: image.ResourceName,
+			Description: MatchDocument{
+				SchemaVersion:  ResultSchemaVersion,
+				ImageURL:       result.ImageURL,
+				ArtifactDigest: result.ArtifactDigest,
+				ImageDigest:    imageDigest,
+				Severity:       strings.ToLower(m.Vulnerability.Severity),
+				Match:          m,
+			},
+			ResultType:  image.ResultType,
+			TaskType:    image.TaskType,
+			Metadata:    image.Metadata,
+			DescribedAt: image.DescribedAt,
+			DescribedBy: image.DescribedBy,
+		}
+		keys, _ := doc.KeysAndIndex()
+		doc.EsID = es.HashOf(keys...)
+		doc.EsIndex = severityIndex(template, m.Vulnerability.Severity)
+		docs = append(docs, routedResult{TaskResult: doc})
+	}
+	return docs
+}
+
+// loadRoutedMatches reads back the matches a previous run stored for the artifact in the match indices of template.
+func loadRoutedMatches(ctx context.Context, client *opensearch.Client, template, artifactDigest, runID string) ([]VulnerabilityMatch, error) {
+	query, err := json.Marshal(map[string]interface{}{
+		"size": maxRoutedMatches,
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"filter": []map[string]interface{}{
+					{"match_phrase": map[string]string{"described_by": runID}},
+					{"match_phrase": map[string]string{"description.artifactDigest": artifactDigest}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ignoreUnavailable := true
+	res, err := opensearchapi.SearchRequest{
+		Index:             []string{strings.ReplaceAll(template, severityPlaceholder, "*")},
+		Body:              strings.NewReader(string(query)),
+		IgnoreUnavailable: &ignoreUnavailable,
+	}.Do(ctx, client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query previous matches: %w", err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return nil, fmt.Errorf("failed to query previous matches: %s", res.String())
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	var page struct {
+		Hits struct {
+			Hits []struct {
+				Source struct {
+					DescribedBy string        `json:"described_by"`
+					Description MatchDocument `json:"description"`
+				} `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.Unmarshal(body, &page); err != nil {
+		return nil, fmt.Errorf("failed to parse previous matches: %w", err)
+	}
+	var matches []VulnerabilityMatch
+	for _, hit := range page.Hits.Hits {
+		// match_phrase is a full text match, keep exact matches only
+		if hit.Source.DescribedBy != runID || hit.Source.Description.ArtifactDigest != artifactDigest {
+			continue
+		}
+		matches = append(matches, hit.Source.Description.Match)
+	}
+	return matches, nil
+}
@@ -0,0 +1,191 @@
+package task
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"oras.land/oras-go/v2/registry/remote"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultMaxTags is the hard cap on the tags of a repository considered by a tag query (max_tags).
+	DefaultMaxTags = 10000
+	// tagListPageSize is the number of tags requested per page of the registry tag list.
+	tagListPageSize = 1000
+)
+
+// errMaxTagsReached stops the tag listing once max_tags tags were considered.
+var errMaxTagsReached = errors.New("max tags reached")
+
+// tagQuery selects tags of a repository. Tags are filtered page by page as they're listed, so only the selected
+// tags are ever held in memory.
+type tagQuery struct {
+	// Regex keeps the tags it matches (tag_regex).
+	Regex *regexp.Regexp
+	// SemverOnly keeps the tags that are semantic versions, e.g. 1.2.3 or v1.2 (tag_semver_only).
+	SemverOnly bool
+	// LatestN keeps only the N highest tags, semantic versions ordering above other tags (tag_latest_n). All tags
+	// are kept when zero.
+	LatestN int
+	// MaxTags is the maximum number of tags listed, the listing stops at that point (max_tags).
+	MaxTags int
+}
+
+// getTagQueryFromParams builds the tag query from the task params.
+func getTagQueryFromParams(params map[string][]string) (tagQuery, error) {
+	q := tagQuery{SemverOnly: getBoolParam(params, "tag_semver_only")}
+	if v := getParamValue(params, "tag_regex", ""); v != "" {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid tag_regex: %w", err)
+		}
+		q.Regex = re
+	}
+
+	var err error
+	if q.LatestN, err = getIntParam(params, "tag_latest_n", 0); err != nil {
+		return q, err
+	}
+	if q.MaxTags, err = getIntParam(params, "max_tags", DefaultMaxTags); err != nil {
+		return q, err
+	}
+	if q.LatestN < 0 || q.MaxTags < 1 {
+		return q, fmt.Errorf("tag_latest_n must not be negative and max_tags must be positive")
+	}
+	return q, nil
+}
+
+func (q tagQuery) matches(tag string) bool {
+	if q.Regex != nil && !q.Regex.MatchString(tag) {
+		return false
+	}
+	if q.SemverOnly {
+		if _, ok := parseTagVersion(tag); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// tagListResult is the outcome of listTags.
+type tagListResult struct {
+	// Tags are the selected tags, highest first when LatestN is set and in listing order otherwise.
+	Tags []string
+	// Considered is the number of tags listed, Truncated being set when the listing stopped at MaxTags.
+	Considered int
+	Truncated  bool
+}
+
+// listTags lists the tags of the repository selected by the query, using the registry's tag list pagination.
+func listTags(ctx context.Context, repo *remote.Repository, q tagQuery) (tagListResult, error) {
+	repo.TagListPageSize = tagListPageSize
+	if q.MaxTags < repo.TagListPageSize {
+		repo.TagListPageSize = q.MaxTags
+	}
+
+	var result tagListResult
+	latest := &tagHeap{}
+	err := repo.Tags(ctx, "", func(tags []string) error {
+		for _, tag := range tags {
+			if result.Considered >= q.MaxTags {
+				result.Truncated = true
+				return errMaxTagsReached
+			}
+			result.Considered++
+			if !q.matches(tag) {
+				continue
+			}
+			if q.LatestN == 0 {
+				result.Tags = append(result.Tags, tag)
+				continue
+			}
+			// Bounded min-heap of the N highest tags seen so far
+			heap.Push(latest, tag)
+			if latest.Len() > q.LatestN {
+				heap.Pop(latest)
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errMaxTagsReached) {
+		return tagListResult{}, fmt.Errorf("failed to list tags of %s: %w", repo.Reference.Repository, err)
+	}
+
+	if q.LatestN > 0 {
+		result.Tags = []string(*latest)
+		sort.Slice(result.Tags, func(i, j int) bool { return tagLess(result.Tags[j], result.Tags[i]) })
+	}
+	return result, nil
+}
+
+// tagHeap is a min-heap of tags ordered by tagLess.
+type tagHeap []string
+
+func (h tagHeap) Len() int            { return len(h) }
+func (h tagHeap) Less(i, j int) bool  { return tagLess(h[i], h[j]) }
+func (h tagHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *tagHeap) Push(x interface{}) { *h = append(*h, x.(string)) }
+func (h *tagHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// tagVersion is a tag parsed as a semantic version.
+type tagVersion struct {
+	core       [3]int
+	prerelease string
+}
+
+var tagVersionPattern = regexp.MustCompile(`^v?(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+// parseTagVersion parses tags like 1, 1.2, v1.2.3 or 1.2.3-rc.1 as semantic versions.
+func parseTagVersion(tag string) (tagVersion, bool) {
+	m := tagVersionPattern.FindStringSubmatch(tag)
+	if m == nil {
+		return tagVersion{}, false
+	}
+	var v tagVersion
+	for i := 0; i < 3; i++ {
+		if m[i+1] != "" {
+			n, err := strconv.Atoi(m[i+1])
+			if err != nil {
+				return tagVersion{}, false
+			}
+			v.core[i] = n
+		}
+	}
+	v.prerelease = m[4]
+	return v, true
+}
+
+// tagLess orders tags by semantic version, pre-releases below their release, with tags that aren't versions below
+// all versions in lexical order.
+func tagLess(a, b string) bool {
+	va, okA := parseTagVersion(a)
+	vb, okB := parseTagVersion(b)
+	switch {
+	case okA != okB:
+		return okB
+	case !okA:
+		return a < b
+	}
+	for i := 0; i < 3; i++ {
+		if va.core[i] != vb.core[i] {
+			return va.core[i] < vb.core[i]
+		}
+	}
+	if va.prerelease != vb.prerelease {
+		if va.prerelease == "" || vb.prerelease == "" {
+			return vb.prerelease == ""
+		}
+		return strings.Compare(va.prerelease, vb.prerelease) < 0
+	}
+	return a < b
+}
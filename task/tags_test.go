@@ -0,0 +1,146 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httptest"
+	"oras.land/oras-go/v2/registry/remote"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTagLess(t *testing.T) {
+	// In ascending order, ties broken lexically
+	ordered := []string{"alpine", "latest", "1.0.0-beta", "1.0.0-rc.1", "1", "1.0", "1.0.0", "v1.0.0", "1.2", "1.10.0", "v2"}
+	for i := range ordered {
+		for j := range ordered {
+			if less := tagLess(ordered[i], ordered[j]); less != (i < j) {
+				t.Errorf("expected tagLess(%q, %q) %t, got %t", ordered[i], ordered[j], i < j, less)
+			}
+		}
+	}
+
+	shuffled := []string{"v2", "1.0.0-rc.1", "latest", "1.10.0", "1", "alpine", "v1.0.0", "1.2", "1.0", "1.0.0-beta", "1.0.0"}
+	sort.Slice(shuffled, func(i, j int) bool { return tagLess(shuffled[i], shuffled[j]) })
+	if !reflect.DeepEqual(shuffled, ordered) {
+		t.Errorf("expected %q, got %q", ordered, shuffled)
+	}
+}
+
+func TestGetTagQueryFromParams(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		params  map[string][]string
+		invalid bool
+	}{
+		{name: "defaults"},
+		{name: "all filters", params: map[string][]string{"tag_regex": {"^v"}, "tag_semver_only": {"true"},
+			"tag_latest_n": {"3"}, "max_tags": {"1"}}},
+		{name: "invalid regex", params: map[string][]string{"tag_regex": {"("}}, invalid: true},
+		{name: "negative latest n", params: map[string][]string{"tag_latest_n": {"-1"}}, invalid: true},
+		{name: "zero max tags", params: map[string][]string{"max_tags": {"0"}}, invalid: true},
+		{name: "max tags not a number", params: map[string][]string{"max_tags": {"many"}}, invalid: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q, err := getTagQueryFromParams(tc.params)
+			if (err != nil) != tc.invalid {
+				t.Fatalf("expected invalid %t, got %v", tc.invalid, err)
+			}
+			if tc.name == "defaults" && (q.MaxTags != DefaultMaxTags || q.LatestN != 0 || q.Regex != nil || q.SemverOnly) {
+				t.Errorf("unexpected default query %+v", q)
+			}
+		})
+	}
+}
+
+// tagListServer serves tags as a registry tag list, paginated by the n and last query params with Link headers.
+func tagListServer(t *testing.T, tags []string) (*httptest.Server, *int) {
+	pages := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/org/repo/tags/list" {
+			http.NotFound(w, r)
+			return
+		}
+		pages++
+		n, err := strconv.Atoi(r.URL.Query().Get("n"))
+		if err != nil {
+			t.Errorf("expected a page size, got %q", r.URL.RawQuery)
+			n = len(tags)
+		}
+		start := 0
+		if last := r.URL.Query().Get("last"); last != "" {
+			for start < len(tags) && tags[start] != last {
+				start++
+			}
+			start++
+		}
+		end := start + n
+		if end >= len(tags) {
+			end = len(tags)
+		} else {
+			w.Header().Set("Link", fmt.Sprintf(`</v2/org/repo/tags/list?n=%d&last=%s>; rel="next"`, n, tags[end-1]))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"name": "org/repo", "tags": tags[start:end]})
+	}))
+	t.Cleanup(server.Close)
+	return server, &pages
+}
+
+func TestListTags(t *testing.T) {
+	tags := []string{"latest", "1.0.0", "1.2.0-rc.1", "v1.2.0", "1.2.0", "dev", "2.0.0", "1.10.0"}
+	for _, tc := range []struct {
+		name       string
+		query      tagQuery
+		expected   []string
+		considered int
+		truncated  bool
+		pages      int
+	}{
+		{name: "all tags", query: tagQuery{MaxTags: DefaultMaxTags}, expected: tags, considered: 8, pages: 1},
+		{name: "regex", query: tagQuery{Regex: regexp.MustCompile(`^1\.2`), MaxTags: DefaultMaxTags},
+			expected: []string{"1.2.0-rc.1", "1.2.0"}, considered: 8, pages: 1},
+		{name: "semver only", query: tagQuery{SemverOnly: true, MaxTags: DefaultMaxTags},
+			expected: []string{"1.0.0", "1.2.0-rc.1", "v1.2.0", "1.2.0", "2.0.0", "1.10.0"}, considered: 8, pages: 1},
+		{name: "latest n, highest first", query: tagQuery{LatestN: 3, MaxTags: DefaultMaxTags},
+			expected: []string{"2.0.0", "1.10.0", "v1.2.0"}, considered: 8, pages: 1},
+		{name: "latest n tie broken lexically", query: tagQuery{Regex: regexp.MustCompile(`1\.2\.0$`), LatestN: 1,
+			MaxTags: DefaultMaxTags}, expected: []string{"v1.2.0"}, considered: 8, pages: 1},
+		{name: "latest n above the number of tags", query: tagQuery{Regex: regexp.MustCompile(`^[a-z]+$`), LatestN: 5,
+			MaxTags: DefaultMaxTags}, expected: []string{"latest", "dev"}, considered: 8, pages: 1},
+		{name: "max tags stops the listing", query: tagQuery{MaxTags: 3}, expected: []string{"latest", "1.0.0", "1.2.0-rc.1"},
+			considered: 3, truncated: true, pages: 2},
+		{name: "max tags at the number of tags", query: tagQuery{MaxTags: 8}, expected: tags, considered: 8, pages: 1},
+		{name: "no match", query: tagQuery{Regex: regexp.MustCompile(`^nightly`), MaxTags: 4}, considered: 4,
+			truncated: true, pages: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, pages := tagListServer(t, tags)
+			repo, err := remote.NewRepository(strings.TrimPrefix(server.URL, "http://") + "/org/repo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			repo.PlainHTTP = true
+			result, err := listTags(context.Background(), repo, tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result.Tags, tc.expected) {
+				t.Errorf("expected tags %q, got %q", tc.expected, result.Tags)
+			}
+			if result.Considered != tc.considered || result.Truncated != tc.truncated {
+				t.Errorf("expected %d considered (truncated %t), got %d (truncated %t)", tc.considered, tc.truncated,
+					result.Considered, result.Truncated)
+			}
+			if *pages != tc.pages {
+				t.Errorf("expected %d pages listed, got %d", tc.pages, *pages)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package task
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+// tracer creates the spans of the stages of a run. They're exported by the tracer provider the worker installs
+// (see worker.InitTracing), and are no-ops without one.
+var tracer = otel.Tracer("github.com/opengovern/og-task-container-vulnerability/task")
+
+// startSpan starts the span of a stage of the run.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, recording err as its failure.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
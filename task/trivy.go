@@ -0,0 +1,297 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TrivyOutputFileName is the name of the file trivy writes its report to when file output is enabled.
+const TrivyOutputFileName = "trivy-output.json"
+
+type trivyScanner struct{}
+
+func (trivyScanner) Name() string {
+	return ScannerTrivy
+}
+
+// Scan runs trivy on target and maps its report into the grype schema. Reports in other scan output formats are
+// converted from the JSON report with `trivy convert`.
+func (trivyScanner) Scan(ctx context.Context, logger *zap.Logger, req ScanRequest) (GrypeOutput, error) {
+	target, toFile := req.Target, req.ToFile
+	var args []string
+	sourceType := "image"
+	switch {
+	case strings.HasPrefix(target, "sbom:"):
+		args = []string{"sbom", strings.TrimPrefix(target, "sbom:")}
+		sourceType = "sbom"
+	case strings.HasPrefix(target, "dir:"):
+		args = []string{"rootfs", strings.TrimPrefix(target, "dir:")}
+		sourceType = "directory"
+	case strings.HasPrefix(target, "oci-dir:"):
+		args = []string{"image", "--input", strings.TrimPrefix(target, "oci-dir:")}
+	default:
+		args = []string{"image", "--input", target}
+	}
+	// All packages are listed to know how many were found, not just the vulnerable ones
+	args = append(args, "-f", "json", "--quiet", "--list-all-pkgs")
+
+	outputPath := filepath.Join(req.RunDir, TrivyOutputFileName)
+	if toFile {
+		args = append(args, "--output", outputPath)
+	}
+
+	// Trivy processes share the grype slots, they're as heavy
+	if err := grypeSemaphore.Acquire(ctx, logger); err != nil {
+		return GrypeOutput{}, err
+	}
+	defer grypeSemaphore.Release()
+
+	cmd := exec.CommandContext(ctx, "trivy", args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	logger.Info("output", zap.String("output", truncateForLog([]byte(stderr.String()))))
+	if err != nil {
+		logger.Error("error running trivy", zap.Error(err))
+		return GrypeOutput{}, err
+	}
+
+	var report trivyReport
+	if toFile {
+		f, err := os.Open(outputPath)
+		if err != nil {
+			return GrypeOutput{}, fmt.Errorf("failed to open trivy output file: %w", err)
+		}
+		defer f.Close()
+		if err := json.NewDecoder(f).Decode(&report); err != nil {
+			return GrypeOutput{}, fmt.Errorf("failed to parse trivy output file: %w", err)
+		}
+	} else if err := json.Unmarshal(output, &report); err != nil {
+		return GrypeOutput{}, fmt.Errorf("failed to parse trivy output: %w", err)
+	}
+
+	out := report.toGrypeOutput(sourceType, target)
+	out.Warnings = parseScannerWarnings([]byte(stderr.String()))
+	if out.DBStatus, err = trivyDBStatus(); err != nil {
+		logger.Warn("failed to read the trivy db status", zap.Error(err))
+	}
+	if req.ReportFormat != ScanOutputJSON {
+		if !toFile {
+			if err := os.WriteFile(outputPath, output, 0600); err != nil {
+				return GrypeOutput{}, fmt.Errorf("failed to write trivy output file: %w", err)
+			}
+		}
+		out.Report, err = convertTrivyReport(ctx, outputPath, req.ReportFormat)
+		if err != nil {
+			return GrypeOutput{}, err
+		}
+	}
+	return out, nil
+}
+
+// trivyFormats are the trivy names of the scan output formats.
+var trivyFormats = map[string]string{
+	ScanOutputSARIF:         "sarif",
+	ScanOutputCycloneDXJSON: "cyclonedx",
+	ScanOutputTable:         "table",
+}
+
+// convertTrivyReport renders the trivy JSON report at reportPath in a scan output format other than json.
+func convertTrivyReport(ctx context.Context, reportPath, format string) (*ScanReport, error) {
+	trivyFormat, ok := trivyFormats[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported scan output format %q", format)
+	}
+	cmd := exec.CommandContext(ctx, "trivy", "convert", "--format", trivyFormat, "--quiet", reportPath)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert trivy report to %s: %w: %s", format, err, strings.TrimSpace(stderr.String()))
+	}
+	return &ScanReport{Format: format, Payload: string(output)}, nil
+}
+
+// trivyDBStatus returns the metadata of the trivy vulnerability database, as reported by `trivy version`.
+func trivyDBStatus() (*GrypeDBStatus, error) {
+	output, err := exec.Command("trivy", "version", "--format", "json").Output()
+	if err != nil {
+		return nil, err
+	}
+	var version struct {
+		VulnerabilityDB *struct {
+			Version   int       `json:"Version"`
+			UpdatedAt time.Time `json:"UpdatedAt"`
+		} `json:"VulnerabilityDB"`
+	}
+	if err := json.Unmarshal(output, &version); err != nil {
+		return nil, fmt.Errorf("failed to parse trivy version: %w", err)
+	}
+	if version.VulnerabilityDB == nil {
+		return nil, fmt.Errorf("no trivy db installed")
+	}
+	return &GrypeDBStatus{
+		SchemaVersion: strconv.Itoa(version.VulnerabilityDB.Version),
+		Built:         version.VulnerabilityDB.UpdatedAt.UTC().Format(time.RFC3339),
+		Valid:         true,
+	}, nil
+}
+
+type trivyReport struct {
+	ArtifactName string `json:"ArtifactName"`
+	Metadata     struct {
+		OS struct {
+			Family string `json:"Family"`
+			Name   string `json:"Name"`
+		} `json:"OS"`
+	} `json:"Metadata"`
+	Results []trivyResult `json:"Results"`
+}
+
+type trivyResult struct {
+	Target          string               `json:"Target"`
+	Class           string               `json:"Class"`
+	Type            string               `json:"Type"`
+	Packages        []json.RawMessage    `json:"Packages"`
+	Vulnerabilities []trivyVulnerability `json:"Vulnerabilities"`
+}
+
+type trivyVulnerability struct {
+	VulnerabilityID  string `json:"VulnerabilityID"`
+	PkgName          string `json:"PkgName"`
+	PkgPath          string `json:"PkgPath"`
+	InstalledVersion string `json:"InstalledVersion"`
+	FixedVersion     string `json:"FixedVersion"`
+	Status           string `json:"Status"`
+	Severity         string `json:"Severity"`
+	Title            string `json:"Title"`
+	Description      string `json:"Description"`
+	PrimaryURL       string `json:"PrimaryURL"`
+	References       []string
+	PkgIdentifier    struct {
+		PURL string `json:"PURL"`
+	} `json:"PkgIdentifier"`
+	DataSource struct {
+		ID   string `json:"ID"`
+		Name string `json:"Name"`
+		URL  string `json:"URL"`
+	} `json:"DataSource"`
+	CVSS map[string]trivyCVSS `json:"CVSS"`
+}
+
+type trivyCVSS struct {
+	V2Vector string  `json:"V2Vector"`
+	V3Vector string  `json:"V3Vector"`
+	V2Score  float64 `json:"V2Score"`
+	V3Score  float64 `json:"V3Score"`
+}
+
+// trivyFixStates maps trivy vulnerability statuses to grype fix states.
+var trivyFixStates = map[string]string{
+	"fixed":        FixStateFixed,
+	"affected":     FixStateNotFixed,
+	"will_not_fix": FixStateWontFix,
+	"fix_deferred": FixStateNotFixed,
+	"end_of_life":  FixStateWontFix,
+}
+
+func (r trivyReport) toGrypeOutput(sourceType, target string) GrypeOutput {
+	out := GrypeOutput{
+		Source: GrypeSource{Type: sourceType, Target: target},
+		Distro: GrypeDistro{Name: r.Metadata.OS.Family, Version: r.Metadata.OS.Name},
+	}
+	packageCount := 0
+	for _, result := range r.Results {
+		packageCount += len(result.Packages)
+		for _, v := range result.Vulnerabilities {
+			out.Matches = append(out.Matches, v.toMatch(result))
+		}
+	}
+	out.PackageCount = &packageCount
+	return out
+}
+
+func (v trivyVulnerability) toMatch(result trivyResult) VulnerabilityMatch {
+	fix := VulnerabilityFix{State: FixStateUnknown}
+	if state, ok := trivyFixStates[strings.ToLower(v.Status)]; ok {
+		fix.State = state
+	}
+	if v.FixedVersion != "" {
+		fix.State = FixStateFixed
+		for _, version := range strings.Split(v.FixedVersion, ",") {
+			fix.Versions = append(fix.Versions, strings.TrimSpace(version))
+		}
+	}
+
+	// Sources are sorted so the order of the CVSS entries is stable
+	var sources []string
+	for source := range v.CVSS {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	var cvss []VulnerabilityCVS
+	for _, source := range sources {
+		c := v.CVSS[source]
+		if c.V3Vector != "" || c.V3Score > 0 {
+			cvss = append(cvss, VulnerabilityCVS{Source: source, Type: "Secondary", Version: "3.1", Vector: c.V3Vector, Metrics: VulnerabilityCVSMetrics{BaseScore: c.V3Score}})
+		}
+		if c.V2Vector != "" || c.V2Score > 0 {
+			cvss = append(cvss, VulnerabilityCVS{Source: source, Type: "Secondary", Version: "2.0", Vector: c.V2Vector, Metrics: VulnerabilityCVSMetrics{BaseScore: c.V2Score}})
+		}
+	}
+
+	description := v.Description
+	if description == "" {
+		description = v.Title
+	}
+
+	artifact := map[string]interface{}{
+		"name":    v.PkgName,
+		"version": v.InstalledVersion,
+		"type":    result.Type,
+		"purl":    v.PkgIdentifier.PURL,
+	}
+	if v.PkgPath != "" {
+		artifact["locations"] = []map[string]string{{"path": v.PkgPath}}
+	}
+
+	return VulnerabilityMatch{
+		Vulnerability: Vulnerability{
+			ID:          v.VulnerabilityID,
+			DataSource:  v.PrimaryURL,
+			Namespace:   v.DataSource.ID,
+			Severity:    trivySeverity(v.Severity),
+			URLs:        v.References,
+			Description: description,
+			CVSs:        cvss,
+			Fix:         fix,
+		},
+		MatchDetails: []MatchDetail{{
+			Type:    "trivy-match",
+			Matcher: ScannerTrivy,
+			SearchedBy: map[string]string{
+				"target": result.Target,
+				"class":  result.Class,
+			},
+		}},
+		Artifact: artifact,
+	}
+}
+
+// trivySeverity converts trivy's upper case severities to the grype spelling (e.g. HIGH -> High).
+func trivySeverity(severity string) string {
+	if severity == "" {
+		return "Unknown"
+	}
+	s := strings.ToLower(severity)
+	return strings.ToUpper(s[:1]) + s[1:]
+}
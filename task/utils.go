@@ -1,14 +1,11 @@
 package task
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"github.com/opengovern/og-util/pkg/es"
-	"github.com/opensearch-project/opensearch-go/v2"
-	"github.com/opensearch-project/opensearch-go/v2/opensearchapi"
-	"golang.org/x/net/context"
+	"go.uber.org/zap"
 	"io/ioutil"
+	"strconv"
+	"strings"
 )
 
 func getCredsFromParams(params map[string][]string) Credentials {
@@ -23,6 +20,18 @@ func getCredsFromParams(params map[string][]string) Credentials {
 			if len(v) > 0 {
 				creds.GithubToken = v[0]
 			}
+		case "github_app_id":
+			if len(v) > 0 {
+				creds.GithubAppID = v[0]
+			}
+		case "github_app_installation_id":
+			if len(v) > 0 {
+				creds.GithubAppInstallationID = v[0]
+			}
+		case "github_app_private_key":
+			if len(v) > 0 {
+				creds.GithubAppPrivateKey = v[0]
+			}
 		case "ecr_account_id":
 			if len(v) > 0 {
 				creds.ECRAccountID = v[0]
@@ -31,6 +40,14 @@ func getCredsFromParams(params map[string][]string) Credentials {
 			if len(v) > 0 {
 				creds.ECRRegion = v[0]
 			}
+		case "ecr_role_arn":
+			if len(v) > 0 {
+				creds.ECRRoleARN = v[0]
+			}
+		case "ecr_external_id":
+			if len(v) > 0 {
+				creds.ECRExternalID = v[0]
+			}
 		case "acr_login_server":
 			if len(v) > 0 {
 				creds.ACRLoginServer = v[0]
@@ -39,54 +56,142 @@ func getCredsFromParams(params map[string][]string) Credentials {
 			if len(v) > 0 {
 				creds.ACRTenantID = v[0]
 			}
+		case "acr_client_id":
+			if len(v) > 0 {
+				creds.ACRClientID = v[0]
+			}
+		case "acr_auth_method":
+			if len(v) > 0 {
+				creds.ACRAuthMethod = v[0]
+			}
+		case "acr_client_secret":
+			if len(v) > 0 {
+				creds.ACRClientSecret = v[0]
+			}
+		case "acr_managed_identity_client_id":
+			if len(v) > 0 {
+				creds.ACRManagedIdentityClientID = v[0]
+			}
+		case "acr_token_scope":
+			if len(v) > 0 {
+				creds.ACRTokenScope = v[0]
+			}
+		case "dockerhub_username":
+			if len(v) > 0 {
+				creds.DockerHubUsername = v[0]
+			}
+		case "dockerhub_token":
+			if len(v) > 0 {
+				creds.DockerHubToken = v[0]
+			}
+		case "gcp_credentials_json":
+			if len(v) > 0 {
+				creds.GCPCredentialsJSON = v[0]
+			}
+		case "gcp_registry_host":
+			if len(v) > 0 {
+				creds.GCPRegistryHost = v[0]
+			}
+		case "registry_host":
+			if len(v) > 0 {
+				creds.RegistryHost = v[0]
+			}
+		case "registry_username":
+			if len(v) > 0 {
+				creds.RegistryUsername = v[0]
+			}
+		case "registry_password":
+			if len(v) > 0 {
+				creds.RegistryPassword = v[0]
+			}
+		case "oidc_token":
+			if len(v) > 0 {
+				creds.OIDCToken = v[0]
+			}
+		case "oidc_token_file":
+			if len(v) > 0 {
+				creds.OIDCTokenFile = v[0]
+			}
+		case "oidc_role_arn":
+			if len(v) > 0 {
+				creds.OIDCRoleARN = v[0]
+			}
 		}
 	}
 	return creds
 }
 
-func showFiles(dir string) error {
-	// List the files in the current directory
+// showFiles logs the files and directories in dir at debug level.
+func showFiles(logger *zap.Logger, dir string) error {
+	if !logger.Core().Enabled(zap.DebugLevel) {
+		return nil
+	}
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return err
 	}
 
-	// Print each file or directory name
-	fmt.Printf("Listing files in directory: %s\n", dir)
+	var dirs, names []string
 	for _, file := range files {
 		if file.IsDir() {
-			fmt.Printf("[DIR] %s\n", file.Name())
+			dirs = append(dirs, file.Name())
 		} else {
-			fmt.Printf("[FILE] %s\n", file.Name())
+			names = append(names, file.Name())
 		}
 	}
+	logger.Debug("listing files in directory", zap.String("dir", dir), zap.Strings("dirs", dirs), zap.Strings("files", names))
 	return nil
 }
 
-func sendDataToOpensearch(client *opensearch.Client, doc es.Doc) error {
-	docJSON, err := json.Marshal(doc)
-	if err != nil {
-		return err
+// validateIndexName checks index against the OpenSearch index naming rules.
+func validateIndexName(index string) error {
+	if index == "." || index == ".." || len(index) > 255 {
+		return fmt.Errorf("invalid index name %q", index)
 	}
+	if strings.ToLower(index) != index {
+		return fmt.Errorf("invalid index name %q: must be lowercase", index)
+	}
+	if strings.ContainsAny(index, "\\/*?\"<>| ,#:") {
+		return fmt.Errorf("invalid index name %q: must not contain \\, /, *, ?, \", <, >, |, space, comma, # or :", index)
+	}
+	if strings.IndexAny(index[:1], "-_+") == 0 {
+		return fmt.Errorf("invalid index name %q: must not start with -, _ or +", index)
+	}
+	return nil
+}
 
-	keys, index := doc.KeysAndIndex()
-
-	// Use the opensearchapi.IndexRequest to index the document
-	req := opensearchapi.IndexRequest{
-		Index:      index,
-		DocumentID: es.HashOf(keys...),
-		Body:       bytes.NewReader(docJSON),
-		Refresh:    "true", // Makes the document immediately available for search
+// getParamValue returns the first value of the given task parameter, or def if it's not provided.
+func getParamValue(params map[string][]string, key, def string) string {
+	if v, ok := params[key]; ok && len(v) > 0 && v[0] != "" {
+		return v[0]
 	}
-	res, err := req.Do(context.Background(), client)
-	if err != nil {
-		return err
+	return def
+}
+
+// paramAt returns the value of an indexed param (one value per artifact, like oci_artifact_url) at position i, or def
+// if it's not provided for that position.
+func paramAt(params map[string][]string, key string, i int, def string) string {
+	if v := params[key]; i < len(v) && v[i] != "" {
+		return v[i]
 	}
-	defer res.Body.Close()
+	return def
+}
+
+// getBoolParam reports whether the given task parameter is set to a true value.
+func getBoolParam(params map[string][]string, key string) bool {
+	b, _ := strconv.ParseBool(getParamValue(params, key, "false"))
+	return b
+}
 
-	// Check the response
-	if res.IsError() {
-		return fmt.Errorf("error indexing document: %s", res.String())
+// getIntParam returns the given task parameter as an integer, or def if it's not provided.
+func getIntParam(params map[string][]string, key string, def int) (int, error) {
+	v := getParamValue(params, key, "")
+	if v == "" {
+		return def, nil
 	}
-	return nil
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return def, fmt.Errorf("invalid %s parameter %q: %w", key, v, err)
+	}
+	return i, nil
 }
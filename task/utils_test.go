@@ -0,0 +1,48 @@
+package task
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestShowFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, ociLayoutDirName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, imageTarName), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		level   zapcore.Level
+		entries int
+	}{
+		{name: "debug", level: zapcore.DebugLevel, entries: 1},
+		{name: "info", level: zapcore.InfoLevel},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			core, logs := observer.New(tc.level)
+			if err := showFiles(zap.New(core), dir); err != nil {
+				t.Fatal(err)
+			}
+			if logs.Len() != tc.entries {
+				t.Fatalf("expected %d log entries, got %d", tc.entries, logs.Len())
+			}
+			if tc.entries == 0 {
+				return
+			}
+			fields := logs.All()[0].ContextMap()
+			if !reflect.DeepEqual(fields["dirs"], []interface{}{ociLayoutDirName}) ||
+				!reflect.DeepEqual(fields["files"], []interface{}{imageTarName}) {
+				t.Errorf("unexpected listing %v", fields)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/opengovern/og-util/pkg/tasks"
+	"github.com/opengovern/opencomply/services/tasks/scheduler"
+	"go.uber.org/zap"
+	"golang.org/x/net/context"
+	"oras.land/oras-go/v2/registry"
+	"sort"
+	"strings"
+)
+
+// CredentialValidationResult is the outcome of validating the credentials of one registry type.
+type CredentialValidationResult struct {
+	RegistryType string   `json:"registryType"`
+	Hosts        []string `json:"hosts,omitempty"`
+	Repository   string   `json:"repository,omitempty"`
+	Success      bool     `json:"success"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// runValidateCredentialsTask checks the configured credentials of every registry_type value without pulling or
+// scanning anything. Credentials are exchanged for registry auths (the token fetch) and, when a validate_repository
+// value is provided at the same index, the repository reference is resolved with a HEAD request.
+func runValidateCredentialsTask(ctx context.Context, logger *zap.Logger, request tasks.TaskRequest, response *scheduler.TaskResponse) error {
+	registryTypes := request.TaskDefinition.Params["registry_type"]
+	if len(registryTypes) == 0 {
+		return fmt.Errorf("registry type parameter is not provided")
+	}
+	repositories := request.TaskDefinition.Params["validate_repository"]
+	creds := getCredsFromParams(request.TaskDefinition.Params)
+
+	var results []CredentialValidationResult
+	var failed []string
+	for i, registryType := range registryTypes {
+		result := CredentialValidationResult{RegistryType: registryType}
+		if len(repositories) >= (i + 1) {
+			result.Repository = repositories[i]
+		}
+
+		if err := validateRegistryCredentials(ctx, registryType, creds, &result); err != nil {
+			result.Error = err.Error()
+			failed = append(failed, registryType)
+			logger.Error("credential validation failed", zap.String("registryType", registryType), zap.Error(err))
+		} else {
+			result.Success = true
+			logger.Info("credential validation succeeded", zap.String("registryType", registryType))
+		}
+		results = append(results, result)
+	}
+
+	resultJson, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	response.Result = resultJson
+
+	if len(failed) > 0 {
+		return fmt.Errorf("credential validation failed for: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func validateRegistryCredentials(ctx context.Context, registryType string, creds Credentials, result *CredentialValidationResult) error {
+	auths, err := getRegistryAuths(ctx, registryType, creds)
+	if err != nil {
+		return err
+	}
+	for host := range auths {
+		result.Hosts = append(result.Hosts, host)
+	}
+	sort.Strings(result.Hosts)
+
+	if result.Repository == "" {
+		return nil
+	}
+
+	ref, err := registry.ParseReference(result.Repository)
+	if err != nil {
+		return fmt.Errorf("invalid validate_repository: %w", err)
+	}
+	repo, err := newRemoteRepository(ref, DockerConfig{Auths: auths}, pullOptions{
+		Anonymous: RegistryType(registryType) == RegistryPublic,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := repo.Resolve(ctx, ref.Reference); err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", result.Repository, err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxVEXDocumentBytes bounds the size of a VEX document downloaded from vex_documents.
+const maxVEXDocumentBytes = 4 * 1024 * 1024 // 4 MiB
+
+// VEXSuppression is a match suppressed by a statement of the VEX documents of the task (vex_documents).
+type VEXSuppression struct {
+	VulnerabilityID string `json:"vulnerabilityId"`
+	PackageName     string `json:"packageName,omitempty"`
+	PackageVersion  string `json:"packageVersion,omitempty"`
+	// Status is the status of the statement, not_affected or fixed.
+	Status        string `json:"status"`
+	Justification string `json:"justification,omitempty"`
+}
+
+// loadVEXDocuments returns the OpenVEX documents of vex_documents, each value being an inline JSON document or the
+// http(s) URL to download it from.
+func loadVEXDocuments(ctx context.Context, params map[string][]string) ([][]byte, error) {
+	var docs [][]byte
+	for i, value := range params["vex_documents"] {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		data := []byte(value)
+		if strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://") {
+			var err error
+			data, err = downloadVEXDocument(ctx, value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to download vex document %s: %w", value, err)
+			}
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("invalid vex document %d: %w", i, err)
+		}
+		if _, ok := doc["statements"]; !ok {
+			return nil, fmt.Errorf("invalid vex document %d: no statements", i)
+		}
+		docs = append(docs, data)
+	}
+	return docs, nil
+}
+
+func downloadVEXDocument(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := outboundHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxVEXDocumentBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxVEXDocumentBytes {
+		return nil, fmt.Errorf("document exceeds %d bytes", maxVEXDocumentBytes)
+	}
+	return data, nil
+}
+
+// writeVEXDocuments writes the VEX documents to dir for the scanner, returning their paths.
+func writeVEXDocuments(dir string, docs [][]byte) ([]string, error) {
+	paths := make([]string, 0, len(docs))
+	for i, doc := range docs {
+		path := filepath.Join(dir, fmt.Sprintf("vex-%d.json", i))
+		if err := os.WriteFile(path, doc, 0600); err != nil {
+			return nil, fmt.Errorf("failed to write vex document: %w", err)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// vexProductIdentifiers returns the references the statements of VEX documents can name the fetched image by: the
+// pulled reference and the repository digests of its manifest and image index.
+func vexProductIdentifiers(fetched *FetchedImage) []string {
+	var ids []string
+	if fetched.ResolvedReference == "" {
+		return ids
+	}
+	ids = append(ids, fetched.ResolvedReference)
+	ref, err := parseImageReference(fetched.ResolvedReference)
+	if err != nil {
+		return ids
+	}
+	repository := ref.Registry + "/" + ref.Repository
+	for _, digest := range []string{fetched.ManifestDigest, fetched.IndexDigest} {
+		if digest != "" {
+			ids = append(ids, repository+"@"+digest)
+		}
+	}
+	return ids
+}
+
+// vexSuppressions returns the ignored matches suppressed by a VEX statement.
+func vexSuppressions(ignored []IgnoredMatch) []VEXSuppression {
+	var suppressions []VEXSuppression
+	for _, m := range ignored {
+		for _, rule := range m.AppliedIgnoreRules {
+			if rule.VexStatus == "" {
+				continue
+			}
+			suppressions = append(suppressions, VEXSuppression{
+				VulnerabilityID: m.Vulnerability.ID,
+				PackageName:     matchPackageName(m.VulnerabilityMatch),
+				PackageVersion:  matchPackageVersion(m.VulnerabilityMatch),
+				Status:          rule.VexStatus,
+				Justification:   rule.VexJustification,
+			})
+			break
+		}
+	}
+	return suppressions
+}
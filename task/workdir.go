@@ -0,0 +1,74 @@
+package task
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// WorkDirRoot is where the working directories of runs are created, the system temp directory by default.
+var WorkDirRoot = os.Getenv("WORK_DIR_ROOT")
+
+// SecretsDir is where the credential files handed to external commands (e.g. the registry config of helm) are
+// written, by default /dev/shm, which keeps them in memory, when it exists and the system temp directory otherwise.
+var SecretsDir = os.Getenv("SECRETS_DIR")
+
+// writeSecretFile writes data to a new file of SecretsDir only the worker can read, named after pattern as
+// os.CreateTemp names files. The caller removes it once done.
+func writeSecretFile(pattern string, data []byte) (string, error) {
+	dir := SecretsDir
+	if dir == "" {
+		dir = os.TempDir()
+		if info, err := os.Stat("/dev/shm"); err == nil && info.IsDir() {
+			dir = "/dev/shm"
+		}
+	}
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to create secret file: %w", err)
+	}
+	// CreateTemp creates files with mode 0600 already, the umask can only restrict it further
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write secret file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write secret file: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// WorkDir is the isolated directory a run writes its intermediate files to (layers, config.json, manifest.json, the
+// image archive, grype reports), so concurrent and consecutive runs never clobber each other.
+type WorkDir struct {
+	Path string
+}
+
+// NewWorkDir creates a run-<RunID>-<random> directory under WorkDirRoot.
+func NewWorkDir(runID uint) (*WorkDir, error) {
+	root := WorkDirRoot
+	if root == "" {
+		root = os.TempDir()
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create work directory root: %w", err)
+	}
+	path, err := os.MkdirTemp(root, RunDir(runID)+"-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create work directory: %w", err)
+	}
+	return &WorkDir{Path: path}, nil
+}
+
+// Sub returns the path of a directory in the work directory, e.g. for the files of one image. It's created by
+// whoever writes to it.
+func (w *WorkDir) Sub(name string) string {
+	return filepath.Join(w.Path, name)
+}
+
+// Close removes the work directory and everything in it.
+func (w *WorkDir) Close() error {
+	return os.RemoveAll(w.Path)
+}
@@ -0,0 +1,227 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/opengovern/og-task-container-vulnerability/task"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// HealthAddr is the address the /healthz (liveness) and /readyz (readiness) probes, and /metrics/blob-cache, are
+// served on, :8081 by default. Probes aren't served when it's "off".
+var HealthAddr = os.Getenv("HEALTH_ADDR")
+
+const (
+	defaultHealthAddr = ":8081"
+	// healthCheckTimeout bounds each check of a probe.
+	healthCheckTimeout = 5 * time.Second
+	// consumeErrorWindow is how long a consume error, e.g. missed heartbeats, keeps the worker not ready.
+	consumeErrorWindow = time.Minute
+)
+
+// Health tracks the state of the worker for the probes. It's served from startup, the worker being live but not
+// ready until it consumes.
+type Health struct {
+	logger *zap.Logger
+
+	mu     sync.Mutex
+	worker *Worker
+	// nc is a connection of its own to NATS, the job queue not exposing its connection. It's made with the reconnect
+	// settings of the job queue's (jobQueueConnectOptions) so it gives up when the job queue's does.
+	nc           *nats.Conn
+	consuming    bool
+	consumeErr   error
+	consumeErrAt time.Time
+}
+
+// healthReport is the body of the probe responses.
+type healthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+func NewHealth(logger *zap.Logger) *Health {
+	return &Health{logger: logger}
+}
+
+// Serve serves the probes on HealthAddr until ctx is done.
+func (h *Health) Serve(ctx context.Context) error {
+	addr := HealthAddr
+	if addr == "off" {
+		return nil
+	}
+	if addr == "" {
+		addr = defaultHealthAddr
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, r *http.Request) {
+		writeHealthReport(rw, h.live())
+	})
+	mux.HandleFunc("/readyz", func(rw http.ResponseWriter, r *http.Request) {
+		writeHealthReport(rw, h.ready(r.Context()))
+	})
+	// The metrics of the blob cache (BLOB_CACHE_DIR) since the worker started
+	mux.HandleFunc("/metrics/blob-cache", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(task.GetBlobCacheStats())
+	})
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: healthCheckTimeout}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	h.logger.Info("serving health probes", zap.String("addr", addr))
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve health probes: %w", err)
+	}
+	return nil
+}
+
+// setWorker registers the worker whose dependencies the probes check.
+func (h *Health) setWorker(w *Worker) error {
+	nc, err := nats.Connect(NatsURL, append(jobQueueConnectOptions(), nats.Name("health"))...)
+	if err != nil {
+		return fmt.Errorf("failed to connect health checks to nats: %w", err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.worker = w
+	h.nc = nc
+	return nil
+}
+
+// jobQueueConnectOptions are the reconnect and ping settings of the NATS connection of the job queue. jq.New connects
+// with the defaults of the nats client, pinned here for the connection of the checks.
+func jobQueueConnectOptions() []nats.Option {
+	return []nats.Option{
+		nats.MaxReconnects(nats.DefaultMaxReconnect),
+		nats.ReconnectWait(nats.DefaultReconnectWait),
+		nats.ReconnectJitter(nats.DefaultReconnectJitter, nats.DefaultReconnectJitterTLS),
+		nats.PingInterval(nats.DefaultPingInterval),
+		nats.MaxPingsOutstanding(nats.DefaultMaxPingOut),
+		nats.Timeout(nats.DefaultTimeout),
+	}
+}
+
+// setConsuming records whether the worker is consuming jobs.
+func (h *Health) setConsuming(consuming bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.consuming = consuming
+}
+
+// consumeError records an error of the consumer.
+func (h *Health) consumeError(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.consumeErr = err
+	h.consumeErrAt = time.Now()
+}
+
+// close closes the NATS connection of the checks.
+func (h *Health) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.nc != nil {
+		h.nc.Close()
+	}
+}
+
+// live fails once the worker can't recover without a restart, NATS having given up reconnecting. A consumer that
+// stops makes the worker exit.
+func (h *Health) live() healthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	checks := map[string]string{}
+	if h.nc != nil && h.nc.IsClosed() {
+		checks["nats"] = "connection closed"
+	}
+	return newHealthReport(checks)
+}
+
+// ready fails while a dependency of the scans is unavailable: NATS, the job consumer, OpenSearch or the grype
+// database.
+func (h *Health) ready(ctx context.Context) healthReport {
+	h.mu.Lock()
+	w, nc := h.worker, h.nc
+	consuming, consumeErr, consumeErrAt := h.consuming, h.consumeErr, h.consumeErrAt
+	h.mu.Unlock()
+
+	checks := map[string]string{}
+	if w == nil {
+		checks["worker"] = "starting"
+		return newHealthReport(checks)
+	}
+
+	checks["nats"] = healthCheck(func() error {
+		if status := nc.Status(); status != nats.CONNECTED {
+			return fmt.Errorf("connection %s", status)
+		}
+		return nil
+	})
+	checks["consumer"] = healthCheck(func() error {
+		if !consuming {
+			return fmt.Errorf("not consuming")
+		}
+		if consumeErr != nil && time.Since(consumeErrAt) < consumeErrorWindow {
+			return consumeErr
+		}
+		ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		defer cancel()
+		js, err := jetstream.New(nc)
+		if err != nil {
+			return err
+		}
+		consumer, err := js.Consumer(ctx, StreamName, NatsConsumer)
+		if err != nil {
+			return err
+		}
+		_, err = consumer.Info(ctx)
+		return err
+	})
+	checks["opensearch"] = healthCheck(func() error {
+		ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		defer cancel()
+		return w.esClient.Healthcheck(ctx)
+	})
+	checks["grypeDB"] = healthCheck(task.CheckGrypeDB)
+	return newHealthReport(checks)
+}
+
+func healthCheck(check func() error) string {
+	if err := check(); err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+// newHealthReport reports checks, healthy when all are ok.
+func newHealthReport(checks map[string]string) healthReport {
+	report := healthReport{Status: "ok", Checks: checks}
+	for _, result := range checks {
+		if result != "ok" {
+			report.Status = "unavailable"
+		}
+	}
+	return report
+}
+
+func writeHealthReport(rw http.ResponseWriter, report healthReport) {
+	rw.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(rw).Encode(report)
+}
@@ -0,0 +1,44 @@
+package worker
+
+import (
+	"context"
+	"github.com/nats-io/nats.go"
+	"testing"
+)
+
+func TestJobQueueConnectOptions(t *testing.T) {
+	// jq.New connects with the defaults of the nats client, the checks' connection must reconnect as it does
+	defaults := nats.GetDefaultOptions()
+	var opts nats.Options
+	for _, opt := range jobQueueConnectOptions() {
+		if err := opt(&opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		name          string
+		got, expected interface{}
+	}{
+		{name: "MaxReconnect", got: opts.MaxReconnect, expected: defaults.MaxReconnect},
+		{name: "ReconnectWait", got: opts.ReconnectWait, expected: defaults.ReconnectWait},
+		{name: "ReconnectJitter", got: opts.ReconnectJitter, expected: defaults.ReconnectJitter},
+		{name: "ReconnectJitterTLS", got: opts.ReconnectJitterTLS, expected: defaults.ReconnectJitterTLS},
+		{name: "PingInterval", got: opts.PingInterval, expected: defaults.PingInterval},
+		{name: "MaxPingsOut", got: opts.MaxPingsOut, expected: defaults.MaxPingsOut},
+		{name: "Timeout", got: opts.Timeout, expected: defaults.Timeout},
+	} {
+		if tc.got != tc.expected {
+			t.Errorf("expected %s %v as the job queue's, got %v", tc.name, tc.expected, tc.got)
+		}
+	}
+}
+
+func TestHealthLiveAndReady(t *testing.T) {
+	h := NewHealth(nil)
+	if report := h.live(); report.Status != "ok" {
+		t.Errorf("expected a starting worker to be live, got %+v", report)
+	}
+	if report := h.ready(context.Background()); report.Status == "ok" || report.Checks["worker"] != "starting" {
+		t.Errorf("expected a starting worker not to be ready, got %+v", report)
+	}
+}
@@ -1,6 +1,8 @@
 package worker
 
 import (
+	"context"
+	"github.com/opengovern/og-task-container-vulnerability/task"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 )
@@ -14,10 +16,35 @@ func WorkerCommand() *cobra.Command {
 			if err != nil {
 				return err
 			}
+			task.SetGrypeBaseLogger(logger)
+
+			shutdownTracing, err := InitTracing(ctx)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := shutdownTracing(context.Background()); err != nil {
+					logger.Error("failed to flush spans", zap.Error(err))
+				}
+			}()
+
+			// Probes are served from startup, the worker isn't ready until it consumes
+			health := NewHealth(logger)
+			go func() {
+				if err := health.Serve(ctx); err != nil {
+					logger.Error("health probes stopped", zap.Error(err))
+				}
+			}()
+
+			// Air-gapped clusters install the vulnerability database once, before taking jobs
+			if err := task.LoadGrypeDBSource(ctx, logger, task.GrypeDBSource); err != nil {
+				return err
+			}
 
 			w, err := NewWorker(
 				logger,
 				cmd.Context(),
+				health,
 			)
 			if err != nil {
 				return err
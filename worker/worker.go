@@ -12,9 +12,15 @@ import (
 	"github.com/opengovern/opencomply/services/tasks/db/models"
 	"github.com/opengovern/opencomply/services/tasks/scheduler"
 	"github.com/opengovern/opencomply/services/tasks/worker/consts"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,6 +31,20 @@ var (
 	TopicName       = os.Getenv(consts.NatsTopicNameEnv)
 	ResultTopicName = os.Getenv(consts.NatsResultTopicNameEnv)
 
+	// FindingsTopicName is the subject findings are streamed to for tasks with stream_findings, findings aren't
+	// streamed when unset. The subject gets its own stream, FindingsStreamName, so streamed findings never crowd out
+	// the jobs and results of the task stream.
+	FindingsTopicName  = os.Getenv("FINDINGS_TOPIC_NAME")
+	FindingsStreamName = os.Getenv("FINDINGS_STREAM_NAME")
+
+	// MaxJobs makes Run return once it processed this many jobs, e.g. to run the worker as a Kubernetes Job. The
+	// worker runs until its context is done when unset.
+	MaxJobs = os.Getenv("MAX_JOBS")
+
+	// WorkerConcurrency is the number of jobs processed at once, 1 by default. Each run scans in its own work
+	// directory, and the scans of all jobs share the MAX_GRYPE_PROCESSES slots.
+	WorkerConcurrency = os.Getenv("WORKER_CONCURRENCY")
+
 	ESAddress       = os.Getenv(consts.ElasticSearchAddressEnv)
 	ESUsername      = os.Getenv(consts.ElasticSearchUsernameEnv)
 	ESPassword      = os.Getenv(consts.ElasticSearchPasswordEnv)
@@ -34,15 +54,20 @@ var (
 	ESAssumeRoleArn = os.Getenv(consts.ElasticSearchAssumeRoleArnEnv)
 )
 
+// TaskRunStatusTimedOut is the status of the runs cancelled by their timeout (RUN_TIMEOUT, run_timeout).
+const TaskRunStatusTimedOut models.TaskRunStatus = "TIMEOUT"
+
 type Worker struct {
 	logger   *zap.Logger
 	jq       *jq.JobQueue
 	esClient opengovernance.Client
+	health   *Health
 }
 
 func NewWorker(
 	logger *zap.Logger,
 	ctx context.Context,
+	health *Health,
 ) (*Worker, error) {
 	jq, err := jq.New(NatsURL, logger)
 	if err != nil {
@@ -57,6 +82,24 @@ func NewWorker(
 		return nil, err
 	}
 
+	if FindingsTopicName != "" {
+		if FindingsStreamName == "" {
+			FindingsStreamName = StreamName + "_findings"
+		}
+		// Findings are only useful while a UI renders the run, old ones expire rather than block new ones
+		if err := jq.StreamWithConfig(ctx, FindingsStreamName, "task findings", []string{FindingsTopicName}, jetstream.StreamConfig{
+			Retention: jetstream.LimitsPolicy,
+			MaxAge:    time.Hour,
+			MaxBytes:  256 * 1024 * 1024,
+			Discard:   jetstream.DiscardOld,
+			Replicas:  1,
+			Storage:   jetstream.MemoryStorage,
+		}); err != nil {
+			logger.Error("failed to create findings stream", zap.Error(err))
+			return nil, err
+		}
+	}
+
 	isOnAks := false
 	isOnAks, _ = strconv.ParseBool(ESIsOnAks)
 	isOpenSearch := false
@@ -74,19 +117,53 @@ func NewWorker(
 	if err != nil {
 		return nil, err
 	}
+	if err := task.EnsureIndexTemplates(ctx, logger, esClient.ES(), isOpenSearch); err != nil {
+		return nil, err
+	}
 
 	w := &Worker{
 		logger:   logger,
 		jq:       jq,
 		esClient: esClient,
+		health:   health,
+	}
+	if err := health.setWorker(w); err != nil {
+		return nil, err
 	}
 
 	return w, nil
 }
 
 func (w *Worker) Run(ctx context.Context) error {
+	maxJobs := 0
+	if MaxJobs != "" {
+		n, err := strconv.Atoi(MaxJobs)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid MAX_JOBS %q: must be a positive integer", MaxJobs)
+		}
+		maxJobs = n
+	}
+
+	concurrency := 1
+	if WorkerConcurrency != "" {
+		n, err := strconv.Atoi(WorkerConcurrency)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid WORKER_CONCURRENCY %q: must be a positive integer", WorkerConcurrency)
+		}
+		concurrency = n
+	}
+
 	w.logger.Info("starting to consume", zap.String("url", NatsURL), zap.String("consumer", NatsConsumer),
-		zap.String("stream", StreamName), zap.String("topic", TopicName))
+		zap.String("stream", StreamName), zap.String("topic", TopicName), zap.Int("maxJobs", maxJobs),
+		zap.Int("concurrency", concurrency))
+
+	// Up to concurrency jobs are processed at once, the handler blocking on a free slot so no more messages are
+	// pulled than can be processed. done is closed once the last of MaxJobs jobs is acked.
+	var started int
+	var finished atomic.Int64
+	var jobs sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	done := make(chan struct{})
 
 	consumeCtx, err := w.jq.ConsumeWithConfig(ctx, NatsConsumer, StreamName, []string{TopicName}, jetstream.ConsumerConfig{
 		Replicas:          1,
@@ -96,47 +173,97 @@ func (w *Worker) Run(ctx context.Context) error {
 		AckWait:           time.Minute * 30,
 		InactiveThreshold: time.Hour,
 	}, []jetstream.PullConsumeOpt{
-		jetstream.PullMaxMessages(1),
+		jetstream.PullMaxMessages(concurrency),
+		jetstream.ConsumeErrHandler(func(_ jetstream.ConsumeContext, err error) {
+			w.logger.Warn("consume error", zap.Error(err))
+			w.health.consumeError(err)
+		}),
 	}, func(msg jetstream.Msg) {
-		w.logger.Info("received a new job")
-		w.logger.Info("committing")
-		if err := msg.InProgress(); err != nil {
-			w.logger.Error("failed to send the initial in progress message", zap.Error(err), zap.Any("msg", msg))
-		}
-		ticker := time.NewTicker(15 * time.Second)
-		go func() {
-			for range ticker.C {
-				if err := msg.InProgress(); err != nil {
-					w.logger.Error("failed to send an in progress message", zap.Error(err), zap.Any("msg", msg))
-				}
+		if maxJobs > 0 && started >= maxJobs {
+			// Delivered before the consumer stopped, leave it to another worker
+			if err := msg.Nak(); err != nil {
+				w.logger.Error("failed to nak the message", zap.Error(err))
 			}
-		}()
-
-		err := w.ProcessMessage(ctx, msg)
-		if err != nil {
-			w.logger.Error("failed to process message", zap.Error(err))
+			return
 		}
-		ticker.Stop()
 
-		if err := msg.Ack(); err != nil {
-			w.logger.Error("failed to send the ack message", zap.Error(err), zap.Any("msg", msg))
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			if err := msg.Nak(); err != nil {
+				w.logger.Error("failed to nak the message", zap.Error(err))
+			}
+			return
 		}
+		started++
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			defer func() { <-slots }()
+			w.processJob(ctx, msg)
 
-		w.logger.Info("processing a job completed")
+			if n := finished.Add(1); maxJobs > 0 && int(n) == maxJobs {
+				w.logger.Info("processed the maximum number of jobs, stopping", zap.Int("maxJobs", maxJobs))
+				close(done)
+			}
+		}()
 	})
 	if err != nil {
 		return err
 	}
 
 	w.logger.Info("consuming")
+	w.health.setConsuming(true)
+	defer w.health.close()
 
-	<-ctx.Done()
+	select {
+	case <-ctx.Done():
+	case <-done:
+	case <-consumeCtx.Closed():
+		// Stopped by the connection, exit so the worker is restarted
+		w.health.setConsuming(false)
+		jobs.Wait()
+		return fmt.Errorf("consumer stopped")
+	}
+	w.health.setConsuming(false)
+	// Buffered messages still reach the handler while draining, which returns them once MaxJobs is reached
 	consumeCtx.Drain()
+	<-consumeCtx.Closed()
 	consumeCtx.Stop()
+	jobs.Wait()
 
 	return nil
 }
 
+// processJob processes the job of msg, keeping it in progress while it runs and acking it once done.
+func (w *Worker) processJob(ctx context.Context, msg jetstream.Msg) {
+	w.logger.Info("received a new job")
+	w.logger.Info("committing")
+	if err := msg.InProgress(); err != nil {
+		w.logger.Error("failed to send the initial in progress message", zap.Error(err), zap.String("subject", msg.Subject()))
+	}
+	ticker := time.NewTicker(15 * time.Second)
+	go func() {
+		for range ticker.C {
+			if err := msg.InProgress(); err != nil {
+				w.logger.Error("failed to send an in progress message", zap.Error(err), zap.String("subject", msg.Subject()))
+			}
+		}
+	}()
+
+	err := w.ProcessMessage(ctx, msg)
+	if err != nil {
+		w.logger.Error("failed to process message", zap.Error(err))
+	}
+	ticker.Stop()
+
+	if err := msg.Ack(); err != nil {
+		w.logger.Error("failed to send the ack message", zap.Error(err), zap.String("subject", msg.Subject()))
+	}
+
+	w.logger.Info("processing a job completed")
+}
+
 func (w *Worker) ProcessMessage(ctx context.Context, msg jetstream.Msg) (err error) {
 	var request tasks.TaskRequest
 	if err := json.Unmarshal(msg.Data(), &request); err != nil {
@@ -144,6 +271,19 @@ func (w *Worker) ProcessMessage(ctx context.Context, msg jetstream.Msg) (err err
 		return err
 	}
 
+	logger := task.RedactingLogger(w.logger, request.TaskDefinition.Params)
+
+	// The run continues the trace of the scheduler, when the message carries one
+	ctx = otel.GetTextMapPropagator().Extract(ctx, natsHeaderCarrier(msg.Headers()))
+	ctx, span := tracer.Start(ctx, "worker.process_message", trace.WithAttributes(attribute.Int("run_id", int(request.TaskDefinition.RunID))))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
 	response := &scheduler.TaskResponse{
 		RunID:  request.TaskDefinition.RunID,
 		Status: models.TaskRunStatusInProgress,
@@ -153,37 +293,80 @@ func (w *Worker) ProcessMessage(ctx context.Context, msg jetstream.Msg) (err err
 		if err != nil {
 			response.FailureMessage = err.Error()
 			response.Status = models.TaskRunStatusFailed
+			if task.ErrorKindOf(err) == task.ErrorKindTimeout {
+				response.Status = TaskRunStatusTimedOut
+			}
 		} else {
 			response.Status = models.TaskRunStatusFinished
 		}
 
 		responseJson, err := json.Marshal(response)
 		if err != nil {
-			w.logger.Error("failed to create job result json", zap.Error(err))
+			logger.Error("failed to create job result json", zap.Error(err))
 			return
 		}
 
-		if _, err := w.jq.Produce(ctx, ResultTopicName, responseJson, fmt.Sprintf("task-run-result-%d", request.TaskDefinition.RunID)); err != nil {
-			w.logger.Error("failed to publish job result", zap.String("jobResult", string(responseJson)), zap.Error(err))
+		if _, err := w.jq.Produce(ctx, ResultTopicName, responseJson, task.ResultMessageID(request.TaskDefinition.RunID)); err != nil {
+			logger.Error("failed to publish job result", zap.String("jobResult", string(responseJson)), zap.Error(err))
 		}
 	}()
 
-	responseJson, err := json.Marshal(response)
+	// The first in-progress response tells the run is queued, the final one has its own result
+	queued := *response
+	queued.Result = task.QueuedProgressResult()
+	responseJson, err := json.Marshal(queued)
 	if err != nil {
-		w.logger.Error("failed to create response json", zap.Error(err))
+		logger.Error("failed to create response json", zap.Error(err))
 		return err
 	}
 
-	if _, err = w.jq.Produce(ctx, ResultTopicName, responseJson, fmt.Sprintf("task-run-inprogress-%d", request.TaskDefinition.RunID)); err != nil {
-		w.logger.Error("failed to publish job in progress", zap.String("response", string(responseJson)), zap.Error(err))
+	if _, err = w.jq.Produce(ctx, ResultTopicName, responseJson, task.InProgressMessageID(request.TaskDefinition.RunID, 0)); err != nil {
+		logger.Error("failed to publish job in progress", zap.String("response", string(responseJson)), zap.Error(err))
 	}
 
-	err = task.RunTask(ctx, w.esClient, w.logger, request, response)
+	err = task.RunTask(ctx, w.esClient, logger, request, response, progressPublisher(w.jq, request.TaskDefinition.RunID), findingsPublisher(w.jq, request.TaskDefinition.RunID))
 	if err != nil {
-		w.logger.Error("failed to publish job result", zap.String("response", string(responseJson)), zap.Error(err))
+		logger.Error("failed to publish job result", zap.String("response", string(responseJson)), zap.Error(err))
 		return err
 	}
 	response.Status = models.TaskRunStatusFinished
 
 	return nil
 }
+
+// producer publishes messages to the job queue, a *jq.JobQueue.
+type producer interface {
+	Produce(ctx context.Context, topic string, data []byte, id string) (*uint64, error)
+}
+
+// progressPublisher returns a task.ProgressPublisher producing in-progress responses to the result topic. Every
+// message gets its own sequence number so JetStream doesn't deduplicate them, the images of a run publishing
+// concurrently.
+func progressPublisher(p producer, runID uint) task.ProgressPublisher {
+	var mu sync.Mutex
+	var seq int
+	return func(ctx context.Context, response *scheduler.TaskResponse) error {
+		mu.Lock()
+		defer mu.Unlock()
+		seq++
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			return err
+		}
+		_, err = p.Produce(ctx, ResultTopicName, responseJson, task.InProgressMessageID(runID, seq))
+		return err
+	}
+}
+
+// findingsPublisher returns a task.FindingsPublisher producing findings messages to the findings topic, or nil when
+// no findings topic is configured. Parallel scans publish concurrently, hence the atomic sequence number.
+func findingsPublisher(p producer, runID uint) task.FindingsPublisher {
+	if FindingsTopicName == "" {
+		return nil
+	}
+	var seq atomic.Int64
+	return func(ctx context.Context, payload []byte) error {
+		_, err := p.Produce(ctx, FindingsTopicName, payload, task.FindingsMessageID(runID, int(seq.Add(1))))
+		return err
+	}
+}
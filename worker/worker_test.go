@@ -0,0 +1,82 @@
+package worker
+
+import (
+	"context"
+	"github.com/opengovern/og-task-container-vulnerability/task"
+	"github.com/opengovern/opencomply/services/tasks/scheduler"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingProducer records the IDs of the messages produced, by topic.
+type recordingProducer struct {
+	mu  sync.Mutex
+	ids map[string][]string
+}
+
+func (p *recordingProducer) Produce(ctx context.Context, topic string, data []byte, id string) (*uint64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ids[topic] = append(p.ids[topic], id)
+	var seq uint64
+	return &seq, nil
+}
+
+func TestRunIDPathsAndMessageIDs(t *testing.T) {
+	defer func(root, topic string) { task.WorkDirRoot, FindingsTopicName = root, topic }(task.WorkDirRoot, FindingsTopicName)
+	task.WorkDirRoot = t.TempDir()
+	FindingsTopicName = "findings"
+
+	for _, tc := range []struct {
+		runID     uint
+		formatted string
+	}{
+		{runID: 1, formatted: "1"},
+		{runID: 42, formatted: "42"},
+		{runID: 4294967295, formatted: "4294967295"},
+	} {
+		t.Run(tc.formatted, func(t *testing.T) {
+			// Task side: the work directory and the run the stored results are described by
+			workDir, err := task.NewWorkDir(tc.runID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer workDir.Close()
+			if name := filepath.Base(workDir.Path); !strings.HasPrefix(name, "run-"+tc.formatted+"-") || !strings.HasPrefix(name, task.RunDir(tc.runID)+"-") {
+				t.Errorf("unexpected work directory %s", name)
+			}
+			if got := task.FormatRunID(tc.runID); got != tc.formatted {
+				t.Errorf("expected described_by %s, got %s", tc.formatted, got)
+			}
+
+			// Worker side: the messages published for the run
+			p := &recordingProducer{ids: map[string][]string{}}
+			progress := progressPublisher(p, tc.runID)
+			for i := 0; i < 2; i++ {
+				if err := progress(context.Background(), &scheduler.TaskResponse{RunID: tc.runID}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := findingsPublisher(p, tc.runID)(context.Background(), []byte(`{}`)); err != nil {
+				t.Fatal(err)
+			}
+
+			expected := map[string][]string{
+				ResultTopicName:   {"task-run-inprogress-" + tc.formatted + "-1", "task-run-inprogress-" + tc.formatted + "-2"},
+				FindingsTopicName: {"task-run-findings-" + tc.formatted + "-1"},
+			}
+			if !reflect.DeepEqual(p.ids, expected) {
+				t.Errorf("expected message ids %v, got %v", expected, p.ids)
+			}
+			if got := task.InProgressMessageID(tc.runID, 0); got != "task-run-inprogress-"+tc.formatted {
+				t.Errorf("unexpected initial in progress message id %s", got)
+			}
+			if got := task.ResultMessageID(tc.runID); got != "task-run-result-"+tc.formatted {
+				t.Errorf("unexpected result message id %s", got)
+			}
+		})
+	}
+}